@@ -24,7 +24,19 @@ func (command *ArchiveCommand) Help() string {
 	nut archive is used to build tarball image from an existing
 	container.
 
-	-sudo    Use sudo while invoking tar
+	-sudo    Invoke tar through sudo and compress with xz, instead of
+	         archiving in process with gzip compression
+	-compression Compression of the image: none, gzip, xz or zstd. Defaults
+	         to the compression implied by the image file name, gzip
+	         without and xz with -sudo
+	-level   Compression level, 0 selects the default of the codec
+	-oci-layout Write the image as OCI image layout into the directory
+	         <image> instead of a tarball
+	-docker-archive Write the image in the format of docker save, which
+	         docker load imports tagged with the container name
+	-sign-key Armored private key to sign the image with using gpg. The
+	         detached signature is written to <image>.asc
+	-oci-config Write the manifest as OCI image configuration next to the image
 	`
 	return strings.TrimSpace(helpText) + AddCommonHelp()
 }
@@ -36,7 +48,13 @@ func (command *ArchiveCommand) Synopsis() string {
 func (command *ArchiveCommand) Run(args []string) int {
 	flagSet := flag.NewFlagSet("archive", flag.ExitOnError)
 	flagSet.Usage = func() { fmt.Println(command.Help()) }
-	sudo := flagSet.Bool("sudo", false, "Use sudo while invoking tar")
+	sudo := flagSet.Bool("sudo", false, "Invoke tar through sudo instead of archiving in process")
+	compression := flagSet.String("compression", "", "Compression of the image: none, gzip, xz or zstd")
+	level := flagSet.Int("level", 0, "Compression level, 0 selects the default of the codec")
+	ociLayout := flagSet.Bool("oci-layout", false, "Write the image as OCI image layout into the directory <image>")
+	dockerArchive := flagSet.Bool("docker-archive", false, "Write the image in the format of docker save")
+	signKey := flagSet.String("sign-key", "", "Armored private key to sign the image with")
+	ociConfig := flagSet.Bool("oci-config", false, "Write the manifest as OCI image configuration next to the image")
 	AddCommonFlags(flagSet)
 	if err := flagSet.Parse(args); err != nil {
 		log.Errorln(err)
@@ -49,14 +67,59 @@ func (command *ArchiveCommand) Run(args []string) int {
 		return -1
 	}
 
+	opts := container.ExportOptions{Sudo: *sudo, Level: *level, SignKey: *signKey}
+	if *compression != "" {
+		c, err := container.ParseCompression(*compression)
+		if err != nil {
+			log.Errorln(err)
+			return -1
+		}
+		opts.Compression = c
+	}
 	image, err := container.NewImage(args[0], args[1])
 	if err != nil {
 		log.Errorf("Failed to initialize container. Error: %s\n", err)
 		return -1
 	}
-	if err := image.Create(*sudo); err != nil {
+	if *ociLayout && *dockerArchive {
+		log.Errorln("-oci-layout and -docker-archive can not be combined")
+		return -1
+	}
+	if *dockerArchive {
+		if err := image.ExportDockerArchive(args[1]); err != nil {
+			log.Errorf("Failed to export docker archive. Error: %s\n", err)
+			return -1
+		}
+		return 0
+	}
+	if *ociLayout {
+		if err := image.ExportOCI(args[1]); err != nil {
+			log.Errorf("Failed to export OCI image layout. Error: %s\n", err)
+			return -1
+		}
+		return 0
+	}
+	result, err := image.CreateWithOptions(opts)
+	if err != nil {
 		log.Errorf("Failed to create image. Error: %s\n", err)
 		return -1
 	}
+	log.Infof("Wrote image %s (%d bytes, %s)", result.Path, result.Size, result.Digest)
+	if result.Signature != "" {
+		log.Infof("Wrote signature %s", result.Signature)
+	}
+	if *ociConfig {
+		var manifest container.Manifest
+		if err := manifest.Load(args[0]); err != nil {
+			log.Errorf("Failed to load container manifest. Error: %s\n", err)
+			return -1
+		}
+		path, err := image.WriteOCIConfig(manifest)
+		if err != nil {
+			log.Errorln(err)
+			return -1
+		}
+		log.Infof("Wrote OCI image configuration %s", path)
+	}
 	return 0
 }
@@ -1,17 +1,33 @@
 package commands
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/PagerDuty/nut/container"
 	"github.com/mitchellh/cli"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/signal"
 	"strings"
 )
 
 type BuildCommand struct {
 }
 
+// argList collects repeated -arg flags
+type argList []string
+
+func (a *argList) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *argList) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
 func Build() (cli.Command, error) {
 	command := &BuildCommand{}
 	return command, nil
@@ -23,6 +39,51 @@ func (command *BuildCommand) Help() string {
 		-ephemeral   Destroy the container after creation
 		-name        Name of the container (defaults to randomly generated UUID)
 		-volume      Mount host directory inside container
+		-arg         Set build argument value (name=value), can be repeated
+		-keep-stages Retain intermediate containers of multi-stage builds
+		-validate    Only validate the specification file, without building
+		-no-cache    Do not use the build cache
+		-keep-on-failure Retain containers of a failed build for inspection
+		-dry-run     Print the build plan without creating any container
+		-resume      Resume a build that failed with -keep-on-failure
+		-allow-unknown Skip unknown instructions instead of failing the build
+		-continue-on-run-failure Continue the build after failed RUN statements
+		-prefix-output Prefix command output with the statement index
+		-step-timeout Default timeout of RUN statements, e.g. 10m
+		-run-retries Default number of retries of failed RUN statements
+		-run-retry-delay Default delay between retries of RUN statements, e.g. 10s
+		-env         Set environment variable of RUN commands (name=value), can be repeated
+		-propagate-proxy Pass the host's proxy variables to RUN commands
+		-cpu-shares  Relative cpu weight of the build containers
+		-cpuset-cpus Cpus the build containers may run on, e.g. 0-3
+		-memory      Memory limit of the build containers, e.g. 2g
+		-pids-limit  Maximum number of processes in the build containers
+		-network     Default network of RUN statements, bridge or none
+		-download-timeout Timeout of downloading remote ADD sources, e.g. 5m
+		-secret      Provide a secret for RUN --secret flags (id=name,src=path), can be repeated
+		-context     Build context of ADD and COPY sources (defaults to the directory of the specfile)
+		-allow-outside-context Permit ADD and COPY sources outside of the build context
+		-omit-history Leave the build history and provenance out of the manifest
+		-manifest-format Format of the manifest, yaml, json or both
+		-require-parent-manifest Fail if the container FROM clones has no manifest
+		-cleanup     Destroy build containers once the build finished: keep (default), destroy-on-success or always
+		-existing-container Handling of containers of the build that exist already: error (default), replace or reuse
+		-backing-store Backing store of build containers, dir, overlayfs, btrfs, zfs or auto
+		-clone-mode  Clone the FROM container as snapshot or copy: auto, snapshot or copy (default)
+		-lxc-log-level Level of the lxc log of build containers, attached to failures with their console output (default warn)
+		-artifact-dir Directory artifacts are fetched into, created if missing (defaults to the current directory)
+		-artifact-name Name of artifacts below the artifact directory, with {label} and {name} placeholders (default {label}/{name})
+		-allow-missing-artifacts Skip artifacts missing in the built container instead of failing the build
+		-unprivileged Build unprivileged containers (default when not running as root)
+		-wait-for-network Wait for build containers to obtain an IPv4 address and resolve DNS names (default true)
+		-network-timeout Timeout of waiting for the network of build containers, e.g. 1m
+		-network-probe Name build containers have to resolve before their network is ready
+		-cache-mount Mount a host cache directory during the build only (host_directory:container_directory), can be repeated
+		-dns         Nameserver of build containers, can be repeated
+		-dns-search  Search domain of build containers, can be repeated
+		-dns-option  Resolver option of build containers, e.g. ndots:2, can be repeated
+		-dns-copy-host Copy the host's resolv.conf into build containers
+		-restore-resolv-conf Restore the original resolv.conf of the container once the build finished
 	`
 	return strings.TrimSpace(helpText) + AddCommonHelp()
 }
@@ -40,6 +101,58 @@ func (command *BuildCommand) Run(args []string) int {
 	ephemeral := flagSet.Bool("ephemeral", false, "Destroy the container after creating it")
 	name := flagSet.String("name", "", "Name of the resulting container (defaults to randomly generated UUID)")
 	volume := flagSet.String("volume", "", "Mount host directory inside container. Format: '[host_directory:]container_directory[:mount options]")
+	noCache := flagSet.Bool("no-cache", false, "Do not use the build cache")
+	validate := flagSet.Bool("validate", false, "Only validate the specification file, without building")
+	keepStages := flagSet.Bool("keep-stages", false, "Retain intermediate containers of multi-stage builds")
+	continueOnRunFailure := flagSet.Bool("continue-on-run-failure", false, "Continue the build after failed RUN statements")
+	runRetries := flagSet.Int("run-retries", 0, "Default number of retries of failed RUN statements")
+	runRetryDelay := flagSet.Duration("run-retry-delay", 0, "Default delay between retries of RUN statements, e.g. 10s")
+	stepTimeout := flagSet.Duration("step-timeout", 0, "Default timeout of RUN statements, e.g. 10m")
+	prefixOutput := flagSet.Bool("prefix-output", false, "Prefix command output with the statement index")
+	allowUnknown := flagSet.Bool("allow-unknown", false, "Skip unknown instructions instead of failing the build")
+	resume := flagSet.Bool("resume", false, "Resume a build that failed with -keep-on-failure")
+	dryRun := flagSet.Bool("dry-run", false, "Print the build plan without creating any container")
+	keepOnFailure := flagSet.Bool("keep-on-failure", false, "Retain containers of a failed build for inspection")
+	propagateProxy := flagSet.Bool("propagate-proxy", false, "Pass the host's proxy variables to RUN commands")
+	cpuShares := flagSet.Int("cpu-shares", 0, "Relative cpu weight of the build containers")
+	cpusetCPUs := flagSet.String("cpuset-cpus", "", "Cpus the build containers may run on, e.g. 0-3")
+	memory := flagSet.String("memory", "", "Memory limit of the build containers, e.g. 2g")
+	pidsLimit := flagSet.Int("pids-limit", 0, "Maximum number of processes in the build containers")
+	network := flagSet.String("network", "bridge", "Default network of RUN statements, bridge or none")
+	downloadTimeout := flagSet.Duration("download-timeout", 0, "Timeout of downloading remote ADD sources, e.g. 5m")
+	contextDir := flagSet.String("context", "", "Build context of ADD and COPY sources (defaults to the directory of the specfile)")
+	manifestFormat := flagSet.String("manifest-format", "yaml", "Format of the manifest, yaml, json or both")
+	requireParentManifest := flagSet.Bool("require-parent-manifest", false, "Fail if the container FROM clones has no manifest")
+	cleanup := flagSet.String("cleanup", "keep", "Destroy build containers once the build finished: keep, destroy-on-success or always")
+	existingContainer := flagSet.String("existing-container", "error", "Handling of containers of the build that exist already: error, replace or reuse")
+	backingStore := flagSet.String("backing-store", "dir", "Backing store of build containers, dir, overlayfs, btrfs, zfs or auto")
+	cloneMode := flagSet.String("clone-mode", "", "Clone the FROM container as snapshot or copy: auto, snapshot or copy (default)")
+	lxcLogLevel := flagSet.String("lxc-log-level", container.DefaultLXCLogLevel, "Level of the lxc log of build containers, attached to failures with their console output")
+	artifactDir := flagSet.String("artifact-dir", "", "Directory artifacts are fetched into, created if missing (defaults to the current directory)")
+	artifactName := flagSet.String("artifact-name", "", "Name of artifacts below the artifact directory, with {label} and {name} placeholders (default {label}/{name})")
+	allowMissingArtifacts := flagSet.Bool("allow-missing-artifacts", false, "Skip artifacts missing in the built container instead of failing the build")
+	unprivileged := flagSet.Bool("unprivileged", false, "Build unprivileged containers (default when not running as root)")
+	waitForNetwork := flagSet.Bool("wait-for-network", true, "Wait for build containers to obtain an IPv4 address and resolve DNS names")
+	networkTimeout := flagSet.Duration("network-timeout", container.DefaultNetworkTimeout, "Timeout of waiting for the network of build containers")
+	networkProbe := flagSet.String("network-probe", container.DefaultNetworkProbe, "Name build containers have to resolve before their network is ready")
+	dnsCopyHost := flagSet.Bool("dns-copy-host", false, "Copy the host's resolv.conf into build containers")
+	restoreResolvConf := flagSet.Bool("restore-resolv-conf", false, "Restore the original resolv.conf of the container once the build finished")
+	omitHistory := flagSet.Bool("omit-history", false, "Leave the build history and provenance out of the manifest")
+	allowOutsideContext := flagSet.Bool("allow-outside-context", false, "Permit ADD and COPY sources outside of the build context")
+	var secrets argList
+	flagSet.Var(&secrets, "secret", "Provide a secret for RUN --secret flags. Format: 'id=name,src=path'. Can be repeated")
+	var extraEnv argList
+	flagSet.Var(&extraEnv, "env", "Set environment variable of RUN commands. Format: 'name=value'. Can be repeated")
+	var buildArgs argList
+	flagSet.Var(&buildArgs, "arg", "Set build argument value. Format: 'name=value'. Can be repeated")
+	var cacheMounts argList
+	flagSet.Var(&cacheMounts, "cache-mount", "Mount a host cache directory during the build only. Format: 'host_directory:container_directory'. Can be repeated")
+	var nameservers argList
+	flagSet.Var(&nameservers, "dns", "Nameserver of build containers. Can be repeated")
+	var searchDomains argList
+	flagSet.Var(&searchDomains, "dns-search", "Search domain of build containers. Can be repeated")
+	var dnsOptions argList
+	flagSet.Var(&dnsOptions, "dns-option", "Resolver option of build containers, e.g. ndots:2. Can be repeated")
 	AddCommonFlags(flagSet)
 
 	if err := flagSet.Parse(args); err != nil {
@@ -57,15 +170,148 @@ func (command *BuildCommand) Run(args []string) int {
 	}
 
 	b := container.NewBuilder(*name)
+	opts := container.BuildOptions{
+		NoCache:               *noCache,
+		Args:                  make(map[string]string),
+		KeepStages:            *keepStages,
+		KeepOnFailure:         *keepOnFailure,
+		AllowUnknown:          *allowUnknown,
+		Prefix:                *prefixOutput,
+		StepTimeout:           *stepTimeout,
+		RunRetries:            *runRetries,
+		RunRetryDelay:         *runRetryDelay,
+		ExtraEnv:              extraEnv,
+		PropagateProxy:        *propagateProxy,
+		DefaultNetwork:        *network,
+		DownloadTimeout:       *downloadTimeout,
+		ContextDir:            *contextDir,
+		AllowOutsideContext:   *allowOutsideContext,
+		OmitHistory:           *omitHistory,
+		ManifestFormat:        *manifestFormat,
+		RequireParentManifest: *requireParentManifest,
+		BackingStore:          container.BackingStore(*backingStore),
+		CloneMode:             container.CloneMode(*cloneMode),
+		LXCLogLevel:           *lxcLogLevel,
+		ArtifactDir:           *artifactDir,
+		ArtifactName:          *artifactName,
+		AllowMissingArtifacts: *allowMissingArtifacts,
+		ExistingContainer:     container.ExistingContainerPolicy(*existingContainer),
+		Cleanup:               container.CleanupPolicy(*cleanup),
+		Unprivileged:          *unprivileged,
+		SkipNetworkWait:       !*waitForNetwork,
+		NetworkTimeout:        *networkTimeout,
+		NetworkProbe:          *networkProbe,
+		DNS: container.DNSOptions{
+			Nameservers:       nameservers,
+			SearchDomains:     searchDomains,
+			Options:           dnsOptions,
+			CopyHost:          *dnsCopyHost,
+			RestoreResolvConf: *restoreResolvConf,
+		},
+		Limits: container.Limits{
+			CPUShares:  *cpuShares,
+			CPUSetCPUs: *cpusetCPUs,
+			PidsLimit:  *pidsLimit,
+		},
+	}
+	if *memory != "" {
+		limit, err := container.ParseSize(*memory)
+		if err != nil {
+			log.Errorln(err)
+			return -1
+		}
+		opts.Limits.MemoryLimit = limit
+	}
+	if *continueOnRunFailure {
+		opts.OnRunFailure = container.ContinueOnRunFailure
+	}
 	if *volume != "" {
-		b.Volumes = []string{*volume}
+		opts.Volumes = []string{*volume}
+	}
+	for _, spec := range cacheMounts {
+		m, err := container.ParseCacheMount(spec)
+		if err != nil {
+			log.Errorln(err)
+			return -1
+		}
+		opts.CacheMounts = append(opts.CacheMounts, m)
+	}
+	if len(secrets) > 0 {
+		opts.Secrets = make(map[string]string)
+	}
+	for _, secret := range secrets {
+		id, src, err := parseSecretFlag(secret)
+		if err != nil {
+			log.Errorln(err)
+			return -1
+		}
+		opts.Secrets[id] = src
+	}
+	for _, arg := range buildArgs {
+		pair := strings.SplitN(arg, "=", 2)
+		if len(pair) != 2 {
+			log.Errorf("Invalid build argument '%s'. Expected name=value\n", arg)
+			return -1
+		}
+		opts.Args[pair[0]] = pair[1]
 	}
 	if err := b.Parse(*file); err != nil {
 		log.Errorf("Failed to parse dockerfile. Error: %s\n", err)
 		return -1
 	}
+	if *validate {
+		errs := b.Validate()
+		for _, err := range errs {
+			log.Errorln(err)
+		}
+		if len(errs) > 0 {
+			return -1
+		}
+		log.Infof("Specification file %s is valid", *file)
+		return 0
+	}
 
-	ct, err := b.Build()
+	if *dryRun {
+		steps, err := b.DryRun(opts)
+		for _, step := range steps {
+			printStep(step)
+		}
+		if err != nil {
+			log.Errorf("Failed to plan build. Error: %s\n", err)
+			return -1
+		}
+		if len(steps) > 0 {
+			manifest, err := yaml.Marshal(steps[len(steps)-1].Manifest)
+			if err != nil {
+				log.Errorln(err)
+				return -1
+			}
+			fmt.Printf("Manifest:\n%s", manifest)
+		}
+		return 0
+	}
+
+	// abort the build on interrupt, so the half built container is cleaned up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Warnln("Interrupted, aborting build")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var ct *container.Container
+	var err error
+	if *resume {
+		ct, err = b.Resume(opts)
+	} else {
+		ct, err = b.BuildContext(ctx, opts)
+	}
 	if err != nil {
 		log.Errorf("Failed to build container from dockerfile. Error: %s\n", err)
 		return -1
@@ -73,14 +319,52 @@ func (command *BuildCommand) Run(args []string) int {
 
 	if *ephemeral {
 		log.Infof("Ephemeral mode. Destroying the container")
-		if err := ct.Stop(); err != nil {
-			log.Errorf("Failed to stop container. Error: %s\n", err)
-			return -1
-		}
-		if err := ct.Destroy(); err != nil {
-			log.Errorf("Failed to destroy container. Error: %s\n", err)
+		if err := ct.DestroyAll(); err != nil {
+			log.Errorf("%s\n", err)
 			return -1
 		}
 	}
 	return 0
 }
+
+// printStep prints a dry run step in a human readable form
+func printStep(step container.PlannedStep) {
+	fmt.Printf("Step %d (line %d): %s\n", step.Index+1, step.Line, step.Statement)
+	switch {
+	case step.Parent != "":
+		fmt.Printf("  clone:   %s\n", step.Parent)
+	case step.Command != nil:
+		fmt.Printf("  run:     %s\n", strings.Join(step.Command, " "))
+		fmt.Printf("  env:     %s\n", strings.Join(step.Env, " "))
+		fmt.Printf("  workdir: %s\n", step.WorkDir)
+		fmt.Printf("  user:    %s\n", step.User)
+	case len(step.Sources) > 0:
+		fmt.Printf("  copy:    %s -> %s\n", strings.Join(step.Sources, " "), step.Destination)
+	}
+	if step.Unverified {
+		fmt.Printf("  unverified: %s\n", step.Reason)
+	}
+}
+
+// parseSecretFlag parses the value of the -secret flag, id=name,src=path
+func parseSecretFlag(value string) (string, string, error) {
+	var id, src string
+	for _, field := range strings.Split(value, ",") {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return "", "", fmt.Errorf("Invalid secret '%s'. Expected id=name,src=path", value)
+		}
+		switch pair[0] {
+		case "id":
+			id = pair[1]
+		case "src", "source":
+			src = pair[1]
+		default:
+			return "", "", fmt.Errorf("Invalid secret '%s'. Unknown option '%s'", value, pair[0])
+		}
+	}
+	if id == "" || src == "" {
+		return "", "", fmt.Errorf("Invalid secret '%s'. Expected id=name,src=path", value)
+	}
+	return id, src, nil
+}
@@ -90,22 +90,8 @@ func (command *FetchCommand) Run(args []string) int {
 		}
 		name = &uuid
 	}
-	i, err := container.NewImage(*name, fo.Name())
-	if err != nil {
-		log.Errorln(err)
-		return -1
-	}
 	fo.Close()
-	if err := i.Decompress(*sudo); err != nil {
-		log.Errorln(err)
-		return -1
-	}
-	ct, err := container.NewContainer(*name)
-	if err != nil {
-		log.Errorln(err)
-		return -1
-	}
-	if err := ct.UpdateUTS(*name); err != nil {
+	if _, err := container.ImportContainer(fo.Name(), *name, container.ImportOptions{Sudo: *sudo}); err != nil {
 		log.Errorln(err)
 		return -1
 	}
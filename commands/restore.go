@@ -21,9 +21,18 @@ func (command *RestoreCommand) Help() string {
 	helpText := `
 	Usage: nut restore [options] <container> <image>
 
-	nut restore is used to create container from archived images
+	nut restore is used to create container from archived images, OCI
+	image layouts or docker save tarballs
 
 	-sudo    Use sudo while invoking tar
+	-force   Replace an existing container of the same name
+	-format  Format of the image: nut (default), oci for an OCI image
+	         layout directory or docker for a docker save tarball
+	-keyring Public keys to verify the image signature against before
+	         extracting it
+	-signature Detached signature of the image, defaults to <image>.asc
+	-ref     Ref name of the image to restore from an OCI image layout
+	         holding multiple images
 	`
 	return strings.TrimSpace(helpText) + AddCommonHelp()
 }
@@ -36,6 +45,11 @@ func (command *RestoreCommand) Run(args []string) int {
 	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
 	flagSet.Usage = func() { fmt.Println(command.Help()) }
 	sudo := flagSet.Bool("sudo", false, "Use sudo while invoking tar")
+	force := flagSet.Bool("force", false, "Replace an existing container of the same name")
+	format := flagSet.String("format", "nut", "Format of the image: nut, oci or docker")
+	keyring := flagSet.String("keyring", "", "Public keys to verify the image signature against")
+	signature := flagSet.String("signature", "", "Detached signature of the image")
+	ref := flagSet.String("ref", "", "Ref name of the image to restore from an OCI image layout")
 	AddCommonFlags(flagSet)
 	if err := flagSet.Parse(args); err != nil {
 		log.Errorln(err)
@@ -49,24 +63,20 @@ func (command *RestoreCommand) Run(args []string) int {
 		return -1
 	}
 
-	i, err := container.NewImage(args[0], args[1])
-	if err != nil {
-		log.Errorln(err)
-		return -1
-	}
-
-	if err := i.Decompress(*sudo); err != nil {
-		log.Errorf("Failed to restore container. Error: %s\n", err)
-		return -1
+	opts := container.ImportOptions{Force: *force, Sudo: *sudo, Keyring: *keyring, Signature: *signature}
+	var err error
+	switch *format {
+	case "nut":
+		_, err = container.ImportContainer(args[1], args[0], opts)
+	case "oci":
+		_, err = container.ImportOCI(args[1], *ref, args[0], opts)
+	case "docker":
+		_, err = container.ImportDockerArchive(args[1], args[0], opts)
+	default:
+		err = fmt.Errorf("Invalid format %s. Supported formats are nut, oci and docker", *format)
 	}
-
-	ct, err := container.NewContainer(args[0])
 	if err != nil {
-		log.Errorln(err)
-		return -1
-	}
-	if err := ct.UpdateUTS(args[0]); err != nil {
-		log.Errorln(err)
+		log.Errorf("Failed to restore container. Error: %s\n", err)
 		return -1
 	}
 	return 0
@@ -57,7 +57,7 @@ func (command *RunCommand) Run(args []string) int {
 		log.Errorln(err)
 		return 1
 	}
-	cmdParts := ct.Manifest.EntryPoint
+	cmdParts := ct.Manifest.Command()
 	if *cmd != "" {
 		cmdParts = strings.Fields(*cmd)
 	}
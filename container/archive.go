@@ -0,0 +1,288 @@
+package container
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// archiveExtensions are the file name extensions of the archives ADD extracts
+var archiveExtensions = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz", ".tbz2", ".tar.xz", ".txz", ".tar.zst", ".tzst"}
+
+// deviceModes maps the tar types of device nodes to their file type
+var deviceModes = map[byte]uint32{
+	tar.TypeChar:  syscall.S_IFCHR,
+	tar.TypeBlock: syscall.S_IFBLK,
+}
+
+// magic bytes of the supported compression formats
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// maxSymlinks limits the symlinks followed when resolving a path in a rootfs
+const maxSymlinks = 255
+
+// archive is the uncompressed content of a tar archive
+type archive struct {
+	io.Reader
+	closers []func() error
+}
+
+// Close releases the archive file and decompressor, reporting decompression errors
+func (a *archive) Close() error {
+	var err error
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		if closeErr := a.closers[i](); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openArchive returns the uncompressed content of the tar archive src, or nil if
+// src is no tar archive. Archives are recognised by their file name extension and
+// the magic bytes of the compression and tar formats
+func openArchive(src string) (*archive, error) {
+	name := strings.ToLower(src)
+	known := false
+	for _, ext := range archiveExtensions {
+		known = known || strings.HasSuffix(name, ext)
+	}
+	if info, err := os.Stat(src); !known || err != nil || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	return openTar(src)
+}
+
+// openTar returns the uncompressed content of the tar archive src, or nil if the
+// content of src is no tar archive. gzip, bzip2, xz and zstd compressed archives
+// are supported, xz and zstd require the respective tool on the host
+func openTar(src string) (*archive, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	a := &archive{Reader: f, closers: []func() error{f.Close}}
+	header := make([]byte, len(xzMagic))
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		a.Close()
+		return nil, err
+	}
+	if bytes.HasPrefix(header, bzip2Magic) {
+		a.Reader = bzip2.NewReader(f)
+	} else {
+		c, _ := compressionFromMagic(header)
+		rc, err := c.decompressor(f)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("Failed to decompress %s. Error: %s", src, err)
+		}
+		a.Reader = rc
+		a.closers = append(a.closers, rc.Close)
+	}
+	r := bufio.NewReader(a.Reader)
+	block, err := r.Peek(512)
+	if err != nil || string(block[257:262]) != "ustar" {
+		a.Close()
+		return nil, nil
+	}
+	a.Reader = r
+	return a, nil
+}
+
+// extractFiles unpacks the tar archive src into the directory dest inside the
+// container. It reports false without extracting anything if src is no archive
+func (c *Container) extractFiles(src, dest string) (bool, error) {
+	a, err := openArchive(src)
+	if err != nil || a == nil {
+		return false, err
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		a.Close()
+		return false, err
+	}
+	ids, err := c.idMap()
+	if err != nil {
+		a.Close()
+		return true, err
+	}
+	dest = resolveWorkDir(c.Manifest.WorkDir, dest)
+	c.logger().Debugf("Extracting archive %s to %s", src, dest)
+	err = extractArchive(c.logger(), a, rootfs, dest, ids)
+	if closeErr := a.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return true, fmt.Errorf("Failed to extract archive %s. Error: %s", src, err)
+	}
+	return true, nil
+}
+
+// extractArchive unpacks the tar stream r into the directory dest below root,
+// treating root as the file system root when following symlinks. Permissions,
+// ownership, modification times and links are preserved. Entries escaping dest
+// via .. are refused. Owners are shifted to host ids according to ids
+func extractArchive(l Logger, r io.Reader, root, dest string, ids idMap) error {
+	destDir, err := resolveInRoot(root, dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := archiveEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		parent, err := resolveInRoot(root, path.Join(dest, path.Dir(name)))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		if err := extractEntry(l, tr, hdr, filepath.Join(parent, path.Base(name)), root, dest, ids); err != nil {
+			return fmt.Errorf("Failed to extract %s. Error: %s", hdr.Name, err)
+		}
+	}
+}
+
+// extractEntry creates the file described by hdr at target
+func extractEntry(l Logger, tr *tar.Reader, hdr *tar.Header, target, root, dest string, ids idMap) error {
+	info := hdr.FileInfo()
+	// entries replace existing files, but not directories
+	if existing, err := os.Lstat(target); err == nil && !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		created, err := mknod(l, target, deviceModes[hdr.Typeflag]|uint32(info.Mode().Perm()), mkdev(hdr.Devmajor, hdr.Devminor))
+		if err != nil || !created {
+			return err
+		}
+	case tar.TypeLink:
+		link, err := archiveEntryPath(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		source, err := resolveInRoot(root, path.Join(dest, link))
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	default:
+		loggerOrDefault(l).Warnf("Skipping archive entry %s of unsupported type %c", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+	if err := os.Lchown(target, ids.shift("u", hdr.Uid, true), ids.shift("g", hdr.Gid, true)); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if err := os.Chmod(target, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// archiveEntryPath returns the cleaned path of an archive entry relative to the
+// destination directory, refusing paths that escape it
+func archiveEntryPath(name string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(path.Clean(name), "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Archive entry '%s' escapes the destination directory", name)
+	}
+	return clean, nil
+}
+
+// resolveInRoot returns the host path of the container path p below root,
+// following symlinks as if root was the file system root, so they can not lead
+// outside of it. Missing path elements are joined as is
+func resolveInRoot(root, p string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(p, "/")
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		links++
+		if links > maxSymlinks {
+			return "", errors.New("Too many levels of symbolic links in " + p)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+	return filepath.Join(root, resolved), nil
+}
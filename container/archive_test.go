@@ -0,0 +1,170 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveEntry describes an entry of a test archive
+type archiveEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func writeArchive(t *testing.T, file string, compress bool, entries []archiveEntry) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body)), Format: tar.FormatUSTAR}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0750
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if compress {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(data)
+		zw.Close()
+		data = gz.Bytes()
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_OpenArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	entries := []archiveEntry{{name: "etc/motd", typeflag: tar.TypeReg, body: "hello"}}
+	writeArchive(t, filepath.Join(dir, "overlay.tar.gz"), true, entries)
+	writeArchive(t, filepath.Join(dir, "overlay.tar"), false, entries)
+	writeArchive(t, filepath.Join(dir, "overlay.bin"), false, entries)
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.tar.gz"), []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"overlay.tar.gz": true, "overlay.tar": true, "overlay.bin": false, "notes.tar.gz": false, "missing.tar": false} {
+		a, err := openArchive(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Failed to open %s. Error: %s", name, err)
+			continue
+		}
+		if (a != nil) != expected {
+			t.Errorf("Expected archive detection of %s to be %t", name, expected)
+		}
+		if a != nil {
+			a.Close()
+		}
+	}
+}
+
+func Test_ExtractArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/lib", filepath.Join(root, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "overlay.tar.gz")
+	writeArchive(t, file, true, []archiveEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", typeflag: tar.TypeReg, body: "hello"},
+		{name: "etc/issue", typeflag: tar.TypeSymlink, linkname: "motd"},
+		{name: "etc/issue.net", typeflag: tar.TypeLink, linkname: "etc/motd"},
+		{name: "lib/libnut.so", typeflag: tar.TypeReg, body: "elf"},
+	})
+	a, err := openArchive(file)
+	if err != nil || a == nil {
+		t.Fatalf("Failed to open archive (%v)", err)
+	}
+	if err := extractArchive(nil, a, root, "/", nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if content, err := ioutil.ReadFile(filepath.Join(root, "etc", "issue.net")); err != nil || string(content) != "hello" {
+		t.Errorf("Expected hard link to the extracted file, found %q (%v)", content, err)
+	}
+	if link, err := os.Readlink(filepath.Join(root, "etc", "issue")); err != nil || link != "motd" {
+		t.Errorf("Expected symlink to motd, found %q (%v)", link, err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "etc")); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("Expected directory permissions from the archive, found %v (%v)", info.Mode(), err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "usr", "lib", "libnut.so")); err != nil {
+		t.Errorf("Expected absolute symlinks to resolve inside the rootfs. Error: %s", err)
+	}
+}
+
+func Test_ExtractArchivePathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	malicious := [][]archiveEntry{
+		{{name: "../escaped", typeflag: tar.TypeReg, body: "pwned"}},
+		{{name: "srv/../../escaped", typeflag: tar.TypeReg, body: "pwned"}},
+		{{name: "srv/escaped", typeflag: tar.TypeLink, linkname: "../../escaped"}},
+	}
+	for i, entries := range malicious {
+		file := filepath.Join(dir, "malicious.tar")
+		writeArchive(t, file, false, entries)
+		a, err := openArchive(file)
+		if err != nil || a == nil {
+			t.Fatalf("Failed to open archive (%v)", err)
+		}
+		if err := extractArchive(nil, a, root, "/srv", nil); err == nil {
+			t.Errorf("Expected malicious archive %d to be refused", i)
+		}
+		a.Close()
+	}
+	// symlinks are followed inside the rootfs only
+	file := filepath.Join(dir, "symlink.tar")
+	writeArchive(t, file, false, []archiveEntry{
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "../../../.."},
+		{name: "link/escaped", typeflag: tar.TypeReg, body: "pwned"},
+	})
+	a, err := openArchive(file)
+	if err != nil || a == nil {
+		t.Fatalf("Failed to open archive (%v)", err)
+	}
+	if err := extractArchive(nil, a, root, "/srv", nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Error("Expected no file outside of the rootfs")
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); err != nil {
+		t.Errorf("Expected symlink to resolve to the rootfs root. Error: %s", err)
+	}
+}
@@ -0,0 +1,59 @@
+package container
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var argReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// buildArg represents a build argument declared via the ARG instruction
+type buildArg struct {
+	value   string
+	defined bool
+}
+
+// declareArg registers a build argument from an ARG instruction of the form
+// name[=default]. Values passed via BuildOptions.Args take precedence over defaults
+func (b *Builder) declareArg(decl string) {
+	name, arg := b.resolveArg(decl)
+	b.args[name] = arg
+}
+
+// resolveArg returns the name and value of the build argument declared by decl
+func (b *Builder) resolveArg(decl string) (string, buildArg) {
+	pair := strings.SplitN(decl, "=", 2)
+	arg := buildArg{}
+	if len(pair) == 2 {
+		arg = buildArg{value: pair[1], defined: true}
+	}
+	if v, ok := b.opts.Args[pair[0]]; ok {
+		arg = buildArg{value: v, defined: true}
+	}
+	return pair[0], arg
+}
+
+// expandArgs substitutes ${name} references to previously declared build arguments.
+// References to names that were never declared are left untouched, since they
+// could be shell or environment variables
+func (b *Builder) expandArgs(statement string) (string, error) {
+	return expandBuildArgs(b.args, statement)
+}
+
+// expandBuildArgs is expandArgs for the build arguments args
+func expandBuildArgs(args map[string]buildArg, statement string) (string, error) {
+	var err error
+	expanded := argReference.ReplaceAllStringFunc(statement, func(ref string) string {
+		name := argReference.FindStringSubmatch(ref)[1]
+		arg, ok := args[name]
+		if !ok {
+			return ref
+		}
+		if !arg.defined && err == nil {
+			err = fmt.Errorf("Build argument '%s' is referenced but has no value", name)
+		}
+		return arg.value
+	})
+	return expanded, err
+}
@@ -0,0 +1,164 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// artifactLabelPrefix prefixes the labels naming artifacts to fetch from the
+// built container
+const artifactLabelPrefix = "nut_artifact_"
+
+// DefaultArtifactName is the name of artifacts fetched into
+// BuildOptions.ArtifactDir if BuildOptions.ArtifactName is not set
+const DefaultArtifactName = "{label}/{name}"
+
+// artifactOutput places the artifacts of a build on the host. name may refer
+// to the suffix of the artifact's label as {label} and to the base name of the
+// artifact as {name}. allowMissing skips artifacts missing in the container
+type artifactOutput struct {
+	dir          string
+	name         string
+	allowMissing bool
+}
+
+// ArtifactStatus is the outcome of fetching an artifact
+type ArtifactStatus string
+
+// Artifact statuses
+const (
+	ArtifactStatusFetched ArtifactStatus = "fetched"
+	// ArtifactStatusMissing is recorded for artifacts missing in the container,
+	// if BuildOptions.AllowMissingArtifacts is set
+	ArtifactStatusMissing ArtifactStatus = "missing"
+	ArtifactStatusFailed  ArtifactStatus = "failed"
+)
+
+// ArtifactResult describes the artifact named by the label Label, at path
+// Source in the container and fetched to the host path Path
+type ArtifactResult struct {
+	Label  string
+	Source string
+	Path   string
+	Status ArtifactStatus
+	Err    error
+	// Digests lists the digests of the regular files of fetched artifacts
+	Digests []ArtifactDigest
+	// optional is set for label values ending with artifactOptionalMarker
+	optional bool
+}
+
+// artifactOptionalMarker ends label values of artifacts that may be missing
+const artifactOptionalMarker = "?"
+
+// parseArtifactValue splits the optional marker off the label value v
+func parseArtifactValue(v string) (string, bool) {
+	if strings.HasSuffix(v, artifactOptionalMarker) {
+		return strings.TrimSuffix(v, artifactOptionalMarker), true
+	}
+	return v, false
+}
+
+// hasGlobMeta reports whether p contains characters of glob patterns
+func hasGlobMeta(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// globInRoot returns the container paths matching the absolute glob pattern in
+// the container whose rootfs is root, sorted. Symbolic links are followed within
+// root like resolveInRoot does. As in shells, wildcards do not match leading dots
+func globInRoot(root, pattern string) ([]string, error) {
+	matches := []string{"/"}
+	for _, part := range strings.Split(pattern, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		var next []string
+		for _, dir := range matches {
+			if !hasGlobMeta(part) {
+				next = append(next, path.Join(dir, part))
+				continue
+			}
+			resolved, err := resolveInRoot(root, dir)
+			if err != nil {
+				return nil, err
+			}
+			if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+				continue
+			}
+			entries, err := ioutil.ReadDir(resolved)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), ".") && !strings.HasPrefix(part, ".") {
+					continue
+				}
+				ok, err := path.Match(part, e.Name())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid pattern '%s'. Error: %s", pattern, err)
+				}
+				if ok {
+					next = append(next, path.Join(dir, e.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+	var existing []string
+	for _, m := range matches {
+		resolved, err := resolveInRoot(root, m)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(resolved); err == nil {
+			existing = append(existing, m)
+		}
+	}
+	return existing, nil
+}
+
+// artifactOutput returns the placement of the build's artifacts. Without an
+// artifact directory or name, artifacts are fetched into the current directory
+// under their base name
+func (b *Builder) artifactOutput() artifactOutput {
+	if b.opts.ArtifactDir == "" && b.opts.ArtifactName == "" {
+		return artifactOutput{dir: ".", name: "{name}", allowMissing: b.opts.AllowMissingArtifacts}
+	}
+	o := artifactOutput{dir: b.opts.ArtifactDir, name: b.opts.ArtifactName, allowMissing: b.opts.AllowMissingArtifacts}
+	if o.dir == "" {
+		o.dir = "."
+	}
+	if o.name == "" {
+		o.name = DefaultArtifactName
+	}
+	return o
+}
+
+// validateArtifactName checks that the artifact name template refers to the
+// artifact and stays within the artifact directory
+func validateArtifactName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if !strings.Contains(name, "{name}") && !strings.Contains(name, "{label}") {
+		return fmt.Errorf("Invalid artifact name '%s'. Expected {label} or {name}", name)
+	}
+	_, err := artifactOutput{dir: ".", name: name}.path("label", "name")
+	return err
+}
+
+// path returns the host path of the artifact at path v in the container, named
+// by the label nut_artifact_ followed by label
+func (o artifactOutput) path(label, v string) (string, error) {
+	name := strings.NewReplacer("{label}", label, "{name}", filepath.Base(v)).Replace(o.name)
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Artifact name '%s' of label %s%s is outside of the artifact directory", name, artifactLabelPrefix, label)
+	}
+	return filepath.Join(o.dir, clean), nil
+}
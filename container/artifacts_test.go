@@ -0,0 +1,200 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_ArtifactPath(t *testing.T) {
+	o := artifactOutput{dir: "/srv/out", name: DefaultArtifactName}
+	if p, err := o.path("ruby", "/root/ruby.deb"); err != nil || p != "/srv/out/ruby/ruby.deb" {
+		t.Errorf("Expected /srv/out/ruby/ruby.deb, found %s (%v)", p, err)
+	}
+	o.name = "{label}-{name}"
+	if p, err := o.path("ruby", "pkg/ruby.deb"); err != nil || p != "/srv/out/ruby-ruby.deb" {
+		t.Errorf("Expected /srv/out/ruby-ruby.deb, found %s (%v)", p, err)
+	}
+	o.name = "../{name}"
+	if _, err := o.path("ruby", "/root/ruby.deb"); err == nil {
+		t.Error("Expected error for artifact outside of the artifact directory")
+	}
+	for _, name := range []string{"artifact", "/tmp/{name}", "{label}/../../{name}"} {
+		if err := validateArtifactName(name); err == nil {
+			t.Errorf("Expected error for artifact name '%s'", name)
+		}
+	}
+	b := NewBuilder("nut-test-artifacts")
+	if o := b.artifactOutput(); o != (artifactOutput{dir: ".", name: "{name}"}) {
+		t.Errorf("Expected artifacts in the current directory by default, found %+v", o)
+	}
+	b.opts.ArtifactDir = "out"
+	if o := b.artifactOutput(); o != (artifactOutput{dir: "out", name: DefaultArtifactName}) {
+		t.Errorf("Expected artifacts named by label in the artifact directory, found %+v", o)
+	}
+}
+
+func Test_FetchArtifacts(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	out, err := ioutil.TempDir("", "nut-test-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	for _, dir := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rootfs, dir, "pkg.deb"), []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := NewContainer("nut-test-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.rootfsDir = rootfs
+	c.unprivileged = true
+	c.Manifest.Labels = map[string]string{"nut_artifact_b": "/b/pkg.deb", "nut_artifact_a": "/a/pkg.deb", "version": "1"}
+	dir := filepath.Join(out, "artifacts")
+	if err := c.fetchArtifacts(artifactOutput{dir: dir, name: "{name}"}, func(ArtifactResult) {}); err == nil {
+		t.Error("Expected error for artifacts fetched to the same path")
+	}
+	var fetched []string
+	record := func(r ArtifactResult) {
+		if r.Status == ArtifactStatusFetched {
+			fetched = append(fetched, r.Path)
+		}
+	}
+	if err := c.fetchArtifacts(artifactOutput{dir: dir, name: DefaultArtifactName}, record); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "a", "pkg.deb"), filepath.Join(dir, "b", "pkg.deb")}
+	if !reflect.DeepEqual(fetched, expected) {
+		t.Errorf("Expected artifacts %v, found %v", expected, fetched)
+	}
+	if content, err := ioutil.ReadFile(expected[1]); err != nil || string(content) != "b" {
+		t.Errorf("Expected content of /b/pkg.deb, found %q (%v)", content, err)
+	}
+}
+
+func Test_FetchMissingArtifacts(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	c, err := NewContainer("nut-test-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.rootfsDir = rootfs
+	c.unprivileged = true
+	c.Manifest.Labels = map[string]string{"nut_artifact_pkg": "/root/pkg.deb"}
+	var results []ArtifactResult
+	record := func(r ArtifactResult) { results = append(results, r) }
+	err = c.fetchArtifacts(artifactOutput{dir: rootfs, name: DefaultArtifactName}, record)
+	artifactErr, ok := err.(*ArtifactError)
+	if !ok {
+		t.Fatalf("Expected artifact error, found %v", err)
+	}
+	if artifactErr.Label != "nut_artifact_pkg" || artifactErr.Source != "/root/pkg.deb" || artifactErr.Destination != filepath.Join(rootfs, "pkg", "pkg.deb") {
+		t.Errorf("Unexpected artifact error %+v", artifactErr)
+	}
+	if len(results) != 1 || results[0].Status != ArtifactStatusFailed {
+		t.Errorf("Expected failed artifact to be recorded, found %+v", results)
+	}
+	results = nil
+	if err := c.fetchArtifacts(artifactOutput{dir: rootfs, name: DefaultArtifactName, allowMissing: true}, record); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != ArtifactStatusMissing {
+		t.Errorf("Expected missing artifact to be recorded, found %+v", results)
+	}
+}
+
+func Test_GlobInRoot(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	for _, f := range []string{"build/out/a.deb", "build/out/b.deb", "build/out/.hidden.deb", "build/out/notes.txt", "build/other/c.deb"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rootfs, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// symlinks are followed within the rootfs
+	if err := os.Symlink("/build/out", filepath.Join(rootfs, "out")); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][]string{
+		"/build/out/*.deb": {"/build/out/a.deb", "/build/out/b.deb"},
+		"/build/*/*.deb":   {"/build/other/c.deb", "/build/out/a.deb", "/build/out/b.deb"},
+		"/out/?.deb":       {"/out/a.deb", "/out/b.deb"},
+		"/build/out/.*":    {"/build/out/.hidden.deb"},
+		"/build/none/*":    nil,
+	}
+	for pattern, expected := range cases {
+		matches, err := globInRoot(rootfs, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(matches, expected) {
+			t.Errorf("Expected %v for %s, found %v", expected, pattern, matches)
+		}
+	}
+	if v, optional := parseArtifactValue("/build/out/*.deb?"); v != "/build/out/*.deb" || !optional {
+		t.Errorf("Expected optional pattern, found %s (%t)", v, optional)
+	}
+}
+
+func Test_FetchGlobArtifacts(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := os.MkdirAll(filepath.Join(rootfs, "build", "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a.deb", "b.deb"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, "build", "out", f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := NewContainer("nut-test-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.rootfsDir = rootfs
+	c.unprivileged = true
+	c.Manifest.WorkDir = "/build"
+	c.Manifest.Labels = map[string]string{"nut_artifact_debs": "out/*.deb", "nut_artifact_rpms": "/build/out/*.rpm?"}
+	dir := filepath.Join(rootfs, "artifacts")
+	var results []ArtifactResult
+	if err := c.fetchArtifacts(artifactOutput{dir: dir, name: DefaultArtifactName}, func(r ArtifactResult) { results = append(results, r) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[2].Status != ArtifactStatusMissing || results[2].Label != "nut_artifact_rpms" {
+		t.Fatalf("Expected two fetched debs and missing rpms, found %+v", results)
+	}
+	for _, f := range []string{"a.deb", "b.deb"} {
+		if !fileExists(filepath.Join(dir, "debs", f)) {
+			t.Errorf("Expected %s to be fetched", f)
+		}
+	}
+	c.Manifest.Labels["nut_artifact_rpms"] = "/build/out/*.rpm"
+	if err := c.fetchArtifacts(artifactOutput{dir: dir, name: DefaultArtifactName}, func(ArtifactResult) {}); err == nil {
+		t.Error("Expected error for a pattern without matches")
+	}
+}
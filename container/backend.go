@@ -0,0 +1,76 @@
+package container
+
+import (
+	"gopkg.in/lxc/go-lxc.v2"
+	"path/filepath"
+	"time"
+)
+
+// lxcContainer is the part of *lxc.Container nut uses. Builds and containers
+// reach lxc only through it and backend, so their logic can be tested against a
+// fake instead of a real lxc installation
+type lxcContainer interface {
+	Name() string
+	Defined() bool
+	Running() bool
+	State() lxc.State
+	InitPid() int
+	Start() error
+	Stop() error
+	Shutdown(timeout time.Duration) error
+	Wait(state lxc.State, timeout time.Duration) bool
+	Destroy() error
+	Clone(name string, options lxc.CloneOptions) error
+	Snapshots() ([]lxc.Snapshot, error)
+	CreateSnapshot() (*lxc.Snapshot, error)
+	DestroySnapshot(snapshot lxc.Snapshot) error
+	ConfigFileName() string
+	ConfigItem(key string) []string
+	SetConfigItem(key, value string) error
+	ClearConfigItem(key string) error
+	SaveConfigFile(path string) error
+	IPAddresses() ([]string, error)
+	IPv4Addresses() ([]string, error)
+	RunCommandStatus(args []string, options lxc.AttachOptions) (int, error)
+}
+
+var _ lxcContainer = (*lxc.Container)(nil)
+
+// backend opens containers by name, whether or not they are defined
+type backend interface {
+	container(name string) (lxcContainer, error)
+}
+
+// lxcBackend opens the containers of the default lxc path with go-lxc
+type lxcBackend struct{}
+
+func (lxcBackend) container(name string) (lxcContainer, error) {
+	ct, err := lxc.NewContainer(name)
+	if err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// containerDir returns the directory of ct, holding its configuration and
+// manifest
+func containerDir(ct lxcContainer) string {
+	return filepath.Dir(ct.ConfigFileName())
+}
+
+// containerBackend returns the backend of the build's containers, go-lxc unless
+// replaced by tests
+func (b *Builder) containerBackend() backend {
+	if b.backend == nil {
+		return lxcBackend{}
+	}
+	return b.backend
+}
+
+// containerBackend returns the backend the container was opened with
+func (c *Container) containerBackend() backend {
+	if c.backend == nil {
+		return lxcBackend{}
+	}
+	return c.backend
+}
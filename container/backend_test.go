@@ -0,0 +1,110 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_BuildBackend(t *testing.T) {
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	b := NewBuilder("nut-test-backend")
+	b.backend = be
+	spec := "FROM nut-test-base\nENV A=1\nWORKDIR /srv\nRUN echo $A\nCMD [\"/bin/app\", \"-v\"]\n"
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.BuildWithResult(BuildOptions{NoCache: true, SkipNetworkWait: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := result.Manifest
+	if m.Parent != "nut-test-base" || m.WorkDir != "/srv" || !reflect.DeepEqual(m.Cmd, []string{"/bin/app", "-v"}) {
+		t.Errorf("Unexpected manifest %+v", m)
+	}
+	if !reflect.DeepEqual(m.Env, []string{"A=1"}) {
+		t.Errorf("Expected env [A=1], found %v", m.Env)
+	}
+	if _, err := os.Stat(result.ManifestPath); err != nil {
+		t.Errorf("Expected the manifest to be written. Error: %s", err)
+	}
+	expected := []string{"mkdir -p '/srv'", "echo $A"}
+	if scripts := be.scripts("nut-test-backend"); !reflect.DeepEqual(scripts, expected) {
+		t.Errorf("Expected commands %q, found %q", expected, scripts)
+	}
+	run := be.commands[len(be.commands)-1]
+	if run.Cwd != "/srv" {
+		t.Errorf("Expected RUN to execute in /srv, found %s", run.Cwd)
+	}
+	if !contains(run.Env, "A=1") || !contains(run.Env, "PWD=/srv") {
+		t.Errorf("Expected RUN environment to hold A=1 and PWD=/srv, found %v", run.Env)
+	}
+	if defined := be.defined(); !reflect.DeepEqual(defined, []string{"nut-test-backend", "nut-test-base"}) {
+		t.Errorf("Unexpected containers %v", defined)
+	}
+}
+
+func Test_BuildBackendErrors(t *testing.T) {
+	failMkdir := func(cmd fakeCommand) (string, int) {
+		if strings.Contains(cmd.Script, "mkdir") {
+			return "", 1
+		}
+		return "", 0
+	}
+	failRun := func(cmd fakeCommand) (string, int) {
+		if strings.Contains(cmd.Script, "false") {
+			return "", 2
+		}
+		return "", 0
+	}
+	tests := []struct {
+		spec  string
+		run   func(cmd fakeCommand) (string, int)
+		index int
+		check func(err error) bool
+	}{
+		{"FROM nut-test-missing\nRUN true\n", nil, 0, func(err error) bool {
+			var ctErr *ContainerError
+			return errors.As(err, &ctErr) && ctErr.Op == "create" && ctErr.Name == "nut-test-backend-errors"
+		}},
+		{"FROM nut-test-base\nRUN true\nRUN false\n", failRun, 2, func(err error) bool {
+			var exitErr *ExitError
+			return errors.As(err, &exitErr) && exitErr.ExitCode == 2
+		}},
+		{"FROM nut-test-base\nENV A\n", nil, 1, func(err error) bool {
+			return strings.Contains(err.Error(), "Missing value for 'A'")
+		}},
+		{"FROM nut-test-base\nWORKDIR /srv\n", failMkdir, 1, func(err error) bool {
+			return strings.Contains(err.Error(), "Failed to create WORKDIR /srv")
+		}},
+		{"FROM nut-test-base\nCMD [\"/bin/app\",\n", nil, 1, func(err error) bool {
+			return strings.Contains(err.Error(), "Invalid exec form")
+		}},
+		{"RUN true\nFROM nut-test-base\n", nil, 0, func(err error) bool {
+			return strings.Contains(err.Error(), "No container has been created yet")
+		}},
+	}
+	for _, test := range tests {
+		be := newFakeBackend(t, "nut-test-base")
+		be.run = test.run
+		b := NewBuilder("nut-test-backend-errors")
+		b.backend = be
+		if err := b.ParseReader(strings.NewReader(test.spec)); err != nil {
+			t.Fatal(err)
+		}
+		_, err := b.BuildWithOptions(BuildOptions{NoCache: true, SkipNetworkWait: true})
+		var stmtErr *StatementError
+		if !errors.As(err, &stmtErr) || stmtErr.Index != test.index {
+			t.Errorf("Expected a StatementError for statement %d of %q, found %v", test.index, test.spec, err)
+		} else if !test.check(stmtErr.Err) {
+			t.Errorf("Unexpected error for %q: %v", test.spec, stmtErr.Err)
+		}
+		if defined := be.defined(); !reflect.DeepEqual(defined, []string{"nut-test-base"}) {
+			t.Errorf("Expected the failed build of %q to be destroyed, found containers %v", test.spec, defined)
+		}
+		be.cleanup()
+	}
+}
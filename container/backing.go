@@ -0,0 +1,200 @@
+package container
+
+import (
+	"fmt"
+	"gopkg.in/lxc/go-lxc.v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BackingStore selects the storage of the rootfs of cloned containers
+type BackingStore string
+
+// Supported backing stores. BackingStoreAuto lets lxc pick the best store
+// available for the parent container
+const (
+	BackingStoreDir       BackingStore = "dir"
+	BackingStoreOverlayfs BackingStore = "overlayfs"
+	BackingStoreBtrfs     BackingStore = "btrfs"
+	BackingStoreZFS       BackingStore = "zfs"
+	BackingStoreAuto      BackingStore = "auto"
+)
+
+var backingStores = map[BackingStore]lxc.BackendStore{
+	BackingStoreDir:       lxc.Directory,
+	BackingStoreOverlayfs: lxc.Overlayfs,
+	BackingStoreBtrfs:     lxc.Btrfs,
+	BackingStoreZFS:       lxc.ZFS,
+	BackingStoreAuto:      lxc.Best,
+}
+
+// ParseBackingStore returns the backing store named s
+func ParseBackingStore(s string) (BackingStore, error) {
+	store := BackingStore(strings.ToLower(s))
+	if _, ok := backingStores[store]; !ok {
+		return "", fmt.Errorf("Invalid backing store %q. Supported backing stores are dir, overlayfs, btrfs, zfs and auto", s)
+	}
+	return store, nil
+}
+
+// cloneOptions returns the options cloning a container onto the store. Overlay
+// clones are always snapshots of their parent. snapshot requests copy on write
+// clones from btrfs and zfs, which stay independent of their parent
+func (s BackingStore) cloneOptions(snapshot bool) lxc.CloneOptions {
+	switch s {
+	case "", BackingStoreDir:
+		return lxc.CloneOptions{}
+	case BackingStoreOverlayfs:
+		return lxc.CloneOptions{Backend: lxc.Overlayfs, Snapshot: true}
+	case BackingStoreBtrfs, BackingStoreZFS:
+		return lxc.CloneOptions{Backend: backingStores[s], Snapshot: snapshot}
+	}
+	return lxc.CloneOptions{Backend: backingStores[s]}
+}
+
+// snapshotOptions returns the options cloning a container as a snapshot on the
+// store. Snapshots of directory backed containers are overlays of their parent
+func (s BackingStore) snapshotOptions() lxc.CloneOptions {
+	switch s {
+	case "", BackingStoreDir, BackingStoreAuto:
+		return lxc.CloneOptions{Snapshot: true}
+	}
+	return s.cloneOptions(true)
+}
+
+// independentSnapshots reports whether snapshot clones on the store can outlive
+// their parent, which makes them suitable for the build cache
+func (s BackingStore) independentSnapshots() bool {
+	return s == BackingStoreBtrfs || s == BackingStoreZFS
+}
+
+// cloneContainer clones orig as name onto the store, falling back to copying
+// the rootfs directory if the store is not supported for orig
+func cloneContainer(l Logger, be backend, orig lxcContainer, name string, store BackingStore, snapshot bool) error {
+	opts := store.cloneOptions(snapshot)
+	err := orig.Clone(name, opts)
+	if err == nil || opts == (lxc.CloneOptions{}) {
+		return err
+	}
+	loggerOrDefault(l).Warnf("Failed to clone %s onto backing store %s, falling back to copying the rootfs directory. Error: %s", orig.Name(), store, err)
+	if ct, err := be.container(name); err == nil && ct.Defined() {
+		ct.Destroy()
+	}
+	return orig.Clone(name, lxc.CloneOptions{})
+}
+
+// CloneMode selects whether FROM clones its container as a snapshot of the parent
+// or as a full copy
+type CloneMode string
+
+// Clone modes. CloneCopy is the default
+const (
+	// CloneAuto snapshots the parent if its backing store supports it, and
+	// copies it otherwise
+	CloneAuto CloneMode = "auto"
+	// CloneSnapshot snapshots the parent, failing if that is not supported. The
+	// snapshot depends on its parent until it is exported
+	CloneSnapshot CloneMode = "snapshot"
+	// CloneCopy copies the rootfs of the parent onto the backing store
+	CloneCopy CloneMode = "copy"
+)
+
+// ParseCloneMode returns the clone mode named s, CloneCopy if s is empty
+func ParseCloneMode(s string) (CloneMode, error) {
+	switch m := CloneMode(strings.ToLower(s)); m {
+	case "":
+		return CloneCopy, nil
+	case CloneAuto, CloneSnapshot, CloneCopy:
+		return m, nil
+	}
+	return "", fmt.Errorf("Invalid clone mode '%s'. Expected auto, snapshot or copy", s)
+}
+
+// validateCloneMode checks that the clone mode can be used with the store.
+// Overlay clones are always snapshots
+func validateCloneMode(mode CloneMode, store BackingStore) error {
+	m, err := ParseCloneMode(string(mode))
+	if err != nil {
+		return err
+	}
+	if m == CloneCopy && mode != "" && store == BackingStoreOverlayfs {
+		return fmt.Errorf("Clone mode copy can not be used with backing store overlayfs, whose clones are always snapshots")
+	}
+	return nil
+}
+
+// cloneWithMode clones orig as name onto the store as the mode selects. In auto
+// mode, a failed snapshot falls back to a copy
+func cloneWithMode(l Logger, be backend, orig lxcContainer, name string, store BackingStore, mode CloneMode) error {
+	switch mode {
+	case CloneSnapshot:
+		if err := orig.Clone(name, store.snapshotOptions()); err != nil {
+			return fmt.Errorf("Failed to snapshot %s. Error: %s", orig.Name(), err)
+		}
+		return nil
+	case CloneAuto:
+		err := orig.Clone(name, store.snapshotOptions())
+		if err == nil {
+			loggerOrDefault(l).Debugf("Cloned %s as snapshot %s", orig.Name(), name)
+			return nil
+		}
+		loggerOrDefault(l).Infof("Snapshots of %s are not supported, copying it instead. Error: %s", orig.Name(), err)
+		if ct, err := be.container(name); err == nil && ct.Defined() {
+			ct.Destroy()
+		}
+	}
+	return cloneContainer(l, be, orig, name, store, false)
+}
+
+// overlayRootfs reports whether the rootfs of ct is an overlay of its parent's,
+// which leaves the rootfs directory of ct empty
+func overlayRootfs(ct lxcContainer) bool {
+	rootfs := rootfsConfig(ct)
+	return strings.HasPrefix(rootfs, "overlay") || strings.HasPrefix(rootfs, "aufs:")
+}
+
+// plainRootfs reports whether the rootfs of ct is a directory on the host that
+// holds all of its files, whether or not it is running
+func plainRootfs(ct lxcContainer) bool {
+	storage, _ := splitRootfs(rootfsConfig(ct))
+	return storage == "" || storage == "dir" || storage == "btrfs"
+}
+
+// exportDir returns the container directory to export. Containers whose rootfs
+// is not a plain directory, like overlay snapshots of their parent, are first
+// copied into a temporary directory backed container, so images always hold a
+// standalone rootfs. cleanup removes that copy
+func (i *Image) exportDir() (dir string, cleanup func(), err error) {
+	lxcdir := lxc.GlobalConfigItem("lxc.lxcpath")
+	if plainRootfs(i.ct) {
+		return filepath.Join(lxcdir, i.ct.Name()), func() {}, nil
+	}
+	name := fmt.Sprintf("%s-export-%d", i.ct.Name(), os.Getpid())
+	i.logger().Debugf("Flattening rootfs of %s into %s for export", i.ct.Name(), name)
+	if err := i.ct.Clone(name, lxc.CloneOptions{Backend: lxc.Directory}); err != nil {
+		return "", nil, fmt.Errorf("Failed to flatten rootfs of %s. Error: %s", i.ct.Name(), err)
+	}
+	flat, err := NewContainer(name)
+	if err != nil {
+		return "", nil, err
+	}
+	flat.log = i.log
+	cleanup = func() {
+		if err := flat.DestroyAll(); err != nil {
+			i.logger().Warnf("Failed to remove temporary container %s. Error: %s", name, err)
+		}
+	}
+	dir = filepath.Join(lxcdir, name)
+	for _, f := range []string{ArchiveManifest, ArchiveManifestJSON} {
+		src := filepath.Join(lxcdir, i.ct.Name(), f)
+		if !fileExists(src) {
+			continue
+		}
+		if err := copyFile(src, filepath.Join(dir, f), 0644); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	return dir, cleanup, nil
+}
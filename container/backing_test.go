@@ -0,0 +1,133 @@
+package container
+
+import (
+	"gopkg.in/lxc/go-lxc.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ParseBackingStore(t *testing.T) {
+	for _, s := range []string{"dir", "overlayfs", "btrfs", "zfs", "auto", "ZFS"} {
+		if _, err := ParseBackingStore(s); err != nil {
+			t.Errorf("Expected %s to be valid, found %s", s, err)
+		}
+	}
+	for _, s := range []string{"", "lvm", "overlay"} {
+		if _, err := ParseBackingStore(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func Test_BackingStoreCloneOptions(t *testing.T) {
+	cases := []struct {
+		store    BackingStore
+		snapshot bool
+		opts     lxc.CloneOptions
+	}{
+		{"", true, lxc.CloneOptions{}},
+		{BackingStoreDir, true, lxc.CloneOptions{}},
+		{BackingStoreOverlayfs, false, lxc.CloneOptions{Backend: lxc.Overlayfs, Snapshot: true}},
+		{BackingStoreBtrfs, false, lxc.CloneOptions{Backend: lxc.Btrfs}},
+		{BackingStoreZFS, true, lxc.CloneOptions{Backend: lxc.ZFS, Snapshot: true}},
+		{BackingStoreAuto, true, lxc.CloneOptions{Backend: lxc.Best}},
+	}
+	for _, c := range cases {
+		if opts := c.store.cloneOptions(c.snapshot); opts != c.opts {
+			t.Errorf("Expected clone options %+v for %q, found %+v", c.opts, c.store, opts)
+		}
+	}
+	if BackingStoreOverlayfs.independentSnapshots() || !BackingStoreZFS.independentSnapshots() {
+		t.Error("Expected only btrfs and zfs snapshots to be independent of their parent")
+	}
+}
+
+func Test_OverlayExportLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.CreateWithBackingStore("trusty", BackingStoreOverlayfs); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.DestroyAll()
+	dir, err := ioutil.TempDir("", "nut-test-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image, err := NewImage("nut-test-overlay", filepath.Join(dir, "image.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := image.Create(false); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportContainer(image.Path, "nut-test-overlay-import", ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.DestroyAll()
+	if overlayRootfs(imported.ct) {
+		t.Error("Expected the exported rootfs to be a plain directory")
+	}
+	if !fileExists(filepath.Join(lxc.GlobalConfigItem("lxc.lxcpath"), "nut-test-overlay-import", "rootfs", "bin", "sh")) {
+		t.Error("Expected the exported rootfs to hold the files of the parent")
+	}
+}
+
+func Test_CloneMode(t *testing.T) {
+	for s, expected := range map[string]CloneMode{"": CloneCopy, "auto": CloneAuto, "Snapshot": CloneSnapshot, "copy": CloneCopy} {
+		if m, err := ParseCloneMode(s); err != nil || m != expected {
+			t.Errorf("Expected %s for %q, found %s (%v)", expected, s, m, err)
+		}
+	}
+	if _, err := ParseCloneMode("link"); err == nil {
+		t.Error("Expected error for unknown clone mode")
+	}
+	if err := validateCloneMode(CloneCopy, BackingStoreOverlayfs); err == nil {
+		t.Error("Expected error copying onto overlayfs")
+	}
+	if err := validateCloneMode("", BackingStoreOverlayfs); err != nil {
+		t.Errorf("Expected default clone mode to be valid with overlayfs, found %s", err)
+	}
+	if opts := BackingStoreDir.snapshotOptions(); opts != (lxc.CloneOptions{Snapshot: true}) {
+		t.Errorf("Expected plain snapshot of directory backed containers, found %+v", opts)
+	}
+	if opts := BackingStoreBtrfs.snapshotOptions(); opts != (lxc.CloneOptions{Backend: lxc.Btrfs, Snapshot: true}) {
+		t.Errorf("Expected btrfs snapshot, found %+v", opts)
+	}
+}
+
+func Test_SnapshotExportLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.CreateWithCloneMode("trusty", "", CloneAuto); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.DestroyAll()
+	dir, err := ioutil.TempDir("", "nut-test-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image, err := NewImage("nut-test-snapshot", filepath.Join(dir, "image.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := image.Create(false); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportContainer(image.Path, "nut-test-snapshot-import", ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.DestroyAll()
+	if !plainRootfs(imported.ct) {
+		t.Error("Expected the exported rootfs to be standalone")
+	}
+}
@@ -2,22 +2,207 @@ package container
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"runtime"
 	"strings"
+	"time"
 )
 
-// Builder represents a container build environment
+// BuildOptions configures a single build
+type BuildOptions struct {
+	// Volumes are bind mounted into every container created by the build
+	Volumes []string
+	// NoCache disables the per-statement build cache
+	NoCache bool
+	// Args overrides the default values of build arguments declared via ARG
+	Args map[string]string
+	// KeepStages retains intermediate stage containers of multi-stage builds
+	KeepStages bool
+	// KeepOnFailure retains the containers of a failed build for inspection
+	KeepOnFailure bool
+	// Stdout and Stderr receive the output of commands run during the build.
+	// They default to the standard output and error of the nut process
+	Stdout io.Writer
+	Stderr io.Writer
+	// Prefix prefixes every line of command output with the statement index
+	Prefix bool
+	// DryRun evaluates the statements without creating any container. Planned
+	// steps are passed to Plan
+	DryRun bool
+	Plan   func(PlannedStep)
+	// Events receives progress events. Sends never block, events are dropped if
+	// the channel is not ready
+	Events chan<- BuildEvent
+	// Logger receives the log messages of the build and its containers,
+	// replacing the logger set with Builder.SetLogger
+	Logger Logger
+	// AllowUnknown skips statements with unknown instructions instead of failing
+	// the build
+	AllowUnknown bool
+	// PreStatementHook is called before every statement. An error skips the
+	// statement and fails the build
+	PreStatementHook StatementHook
+	// PostStatementHook is called after every successful statement. An error fails
+	// the build
+	PostStatementHook StatementHook
+	// OnRunFailure decides whether the build continues after a failed RUN
+	// statement. RunFailurePrompt is consulted with PromptOnRunFailure
+	OnRunFailure     RunFailurePolicy
+	RunFailurePrompt func(statement string, exitCode int) bool
+	// StepTimeout limits the duration of RUN statements without a --timeout flag.
+	// Zero means no limit
+	StepTimeout time.Duration
+	// RunRetries and RunRetryDelay set how often and after which delay RUN
+	// statements without --retries and --retry-delay flags are retried after
+	// exiting with a non zero status
+	RunRetries    int
+	RunRetryDelay time.Duration
+	// BaseEnv replaces MinimalEnv as the environment of commands run during the
+	// build, ExtraEnv is added on top of it. Variables declared via ENV take
+	// precedence over both
+	BaseEnv  []string
+	ExtraEnv []string
+	// PropagateProxy passes the host's proxy variables (http_proxy, https_proxy,
+	// no_proxy and their upper case variants) to commands run during the build
+	PropagateProxy bool
+	// Limits restricts the resources available to the build containers
+	Limits Limits
+	// DefaultNetwork is the network mode, NetworkBridge or NetworkNone, of RUN
+	// statements without a --network flag. Empty means NetworkBridge
+	DefaultNetwork string
+	// Secrets maps the ids of secrets used by RUN --secret flags to host files.
+	// Secrets are never stored in the containers
+	Secrets map[string]string
+	// DownloadTimeout limits the download of remote ADD sources. Zero means no
+	// limit
+	DownloadTimeout time.Duration
+	// ContextDir is the build context ADD and COPY sources are resolved against.
+	// It defaults to the directory of the parsed spec file
+	ContextDir string
+	// AllowOutsideContext permits ADD and COPY sources escaping the build context
+	// via ..
+	AllowOutsideContext bool
+	// OmitHistory leaves the build history and provenance out of the manifest of
+	// the built container, e.g. to not disclose the statements of the spec
+	OmitHistory bool
+	// Architecture and OS override the platform recorded in the manifest, which
+	// defaults to the one nut runs on, for cross built rootfses
+	Architecture string
+	OS           string
+	// ManifestFormat selects whether the manifest of the built container is
+	// written as manifest.yml (ManifestYAML, the default), manifest.json
+	// (ManifestJSON) or both (ManifestBoth)
+	ManifestFormat string
+	// RequireParentManifest fails the build if the container a FROM statement
+	// clones has no manifest, instead of building on an empty one
+	RequireParentManifest bool
+	// Unprivileged builds in unprivileged containers, mapping the ids of their
+	// clones to the subordinate ids of the user running nut. It is set
+	// automatically if nut does not run as root
+	Unprivileged bool
+	// SkipNetworkWait starts build containers without waiting for their network,
+	// for builds that need none. Otherwise build containers are waited for to
+	// obtain an IPv4 address and to resolve NetworkProbe, DefaultNetworkProbe by
+	// default, for up to NetworkTimeout, DefaultNetworkTimeout by default
+	SkipNetworkWait bool
+	NetworkTimeout  time.Duration
+	NetworkProbe    string
+	// StopTimeout is how long build containers are given to shut down
+	// gracefully, DefaultStopTimeout by default
+	StopTimeout time.Duration
+	// CacheMounts are bind mounted into every container created by the build,
+	// and removed before its manifest is written
+	CacheMounts []CacheMount
+	// DNS configures the resolv.conf of build containers, which keep the one of
+	// their parent by default
+	DNS DNSOptions
+	// Cleanup selects whether the build containers are destroyed once the build
+	// finished, CleanupKeep by default
+	Cleanup CleanupPolicy
+	// ExistingContainer selects what the build does if its containers exist
+	// already, ExistingContainerError by default
+	ExistingContainer ExistingContainerPolicy
+	// BackingStore is the backing store of the build containers cloned from
+	// their FROM container. Unsupported stores fall back to copying the rootfs
+	// directory
+	BackingStore BackingStore
+	// CloneMode selects whether FROM snapshots its container or copies it,
+	// CloneCopy by default. Exports of snapshots are flattened into a standalone
+	// rootfs
+	CloneMode CloneMode
+	// LXCLogLevel is the level of the lxc log of build containers,
+	// DefaultLXCLogLevel by default. The ends of the lxc log and the console
+	// output of build containers are attached to errors of failed statements
+	LXCLogLevel string
+	// ArtifactDir is the host directory artifacts named by nut_artifact_ labels
+	// are fetched into, created if missing. ArtifactName names them below it,
+	// DefaultArtifactName by default. Without either, artifacts are fetched into
+	// the current directory under their base name. The current directory is
+	// shared by the whole process, so concurrent builds must set either to keep
+	// their artifacts apart
+	ArtifactDir  string
+	ArtifactName string
+	// AllowMissingArtifacts skips artifacts missing in the built container with
+	// a warning. Other artifacts that can not be fetched always fail the build
+	AllowMissingArtifacts bool
+}
+
+// Builder represents a container build environment. A Builder must not be
+// used from several goroutines at once. Builders of different names may build
+// concurrently within a process, their access to the build cache and to shared
+// artifact directories is synchronized. They must set BuildOptions.ArtifactDir
+// or ArtifactName, see there
 type Builder struct {
-	Name       string
+	Name string
+	// Volumes are bind mounted into containers created via CreateContainer, and
+	// into builds started via Build
 	Volumes    []string
-	Statements []string
+	Statements []Statement
 	RootDir    string
+	// Directives holds parser directives (e.g. escape, syntax) declared at the
+	// top of the specification
+	Directives map[string]string
+	opts       BuildOptions
+	log        Logger
+	// backend opens the containers of the build, see containerBackend
+	backend backend
+	ctx     context.Context
+	step    *PlannedStep
+	// done is the index of the last successfully executed statement
+	done int
+	// replaying is set while restoring the state of a failed build
+	replaying bool
+	result    *BuildResult
+	// current is the index of the statement being executed
+	current int
+	// failures holds RUN failures the build continued after
+	failures []error
+	// built is set once the final container is complete
+	built     bool
+	ct        *Container
+	args      map[string]buildArg
+	stages    map[string]*Container
+	stageList []*Container
+	ignore    *IgnoreMatcher
+	cache     []string
+	// healthcheckDeclared tracks HEALTHCHECK declarations of the current stage
+	healthcheckDeclared bool
+	// commandLines maps CMD and ENTRYPOINT to the line of their last declaration
+	// in the current stage
+	commandLines map[string]int
+	// idMap is the default id map of unprivileged builds
+	idMap idMap
+	// unregistered is a container cloned for a stage that failed before it was
+	// registered, which cleanup has to destroy as well
+	unregistered *Container
 }
 
 // NewBuilder returns a Builder struct
@@ -34,22 +219,80 @@ func (b *Builder) Parse(file string) error {
 		return err
 	}
 	defer fi.Close()
+	if err := b.ParseReader(fi); err != nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			parseErr.File = file
+		}
+		return err
+	}
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	b.RootDir = filepath.Dir(absPath)
+	return nil
+}
+
+// ParseReader reads dockerfile like DSL from r and populates build instructions.
+// Malformed specifications are reported as ParseError
+func (b *Builder) ParseReader(r io.Reader) error {
 	var statements []string
-	scanner := bufio.NewScanner(fi)
+	scanner := bufio.NewScanner(r)
 	scanner.Split(bufio.ScanLines)
 	var isComment = regexp.MustCompile(`^#`)
-	var isExtendedStatement = regexp.MustCompile(`\\$`)
+	var lines []int
+	directives := make(map[string]string)
+	escape := "\\"
+	parsingDirectives := true
 	previousStatement := ""
+	lineNumber := 0
+	startLine := 0
+	heredoc := ""
+	stripTabs := false
 	for scanner.Scan() {
 		line := scanner.Text()
+		lineNumber++
+		if heredoc != "" {
+			// heredoc bodies are consumed verbatim until the terminator
+			if stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			statements[len(statements)-1] += "\n" + line
+			if line == heredoc {
+				heredoc = ""
+			}
+			continue
+		}
+		if parsingDirectives {
+			key, value, ok := parseDirective(line)
+			if ok {
+				if _, exists := directives[key]; exists {
+					return &ParseError{Line: lineNumber, Msg: fmt.Sprintf("Parser directive '%s' declared more than once", key)}
+				}
+				if key == "escape" {
+					if value != "\\" && value != "`" {
+						return &ParseError{Line: lineNumber, Msg: fmt.Sprintf("Invalid escape character '%s', expected \\ or `", value)}
+					}
+					escape = value
+				}
+				directives[key] = value
+				continue
+			}
+			// directives are only honored before any comment, blank line or statement
+			parsingDirectives = false
+		}
 		if isComment.MatchString(line) {
 			continue
-		} else if isExtendedStatement.MatchString(line) {
-			// if line ends with \ then append statement
+		}
+		line = stripTrailingComment(line, escape)
+		if strings.HasSuffix(line, escape) {
+			// if line ends with the escape character then append statement
 			if previousStatement != "" {
-				previousStatement = previousStatement + " " + strings.TrimRight(line, "\\")
+				previousStatement = previousStatement + " " + strings.TrimRight(line, escape)
 			} else {
-				previousStatement = strings.TrimRight(line, "\\")
+				previousStatement = strings.TrimRight(line, escape)
+				startLine = lineNumber
 			}
 		} else if strings.TrimSpace(line) == "" {
 			// dont process if line empty
@@ -60,125 +303,738 @@ func (b *Builder) Parse(file string) error {
 			if previousStatement != "" {
 				statement = previousStatement + " " + line
 				previousStatement = ""
+				lines = append(lines, startLine)
 			} else {
 				statement = line
+				lines = append(lines, lineNumber)
 			}
 			statements = append(statements, statement)
+			heredoc, stripTabs, _ = heredocMarker(statement)
 		}
 	}
-	b.Statements = statements
-	absPath, err := filepath.Abs(file)
-	if err != nil {
+	if err := scanner.Err(); err != nil {
 		return err
 	}
-	b.RootDir = filepath.Dir(absPath)
+	if previousStatement != "" {
+		return &ParseError{Line: startLine, Msg: "Unterminated line continuation"}
+	}
+	if heredoc != "" {
+		return &ParseError{Line: lines[len(lines)-1], Msg: fmt.Sprintf("Unterminated heredoc '%s'", heredoc)}
+	}
+	b.Statements = make([]Statement, len(statements))
+	for i, statement := range statements {
+		b.Statements[i] = NewStatement(statement, lines[i])
+		if words := strings.Fields(statement); len(words) > 0 && words[0] != b.Statements[i].Instruction {
+			b.logger().Debugf("Normalized instruction '%s' to '%s'", words[0], b.Statements[i].Instruction)
+		}
+	}
+	b.Directives = directives
 	return nil
 }
 
+// stripTrailingComment removes a trailing '# comment' from a statement line. Only a
+// '#' preceded by whitespace and outside of single or double quotes starts a comment
+func stripTrailingComment(line, escape string) string {
+	var quote rune
+	escaped := false
+	previous := ' '
+	for i, ch := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case string(ch) == escape && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '#' && (previous == ' ' || previous == '\t') && i > 0:
+			return strings.TrimRight(line[:i], " \t")
+		}
+		previous = ch
+	}
+	return line
+}
+
+var directivePattern = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(\S+)\s*$`)
+
+// parseDirective parses a parser directive line of the form '# key=value'. Only
+// known directives are recognized, anything else is an ordinary comment
+func parseDirective(line string) (string, string, bool) {
+	match := directivePattern.FindStringSubmatch(line)
+	if match == nil {
+		return "", "", false
+	}
+	key := strings.ToLower(match[1])
+	switch key {
+	case "escape", "syntax", "version":
+		return key, match[2], true
+	}
+	return "", "", false
+}
+
+// CreateContainer clones the container referenced by from into a new container
+// named after the builder, and starts it
 func (b *Builder) CreateContainer(from string) (*Container, error) {
+	return b.createContainer(b.Name, from, b.Volumes)
+}
+
+// networkWait returns how build containers wait for their network
+func (b *Builder) networkWait() networkWait {
+	probe := b.opts.NetworkProbe
+	if probe == "" {
+		probe = DefaultNetworkProbe
+	}
+	return networkWait{skip: b.opts.SkipNetworkWait, timeout: b.opts.NetworkTimeout, probe: probe}
+}
+
+func (b *Builder) createContainer(name, from string, volumes []string) (*Container, error) {
+	if err := validateVolumes(volumes); err != nil {
+		return nil, err
+	}
 	parent := TagToName(from)
-	c, err := NewContainer(b.Name)
+	c, err := newContainer(b.containerBackend(), name)
+	if err != nil {
+		return nil, err
+	}
+	c.log = b.logger()
+	if err := b.loadParentManifest(&c.Manifest, parent); err != nil {
+		return nil, err
+	}
+	mode, err := ParseCloneMode(string(b.opts.CloneMode))
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Create(parent); err != nil {
+	if err := c.CreateWithCloneMode(parent, b.opts.BackingStore, mode); err != nil {
 		return nil, err
 	}
-	log.Infoln("Created container named ", b.Name)
-	for _, volume := range b.Volumes {
+	b.unregistered = c
+	if b.opts.Unprivileged {
+		if err := c.applyIDMap(b.idMap); err != nil {
+			return nil, err
+		}
+		c.unprivileged = true
+	}
+	b.logger().Infof("Created container named %s", name)
+	c.stdout, c.stderr = b.commandWriters()
+	c.env = b.environment()
+	c.network = b.networkWait()
+	c.StopTimeout = b.opts.StopTimeout
+	for _, volume := range volumes {
 		if err = c.BindMount(volume); err != nil {
 			return nil, err
 		}
 	}
+	for _, m := range b.opts.CacheMounts {
+		if err = c.MountCache(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.SetLimits(b.opts.Limits); err != nil {
+		return nil, err
+	}
+	if err := c.captureLogs(b.opts.LXCLogLevel); err != nil {
+		return nil, err
+	}
 	if err := c.Start(); err != nil {
+		if keys := limitKeys(b.opts.Limits); keys != "" {
+			return nil, fmt.Errorf("Failed to start container %s with resource limits %s. Error: %s", name, keys, err)
+		}
 		return nil, err
 	}
-	if err = c.Manifest.Load(parent); err != nil {
-		log.Warnf("Failed to load manifest from patent container. Error: %s\n", err)
+	if err := c.configureDNS(b.opts.DNS); err != nil {
+		return nil, err
 	}
 	return c, nil
 }
 
+// loadParentManifest loads the manifest of the parent container into m. Parents
+// without a manifest, like base OS containers, are accepted unless
+// RequireParentManifest is set. Corrupt manifests are always an error
+func (b *Builder) loadParentManifest(m *Manifest, parent string) error {
+	ct, err := b.containerBackend().container(parent)
+	if err == nil {
+		err = m.loadDir(b.logger(), containerDir(ct))
+	}
+	if err == nil {
+		return nil
+	}
+	var invalid *InvalidManifestError
+	if errors.As(err, &invalid) || b.opts.RequireParentManifest {
+		return fmt.Errorf("Failed to load manifest of parent container %s. Error: %s", parent, err)
+	}
+	b.logger().Warnf("Failed to load manifest of parent container %s. Error: %s", parent, err)
+	return nil
+}
+
+// parseCommand parses the arguments of CMD and ENTRYPOINT instructions. Arguments
+// starting with '[' are treated as JSON exec form (["executable", "param"]), anything
+// else as shell form
+func parseCommand(args string) ([]string, error) {
+	args = strings.TrimSpace(args)
+	if !strings.HasPrefix(args, "[") {
+		return tokenize(args)
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(args), &argv); err != nil {
+		return nil, fmt.Errorf("Invalid exec form '%s'. Error: %s", args, err)
+	}
+	return argv, nil
+}
+
 // Build creates a new container from  build instructions and return the container
-// struct
+// struct. It is equivalent to BuildWithOptions with the builder's volumes
 func (b *Builder) Build() (*Container, error) {
-	var c *Container
-	var err error
-	for _, statement := range b.Statements {
-		words := strings.Fields(statement)
-		switch words[0] {
-		case "FROM":
-			if c != nil {
-				return nil, errors.New("Container already built. Multiple FROM declaration?")
+	return b.BuildWithOptions(BuildOptions{Volumes: b.Volumes})
+}
+
+// BuildWithOptions creates a new container from build instructions as configured
+// by opts. Unless opts.KeepOnFailure is set, containers created by a failed build
+// are destroyed
+func (b *Builder) BuildWithOptions(opts BuildOptions) (*Container, error) {
+	return b.BuildContext(context.Background(), opts)
+}
+
+// BuildContext is like BuildWithOptions, but aborts the build once ctx is done.
+// The command running at that time is killed and the build containers are
+// stopped, and destroyed unless opts.KeepOnFailure is set
+func (b *Builder) BuildContext(ctx context.Context, opts BuildOptions) (*Container, error) {
+	result, err := b.run(ctx, opts, 0)
+	return result.Container, err
+}
+
+// BuildWithResult is like BuildWithOptions, but returns details about the build
+// along with the container. The result is returned for failed builds as well
+func (b *Builder) BuildWithResult(opts BuildOptions) (*BuildResult, error) {
+	return b.run(context.Background(), opts, 0)
+}
+
+// run builds the container, starting execution at the statement at index start.
+// Preceding statements are replayed against the containers of a previous build
+func (b *Builder) run(ctx context.Context, opts BuildOptions, start int) (*BuildResult, error) {
+	if !opts.DryRun {
+		release, err := claimBuild(b.Name)
+		if err != nil {
+			return &BuildResult{}, err
+		}
+		defer release()
+	}
+	b.opts = opts
+	b.ctx = ctx
+	b.result = &BuildResult{}
+	started := time.Now()
+	c, err := b.build(start)
+	defer b.finish(c, err)
+	if err != nil && !opts.DryRun && !b.built {
+		if opts.KeepOnFailure {
+			b.saveProgress()
+		}
+		b.cleanup(!opts.KeepOnFailure || ctx.Err() != nil, !opts.KeepOnFailure)
+	}
+	result := b.result
+	result.Duration = time.Since(started)
+	if c != nil {
+		result.Container = c
+		result.Manifest = c.Manifest
+		if err == nil {
+			result.ManifestPath = c.manifestPath()
+			if opts.ManifestFormat == ManifestJSON {
+				result.ManifestPath = c.jsonManifestPath()
 			}
-			c, err = b.CreateContainer(words[1])
+		}
+	}
+	b.emit(BuildFinished{Err: err})
+	return result, err
+}
+
+func (b *Builder) build(start int) (*Container, error) {
+	b.ct = nil
+	b.args = make(map[string]buildArg)
+	b.stages = make(map[string]*Container)
+	b.stageList = nil
+	b.unregistered = nil
+	b.ignore = nil
+	switch b.opts.ManifestFormat {
+	case "", ManifestYAML, ManifestJSON, ManifestBoth:
+	default:
+		return nil, fmt.Errorf("Unknown manifest format '%s'", b.opts.ManifestFormat)
+	}
+	if _, err := ParseCleanupPolicy(string(b.opts.Cleanup)); err != nil {
+		return nil, err
+	}
+	if err := b.opts.DNS.validate(b.logger()); err != nil {
+		return nil, err
+	}
+	if b.opts.BackingStore != "" {
+		if _, err := ParseBackingStore(string(b.opts.BackingStore)); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateCloneMode(b.opts.CloneMode, b.opts.BackingStore); err != nil {
+		return nil, err
+	}
+	if _, err := parseLXCLogLevel(b.opts.LXCLogLevel); err != nil {
+		return nil, err
+	}
+	if err := validateArtifactName(b.opts.ArtifactName); err != nil {
+		return nil, err
+	}
+	if runningUnprivileged() && !b.opts.Unprivileged {
+		b.logger().Infof("Not running as root, building unprivileged containers")
+		b.opts.Unprivileged = true
+	}
+	if b.opts.Unprivileged {
+		ids, err := checkUnprivileged()
+		if err != nil {
+			return nil, err
+		}
+		b.idMap = ids
+	}
+	if b.opts.ContextDir != "" {
+		if info, err := os.Stat(b.opts.ContextDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("Build context %s is not a directory", b.opts.ContextDir)
+		}
+	}
+	if b.RootDir != "" || b.opts.ContextDir != "" {
+		ignore, err := LoadIgnoreFile(b.contextDir())
+		if err != nil {
+			return nil, err
+		}
+		b.ignore = ignore
+	}
+	if err := validateVolumes(b.opts.Volumes); err != nil {
+		return nil, err
+	}
+	if err := validateCacheMounts(b.opts.CacheMounts); err != nil {
+		return nil, err
+	}
+	if start == 0 && !b.opts.DryRun {
+		var err error
+		if start, err = b.resolveExisting(); err != nil {
+			return nil, err
+		}
+	}
+	b.cache = nil
+	b.failures = nil
+	b.built = false
+	b.done = start - 1
+	if err := b.replay(start); err != nil {
+		return nil, err
+	}
+	lastFrom := -1
+	for i, st := range b.Statements {
+		if st.Instruction == "FROM" {
+			lastFrom = i
+		}
+	}
+	for i := start; i < len(b.Statements); i++ {
+		st := b.Statements[i]
+		if err := b.ctx.Err(); err != nil {
+			return nil, &StatementError{Index: i, Line: st.Line, Statement: st.Raw, Err: err}
+		}
+		if i == lastFrom && !b.opts.NoCache && !b.opts.DryRun {
+			last, err := b.restoreFromCache(i)
 			if err != nil {
-				return nil, err
-			}
-		case "RUN":
-			if c == nil {
-				log.Error("No container has been created yet. Use FROM directive")
-				return nil, errors.New("No container has been created yet. Use FROM directive")
-			}
-			command := words[1:len(words)]
-			if err := c.RunCommand(command); err != nil {
-				log.Errorf("Failed to run command inside container. Error: %s\n", err)
-				return nil, err
-			}
-		case "ENV":
-			for i := 1; i < len(words); i++ {
-				if strings.Contains(words[i], "=") {
-					c.Manifest.Env = append(c.Manifest.Env, words[i])
-				} else {
-					c.Manifest.Env = append(c.Manifest.Env, words[i]+"="+words[i+1])
-					i++
+				return nil, &StatementError{Index: i, Line: st.Line, Statement: st.Raw, Err: err}
+			}
+			if last >= 0 {
+				for j := i; j <= last; j++ {
+					b.result.Steps = append(b.result.Steps, StepResult{Index: j, Raw: b.Statements[j].Raw, CacheHit: true})
+					if err := b.skippedHooks(j); err != nil {
+						return nil, &StatementError{Index: j, Line: b.Statements[j].Line, Statement: b.Statements[j].Raw, Err: err}
+					}
+				}
+				i = last
+				b.done = last
+				continue
+			}
+		}
+		b.current = i
+		b.emit(StatementStarted{Index: i, Raw: st.Raw})
+		start := time.Now()
+		proceed := false
+		err := b.preStatement(i, false)
+		if err == nil {
+			if b.opts.DryRun {
+				err = b.plan(i, st)
+			} else {
+				err = b.execute(st)
+			}
+			proceed = err != nil && b.continueAfterRun(st, err)
+		}
+		if err == nil {
+			err = b.postStatement(i, false)
+		}
+		if err != nil {
+			if ctxErr := b.ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			err = &StatementError{Index: i, Line: st.Line, Statement: st.Raw, Err: err, Log: b.containerLog(i)}
+		}
+		duration := time.Since(start)
+		b.emit(StatementFinished{Index: i, Duration: duration, Err: err})
+		b.result.Steps = append(b.result.Steps, StepResult{Index: i, Raw: st.Raw, Duration: duration, Err: err})
+		if proceed {
+			b.logger().Warnf("Continuing build after failed statement at line %d", st.Line)
+			b.failures = append(b.failures, err)
+			// later cache keys assume the failed statement took effect
+			b.cache = nil
+			b.done = i
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		b.done = i
+		if b.opts.DryRun {
+			continue
+		}
+		b.recordHistory(st, start, duration)
+		if b.cache != nil && i > lastFrom && b.cache[i-lastFrom] != "" && cacheable(st) {
+			if err := b.checkpoint(b.ct, b.cache[i-lastFrom]); err != nil {
+				b.logger().Warnf("Failed to store build cache. Error: %s", err)
+			}
+		}
+	}
+	c := b.ct
+	if c == nil {
+		return nil, errors.New("No container has been created. Use FROM directive")
+	}
+	for name := range b.opts.Args {
+		if _, ok := b.args[name]; !ok {
+			b.logger().Warnf("Build argument %s was not consumed by any ARG instruction", name)
+		}
+	}
+	if b.opts.DryRun {
+		return nil, nil
+	}
+	record := func(artifact ArtifactResult) {
+		b.result.ArtifactResults = append(b.result.ArtifactResults, artifact)
+		if artifact.Status == ArtifactStatusFetched {
+			b.result.Artifacts = append(b.result.Artifacts, artifact.Path)
+			b.emit(ArtifactFetched{Path: artifact.Path})
+		}
+	}
+	out := b.artifactOutput()
+	unlock := lockArtifactDir(out.dir)
+	err := c.fetchArtifacts(out, record)
+	unlock()
+	if err != nil {
+		return c, err
+	}
+	if err := c.finishDNS(b.opts.DNS); err != nil {
+		return c, err
+	}
+	if err := b.unmountCaches(c); err != nil {
+		return c, err
+	}
+	if err := c.clearLogs(true); err != nil {
+		return c, err
+	}
+	b.clearProgress()
+	if !b.opts.KeepStages {
+		if err := b.destroyStages(c); err != nil {
+			return c, err
+		}
+	}
+	b.recordProvenance(c)
+	b.recordPlatform(c, time.Now())
+	if err := c.writeManifests(b.opts.ManifestFormat); err != nil {
+		return c, err
+	}
+	b.built = true
+	return c, errors.Join(b.failures...)
+}
+
+// recordHistory appends the statement, executed at started, to the history of the
+// build container's manifest
+func (b *Builder) recordHistory(st Statement, started time.Time, duration time.Duration) {
+	if b.opts.OmitHistory || b.ct == nil {
+		return
+	}
+	entry := HistoryEntry{Statement: st.Raw, Created: started.UTC(), Duration: duration}
+	b.ct.Manifest.History = append(b.ct.Manifest.History, entry)
+}
+
+// recordProvenance adds the nut version and build host to the manifest of the
+// built container, or removes all provenance if OmitHistory is set
+func (b *Builder) recordProvenance(c *Container) {
+	if b.opts.OmitHistory {
+		c.Manifest.Parent = ""
+		c.Manifest.NutVersion = ""
+		c.Manifest.BuildHost = ""
+		c.Manifest.History = nil
+		return
+	}
+	c.Manifest.NutVersion = Version
+	host, err := os.Hostname()
+	if err != nil {
+		b.logger().Warnf("Failed to determine build host. Error: %s", err)
+	}
+	c.Manifest.BuildHost = host
+}
+
+// recordPlatform adds the completion time of the build and the platform of the
+// rootfs to the manifest of the built container. Go's architecture names are
+// the ones used by OCI images
+func (b *Builder) recordPlatform(c *Container, completed time.Time) {
+	c.Manifest.Created = completed.UTC().Format(time.RFC3339)
+	c.Manifest.Architecture = runtime.GOARCH
+	if b.opts.Architecture != "" {
+		c.Manifest.Architecture = b.opts.Architecture
+	}
+	c.Manifest.OS = "linux"
+	if b.opts.OS != "" {
+		c.Manifest.OS = b.opts.OS
+	}
+}
+
+// plan evaluates the statement at index in dry run mode and passes the planned step
+// to the Plan callback
+func (b *Builder) plan(index int, st Statement) error {
+	step := PlannedStep{Index: index, Line: st.Line, Statement: st.Raw}
+	if b.ct != nil {
+		step.Env = b.ct.Manifest.Env
+		step.WorkDir = b.ct.Manifest.WorkDir
+		step.User = b.ct.Manifest.User
+	}
+	b.step = &step
+	defer func() { b.step = nil }()
+	if err := b.execute(st); err != nil {
+		return err
+	}
+	if b.ct != nil {
+		step.Manifest = b.ct.Manifest.snapshot()
+	}
+	if b.opts.Plan != nil {
+		b.opts.Plan(step)
+	}
+	return nil
+}
+
+// execute processes a single build statement against the current container
+func (b *Builder) execute(st Statement) error {
+	expanded, err := b.expandArgs(st.Raw)
+	if err != nil {
+		return err
+	}
+	st = NewStatement(expanded, st.Line)
+	if !instructions[st.Instruction] {
+		if b.opts.AllowUnknown {
+			b.logger().Warnf("Skipping unknown instruction %s at line %d", st.Instruction, st.Line)
+			return nil
+		}
+		return &UnknownInstructionError{Instruction: st.Instruction, Line: st.Line}
+	}
+	if expandableInstructions[st.Instruction] {
+		expanded, missing := expandVariables(st.Raw, func(name string) (string, bool) {
+			return b.lookupVariable(b.ct, name)
+		})
+		for _, name := range missing {
+			b.logger().Warnf("Variable %s is not set, substituting empty string in statement '%s'", name, st.Raw)
+		}
+		st = NewStatement(expanded, st.Line)
+	}
+	if len(st.Args) == 0 {
+		return fmt.Errorf("%s requires at least one argument", st.Instruction)
+	}
+	if st.Instruction != "ARG" && st.Instruction != "FROM" && b.ct == nil {
+		b.logger().Errorf("No container has been created yet. Use FROM directive")
+		return errors.New("No container has been created yet. Use FROM directive")
+	}
+	c := b.ct
+	args := st.ArgString()
+	if b.step != nil {
+		b.step.Statement = st.Raw
+	}
+	switch st.Instruction {
+	case "ARG":
+		if len(st.Args) != 1 {
+			return errors.New("Invalid ARG instruction. Expected ARG name[=default]")
+		}
+		b.declareArg(st.Args[0])
+	case "FROM":
+		from, alias, err := parseFrom(st.Args)
+		if err != nil {
+			return err
+		}
+		base := from
+		if b.opts.DryRun {
+			c = b.planContainer(from)
+			if b.replaying {
+				if err := b.attachContainer(c); err != nil {
+					return err
 				}
 			}
-		case "WORKDIR":
-			c.Manifest.WorkDir = words[1]
-		case "ADD":
-			if err := c.addFiles(filepath.Join(b.RootDir, words[1]), words[2]); err != nil {
-				return nil, err
-			}
-		case "COPY":
-			if err := c.addFiles(filepath.Join(b.RootDir, words[1]), words[2]); err != nil {
-				return nil, err
-			}
-		case "LABEL":
-			for i := 1; i < len(words); i++ {
-				if strings.Contains(words[i], "=") {
-					pair := strings.Split(words[i], "=")
-					c.Manifest.Labels[pair[0]] = pair[1]
-				} else {
-					return nil, errors.New("Invalid LABEL instruction. LABELS must have '=' in them")
+		} else {
+			if c != nil {
+				if err := c.WriteManifest(); err != nil {
+					return err
 				}
 			}
-		case "EXPOSE":
-			for _, p := range words[1:len(words)] {
-				port, err := strconv.ParseUint(p, 10, 64)
-				if err != nil {
-					return nil, fmt.Errorf("Error parsing ports in EXPOSE instruction. Err:%s\n", err)
+			if parent, ok := b.stages[from]; ok {
+				// building on top of a previous stage requires it to be stopped for cloning
+				if parent.ct.Running() {
+					if err := parent.Stop(); err != nil {
+						return err
+					}
 				}
-				c.Manifest.ExposedPorts = append(c.Manifest.ExposedPorts, port)
-			}
-		case "MAINTAINER":
-			c.Manifest.Maintainers = append(c.Manifest.Maintainers, strings.Join(words[1:len(words)], " "))
-		case "USER":
-			c.Manifest.User = words[1]
-		case "VOLUME":
-			// FIXME
-		case "STOPSIGNAL":
-			// FIXME
-		case "CMD":
-			c.Manifest.EntryPoint = words[1:]
-		case "ENTRYPOINT":
-			c.Manifest.EntryPoint = words[1:]
-		default:
-			return nil, fmt.Errorf("Unknown instruction: %s", words[0])
-		}
-	}
-	if err = c.fetchArtifacts(); err != nil {
-		return c, err
+				from = parent.ct.Name()
+			}
+			c, err = b.createContainer(b.stageContainerName(len(b.stageList), b.countStages()), from, b.opts.Volumes)
+			if err != nil {
+				return err
+			}
+		}
+		b.ct = c
+		b.healthcheckDeclared = false
+		b.commandLines = make(map[string]int)
+		c.Manifest.Parent = base
+		if err := b.addStage(c, alias); err != nil {
+			return err
+		}
+		// triggers registered by the parent are executed once, before any statement
+		// of the child, and are not inherited further
+		triggers := c.Manifest.OnBuild
+		c.Manifest.OnBuild = nil
+		step := b.step
+		b.step = nil
+		defer func() { b.step = step }()
+		for _, trigger := range triggers {
+			b.logger().Infof("Executing ONBUILD trigger '%s'", trigger)
+			if err := b.execute(NewStatement(trigger, st.Line)); err != nil {
+				return fmt.Errorf("ONBUILD trigger '%s' failed. Error: %s", trigger, err)
+			}
+		}
+	case "HEALTHCHECK":
+		if b.healthcheckDeclared {
+			return errors.New("Multiple HEALTHCHECK declarations")
+		}
+		healthcheck, err := parseHealthcheck(args)
+		if err != nil {
+			return err
+		}
+		b.healthcheckDeclared = true
+		c.Manifest.Healthcheck = healthcheck
+	case "ONBUILD":
+		trigger := NewStatement(args, st.Line)
+		switch trigger.Instruction {
+		case "ONBUILD":
+			return errors.New("Chaining ONBUILD via 'ONBUILD ONBUILD' is not allowed")
+		case "FROM", "MAINTAINER":
+			return fmt.Errorf("%s is not allowed as an ONBUILD trigger", trigger.Instruction)
+		}
+		c.Manifest.OnBuild = append(c.Manifest.OnBuild, trigger.String())
+	case "RUN":
+		return b.executeRun(c, st, args)
+	case "ENV":
+		tokens, err := tokenize(args)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(tokens); i++ {
+			if strings.Contains(tokens[i], "=") {
+				c.Manifest.Env = mergeEnv(c.Manifest.Env, []string{tokens[i]})
+			} else if i+1 < len(tokens) {
+				c.Manifest.Env = mergeEnv(c.Manifest.Env, []string{tokens[i] + "=" + tokens[i+1]})
+				i++
+			} else {
+				return fmt.Errorf("Invalid ENV instruction. Missing value for '%s'", tokens[i])
+			}
+		}
+	case "WORKDIR":
+		dir := resolveWorkDir(c.Manifest.WorkDir, args)
+		if !b.opts.DryRun {
+			// the directory is created by root, like docker does
+			if err := c.runAsRoot(b.ctx, []string{"mkdir", "-p", shellQuote(dir)}); err != nil {
+				return fmt.Errorf("Failed to create WORKDIR %s. Error: %s", dir, err)
+			}
+		}
+		c.Manifest.WorkDir = dir
+	case "ADD", "COPY":
+		return b.transferFiles(c, st)
+	case "LABEL":
+		tokens, err := tokenize(args)
+		if err != nil {
+			return err
+		}
+		if c.Manifest.Labels == nil {
+			c.Manifest.Labels = make(map[string]string)
+		}
+		for _, token := range tokens {
+			if strings.Contains(token, "=") {
+				pair := strings.SplitN(token, "=", 2)
+				c.Manifest.Labels[pair[0]] = pair[1]
+			} else {
+				return errors.New("Invalid LABEL instruction. LABELS must have '=' in them")
+			}
+		}
+	case "EXPOSE":
+		for _, p := range st.Args {
+			port, err := parseExposedPort(p)
+			if err != nil {
+				return err
+			}
+			c.Manifest.ExposedPorts = unitePorts(c.Manifest.ExposedPorts, []ExposedPort{port})
+		}
+	case "MAINTAINER":
+		tokens, err := tokenize(args)
+		if err != nil {
+			return err
+		}
+		c.Manifest.Maintainers = appendUnique(c.Manifest.Maintainers, strings.Join(tokens, " "))
+	case "USER":
+		if !b.opts.DryRun {
+			rootfs, err := c.rootfs()
+			if err != nil {
+				return err
+			}
+			if _, err := lookupUser(rootfs, st.Args[0]); err != nil {
+				return err
+			}
+		}
+		c.Manifest.User = st.Args[0]
+	case "VOLUME":
+		volumes, err := parseCommand(args)
+		if err != nil {
+			return err
+		}
+		for _, volume := range volumes {
+			if !path.IsAbs(volume) {
+				return fmt.Errorf("Invalid VOLUME '%s'. Mount points must be absolute paths", volume)
+			}
+		}
+		c.Manifest.Volumes = appendUnique(c.Manifest.Volumes, volumes...)
+	case "STOPSIGNAL":
+		name, _, err := ParseSignal(st.Args[0])
+		if err != nil {
+			return err
+		}
+		if b.opts.DryRun {
+			c.Manifest.StopSignal = name
+			return nil
+		}
+		if err := c.SetStopSignal(name); err != nil {
+			return err
+		}
+	case "CMD", "ENTRYPOINT":
+		command, err := parseCommand(args)
+		if err != nil {
+			return err
+		}
+		if line, ok := b.commandLines[st.Instruction]; ok {
+			b.logger().Warnf("%s at line %d overrides the %s at line %d", st.Instruction, st.Line, st.Instruction, line)
+		}
+		b.commandLines[st.Instruction] = st.Line
+		if st.Instruction == "CMD" {
+			c.Manifest.Cmd = command
+		} else {
+			c.Manifest.EntryPoint = command
+		}
+	default:
+		return &UnknownInstructionError{Instruction: st.Instruction, Line: st.Line}
 	}
-	return c, c.WriteManifest()
+	return nil
 }
@@ -1,7 +1,16 @@
 package container
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -31,3 +40,571 @@ func Test_Builder(t *testing.T) {
 		t.Fatal("Failed to destroy test container")
 	}
 }
+
+func Test_ExpandArgs(t *testing.T) {
+	b := NewBuilder("nut-test-args")
+	b.opts.Args = map[string]string{"VERSION": "2.2.3"}
+	b.args = make(map[string]buildArg)
+	b.declareArg("VERSION=1.0.0")
+	b.declareArg("ARCH=amd64")
+	b.declareArg("DISTRO")
+	out, err := b.expandArgs("RUN install ruby-${VERSION}_${ARCH}.deb ${HOME}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "RUN install ruby-2.2.3_amd64.deb ${HOME}" {
+		t.Fatalf("Unexpected expansion: %s", out)
+	}
+	if _, err := b.expandArgs("FROM ${DISTRO}"); err == nil {
+		t.Fatal("Expected error for build argument without value")
+	}
+}
+
+func Test_ParseCommand(t *testing.T) {
+	argv, err := parseCommand(" /sleep.sh  10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(argv) != 2 || argv[0] != "/sleep.sh" || argv[1] != "10" {
+		t.Fatalf("Unexpected shell form parsing: %#v", argv)
+	}
+	if _, err := parseCommand(`["/sleep.sh", 10`); err == nil {
+		t.Fatal("Expected error for malformed exec form")
+	}
+}
+
+func Test_ParseFrom(t *testing.T) {
+	parent, alias, err := parseFrom([]string{"golang:1.5", "as", "compiler"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent != "golang:1.5" || alias != "compiler" {
+		t.Fatalf("Unexpected parent: %s, stage: %s", parent, alias)
+	}
+	if _, _, err := parseFrom([]string{"trusty", "compiler"}); err == nil {
+		t.Fatal("Expected error for FROM without AS keyword")
+	}
+}
+
+func Test_StatementErrorLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	specfile := filepath.Join(dir, "Dockerfile")
+	spec := "# comment\nARG GREETING=hello\n\nRUN echo \\\n  ${GREETING}\n"
+	if err := ioutil.WriteFile(specfile, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("nut-test-statement-error")
+	if err := b.Parse(specfile); err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Build()
+	stmtErr, ok := err.(*StatementError)
+	if !ok {
+		t.Fatalf("Expected StatementError, found: %v", err)
+	}
+	if stmtErr.Line != 4 {
+		t.Fatalf("Expected error at line 4, found: %d", stmtErr.Line)
+	}
+}
+
+const testSpec = `# comment
+FROM trusty
+RUN apt-get update && \
+  apt-get install -y curl
+
+ENV GREETING hello
+`
+
+func Test_ParseReader(t *testing.T) {
+	b := NewBuilder("nut-test-parse-reader")
+	if err := b.ParseReader(strings.NewReader(testSpec)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"FROM trusty",
+		"RUN apt-get update &&    apt-get install -y curl",
+		"ENV GREETING hello",
+	}
+	if !reflect.DeepEqual(b.RawStatements(), expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, b.RawStatements())
+	}
+	if lines := statementLines(b); !reflect.DeepEqual(lines, []int{2, 3, 6}) {
+		t.Fatalf("Unexpected line numbers: %v", lines)
+	}
+}
+
+func Test_Parse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	specfile := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(specfile, []byte(testSpec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fromFile := NewBuilder("nut-test-parse")
+	if err := fromFile.Parse(specfile); err != nil {
+		t.Fatal(err)
+	}
+	fromReader := NewBuilder("nut-test-parse")
+	if err := fromReader.ParseReader(strings.NewReader(testSpec)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromFile.Statements, fromReader.Statements) {
+		t.Fatalf("Parse and ParseReader disagree: %#v vs %#v", fromFile.Statements, fromReader.Statements)
+	}
+	if fromFile.RootDir != dir {
+		t.Fatalf("Expected root directory %s, found %s", dir, fromFile.RootDir)
+	}
+}
+
+func Test_ParseDirectives(t *testing.T) {
+	spec := "# escape=`\n# syntax=nut/v1\nFROM trusty\n# escape=\\\nCOPY app C:\\app\\\nRUN echo `\n  hello\n"
+	b := NewBuilder("nut-test-directives")
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	if b.Directives["escape"] != "`" || b.Directives["syntax"] != "nut/v1" {
+		t.Fatalf("Unexpected directives: %v", b.Directives)
+	}
+	expected := []string{"FROM trusty", `COPY app C:\app\`, "RUN echo    hello"}
+	if !reflect.DeepEqual(b.RawStatements(), expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, b.RawStatements())
+	}
+}
+
+func Test_StripTrailingComment(t *testing.T) {
+	cases := map[string]string{
+		"EXPOSE 80 # http":                       "EXPOSE 80",
+		"RUN apt-get update  # refresh indexes":  "RUN apt-get update",
+		`LABEL desc="a # not a comment"`:         `LABEL desc="a # not a comment"`,
+		`LABEL desc='a # not a comment' # note`:  `LABEL desc='a # not a comment'`,
+		`RUN echo "it's # inside" # outside`:     `RUN echo "it's # inside"`,
+		"RUN echo ${#PATH} a#b":                  "RUN echo ${#PATH} a#b",
+		`RUN echo \# literal`:                    `RUN echo \# literal`,
+		"RUN make && \\ # continue on next line": "RUN make && \\",
+	}
+	for in, expected := range cases {
+		if out := stripTrailingComment(in, "\\"); out != expected {
+			t.Errorf("Expected: %s, found: %s", expected, out)
+		}
+	}
+}
+
+func Test_ParseDanglingContinuation(t *testing.T) {
+	b := NewBuilder("nut-test-dangling")
+	for _, spec := range []string{
+		"FROM trusty\nRUN apt-get update && \\\n  apt-get install -y curl \\",
+		"FROM trusty\nRUN apt-get update \\\n# trailing comment\n",
+	} {
+		err := b.ParseReader(strings.NewReader(spec))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Fatalf("Expected dangling continuation error naming line 2, found: %v", err)
+		}
+	}
+}
+
+func Test_ParseMixedCase(t *testing.T) {
+	spec := "from trusty\nRun echo Hello World\nCmd [\"/bin/Sleep\"]\nonbuild run make\nrun <<EOF\necho heredoc\nEOF\n"
+	b := NewBuilder("nut-test-mixed-case")
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"FROM trusty",
+		"RUN echo Hello World",
+		`CMD ["/bin/Sleep"]`,
+		"ONBUILD run make",
+		"RUN <<EOF\necho heredoc\nEOF",
+	}
+	var rendered []string
+	for _, st := range b.Statements {
+		rendered = append(rendered, st.String())
+	}
+	if !reflect.DeepEqual(rendered, expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, rendered)
+	}
+	if b.Statements[1].Raw != "Run echo Hello World" {
+		t.Fatalf("Expected raw statement to keep its casing, found: %s", b.Statements[1].Raw)
+	}
+	if errs := b.Validate(); len(errs) != 0 {
+		t.Fatalf("Expected valid spec, found errors: %v", errs)
+	}
+}
+
+func statementLines(b *Builder) []int {
+	var lines []int
+	for _, st := range b.Statements {
+		lines = append(lines, st.Line)
+	}
+	return lines
+}
+
+func Test_NewStatement(t *testing.T) {
+	st := NewStatement("copy  --from=builder /src   /dest", 7)
+	expected := Statement{
+		Instruction: "COPY",
+		Args:        []string{"--from=builder", "/src", "/dest"},
+		Raw:         "copy  --from=builder /src   /dest",
+		Line:        7,
+	}
+	if !reflect.DeepEqual(st, expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, st)
+	}
+	if st.ArgString() != "--from=builder /src   /dest" {
+		t.Fatalf("Unexpected argument string: %s", st.ArgString())
+	}
+}
+
+func Test_BuildContextCancelled(t *testing.T) {
+	b := NewBuilder("nut-test-cancelled")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nRUN true\n")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := b.BuildContext(ctx, BuildOptions{})
+	stmtErr, ok := err.(*StatementError)
+	if !ok {
+		t.Fatalf("Expected StatementError, found: %v", err)
+	}
+	if stmtErr.Err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, found: %v", stmtErr.Err)
+	}
+	if stmtErr.Line != 1 {
+		t.Fatalf("Expected error at line 1, found: %d", stmtErr.Line)
+	}
+}
+
+func Test_CreateContainerVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, count := range []int{0, 1, 3} {
+		b := NewBuilder(fmt.Sprintf("nut-test-volumes-%d", count))
+		for i := 0; i < count; i++ {
+			b.Volumes = append(b.Volumes, fmt.Sprintf("%s:/mnt/volume-%d", dir, i))
+		}
+		c, err := b.CreateContainer("trusty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := c.ct.ConfigItem("lxc.mount.entry")
+		mounts := 0
+		for _, entry := range entries {
+			if strings.HasPrefix(entry, dir+" ") {
+				mounts++
+			}
+		}
+		if mounts != count {
+			t.Errorf("Expected %d bind mounts, found %d: %v", count, mounts, entries)
+		}
+		if !c.ct.Running() {
+			t.Errorf("Expected container with %d volumes to be running", count)
+		}
+		if err := c.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Destroy(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_UnknownInstruction(t *testing.T) {
+	b := NewBuilder("nut-test-unknown")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nRNU apt-get update\nENV A=1\n")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := b.BuildWithOptions(BuildOptions{DryRun: true})
+	stmtErr, ok := err.(*StatementError)
+	if !ok {
+		t.Fatalf("Expected StatementError, found: %v", err)
+	}
+	unknown, ok := stmtErr.Err.(*UnknownInstructionError)
+	if !ok {
+		t.Fatalf("Expected UnknownInstructionError, found: %v", stmtErr.Err)
+	}
+	if unknown.Instruction != "RNU" || unknown.Line != 2 {
+		t.Fatalf("Unexpected error: %+v", unknown)
+	}
+	steps, err := b.DryRun(BuildOptions{AllowUnknown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 || len(steps[2].Manifest.Env) != 1 {
+		t.Fatalf("Expected build to continue past unknown instruction, found: %+v", steps)
+	}
+}
+
+func Test_BuildWithResult(t *testing.T) {
+	b := NewBuilder("nut-test-result")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nENV A=1\nRNU false\n")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.BuildWithResult(BuildOptions{DryRun: true})
+	if err == nil {
+		t.Fatal("Expected build to fail")
+	}
+	if len(result.Steps) != 3 {
+		t.Fatalf("Expected 3 step results, found %d", len(result.Steps))
+	}
+	for i, step := range result.Steps {
+		if step.Index != i || step.Raw != b.Statements[i].Raw || step.CacheHit {
+			t.Errorf("Unexpected step result %+v", step)
+		}
+	}
+	if result.Steps[1].Err != nil || result.Steps[2].Err == nil {
+		t.Errorf("Expected only the last step to fail, found: %+v", result.Steps)
+	}
+}
+
+func Test_BuildRemovesScripts(t *testing.T) {
+	b := NewBuilder("nut-test-scripts")
+	if err := b.ParseReader(strings.NewReader("FROM trusty\nRUN echo one\nRUN echo two\n")); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Destroy()
+	defer ct.Stop()
+	rootfs, err := ct.rootfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(rootfs, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), scriptPrefix) {
+			t.Errorf("Expected /tmp to contain no scripts, found %s", f.Name())
+		}
+	}
+}
+
+func Test_BuildSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := "nut-test-secret-d41d8cd98f00"
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("nut-test-secrets")
+	if err := b.ParseReader(strings.NewReader("FROM trusty\nRUN --secret=id=token,target=/root/.token test -s /root/.token\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BuildWithOptions(BuildOptions{}); err == nil {
+		t.Fatal("Expected build to fail without the secret")
+	}
+	ct, err := b.BuildWithOptions(BuildOptions{Secrets: map[string]string{"token": filepath.Join(dir, "token")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Destroy()
+	if err := ct.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	image, err := NewImage("nut-test-secrets", filepath.Join(dir, "image.tar.xz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := image.Create(true); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("tar", "-xOJf", image.Path).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte(secret)) {
+		t.Error("Expected the exported image not to contain the secret")
+	}
+}
+
+func Test_CopyDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"app.conf", "conf/a.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := NewBuilder("nut-test-copy")
+	b.RootDir = dir
+	spec := "FROM trusty\nCOPY app.conf /etc/myapp/app.conf\nCOPY app.conf /etc/myapp/conf.d/\nCOPY conf /srv/conf\nCOPY conf /srv/conf\n"
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Destroy()
+	defer ct.Stop()
+	rootfs, err := ct.rootfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"etc/myapp/app.conf", "etc/myapp/conf.d/app.conf", "srv/conf/a.conf"} {
+		if info, err := os.Stat(filepath.Join(rootfs, f)); err != nil || info.IsDir() {
+			t.Errorf("Expected file %s. Error: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "srv", "conf", "conf")); !os.IsNotExist(err) {
+		t.Error("Expected repeated directory copy not to nest the directory")
+	}
+}
+
+func Test_AddFilesCleanupOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(src, []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("nut-test-staging")
+	c, err := b.CreateContainer("trusty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	defer c.Stop()
+	if err := c.RunCommand([]string{"mkdir", "-p", "/srv/app.conf"}); err != nil {
+		t.Fatal(err)
+	}
+	// a file can not replace a directory, failing the copy inside the container
+	if err := c.addFiles(src, "/srv/app.conf", nil, ""); err == nil {
+		t.Fatal("Expected copy onto a directory to fail")
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(rootfs, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), stagePrefix) {
+			t.Errorf("Expected staged files to be removed, found %s", f.Name())
+		}
+	}
+}
+
+func Test_ParseCleanupPolicy(t *testing.T) {
+	for s, expected := range map[string]CleanupPolicy{
+		"":                   CleanupKeep,
+		"keep":               CleanupKeep,
+		"destroy-on-success": CleanupDestroyOnSuccess,
+		"Always":             CleanupAlways,
+	} {
+		if p, err := ParseCleanupPolicy(s); err != nil || p != expected {
+			t.Errorf("Expected %q to select %s, found %s (%v)", s, expected, p, err)
+		}
+	}
+	b := NewBuilder("nut-test-cleanup")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BuildWithResult(BuildOptions{Cleanup: "never"}); err == nil || !strings.Contains(err.Error(), "cleanup policy") {
+		t.Errorf("Expected invalid cleanup policy to fail the build, found %v", err)
+	}
+}
+
+func Test_CleanupPolicyLXC(t *testing.T) {
+	b := NewBuilder("nut-test-cleanup")
+	if err := b.ParseReader(strings.NewReader("FROM trusty\nRUN true\n")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.BuildWithResult(BuildOptions{Cleanup: CleanupDestroyOnSuccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Container.ct.Defined() {
+		t.Error("Expected container of successful build to be destroyed")
+	}
+	if err := b.ParseReader(strings.NewReader("FROM trusty\nRUN false\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BuildWithResult(BuildOptions{Cleanup: CleanupAlways, KeepOnFailure: true}); err == nil {
+		t.Fatal("Expected build to fail")
+	}
+	if ct, err := NewContainer("nut-test-cleanup"); err != nil || ct.ct.Defined() {
+		t.Errorf("Expected container of failed build to be destroyed despite KeepOnFailure (%v)", err)
+	}
+}
+
+func Test_OnBuild(t *testing.T) {
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	build := func(name, spec string) (*Container, error) {
+		b := NewBuilder(name)
+		b.backend = be
+		if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+			t.Fatal(err)
+		}
+		return b.BuildWithOptions(BuildOptions{NoCache: true, SkipNetworkWait: true})
+	}
+	parent, err := build("nut-test-onbuild-parent", "FROM nut-test-base\nONBUILD RUN echo triggered\nonbuild env TRIGGERED=1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"RUN echo triggered", "ENV TRIGGERED=1"}
+	if !reflect.DeepEqual(parent.Manifest.OnBuild, expected) {
+		t.Fatalf("Expected triggers %q in the manifest, found %q", expected, parent.Manifest.OnBuild)
+	}
+	if scripts := be.scripts("nut-test-onbuild-parent"); len(scripts) != 0 {
+		t.Errorf("Expected triggers not to run in the parent, found %q", scripts)
+	}
+	if err := parent.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	child, err := build("nut-test-onbuild-child", "FROM nut-test-onbuild-parent\nRUN echo child\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scripts := be.scripts("nut-test-onbuild-child"); !reflect.DeepEqual(scripts, []string{"echo triggered", "echo child"}) {
+		t.Errorf("Expected triggers to run before the child's statements, found %q", scripts)
+	}
+	if !contains(child.Manifest.Env, "TRIGGERED=1") {
+		t.Errorf("Expected the ENV trigger to apply to the child, found %v", child.Manifest.Env)
+	}
+	if len(child.Manifest.OnBuild) != 0 {
+		t.Errorf("Expected triggers not to be inherited by the child, found %q", child.Manifest.OnBuild)
+	}
+
+	invalid := map[string]string{
+		"ONBUILD ONBUILD RUN make": "Chaining ONBUILD via 'ONBUILD ONBUILD' is not allowed",
+		"ONBUILD FROM ubuntu":      "FROM is not allowed as an ONBUILD trigger",
+		"ONBUILD MAINTAINER me":    "MAINTAINER is not allowed as an ONBUILD trigger",
+	}
+	for statement, message := range invalid {
+		_, err := build("nut-test-onbuild-invalid", "FROM nut-test-base\n"+statement+"\n")
+		var stmtErr *StatementError
+		if !errors.As(err, &stmtErr) || stmtErr.Index != 1 || stmtErr.Err.Error() != message {
+			t.Errorf("Expected %q to fail with %q, found %v", statement, message, err)
+		}
+	}
+}
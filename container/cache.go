@@ -0,0 +1,420 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/lxc/go-lxc.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// cachePrefix prefixes the names of containers holding cached build states
+	cachePrefix = "nut-cache-"
+	// cacheStampFile records when a cache container was last used
+	cacheStampFile = "nut-cache-used"
+)
+
+// cacheable reports whether the state after a statement is worth caching, i.e.
+// the statement modifies the container's rootfs
+func cacheable(st Statement) bool {
+	switch st.Instruction {
+	case "RUN", "ADD":
+		return true
+	case "COPY":
+		// the content of other stages is not tracked by the cache
+		flags, _, err := parseFileFlags(st.Instruction, st.Args)
+		return err == nil && flags.from == ""
+	}
+	return false
+}
+
+// cacheKeys computes the cache key of every statement starting at the FROM
+// statement at index from. Each key is derived from the previous key, the
+// statement text with build arguments expanded, the values of arguments it
+// declares and, for ADD and COPY, the content of the source files. The first
+// key also covers the parent container and the arguments declared before it.
+// Keys are empty from the first statement that cannot be cached onwards
+func (b *Builder) cacheKeys(from int) []string {
+	keys := make([]string, len(b.Statements)-from)
+	h := sha256.New()
+	parent, err := b.cacheParent(b.Statements[from])
+	if err != nil {
+		b.logger().Debugf("Disabling build cache from line %d. Error: %s", b.Statements[from].Line, err)
+		return keys
+	}
+	if err := b.hashParent(h, parent); err != nil {
+		b.logger().Debugf("Disabling build cache from line %d. Error: %s", b.Statements[from].Line, err)
+		return keys
+	}
+	// arguments are resolved like execute does, as statements declare them
+	declared := make(map[string]buildArg)
+	var names []string
+	for name, arg := range b.args {
+		declared[name] = arg
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "ARG %s=%s\n", name, b.args[name].value)
+	}
+	previous := ""
+	for i, unexpanded := range b.Statements[from:] {
+		expanded, err := expandBuildArgs(declared, unexpanded.Raw)
+		if err != nil {
+			b.logger().Debugf("Disabling build cache from line %d. Error: %s", unexpanded.Line, err)
+			break
+		}
+		st := NewStatement(expanded, unexpanded.Line)
+		h.Write([]byte(previous + "\n" + expanded + "\n"))
+		if st.Instruction == "ARG" && len(st.Args) == 1 {
+			name, arg := b.resolveArg(st.Args[0])
+			declared[name] = arg
+			fmt.Fprintf(h, "ARG %s=%s %v\n", name, arg.value, arg.defined)
+		}
+		if st.Instruction == "COPY" || st.Instruction == "ADD" {
+			flags, args, err := parseFileFlags(st.Instruction, st.Args)
+			if !cacheable(st) || err != nil || len(args) < 2 {
+				break
+			}
+			if err := b.hashSources(h, st.Instruction, args[:len(args)-1], flags); err != nil {
+				b.logger().Debugf("Disabling build cache from line %d. Error: %s", st.Line, err)
+				break
+			}
+		}
+		keys[i] = hex.EncodeToString(h.Sum(nil))
+		previous = keys[i]
+		h.Reset()
+	}
+	return keys
+}
+
+// cacheParent returns the name of the parent container of the FROM statement
+// st. Previous stages are refused, their content is not tracked by the cache
+func (b *Builder) cacheParent(st Statement) (string, error) {
+	expanded, err := b.expandArgs(st.Raw)
+	if err != nil {
+		return "", err
+	}
+	from, _, err := parseFrom(NewStatement(expanded, st.Line).Args)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := b.stages[from]; ok {
+		return "", fmt.Errorf("Parent %s is a build stage", from)
+	}
+	return TagToName(from), nil
+}
+
+// hashParent writes the manifest of the parent container name, and the paths,
+// modes, sizes and modification times of the files of its rootfs, so cached
+// states are not reused once the parent is rebuilt or modified. Stat'ing the
+// rootfs costs a fraction of the copy FROM makes of it
+func (b *Builder) hashParent(w io.Writer, name string) error {
+	ct, err := b.containerBackend().container(name)
+	if err != nil {
+		return err
+	}
+	if !ct.Defined() {
+		return fmt.Errorf("Parent container %s does not exist", name)
+	}
+	// the rootfs of running containers changes while being hashed
+	if ct.Running() {
+		return fmt.Errorf("Parent container %s is running", name)
+	}
+	fmt.Fprintf(w, "FROM %s\n", name)
+	for _, file := range []string{ArchiveManifest, ArchiveManifestJSON} {
+		data, err := ioutil.ReadFile(filepath.Join(containerDir(ct), file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %d\n", file, len(data))
+		w.Write(data)
+	}
+	rootfs, err := rootfsPath(ct)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %o %d %d\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+}
+
+// hashSources writes the names and contents of all sources matching the glob
+// patterns of an ADD or COPY statement. Remote sources are identified by their
+// checksum, which is part of the statement, and can not be cached without one
+func (b *Builder) hashSources(w io.Writer, instruction string, patterns []string, flags fileFlags) error {
+	sources, err := expandSources(instruction, b.contextDir(), patterns, b.opts.AllowOutsideContext)
+	if err != nil {
+		return err
+	}
+	for _, src := range sources {
+		if isRemote(src) {
+			if flags.checksum == "" {
+				return fmt.Errorf("Remote source %s has no checksum", src)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s\n", filepath.Base(src))
+		if err := hashSource(w, src, b.ignore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashSource writes relative paths, modes and contents of the files below src
+func hashSource(w io.Writer, src string, ignore *IgnoreMatcher) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ignore.Ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %o\n", rel, info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(w, link)
+		case info.Mode().IsRegular():
+			fi, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			if _, err := io.Copy(w, fi); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// cacheContainerName returns the name of the container holding the cached state
+// for key
+func cacheContainerName(key string) string {
+	return cachePrefix + key[:24]
+}
+
+// restoreFromCache looks up the deepest cached state of the stage starting at the
+// FROM statement at index from. On a hit the build container is cloned from the
+// cache, builder state of the skipped statements is replayed and the index of the
+// last skipped statement is returned. On a miss -1 is returned
+func (b *Builder) restoreFromCache(from int) (int, error) {
+	b.cache = b.cacheKeys(from)
+	hit := -1
+	for i, key := range b.cache {
+		if key == "" {
+			break
+		}
+		if !cacheable(b.Statements[from+i]) {
+			continue
+		}
+		ct, err := b.containerBackend().container(cacheContainerName(key))
+		if err != nil {
+			return -1, err
+		}
+		if ct.Defined() {
+			hit = i
+		}
+	}
+	if hit < 0 {
+		return -1, nil
+	}
+	name := cacheContainerName(b.cache[hit])
+	unlock := cacheLocks.lock(name)
+	defer unlock()
+	// the cache may have been pruned meanwhile
+	if ct, err := b.containerBackend().container(name); err != nil || !ct.Defined() {
+		return -1, nil
+	}
+	b.logger().Infof("Using build cache %s for statements up to line %d", name, b.Statements[from+hit].Line)
+	base, alias, err := parseFrom(b.Statements[from].Args)
+	if err != nil {
+		return -1, err
+	}
+	c, err := b.createContainer(b.stageContainerName(len(b.stageList), b.countStages()), name, b.opts.Volumes)
+	if err != nil {
+		return -1, err
+	}
+	b.ct = c
+	b.healthcheckDeclared = false
+	b.commandLines = make(map[string]int)
+	c.Manifest.Parent = base
+	// the cached history ends with the skipped statements, unless it was omitted
+	history := c.Manifest.History
+	for i := 0; i <= hit && len(history)-hit-1+i >= 0; i++ {
+		if entry := &history[len(history)-hit-1+i]; entry.Statement == b.Statements[from+i].Raw {
+			entry.CacheHit = true
+		}
+	}
+	if err := b.addStage(c, alias); err != nil {
+		return -1, err
+	}
+	// the cached manifest already reflects skipped statements, only builder
+	// state needs to be replayed
+	for _, st := range b.Statements[from+1 : from+hit+1] {
+		switch st.Instruction {
+		case "ARG":
+			expanded, err := b.expandArgs(st.Raw)
+			if err != nil {
+				return -1, err
+			}
+			if st := NewStatement(expanded, st.Line); len(st.Args) == 1 {
+				b.declareArg(st.Args[0])
+			}
+		case "HEALTHCHECK":
+			b.healthcheckDeclared = true
+		case "CMD", "ENTRYPOINT":
+			b.commandLines[st.Instruction] = st.Line
+		}
+	}
+	b.touchCache(name)
+	return from + hit, nil
+}
+
+// checkpoint stores the current state of the build container in the cache under key
+func (b *Builder) checkpoint(c *Container, key string) error {
+	if err := c.Stop(); err != nil {
+		return err
+	}
+	err := b.storeCache(c, cacheContainerName(key))
+	if startErr := c.Start(); err == nil {
+		err = startErr
+	}
+	return err
+}
+
+// storeCache clones the stopped build container as the cache container name,
+// unless a concurrent build stored it already
+func (b *Builder) storeCache(c *Container, name string) error {
+	unlock := cacheLocks.lock(name)
+	defer unlock()
+	if ct, err := b.containerBackend().container(name); err == nil && ct.Defined() {
+		b.logger().Debugf("Build cache %s has already been stored", name)
+		b.touchCache(name)
+		return nil
+	}
+	b.logger().Debugf("Storing build cache %s", name)
+	// cache containers outlive the build container, so only snapshots that do
+	// not depend on it are used
+	var store BackingStore
+	if b.opts.BackingStore.independentSnapshots() {
+		store = b.opts.BackingStore
+	}
+	var err error
+	if store == "" && !plainRootfs(c.ct) {
+		// snapshots are flattened, as their parent may be destroyed before the cache
+		err = c.ct.Clone(name, lxc.CloneOptions{Backend: lxc.Directory})
+	} else {
+		err = cloneContainer(b.logger(), b.containerBackend(), c.ct, name, store, true)
+	}
+	if err != nil {
+		return err
+	}
+	cached, err := newContainer(b.containerBackend(), name)
+	if err != nil {
+		return err
+	}
+	// volumes are specific to a build and must not leak into later builds
+	if err := cached.ct.ClearConfigItem("lxc.mount.entry"); err != nil {
+		return err
+	}
+	// so are resource limits, which are applied again when restoring the cache
+	if err := cached.clearLimits(); err != nil {
+		return err
+	}
+	// and the logs, which are written to the directory of the build container
+	if err := cached.clearLogs(false); err != nil {
+		return err
+	}
+	cached.Manifest = c.Manifest
+	if err := cached.WriteManifest(); err != nil {
+		return err
+	}
+	b.touchCache(name)
+	return nil
+}
+
+func (b *Builder) touchCache(name string) {
+	ct, err := b.containerBackend().container(name)
+	if err != nil {
+		b.logger().Warnf("Failed to update build cache timestamp of %s. Error: %s", name, err)
+		return
+	}
+	stamp := filepath.Join(containerDir(ct), cacheStampFile)
+	if err := ioutil.WriteFile(stamp, []byte(time.Now().UTC().Format(time.RFC3339)), 0644); err != nil {
+		b.logger().Warnf("Failed to update build cache timestamp %s. Error: %s", stamp, err)
+	}
+}
+
+// CachePrune destroys cached build states that have not been used within maxAge.
+// A zero maxAge removes the whole cache. It may run while builds of the same
+// process use the cache. Messages go to l, the standard logger of logrus if l is
+// nil
+func CachePrune(maxAge time.Duration, l Logger) error {
+	lxcpath := lxc.GlobalConfigItem("lxc.lxcpath")
+	var errs []string
+	for _, name := range lxc.DefinedContainerNames(lxcpath) {
+		if !strings.HasPrefix(name, cachePrefix) {
+			continue
+		}
+		if err := pruneCache(l, lxcpath, name, maxAge); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to prune build cache. Errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pruneCache destroys the cache container name unless it was used within
+// maxAge. Builds restoring or storing it are waited for
+func pruneCache(l Logger, lxcpath, name string, maxAge time.Duration) error {
+	unlock := cacheLocks.lock(name)
+	defer unlock()
+	if maxAge > 0 {
+		stamp, err := os.Stat(filepath.Join(lxcpath, name, cacheStampFile))
+		if err == nil && time.Since(stamp.ModTime()) < maxAge {
+			return nil
+		}
+	}
+	ct, err := lxc.NewContainer(name, lxcpath)
+	if err != nil {
+		return err
+	}
+	loggerOrDefault(l).Infof("Pruning build cache %s", name)
+	if err := ct.Destroy(); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_CacheKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "app", "main.go")
+	if err := ioutil.WriteFile(main, []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spec := `FROM ubuntu
+RUN apt-get update
+ADD app /app
+RUN make
+COPY --from=builder /out /out
+RUN make install
+`
+	be := newFakeBackend(t, "ubuntu")
+	defer be.cleanup()
+	keys := func() []string {
+		b := NewBuilder("test")
+		b.backend = be
+		if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+			t.Fatal(err)
+		}
+		b.RootDir = dir
+		return b.cacheKeys(0)
+	}
+	first := keys()
+	if len(first) != 6 {
+		t.Fatalf("Expected 6 keys, got %d", len(first))
+	}
+	for i := 0; i < 4; i++ {
+		if first[i] == "" {
+			t.Errorf("Expected key for statement %d", i)
+		}
+	}
+	for i := 4; i < 6; i++ {
+		if first[i] != "" {
+			t.Errorf("Expected no key after COPY --from, got %q for statement %d", first[i], i)
+		}
+	}
+	second := keys()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Expected stable key for statement %d", i)
+		}
+	}
+	if err := ioutil.WriteFile(main, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	third := keys()
+	if third[1] != first[1] {
+		t.Error("Expected key before ADD to be unaffected by source changes")
+	}
+	if third[2] == first[2] || third[3] == first[3] {
+		t.Error("Expected source changes to invalidate ADD and later keys")
+	}
+	if err := ioutil.WriteFile(filepath.Join(be.dir, "ubuntu", "rootfs", "tmp", "patch"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if fourth := keys(); fourth[0] == third[0] || fourth[3] == third[3] {
+		t.Error("Expected changes of the parent rootfs to invalidate all keys")
+	}
+}
+
+func Test_CacheParentChanged(t *testing.T) {
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	build := func() *Container {
+		b := NewBuilder("nut-test-cache-parent")
+		b.backend = be
+		if err := b.ParseReader(strings.NewReader("FROM nut-test-base\nRUN echo hi\n")); err != nil {
+			t.Fatal(err)
+		}
+		c, err := b.BuildWithOptions(BuildOptions{SkipNetworkWait: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	build()
+	if err := be.open("nut-test-cache-parent").Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	build()
+	if runs := len(be.scripts("nut-test-cache-parent")); runs != 1 {
+		t.Fatalf("Expected the second build to use the cache, found %d runs", runs)
+	}
+	if err := be.open("nut-test-cache-parent").Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	patch := filepath.Join(be.dir, "nut-test-base", "rootfs", "etc", "patched")
+	if err := os.MkdirAll(filepath.Dir(patch), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(patch, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := build()
+	if runs := len(be.scripts("nut-test-cache-parent")); runs != 2 {
+		t.Errorf("Expected the build on the changed parent to run again, found %d runs", runs)
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(rootfs, "etc", "patched")) {
+		t.Error("Expected the child to hold the file added to its parent")
+	}
+}
+
+func Test_CacheArgs(t *testing.T) {
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	build := func(version string) {
+		b := NewBuilder("nut-test-cache-args")
+		b.backend = be
+		if err := b.ParseReader(strings.NewReader("FROM nut-test-base\nARG V=1\nRUN echo version ${V}\n")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.BuildWithOptions(BuildOptions{SkipNetworkWait: true, Args: map[string]string{"V": version}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := be.open("nut-test-cache-args").Destroy(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, version := range []string{"2", "3", "3"} {
+		build(version)
+	}
+	expected := []string{"echo version 2", "echo version 3"}
+	if scripts := be.scripts("nut-test-cache-args"); !reflect.DeepEqual(scripts, expected) {
+		t.Errorf("Expected commands %q, found %q", expected, scripts)
+	}
+}
@@ -0,0 +1,125 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CacheMount bind mounts a host directory read-write into build containers, for
+// caches like those of apt, pip or go modules to persist across builds. Unlike
+// volumes, cache mounts are removed before the manifest is written, so they
+// never become part of the built container
+type CacheMount struct {
+	HostDir      string
+	ContainerDir string
+}
+
+// validateCacheMounts checks that the directories of all cache mounts are
+// absolute paths
+func validateCacheMounts(mounts []CacheMount) error {
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.HostDir) {
+			return fmt.Errorf("Invalid cache mount '%s:%s'. Host directory must be an absolute path", m.HostDir, m.ContainerDir)
+		}
+		if !filepath.IsAbs(m.ContainerDir) || filepath.Clean(m.ContainerDir) == "/" {
+			return fmt.Errorf("Invalid cache mount '%s:%s'. Container directory must be an absolute path other than /", m.HostDir, m.ContainerDir)
+		}
+	}
+	return nil
+}
+
+// ParseCacheMount parses a cache mount specification of the form
+// host_directory:container_directory
+func ParseCacheMount(spec string) (CacheMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 {
+		return CacheMount{}, fmt.Errorf("Invalid cache mount spec '%s'. Expected host_directory:container_directory", spec)
+	}
+	m := CacheMount{HostDir: parts[0], ContainerDir: parts[1]}
+	return m, validateCacheMounts([]CacheMount{m})
+}
+
+// entry returns the lxc.mount.entry of the cache mount
+func (m CacheMount) entry() string {
+	return filepath.Clean(m.HostDir) + " " + strings.TrimPrefix(filepath.Clean(m.ContainerDir), "/") + " none bind,create=dir 0 0"
+}
+
+// MountCache bind mounts the cache m into the container once it is started,
+// creating its host directory if missing
+func (c *Container) MountCache(m CacheMount) error {
+	if err := validateCacheMounts([]CacheMount{m}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.HostDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create cache directory %s. Error: %s", m.HostDir, err)
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, m.ContainerDir), 0755); err != nil {
+		return fmt.Errorf("Failed to create mountpoint %s. Error: %s", m.ContainerDir, err)
+	}
+	if err := c.ct.SetConfigItem("lxc.mount.entry", m.entry()); err != nil {
+		return err
+	}
+	return c.ct.SaveConfigFile(c.ct.ConfigFileName())
+}
+
+// unmountCaches unmounts the cache mounts from the running container and
+// removes them from its configuration, keeping other mount entries. The
+// mountpoints stay behind empty
+func (c *Container) unmountCaches(mounts []CacheMount) error {
+	if len(mounts) == 0 {
+		return nil
+	}
+	drop := make(map[string]bool)
+	var script []string
+	for _, m := range mounts {
+		drop[m.entry()] = true
+		dir := shellQuote(filepath.Clean(m.ContainerDir))
+		script = append(script, fmt.Sprintf("if grep -qsF \" \"%s\" \" /proc/mounts; then umount %s; fi", dir, dir))
+	}
+	if c.ct.Running() {
+		if err := c.runAsRoot(context.Background(), []string{strings.Join(script, "\n")}); err != nil {
+			return fmt.Errorf("Failed to unmount caches of container %s. Error: %s", c.ct.Name(), err)
+		}
+	}
+	entries := c.ct.ConfigItem("lxc.mount.entry")
+	if err := c.ct.ClearConfigItem("lxc.mount.entry"); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry == "" || drop[entry] {
+			continue
+		}
+		if err := c.ct.SetConfigItem("lxc.mount.entry", entry); err != nil {
+			return err
+		}
+	}
+	c.logger().Debugf("Unmounted caches of container %s", c.ct.Name())
+	return c.ct.SaveConfigFile(c.ct.ConfigFileName())
+}
+
+// unmountCaches removes the cache mounts from the built container and the stage
+// containers kept after the build
+func (b *Builder) unmountCaches(final *Container) error {
+	if err := final.unmountCaches(b.opts.CacheMounts); err != nil {
+		return err
+	}
+	if !b.opts.KeepStages {
+		return nil
+	}
+	for _, c := range b.stageList {
+		if c == final {
+			continue
+		}
+		if err := c.unmountCaches(b.opts.CacheMounts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ParseCacheMount(t *testing.T) {
+	m, err := ParseCacheMount("/var/cache/nut/apt:/var/cache/apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != (CacheMount{HostDir: "/var/cache/nut/apt", ContainerDir: "/var/cache/apt"}) {
+		t.Errorf("Unexpected cache mount %+v", m)
+	}
+	if entry := m.entry(); entry != "/var/cache/nut/apt var/cache/apt none bind,create=dir 0 0" {
+		t.Errorf("Unexpected mount entry %q", entry)
+	}
+	for _, spec := range []string{"/var/cache/apt", "cache/apt:/var/cache/apt", "/cache:var/cache/apt", "/cache:/", "/a:/b:ro"} {
+		if _, err := ParseCacheMount(spec); err == nil {
+			t.Errorf("Expected error for cache mount spec '%s'", spec)
+		}
+	}
+}
+
+func Test_CacheMountLXC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ct, err := NewContainer("nut-test-cache-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.DestroyAll()
+	if err := ct.BindMount(dir + ":/mnt/volume"); err != nil {
+		t.Fatal(err)
+	}
+	m := CacheMount{HostDir: filepath.Join(dir, "cache"), ContainerDir: "/var/cache/nut-test"}
+	if err := ct.MountCache(m); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(m.HostDir) {
+		t.Error("Expected missing cache directory to be created")
+	}
+	ct.network = networkWait{skip: true}
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.RunCommand([]string{"touch", "/var/cache/nut-test/cached"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.unmountCaches([]CacheMount{m}); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(m.HostDir, "cached")) {
+		t.Error("Expected file written to the cache to persist on the host")
+	}
+	rootfs, err := ct.rootfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(rootfs, "var", "cache", "nut-test")); len(files) != 0 {
+		t.Errorf("Expected empty mountpoint, found %d files", len(files))
+	}
+	entries := ct.ct.ConfigItem("lxc.mount.entry")
+	if len(entries) != 1 || entries[0] == m.entry() {
+		t.Errorf("Expected only the volume to stay mounted, found %v", entries)
+	}
+}
@@ -0,0 +1,144 @@
+package container
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// artifactSumsFile lists the digests of fetched artifacts in the artifact
+// directory, in the format of sha256sum
+const artifactSumsFile = "SHA256SUMS"
+
+// ArtifactDigest is the digest of a regular file fetched as or within an
+// artifact, at Path relative to the artifact directory
+type ArtifactDigest struct {
+	Path   string
+	Digest string
+}
+
+// fileDigest returns the sha256 digest of the file at path, streaming its content
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return digestOf(h), nil
+}
+
+// artifactDigests returns the digests of the regular files at the host path
+// artifact, recursing into directories, with paths relative to dir
+func artifactDigests(dir, artifact string) ([]ArtifactDigest, error) {
+	var digests []ArtifactDigest
+	err := filepath.Walk(artifact, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		digests = append(digests, ArtifactDigest{Path: filepath.ToSlash(rel), Digest: digest})
+		return nil
+	})
+	return digests, err
+}
+
+// writeArtifactSums writes the digests of all fetched artifacts to the
+// SHA256SUMS file of the artifact directory dir
+func writeArtifactSums(dir string, artifacts []ArtifactResult) error {
+	var digests []ArtifactDigest
+	for _, a := range artifacts {
+		digests = append(digests, a.Digests...)
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].Path < digests[j].Path })
+	var content strings.Builder
+	for _, d := range digests {
+		fmt.Fprintf(&content, "%s  %s\n", strings.TrimPrefix(d.Digest, "sha256:"), d.Path)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, artifactSumsFile), []byte(content.String()), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s. Error: %s", artifactSumsFile, err)
+	}
+	return nil
+}
+
+// checksumPath returns the location of the checksum file of the image at path
+func checksumPath(path string) string {
+	return path + ".sha256"
+}
+
+// writeChecksumFile records the digest of the image in its checksum file, in the
+// format of sha256sum
+func writeChecksumFile(result ExportResult) error {
+	line := fmt.Sprintf("%s  %s\n", strings.TrimPrefix(result.Digest, "sha256:"), filepath.Base(result.Path))
+	if err := ioutil.WriteFile(checksumPath(result.Path), []byte(line), 0644); err != nil {
+		return fmt.Errorf("Failed to write checksum file. Error: %s", err)
+	}
+	return nil
+}
+
+// readChecksumFile returns the digest recorded in the checksum file of the image
+// at path
+func readChecksumFile(path string) (string, error) {
+	f, err := os.Open(checksumPath(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != filepath.Base(path) {
+			continue
+		}
+		if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+			return "", fmt.Errorf("Invalid sha256 digest %s in %s", fields[0], checksumPath(path))
+		}
+		return "sha256:" + strings.ToLower(fields[0]), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("No checksum of %s found in %s", filepath.Base(path), checksumPath(path))
+}
+
+// VerifyExport checks the image at path against the digest recorded in its
+// checksum file. A DigestMismatchError is returned if they differ
+func VerifyExport(path string) error {
+	expected, err := readChecksumFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := digestOf(h); actual != expected {
+		return &DigestMismatchError{Path: path, Expected: expected, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func Test_VerifyExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.tar.gz")
+	content := []byte("image content")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	result := ExportResult{Path: path, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	if err := writeChecksumFile(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyExport(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.LookPath("sha256sum"); err == nil {
+		cmd := exec.Command("sha256sum", "-c", filepath.Base(checksumPath(path)))
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("Expected checksum file readable by sha256sum. Error: %s %s", err, out)
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mismatch, ok := VerifyExport(path).(*DigestMismatchError)
+	if !ok {
+		t.Fatalf("Expected DigestMismatchError, found %v", VerifyExport(path))
+	}
+	tampered := sha256.Sum256([]byte("tampered"))
+	if mismatch.Expected != result.Digest || mismatch.Actual != "sha256:"+hex.EncodeToString(tampered[:]) {
+		t.Errorf("Unexpected mismatch %+v", mismatch)
+	}
+	os.Remove(checksumPath(path))
+	if err := VerifyExport(path); err == nil {
+		t.Error("Expected error without checksum file")
+	}
+}
+
+func Test_ArtifactDigests(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	files := map[string]string{"pkg.deb": "deb", "docs/README": "readme", "docs/html/index.html": "<html>"}
+	for f, content := range files {
+		p := filepath.Join(rootfs, "out", f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("README", filepath.Join(rootfs, "out", "docs", "link")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewContainer("nut-test-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.rootfsDir = rootfs
+	c.unprivileged = true
+	c.Manifest.Labels = map[string]string{"nut_artifact_pkg": "/out/pkg.deb", "nut_artifact_docs": "/out/docs"}
+	dir := filepath.Join(rootfs, "artifacts")
+	var results []ArtifactResult
+	if err := c.fetchArtifacts(artifactOutput{dir: dir, name: DefaultArtifactName}, func(r ArtifactResult) { results = append(results, r) }); err != nil {
+		t.Fatal(err)
+	}
+	sum := func(s string) string {
+		digest := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(digest[:])
+	}
+	if len(results) != 2 || len(results[0].Digests) != 2 || results[0].Digests[0] != (ArtifactDigest{Path: "docs/docs/README", Digest: "sha256:" + sum("readme")}) {
+		t.Errorf("Unexpected digests of directory artifact %+v", results)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, artifactSumsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sum("readme") + "  docs/docs/README\n" + sum("<html>") + "  docs/docs/html/index.html\n" + sum("deb") + "  pkg/pkg.deb\n"
+	if string(content) != expected {
+		t.Errorf("Expected %s:\n%s\nfound:\n%s", artifactSumsFile, expected, content)
+	}
+}
@@ -0,0 +1,267 @@
+package container
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Compression is the codec image tarballs are compressed with
+type Compression string
+
+// Supported image compressions. xz and zstd require the respective tool on the
+// host
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionXz   Compression = "xz"
+	CompressionZstd Compression = "zstd"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// compressionLevels are the valid levels of each compression, 0 selects the
+// default level of the codec
+var compressionLevels = map[Compression][2]int{
+	CompressionNone: {0, 0},
+	CompressionGzip: {gzip.BestSpeed, gzip.BestCompression},
+	CompressionXz:   {0, 9},
+	CompressionZstd: {1, 19},
+}
+
+// ExportOptions controls how images are created
+type ExportOptions struct {
+	// Sudo invokes tar through sudo instead of archiving in process
+	Sudo bool
+	// Compression defaults to the compression implied by the image file name, or
+	// gzip (xz with Sudo) if the name does not imply one
+	Compression Compression
+	// Level is the compression level, 0 selects the default of the codec
+	Level int
+	// Progress, if set, is called after each write with the total number of
+	// bytes written
+	Progress func(written int64)
+	// SignKey is the armored private key images are signed with using gpg.
+	// Signer replaces gpg if set. The detached signature is written next to the
+	// image, with .asc appended to its name. Streamed images are not signed
+	SignKey string
+	Signer  Signer
+}
+
+// ParseCompression returns the compression named s
+func ParseCompression(s string) (Compression, error) {
+	c := Compression(strings.ToLower(s))
+	if _, ok := compressionLevels[c]; !ok {
+		return "", fmt.Errorf("Invalid compression %q. Supported compressions are none, gzip, xz and zstd", s)
+	}
+	return c, nil
+}
+
+// Extension returns the file name extension of tarballs compressed with c
+func (c Compression) Extension() string {
+	switch c {
+	case CompressionGzip:
+		return ".tar.gz"
+	case CompressionXz:
+		return ".tar.xz"
+	case CompressionZstd:
+		return ".tar.zst"
+	}
+	return ".tar"
+}
+
+// validateLevel checks that level is a valid level for c
+func (c Compression) validateLevel(level int) error {
+	bounds := compressionLevels[c]
+	if level != 0 && (level < bounds[0] || level > bounds[1]) {
+		if c == CompressionNone {
+			return fmt.Errorf("Compression level %d can not be used without compression", level)
+		}
+		return fmt.Errorf("Invalid %s compression level %d. Valid levels are %d to %d", c, level, bounds[0], bounds[1])
+	}
+	return nil
+}
+
+// compressionFromPath returns the compression implied by the file name extension
+// of path, or an empty compression if the extension implies none
+func compressionFromPath(path string) Compression {
+	name := strings.ToLower(path)
+	for _, e := range []struct {
+		c    Compression
+		exts []string
+	}{
+		{CompressionGzip, []string{".tar.gz", ".tgz"}},
+		{CompressionXz, []string{".tar.xz", ".txz"}},
+		{CompressionZstd, []string{".tar.zst", ".tzst"}},
+		{CompressionNone, []string{".tar"}},
+	} {
+		for _, ext := range e.exts {
+			if strings.HasSuffix(name, ext) {
+				return e.c
+			}
+		}
+	}
+	return ""
+}
+
+// detectCompression returns the compression of the file at path, recognised by
+// its magic bytes. bzip2 compressed files are reported with an error, since
+// images are not exported with bzip2
+func detectCompression(path string) (Compression, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, len(xzMagic))
+	n, _ := io.ReadFull(f, header)
+	return compressionFromMagic(header[:n])
+}
+
+func compressionFromMagic(header []byte) (Compression, error) {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(header, xzMagic):
+		return CompressionXz, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		return CompressionZstd, nil
+	case bytes.HasPrefix(header, bzip2Magic):
+		return "", fmt.Errorf("bzip2 compressed images are not supported")
+	}
+	return CompressionNone, nil
+}
+
+// tarFlags returns the GNU tar flags selecting c
+func (c Compression) tarFlags(level int) []string {
+	switch c {
+	case CompressionGzip:
+		if level != 0 {
+			return []string{"--use-compress-program=gzip -" + strconv.Itoa(level)}
+		}
+		return []string{"-z"}
+	case CompressionXz:
+		if level != 0 {
+			return []string{"--use-compress-program=xz -" + strconv.Itoa(level)}
+		}
+		return []string{"-J"}
+	case CompressionZstd:
+		if level != 0 {
+			return []string{"--use-compress-program=zstd -" + strconv.Itoa(level)}
+		}
+		return []string{"--zstd"}
+	}
+	return nil
+}
+
+// compressor returns a writer compressing into w with c. Closing the writer
+// flushes the compressed stream, but does not close w
+func (c Compression) compressor(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionXz, CompressionZstd:
+		args := []string{"-c"}
+		if level != 0 {
+			args = append(args, "-"+strconv.Itoa(level))
+		}
+		return startFilter(w, string(c), args...)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// decompressor returns a reader decompressing r with c
+func (c Compression) decompressor(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionXz, CompressionZstd:
+		cmd := exec.Command(string(c), "-dc")
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("Failed to start %s. Error: %s", c, err)
+		}
+		return &filterReader{ReadCloser: out, cmd: cmd}, nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// filterWriter pipes writes through an external compression tool
+type filterWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+func startFilter(w io.Writer, name string, args ...string) (*filterWriter, error) {
+	f := &filterWriter{cmd: exec.Command(name, args...)}
+	f.cmd.Stdout = w
+	f.cmd.Stderr = &f.stderr
+	in, err := f.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	f.WriteCloser = in
+	if err := f.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start %s. Error: %s", name, err)
+	}
+	return f, nil
+}
+
+// Close ends the input of the tool and waits for it to exit
+func (f *filterWriter) Close() error {
+	f.WriteCloser.Close()
+	if err := f.cmd.Wait(); err != nil {
+		return fmt.Errorf("Failed to compress with %s. Error: %s %s", f.cmd.Path, err, strings.TrimSpace(f.stderr.String()))
+	}
+	return nil
+}
+
+// filterReader reads the output of an external decompression tool
+type filterReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close waits for the tool to exit, reporting decompression errors
+func (f *filterReader) Close() error {
+	f.ReadCloser.Close()
+	return f.cmd.Wait()
+}
+
+// progressWriter counts the bytes written to w and reports them to progress
+type progressWriter struct {
+	w        io.Writer
+	n        int64
+	progress func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if p.progress != nil && n > 0 {
+		p.progress(p.n)
+	}
+	return n, err
+}
@@ -0,0 +1,159 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_CompressionRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "ct")
+	if err := os.MkdirAll(filepath.Join(src, "rootfs", "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "rootfs", "etc", "hostname"), []byte("app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionXz, CompressionZstd} {
+		if c == CompressionXz || c == CompressionZstd {
+			if _, err := exec.LookPath(string(c)); err != nil {
+				t.Logf("Skipping %s, which is not installed", c)
+				continue
+			}
+		}
+		path := filepath.Join(dir, "image"+c.Extension())
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := exportCompressed(nil, f, src, c, compressionLevels[c][1]); err != nil {
+			t.Fatalf("Failed to export with %s. Error: %s", c, err)
+		}
+		f.Close()
+		if detected, err := detectCompression(path); err != nil || detected != c {
+			t.Errorf("Expected %s to be detected, found %s (%v)", c, detected, err)
+		}
+		a, err := openArchive(path)
+		if err != nil || a == nil {
+			t.Fatalf("Failed to open %s image. Error: %v", c, err)
+		}
+		tr := tar.NewReader(a)
+		found := false
+		for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+			if hdr.Name == "./rootfs/etc/hostname" {
+				d, _ := ioutil.ReadAll(tr)
+				found = string(d) == "app\n"
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Errorf("Failed to decompress %s image. Error: %s", c, err)
+		}
+		if !found {
+			t.Errorf("Expected hostname in %s image", c)
+		}
+		dest := filepath.Join(dir, "restore-"+string(c))
+		if err := os.Mkdir(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"-xpf", path}, c.tarFlags(0)...)
+		if out, err := exec.Command("tar", append(args, "-C", dest)...).CombinedOutput(); err != nil {
+			t.Errorf("Failed to extract %s image with tar. Error: %s %s", c, err, out)
+		} else if d, err := ioutil.ReadFile(filepath.Join(dest, "rootfs", "etc", "hostname")); err != nil || string(d) != "app\n" {
+			t.Errorf("Expected hostname extracted from %s image, found %q (%v)", c, d, err)
+		}
+	}
+}
+
+func Test_CompressionOptions(t *testing.T) {
+	if _, err := ParseCompression("brotli"); err == nil {
+		t.Error("Expected error for unsupported compression")
+	}
+	if c, err := ParseCompression("ZSTD"); err != nil || c != CompressionZstd {
+		t.Errorf("Expected zstd, found %s (%v)", c, err)
+	}
+	for path, expected := range map[string]Compression{
+		"app.tar.gz": CompressionGzip,
+		"app.TGZ":    CompressionGzip,
+		"app.tar.xz": CompressionXz,
+		"app.tzst":   CompressionZstd,
+		"app.tar":    CompressionNone,
+		"app":        "",
+		"app.img":    "",
+	} {
+		if c := compressionFromPath(path); c != expected {
+			t.Errorf("Expected %q for %s, found %q", expected, path, c)
+		}
+	}
+	for _, invalid := range []struct {
+		c     Compression
+		level int
+	}{{CompressionGzip, 10}, {CompressionZstd, 20}, {CompressionXz, -1}, {CompressionNone, 1}} {
+		if err := invalid.c.validateLevel(invalid.level); err == nil {
+			t.Errorf("Expected error for %s level %d", invalid.c, invalid.level)
+		}
+	}
+	if err := CompressionZstd.validateLevel(0); err != nil {
+		t.Error(err)
+	}
+}
+
+// failingWriter fails once more than limit bytes are written to it
+type failingWriter struct {
+	limit int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		n := f.limit
+		f.limit = 0
+		return n, errors.New("connection reset")
+	}
+	f.limit -= len(p)
+	return len(p), nil
+}
+
+func Test_ProgressWriter(t *testing.T) {
+	var reported []int64
+	var buf bytes.Buffer
+	pw := &progressWriter{w: &buf, progress: func(n int64) { reported = append(reported, n) }}
+	pw.Write([]byte("abc"))
+	pw.Write([]byte("de"))
+	if !reflect.DeepEqual(reported, []int64{3, 5}) || pw.n != 5 || buf.String() != "abcde" {
+		t.Errorf("Unexpected progress %v, %d bytes written", reported, pw.n)
+	}
+	pw = &progressWriter{w: &failingWriter{limit: 100}}
+	if _, err := pw.Write(make([]byte, 150)); err == nil || pw.n != 100 {
+		t.Errorf("Expected 100 bytes written before failure, found %d (%v)", pw.n, err)
+	}
+}
+
+func Test_ExportToLXC(t *testing.T) {
+	image, err := NewImage("trusty", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	var progress int64
+	if err := image.ExportTo(&buf, ExportOptions{Sudo: true, Compression: CompressionZstd, Progress: func(n int64) { progress = n }}); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := compressionFromMagic(buf.Bytes()); c != CompressionZstd || progress != int64(buf.Len()) {
+		t.Errorf("Expected %d bytes of zstd compressed image, found %s and %d bytes reported", buf.Len(), c, progress)
+	}
+	err = image.ExportTo(&failingWriter{limit: 4096}, ExportOptions{Sudo: true})
+	partial, ok := err.(*PartialExportError)
+	if !ok || partial.Written != 4096 {
+		t.Errorf("Expected partial export error after 4096 bytes, found %v", err)
+	}
+}
@@ -2,67 +2,200 @@ package container
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"gopkg.in/lxc/go-lxc.v2"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// Container represents a container with some metadata
+// scriptPrefix prefixes the temporary scripts, and the pid files next to them,
+// written into the container's /tmp by RunCommand
+const scriptPrefix = "nut-run-"
+
+// Container represents a container with some metadata. It must not be used
+// from several goroutines at once
 type Container struct {
-	ct       *lxc.Container
+	ct       lxcContainer
 	Manifest Manifest
+	// StopTimeout is how long the container is given to shut down gracefully
+	// before it is stopped forcefully, DefaultStopTimeout if zero
+	StopTimeout time.Duration
+	// backend opens the parent and the clone of the container in Create
+	backend backend
+	// stdout and stderr receive the output of commands, default to the process's
+	// stdout and stderr
+	stdout io.Writer
+	stderr io.Writer
+	// env replaces MinimalEnv as the base environment of commands if set
+	env []string
+	// noNetwork runs commands in a network namespace without connectivity
+	noNetwork bool
+	// unprivileged is set for containers of unprivileged builds, whose files are
+	// handed to the container's root inside a user namespace
+	unprivileged bool
+	// network configures how Start waits for the network of the container
+	network networkWait
+	// ipAddress is the IPv4 address the container obtained when started
+	ipAddress string
+	// rootfsDir caches the host path of the rootfs, see rootfs
+	rootfsDir string
+	// log receives the container's log messages, see SetLogger
+	log Logger
 }
 
 // NewContainer returns a container struct
 func NewContainer(name string) (*Container, error) {
-	ct, err := lxc.NewContainer(name)
+	return newContainer(lxcBackend{}, name)
+}
+
+// newContainer returns a container struct for the container name of be
+func newContainer(be backend, name string) (*Container, error) {
+	ct, err := be.container(name)
 	if err != nil {
 		return nil, err
 	}
 	return &Container{
-		ct: ct,
+		ct:      ct,
+		backend: be,
 	}, nil
 }
 
 // Create creates new container by clonin parent
 func (c *Container) Create(parent string) error {
-	orig, err := lxc.NewContainer(parent)
+	return c.CreateWithBackingStore(parent, "")
+}
+
+// CreateWithBackingStore creates new container by cloning parent onto store. If
+// store is not supported for parent, the rootfs directory is copied instead. An
+// empty store copies the rootfs directory
+func (c *Container) CreateWithBackingStore(parent string, store BackingStore) error {
+	return c.CreateWithCloneMode(parent, store, CloneCopy)
+}
+
+// CreateWithCloneMode creates new container by cloning parent onto store, as a
+// snapshot or a copy of parent as mode selects
+func (c *Container) CreateWithCloneMode(parent string, store BackingStore, mode CloneMode) error {
+	be := c.containerBackend()
+	orig, err := be.container(parent)
 	if err != nil {
-		return err
+		return &ContainerError{Op: "create", Name: c.ct.Name(), Err: err}
 	}
-	if err := orig.Clone(c.ct.Name(), lxc.CloneOptions{}); err != nil {
-		return err
+	if err := cloneWithMode(c.logger(), be, orig, c.ct.Name(), store, mode); err != nil {
+		return &ContainerError{Op: "create", Name: c.ct.Name(), Err: err}
 	}
-	ct, err := lxc.NewContainer(c.ct.Name())
+	ct, err := be.container(c.ct.Name())
 	if err != nil {
 		return err
 	}
 	c.ct = ct
+	c.rootfsDir = ""
 	return nil
 }
 
 // Stop stops the container
 func (c *Container) Stop() error {
-	return c.ct.Stop()
+	c.rootfsDir = ""
+	if err := c.ct.Stop(); err != nil {
+		return &ContainerError{Op: "stop", Name: c.ct.Name(), Err: err}
+	}
+	return nil
+}
+
+// DefaultStopTimeout is how long StopWithTimeout waits for a graceful shutdown
+// if neither its timeout nor the StopTimeout of the container are set
+const DefaultStopTimeout = 30 * time.Second
+
+// StopWithTimeout asks the container to shut down and waits up to d for it to
+// stop, before stopping it forcefully. It reports whether the container shut
+// down gracefully. A zero d waits for the StopTimeout of the container
+func (c *Container) StopWithTimeout(d time.Duration) (bool, error) {
+	if !c.ct.Running() {
+		return true, nil
+	}
+	c.rootfsDir = ""
+	if d <= 0 {
+		d = c.StopTimeout
+	}
+	if d <= 0 {
+		d = DefaultStopTimeout
+	}
+	err := c.ct.Shutdown(d)
+	if err == nil && c.ct.State() == lxc.STOPPED {
+		return true, nil
+	}
+	c.logger().Warnf("Container %s did not shut down within %s, stopping it forcefully", c.ct.Name(), d)
+	if err := c.ct.Stop(); err != nil {
+		return false, &ContainerError{Op: "stop", Name: c.ct.Name(), Err: err}
+	}
+	if !c.ct.Wait(lxc.STOPPED, d) {
+		return false, &ContainerError{Op: "stop", Name: c.ct.Name(), Err: fmt.Errorf("Container did not stop within %s", d)}
+	}
+	return false, nil
 }
 
-// Destroy destroys the container
+// Destroy destroys the container, stopping it first if it is running
 func (c *Container) Destroy() error {
-	return c.ct.Destroy()
+	if c.ct.Running() {
+		if _, err := c.StopWithTimeout(0); err != nil {
+			return err
+		}
+	}
+	if err := c.ct.Destroy(); err != nil {
+		return &ContainerError{Op: "destroy", Name: c.ct.Name(), Err: err}
+	}
+	return nil
+}
+
+// DestroyAll stops the container if it is running, deletes its snapshots and
+// destroys it, reporting all failures in a single error. Containers that do not
+// exist are ignored, so cleanup code can call it unconditionally
+func (c *Container) DestroyAll() error {
+	if !c.ct.Defined() {
+		return nil
+	}
+	var errs []string
+	if c.ct.Running() {
+		if _, err := c.StopWithTimeout(0); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	snapshots, err := c.ct.Snapshots()
+	if err != nil && err != lxc.ErrNoSnapshot {
+		errs = append(errs, fmt.Sprintf("Failed to list snapshots. Error: %s", err))
+	}
+	for _, s := range snapshots {
+		if err := c.ct.DestroySnapshot(s); err != nil {
+			errs = append(errs, fmt.Sprintf("Failed to destroy snapshot %s. Error: %s", s.Name, err))
+		}
+	}
+	if err := c.ct.Destroy(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return &ContainerError{Op: "destroy", Name: c.ct.Name(), Err: errors.New(strings.Join(errs, "; "))}
+	}
+	return nil
 }
 
-// Start starts the container and wait for IP allocation
+// Start starts the container and waits for it to obtain an IPv4 address. Build
+// containers additionally wait for DNS resolution, or skip waiting altogether
 func (c *Container) Start() error {
+	c.ipAddress, c.rootfsDir = "", ""
 	if err := c.ct.Start(); err != nil {
-		return err
+		return &ContainerError{Op: "start", Name: c.ct.Name(), Err: err}
+	}
+	if c.network.skip {
+		return nil
 	}
-	if _, err := c.ct.WaitIPAddresses(30 * time.Second); err != nil {
-		log.Errorf("Failed to while waiting to start the container %s. Error: %v", c.ct.Name(), err)
+	if err := c.waitForNetwork(); err != nil {
+		c.logger().Errorf("Failed to while waiting to start the container %s. Error: %v", c.ct.Name(), err)
 		return err
 	}
 	return nil
@@ -71,93 +204,333 @@ func (c *Container) Start() error {
 // UpdateUTS changes the container's nameand rootfs path
 func (c *Container) UpdateUTS(name string) error {
 	rootfs := filepath.Join(lxc.GlobalConfigItem("lxc.lxcpath"), name, "rootfs")
-	if err := c.ct.SetConfigItem("lxc.utsname", name); err != nil {
+	if err := c.ct.SetConfigItem(configKey("lxc.utsname"), name); err != nil {
 		return err
 	}
-	if err := c.ct.SetConfigItem("lxc.rootfs", rootfs); err != nil {
+	if err := c.ct.SetConfigItem(configKey("lxc.rootfs"), rootfs); err != nil {
 		return err
 	}
+	c.rootfsDir = ""
 	return c.ct.SaveConfigFile(c.ct.ConfigFileName())
 }
 
 // RunCommand runs a command inside the container with enviroment, workdir, user as specified
 // by its manifest
 func (c *Container) RunCommand(command []string) error {
-	options := lxc.DefaultAttachOptions
-	options.Cwd = "/root"
-	options.Env = MinimalEnv
-	log.Debugf("Exec environment: %#v\n", options.Env)
-	rootfs := c.ct.ConfigItem("lxc.rootfs")[0]
+	return c.RunCommandContext(context.Background(), command)
+}
+
+// RunCommandContext is like RunCommand, but kills the command once ctx is done
+func (c *Container) RunCommandContext(ctx context.Context, command []string) error {
+	exitCode, err := c.runScript(ctx, command, c.stdout, c.stderr)
+	return c.commandResult(ctx, command, exitCode, err)
+}
+
+// RunExecContext runs argv directly inside the container, without a shell, with
+// the environment, workdir and user specified by its manifest. The command is
+// killed once ctx is done
+func (c *Container) RunExecContext(ctx context.Context, argv []string) error {
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	options, err := c.attachOptions(rootfs)
+	if err != nil {
+		return err
+	}
+	exitCode, err := c.attach(ctx, argv, options, "", c.stdout, c.stderr)
+	return c.commandResult(ctx, argv, exitCode, err)
+}
+
+// runAsRoot is like RunCommandContext, but runs command as root regardless of the
+// manifest's user
+func (c *Container) runAsRoot(ctx context.Context, command []string) error {
+	user := c.Manifest.User
+	c.Manifest.User = ""
+	defer func() { c.Manifest.User = user }()
+	return c.RunCommandContext(ctx, command)
+}
+
+// commandResult converts the outcome of an attached command into an error
+func (c *Container) commandResult(ctx context.Context, command []string, exitCode int, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		c.logger().Errorf("Failed to execute command: '%s'. Error: %v", command, err)
+		return &ContainerError{Op: "attach to", Name: c.ct.Name(), Err: err}
+	}
+	if exitCode != 0 {
+		c.logger().Errorf("Failed to execute command: '%s'. Exit code: %d", strings.Join(command, " "), exitCode)
+		return &ExitError{Command: command, ExitCode: exitCode}
+	}
+	return nil
+}
+
+// RunCommandOutput runs a command like RunCommand and returns its captured output
+// and exit code. A non zero exit code is not treated as an error
+func (c *Container) RunCommandOutput(command []string) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := c.runScript(context.Background(), command, &stdout, &stderr)
+	if err != nil {
+		return "", "", -1, err
+	}
+	c.logger().Debugf("Command '%s' exited with %d. Stdout: %q, stderr: %q", strings.Join(command, " "), exitCode, stdout.String(), stderr.String())
+	return stdout.String(), stderr.String(), exitCode, nil
+}
+
+// commandScript generates the script running command, recording its pid in
+// pidFile. The command words are joined with spaces and otherwise passed to the
+// shell verbatim
+func (c *Container) commandScript(command []string, pidFile string) []byte {
 	var buffer bytes.Buffer
 	buffer.WriteString("#!/bin/bash\n")
-	for _, v := range c.Manifest.Env {
-		if _, err := buffer.WriteString("export " + v + "\n"); err != nil {
-			return err
+	buffer.WriteString("echo $$ > " + pidFile + "\n")
+	buffer.WriteString(strings.Join(command, " "))
+	return buffer.Bytes()
+}
+
+// attachOptions returns the options to attach commands with, applying the
+// manifest's environment, workdir and user. The environment consists of the
+// base environment, MinimalEnv unless configured by the build, the login
+// environment of the user and the manifest's variables, later values overriding
+// earlier ones
+func (c *Container) attachOptions(rootfs string) (lxc.AttachOptions, error) {
+	options := lxc.DefaultAttachOptions
+	options.Cwd = "/root"
+	options.ClearEnv = true
+	var login []string
+	if c.Manifest.User != "" {
+		u, err := lookupUser(rootfs, c.Manifest.User)
+		if err != nil {
+			return options, err
 		}
+		options.UID = u.uid
+		options.GID = u.gid
+		options.Cwd = u.home
+		login = []string{"HOME=" + u.home, "USER=" + u.name, "LOGNAME=" + u.name}
 	}
-	options.ClearEnv = true
 	if c.Manifest.WorkDir != "" {
-		buffer.WriteString("cd " + c.Manifest.WorkDir + "\n")
+		options.Cwd = c.Manifest.WorkDir
 	}
-	if c.Manifest.User != "" {
-		buffer.WriteString("su - " + c.Manifest.User + "\n")
+	base := MinimalEnv
+	if c.env != nil {
+		base = c.env
 	}
-	buffer.WriteString(strings.Join(command, " "))
-	file := filepath.Join(rootfs, "/tmp/dockerfile.sh")
-	err := ioutil.WriteFile(file, buffer.Bytes(), 0755)
+	options.Env = mergeEnv(base, login, []string{"PWD=" + options.Cwd}, c.Manifest.Env)
+	c.logger().Debugf("Exec environment: %#v\n", options.Env)
+	return options, nil
+}
+
+// runScript writes command into a uniquely named script and runs it inside the
+// container with the manifest's environment, workdir and user, returning its exit
+// code. The script and its pid file are removed once the command has finished.
+// Output goes to stdout and stderr if set, otherwise to the process's own
+func (c *Container) runScript(ctx context.Context, command []string, stdout, stderr io.Writer) (int, error) {
+	rootfs, err := c.rootfs()
 	if err != nil {
-		log.Errorf("Failed to open file %s. Error: %v", file, err)
-		return err
+		return -1, err
 	}
-
-	exitCode, err := c.ct.RunCommandStatus([]string{"/bin/bash", "/tmp/dockerfile.sh"}, options)
+	options, err := c.attachOptions(rootfs)
 	if err != nil {
-		log.Errorf("Failed to execute command: '%s'. Error: %v", command, err)
-		return err
+		return -1, err
 	}
-	if exitCode != 0 {
-		log.Warnf("Failed to execute command: '%s'. Exit code: %d", strings.Join(command, " "), exitCode)
-		return fmt.Errorf("Failed to execute command: '%s'. Exit code: %d", strings.Join(command, " "), exitCode)
+	if _, err := os.Lstat(filepath.Join(rootfs, "bin", "bash")); os.IsNotExist(err) {
+		return -1, errors.New("No /bin/bash in the container to run the shell form of the command. Use the exec form [\"executable\", \"param\"] for images without a shell")
 	}
-	return nil
+	f, err := ioutil.TempFile(filepath.Join(rootfs, "tmp"), scriptPrefix+"*.sh")
+	if err != nil {
+		c.logger().Errorf("Failed to create script in container %s. Error: %v", c.ct.Name(), err)
+		return -1, err
+	}
+	script := filepath.Join("/tmp", filepath.Base(f.Name()))
+	pidFile := strings.TrimSuffix(script, ".sh") + ".pid"
+	defer func() {
+		for _, file := range []string{script, pidFile} {
+			if err := os.Remove(filepath.Join(rootfs, file)); err != nil && !os.IsNotExist(err) {
+				c.logger().Warnf("Failed to remove %s from container %s. Error: %v", file, c.ct.Name(), err)
+			}
+		}
+	}()
+	_, err = f.Write(c.commandScript(command, pidFile))
+	if err == nil {
+		err = f.Chmod(0755)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.logger().Errorf("Failed to write file %s. Error: %v", f.Name(), err)
+		return -1, err
+	}
+	return c.attach(ctx, []string{"/bin/bash", script}, options, pidFile, stdout, stderr)
 }
 
-// BindMount sets up bind mount for the container, where the input string
-// specifies the host directory, container directory and mount options
-// separated by ":"
-func (c *Container) BindMount(volume string) error {
-	parts := strings.Split(volume, ":")
-	options := []string{"none", "bind,create=dir", "0", "0"}
-	var hostDir string
-	var containerDir string
-	switch len(parts) {
-	case 1:
-		containerDir = volume
-		dir, err := os.Getwd()
+// attach runs argv inside the container, returning its exit code. pidFile is
+// where the command records its pid, empty if it does not. Output goes to stdout
+// and stderr if set, otherwise to the process's own
+func (c *Container) attach(ctx context.Context, argv []string, options lxc.AttachOptions, pidFile string, stdout, stderr io.Writer) (int, error) {
+	if c.noNetwork {
+		rootfs, err := c.rootfs()
 		if err != nil {
-			return err
+			return -1, err
+		}
+		if argv, err = isolateNetwork(rootfs, argv, &options); err != nil {
+			return -1, err
+		}
+	}
+	if stdout != nil || stderr != nil {
+		if stdout == nil {
+			stdout = os.Stdout
 		}
-		hostDir = dir
-	case 2:
-		containerDir = parts[1]
-		p, err := filepath.Abs(parts[0])
+		if stderr == nil {
+			stderr = os.Stderr
+		}
+		done, err := attachOutput(&options, stdout, stderr)
 		if err != nil {
-			return err
+			return -1, err
+		}
+		defer done()
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.killCommand(pidFile, finished)
+		case <-finished:
+		}
+	}()
+	return c.ct.RunCommandStatus(argv, options)
+}
+
+// killGracePeriod is how long a command may take to exit after being signalled
+const killGracePeriod = 10 * time.Second
+
+// killCommand sends the container's stop signal, SIGKILL by default, to the
+// command whose pid is recorded in pidFile. If the command does not finish
+// within killGracePeriod, or was started without a shell recording its pid, the
+// container is restarted. Processes spawned by the command are left to be
+// terminated by stopping the container
+func (c *Container) killCommand(pidFile string, finished <-chan struct{}) {
+	sig := 9
+	if c.Manifest.StopSignal != "" {
+		if _, s, err := ParseSignal(c.Manifest.StopSignal); err == nil {
+			sig = int(s)
+		}
+	}
+	// commands run without a shell do not record their pid
+	rootfs, err := c.rootfs()
+	if err == nil && pidFile != "" && fileExists(filepath.Join(rootfs, pidFile)) {
+		c.logger().Warnf("Sending signal %d to command running in container %s", sig, c.ct.Name())
+		kill := []string{"/bin/bash", "-c", fmt.Sprintf("kill -%d $(cat %s)", sig, pidFile)}
+		if _, err := c.ct.RunCommandStatus(kill, lxc.DefaultAttachOptions); err != nil {
+			c.logger().Errorf("Failed to signal command. Error: %s", err)
+		}
+		select {
+		case <-finished:
+			return
+		case <-time.After(killGracePeriod):
 		}
-		hostDir = p
-	case 3:
-		containerDir = parts[1]
-		p, err := filepath.Abs(parts[0])
+	}
+	c.logger().Warnf("Command did not exit, restarting container %s", c.ct.Name())
+	if err := c.Stop(); err != nil {
+		c.logger().Errorf("%s", err)
+		return
+	}
+	if err := c.Start(); err != nil {
+		c.logger().Errorf("%s", err)
+	}
+}
+
+// attachOutput redirects stdout and stderr of an attached command to the given
+// writers, feeding writers other than files through pipes. The returned function
+// must be called once the command has finished, it waits until all output has
+// been copied
+func attachOutput(options *lxc.AttachOptions, stdout, stderr io.Writer) (func(), error) {
+	var wait []func()
+	attach := func(w io.Writer, fd *uintptr) error {
+		if f, ok := w.(*os.File); ok {
+			*fd = f.Fd()
+			return nil
+		}
+		r, pw, err := os.Pipe()
 		if err != nil {
 			return err
 		}
-		hostDir = p
-		options[1] = "bind," + parts[2]
-	default:
-		return fmt.Errorf("Invalid volume spec. Parts: %d", len(parts))
+		*fd = pw.Fd()
+		copied := make(chan struct{})
+		go func() {
+			io.Copy(w, r)
+			r.Close()
+			close(copied)
+		}()
+		wait = append(wait, func() {
+			pw.Close()
+			<-copied
+			if f, ok := w.(interface {
+				Flush()
+			}); ok {
+				f.Flush()
+			}
+		})
+		return nil
+	}
+	done := func() {
+		for _, w := range wait {
+			w()
+		}
+	}
+	if err := attach(stdout, &options.StdoutFd); err != nil {
+		return nil, err
+	}
+	if err := attach(stderr, &options.StderrFd); err != nil {
+		done()
+		return nil, err
+	}
+	return done, nil
+}
+
+// SetStopSignal records the signal used to stop the container in its manifest and
+// lxc configuration, so Stop sends it instead of SIGKILL
+func (c *Container) SetStopSignal(name string) error {
+	name, sig, err := ParseSignal(name)
+	if err != nil {
+		return err
+	}
+	// lxc 2.1 renamed lxc.stopsignal to lxc.signal.stop
+	key := "lxc.signal.stop"
+	if !lxc.VersionAtLeast(2, 1, 0) {
+		key = "lxc.stopsignal"
+	}
+	if err := c.ct.SetConfigItem(key, strconv.Itoa(int(sig))); err != nil {
+		return fmt.Errorf("Failed to set %s. Error: %s", key, err)
+	}
+	if err := c.ct.SaveConfigFile(c.ct.ConfigFileName()); err != nil {
+		return err
+	}
+	c.Manifest.StopSignal = name
+	return nil
+}
+
+// BindMount sets up bind mount for the container, where the input string
+// specifies the host directory, container directory and mount options
+// separated by ":"
+func (c *Container) BindMount(spec string) error {
+	v, err := parseVolume(spec)
+	if err != nil {
+		return err
+	}
+	containerDir := strings.TrimPrefix(v.containerDir, "/")
+	// create the mountpoint, as custom mount options may lack create=dir
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, containerDir), 0755); err != nil {
+		return fmt.Errorf("Failed to create mountpoint %s. Error: %s", v.containerDir, err)
 	}
-	containerDir = strings.TrimPrefix(containerDir, "/")
-	val := hostDir + " " + containerDir + " " + strings.Join(options, " ")
+	val := v.hostDir + " " + containerDir + " none " + v.options + " 0 0"
 	path := c.ct.ConfigFileName()
 	if err := c.ct.SetConfigItem("lxc.mount.entry", val); err != nil {
 		return err
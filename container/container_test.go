@@ -1,10 +1,14 @@
 package container
 
 import (
+	"errors"
 	"fmt"
 	"gopkg.in/lxc/go-lxc.v2"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func setup() error {
@@ -74,3 +78,146 @@ func Test_Container(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_RunCommandOutput(t *testing.T) {
+	ct, err := NewContainer("nut-test-command-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Destroy()
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Stop()
+	ct.Manifest.Env = []string{"GREETING=hello world"}
+	stdout, stderr, exitCode, err := ct.RunCommandOutput([]string{"echo", "$GREETING;", "echo", "oops", ">&2;", "exit", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "hello world\n" || stderr != "oops\n" || exitCode != 3 {
+		t.Fatalf("Unexpected result. Stdout: %q, stderr: %q, exit code: %d", stdout, stderr, exitCode)
+	}
+}
+
+func Test_RunCommandExitError(t *testing.T) {
+	ct, err := NewContainer("nut-test-exit-error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Destroy()
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Stop()
+	for command, expected := range map[string]int{"false": 1, "no-such-command": 127} {
+		err := ct.RunCommand([]string{command})
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("Expected ExitError for '%s', found %v", command, err)
+		}
+		if exitErr.ExitCode != expected || !reflect.DeepEqual(exitErr.Command, []string{command}) {
+			t.Errorf("Expected exit code %d for '%s', found %+v", expected, command, exitErr)
+		}
+	}
+}
+
+func Test_StopWithTimeoutLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	graceful, err := ct.StopWithTimeout(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !graceful || ct.ct.State() != lxc.STOPPED {
+		t.Errorf("Expected graceful shutdown, found graceful %t and state %s", graceful, ct.ct.State())
+	}
+	if graceful, err := ct.StopWithTimeout(0); err != nil || !graceful {
+		t.Errorf("Expected stopped container to be reported as stopped, found %t (%v)", graceful, err)
+	}
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Destroy stops running containers
+	if err := ct.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_StopTimeout(t *testing.T) {
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	c, err := newContainer(be, "nut-test-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		c.StopTimeout = timeout
+		if err := c.ct.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.StopWithTimeout(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := NewBuilder("nut-test-stop-timeout")
+	b.backend = be
+	if err := b.ParseReader(strings.NewReader("FROM nut-test-base\nRUN true\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BuildWithOptions(BuildOptions{NoCache: true, SkipNetworkWait: true, StopTimeout: time.Hour, Cleanup: CleanupAlways}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{DefaultStopTimeout, time.Minute, time.Hour}
+	if !reflect.DeepEqual(be.shutdowns, expected) {
+		t.Errorf("Expected shutdown timeouts %v, found %v", expected, be.shutdowns)
+	}
+}
+
+func Test_DestroyAllLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-destroy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ct.ct.CreateSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.DestroyAll(); err != nil {
+		t.Fatal(err)
+	}
+	if ct.ct.Defined() {
+		t.Error("Expected container to be destroyed")
+	}
+	if err := ct.DestroyAll(); err != nil {
+		t.Errorf("Expected destroying a destroyed container to succeed, found %s", err)
+	}
+}
+
+func Test_DestroyAllMissing(t *testing.T) {
+	ct, err := NewContainer("nut-test-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.DestroyAll(); err != nil {
+		t.Errorf("Expected missing container to be ignored, found %s", err)
+	}
+}
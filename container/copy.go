@@ -0,0 +1,189 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// legacyCopyEnv switches copying files between the host and containers back to
+// /bin/cp. It will be removed in the next release
+const legacyCopyEnv = "NUT_LEGACY_CP"
+
+// copier copies file trees, preserving permissions, ownership, modification
+// times, symlinks, hard links and extended attributes
+type copier struct {
+	// log receives warnings, like those about skipped device nodes
+	log Logger
+	// ignore excludes paths, along with everything below excluded directories
+	ignore *IgnoreMatcher
+	// links maps files with several links, by device and inode, to their copy
+	links map[[2]uint64]string
+}
+
+// copyTree recursively copies the src directory to dst, preserving permissions,
+// ownership, modification times and symlinks. Paths excluded by the ignore
+// matcher are skipped, along with everything below excluded directories
+func copyTree(l Logger, src, dst string, ignore *IgnoreMatcher) error {
+	c := &copier{log: l, ignore: ignore, links: make(map[[2]uint64]string)}
+	return c.copy(src, dst)
+}
+
+// hostCopy copies the file or directory src to dst, falling back to /bin/cp if
+// the NUT_LEGACY_CP environment variable is set
+func hostCopy(l Logger, src, dst string) error {
+	if os.Getenv(legacyCopyEnv) == "" {
+		return copyTree(l, src, dst, nil)
+	}
+	if out, err := exec.Command("/bin/cp", "-ar", src, dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to copy %s to %s. Error: %s. Output: %s", src, dst, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// copy copies src, a file or a directory, to dst
+func (c *copier) copy(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if c.ignore.Ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := c.copyEntry(path, target, info); err != nil {
+			return fmt.Errorf("Failed to copy %s to %s. Error: %s", path, target, err)
+		}
+		return nil
+	})
+}
+
+// copyEntry copies a single directory, symlink, regular file or device node
+func (c *copier) copyEntry(src, dst string, info os.FileInfo) error {
+	stat, _ := info.Sys().(*syscall.Stat_t)
+	if stat != nil && stat.Nlink > 1 && !info.IsDir() {
+		key := [2]uint64{uint64(stat.Dev), stat.Ino}
+		if first, ok := c.links[key]; ok {
+			os.Remove(dst)
+			return os.Link(first, dst)
+		}
+		c.links[key] = dst
+	}
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(link, dst); err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	case info.Mode()&os.ModeDevice != 0 && stat != nil:
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		created, err := mknod(c.log, dst, stat.Mode, int(stat.Rdev))
+		if err != nil || !created {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unsupported file type %s", info.Mode().Type())
+	}
+	if stat != nil {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		if err := copyXattrs(src, dst); err != nil {
+			return err
+		}
+		if err := os.Chmod(dst, info.Mode()); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// copyXattrs copies the extended attributes of src to dst. Attributes the file
+// systems or privileges do not support are skipped
+func copyXattrs(src, dst string) error {
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(src, buf)
+	if err != nil {
+		return nil
+	}
+	for _, name := range splitNull(buf[:size]) {
+		n, err := syscall.Getxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(src, name, value); err != nil {
+			continue
+		}
+		if err := syscall.Setxattr(dst, name, value[:n], 0); err != nil && err != syscall.ENOTSUP && err != syscall.EPERM {
+			return fmt.Errorf("Failed to set extended attribute %s. Error: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// splitNull splits a list of null terminated strings
+func splitNull(buf []byte) []string {
+	var names []string
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,88 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func Test_CopyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "bin", "tool"), []byte("tool"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "bin", "tool"), filepath.Join(src, "bin", "alias")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/tool", filepath.Join(src, "tool")); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := copyTree(nil, src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	tool, err := os.Stat(filepath.Join(dst, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tool.Mode().Perm() != 0750 {
+		t.Errorf("Expected permissions to be preserved, found %v", tool.Mode())
+	}
+	alias, err := os.Stat(filepath.Join(dst, "bin", "alias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(tool, alias) {
+		t.Error("Expected hard links to be preserved")
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "tool")); err != nil || link != "bin/tool" {
+		t.Errorf("Expected symlink to bin/tool, found %q (%v)", link, err)
+	}
+	// single files are copied to the destination path
+	if err := hostCopy(nil, filepath.Join(src, "bin", "tool"), filepath.Join(dir, "tool")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "tool")); err != nil || string(content) != "tool" {
+		t.Errorf("Expected copied file, found %q (%v)", content, err)
+	}
+	fifo := filepath.Join(src, "bin", "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTree(nil, src, filepath.Join(dir, "failed"), nil); err == nil || !strings.Contains(err.Error(), fifo) {
+		t.Errorf("Expected error naming %s, found %v", fifo, err)
+	}
+}
+
+func Test_HostCopyLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv(legacyCopyEnv, os.Getenv(legacyCopyEnv))
+	os.Setenv(legacyCopyEnv, "1")
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := hostCopy(nil, filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "b")); err != nil || string(content) != "a" {
+		t.Errorf("Expected copied file, found %q (%v)", content, err)
+	}
+	if err := hostCopy(nil, filepath.Join(dir, "missing"), filepath.Join(dir, "c")); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected error naming the missing file, found %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ManifestDiff describes the differences between two manifests. Unchanged
+// fields are nil
+type ManifestDiff struct {
+	Env          *MapDiff `json:"env,omitempty"`
+	Labels       *MapDiff `json:"labels,omitempty"`
+	ExposedPorts *SetDiff `json:"exposedports,omitempty"`
+	Volumes      *SetDiff `json:"volumes,omitempty"`
+	EntryPoint   *Change  `json:"entrypoint,omitempty"`
+	Cmd          *Change  `json:"cmd,omitempty"`
+	User         *Change  `json:"user,omitempty"`
+	WorkDir      *Change  `json:"workdir,omitempty"`
+}
+
+// MapDiff describes the differences between two sets of key value pairs
+type MapDiff struct {
+	Added   map[string]string `json:"added,omitempty"`
+	Removed map[string]string `json:"removed,omitempty"`
+	Changed map[string]Change `json:"changed,omitempty"`
+}
+
+// SetDiff describes the differences between two sets of values
+type SetDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Change describes a changed value
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DiffManifests reports the differences from manifest a to manifest b.
+// Environment variables and labels are compared by key, with later declarations
+// of a variable overriding earlier ones like in Merge. Exposed ports and volumes
+// are compared as sets
+func DiffManifests(a, b Manifest) ManifestDiff {
+	var d ManifestDiff
+	d.Env = diffMaps(envMap(a.Env), envMap(b.Env))
+	d.Labels = diffMaps(a.Labels, b.Labels)
+	d.ExposedPorts = diffSets(portStrings(a.ExposedPorts), portStrings(b.ExposedPorts))
+	d.Volumes = diffSets(a.Volumes, b.Volumes)
+	d.EntryPoint = diffValues(commandString(a.EntryPoint), commandString(b.EntryPoint))
+	d.Cmd = diffValues(commandString(a.Cmd), commandString(b.Cmd))
+	d.User = diffValues(a.User, b.User)
+	d.WorkDir = diffValues(a.WorkDir, b.WorkDir)
+	return d
+}
+
+// Empty reports whether the manifests are equal
+func (d ManifestDiff) Empty() bool {
+	return d == ManifestDiff{}
+}
+
+// JSON returns the json form of the differences
+func (d ManifestDiff) JSON() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// String renders the differences line by line, prefixing added values with +,
+// removed ones with - and changed ones with ~
+func (d ManifestDiff) String() string {
+	if d.Empty() {
+		return "No differences"
+	}
+	var lines []string
+	for _, m := range []struct {
+		name string
+		diff *MapDiff
+	}{{"env", d.Env}, {"labels", d.Labels}} {
+		if m.diff == nil {
+			continue
+		}
+		lines = append(lines, m.name+":")
+		for _, k := range sortedKeys(m.diff.Added) {
+			lines = append(lines, fmt.Sprintf("  + %s=%s", k, m.diff.Added[k]))
+		}
+		for _, k := range sortedKeys(m.diff.Removed) {
+			lines = append(lines, fmt.Sprintf("  - %s=%s", k, m.diff.Removed[k]))
+		}
+		var changed []string
+		for k := range m.diff.Changed {
+			changed = append(changed, k)
+		}
+		sort.Strings(changed)
+		for _, k := range changed {
+			lines = append(lines, fmt.Sprintf("  ~ %s: %s -> %s", k, m.diff.Changed[k].From, m.diff.Changed[k].To))
+		}
+	}
+	for _, s := range []struct {
+		name string
+		diff *SetDiff
+	}{{"exposed ports", d.ExposedPorts}, {"volumes", d.Volumes}} {
+		if s.diff == nil {
+			continue
+		}
+		lines = append(lines, s.name+":")
+		for _, v := range s.diff.Added {
+			lines = append(lines, "  + "+v)
+		}
+		for _, v := range s.diff.Removed {
+			lines = append(lines, "  - "+v)
+		}
+	}
+	for _, c := range []struct {
+		name   string
+		change *Change
+	}{{"entrypoint", d.EntryPoint}, {"cmd", d.Cmd}, {"user", d.User}, {"workdir", d.WorkDir}} {
+		if c.change != nil {
+			lines = append(lines, fmt.Sprintf("%s: %s -> %s", c.name, quoteEmpty(c.change.From), quoteEmpty(c.change.To)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// envMap returns the environment variables of env by name
+func envMap(env []string) map[string]string {
+	vars := make(map[string]string)
+	for _, v := range mergeEnv(env) {
+		pair := strings.SplitN(v, "=", 2)
+		if len(pair) == 2 {
+			vars[pair[0]] = pair[1]
+		} else {
+			vars[pair[0]] = ""
+		}
+	}
+	return vars
+}
+
+func portStrings(ports []ExposedPort) []string {
+	var s []string
+	for _, p := range ports {
+		s = append(s, p.String())
+	}
+	return s
+}
+
+// commandString renders a command in exec form
+func commandString(command []string) string {
+	if len(command) == 0 {
+		return ""
+	}
+	d, _ := json.Marshal(command)
+	return string(d)
+}
+
+func diffMaps(a, b map[string]string) *MapDiff {
+	d := &MapDiff{}
+	for k, v := range b {
+		old, ok := a[k]
+		if !ok {
+			if d.Added == nil {
+				d.Added = make(map[string]string)
+			}
+			d.Added[k] = v
+		} else if old != v {
+			if d.Changed == nil {
+				d.Changed = make(map[string]Change)
+			}
+			d.Changed[k] = Change{From: old, To: v}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			if d.Removed == nil {
+				d.Removed = make(map[string]string)
+			}
+			d.Removed[k] = v
+		}
+	}
+	if d.Added == nil && d.Removed == nil && d.Changed == nil {
+		return nil
+	}
+	return d
+}
+
+func diffSets(a, b []string) *SetDiff {
+	d := &SetDiff{}
+	for _, v := range b {
+		if !contains(a, v) && !contains(d.Added, v) {
+			d.Added = append(d.Added, v)
+		}
+	}
+	for _, v := range a {
+		if !contains(b, v) && !contains(d.Removed, v) {
+			d.Removed = append(d.Removed, v)
+		}
+	}
+	if d.Added == nil && d.Removed == nil {
+		return nil
+	}
+	return d
+}
+
+func diffValues(a, b string) *Change {
+	if a == b {
+		return nil
+	}
+	return &Change{From: a, To: b}
+}
+
+func contains(list []string, v string) bool {
+	for _, existing := range list {
+		if existing == v {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func quoteEmpty(s string) string {
+	if s == "" {
+		return `""`
+	}
+	return s
+}
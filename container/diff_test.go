@@ -0,0 +1,77 @@
+package container
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_DiffManifests(t *testing.T) {
+	a := Manifest{
+		Env:          []string{"PATH=/bin", "DEBUG=1", "LANG=C", "LANG=C.UTF-8"},
+		Labels:       map[string]string{"version": "1.0", "team": "core"},
+		ExposedPorts: []ExposedPort{{Port: 80, Protocol: "tcp"}},
+		Volumes:      []string{"/var/log"},
+		EntryPoint:   []string{"/srv/app"},
+		User:         "app",
+		WorkDir:      "/srv",
+	}
+	b := Manifest{
+		Env:          []string{"LANG=C.UTF-8", "PATH=/usr/bin", "HOME=/srv"},
+		Labels:       map[string]string{"version": "1.1", "source": "https://git.example.com/a=b"},
+		ExposedPorts: []ExposedPort{{Port: 80, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}},
+		Volumes:      []string{"/var/log"},
+		EntryPoint:   []string{"/srv/app"},
+		Cmd:          []string{"--port", "80"},
+		User:         "root",
+		WorkDir:      "/srv",
+	}
+	d := DiffManifests(a, b)
+	expected := ManifestDiff{
+		Env: &MapDiff{
+			Added:   map[string]string{"HOME": "/srv"},
+			Removed: map[string]string{"DEBUG": "1"},
+			Changed: map[string]Change{"PATH": {From: "/bin", To: "/usr/bin"}},
+		},
+		Labels: &MapDiff{
+			Added:   map[string]string{"source": "https://git.example.com/a=b"},
+			Removed: map[string]string{"team": "core"},
+			Changed: map[string]Change{"version": {From: "1.0", To: "1.1"}},
+		},
+		ExposedPorts: &SetDiff{Added: []string{"53/udp"}},
+		Cmd:          &Change{From: "", To: `["--port","80"]`},
+		User:         &Change{From: "app", To: "root"},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Fatalf("Expected %+v, found %+v", expected, d)
+	}
+	rendered := `env:
+  + HOME=/srv
+  - DEBUG=1
+  ~ PATH: /bin -> /usr/bin
+labels:
+  + source=https://git.example.com/a=b
+  - team=core
+  ~ version: 1.0 -> 1.1
+exposed ports:
+  + 53/udp
+cmd: "" -> ["--port","80"]
+user: app -> root`
+	if d.String() != rendered {
+		t.Errorf("Expected:\n%s\nfound:\n%s", rendered, d.String())
+	}
+	data, err := d.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ManifestDiff
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Expected %+v after json round trip, found %+v", expected, decoded)
+	}
+	if d := DiffManifests(a, a); !d.Empty() || d.String() != "No differences" {
+		t.Errorf("Expected no differences, found %s", d)
+	}
+}
@@ -0,0 +1,144 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hostResolvConf is the resolv.conf copied into build containers by
+// DNSOptions.CopyHost
+var hostResolvConf = "/etc/resolv.conf"
+
+// resolvConfBackup holds the original resolv.conf of build containers while
+// their DNS is configured by the build. If there was none, resolvConfBackup with
+// .absent appended is created instead
+const resolvConfBackup = "/etc/.resolv.conf.nut"
+
+// maxNameservers is the number of nameservers the resolver of glibc uses
+const maxNameservers = 3
+
+// DNSOptions configures the DNS resolution of build containers, which is
+// written to their /etc/resolv.conf after FROM. The zero value keeps the
+// resolv.conf inherited from the parent container
+type DNSOptions struct {
+	Nameservers   []string
+	SearchDomains []string
+	// Options are resolver options, e.g. ndots:2
+	Options []string
+	// CopyHost copies the resolv.conf of the host verbatim, instead of
+	// generating it from the fields above
+	CopyHost bool
+	// RestoreResolvConf restores the original resolv.conf of the built
+	// container once the build finished, so the image does not carry the DNS
+	// configuration of the build environment
+	RestoreResolvConf bool
+}
+
+// enabled reports whether the options replace the resolv.conf of containers
+func (o DNSOptions) enabled() bool {
+	return o.CopyHost || len(o.Nameservers) > 0 || len(o.SearchDomains) > 0 || len(o.Options) > 0
+}
+
+// validate checks the nameservers and that CopyHost is not combined with other
+// settings, warning l about nameservers most resolvers ignore
+func (o DNSOptions) validate(l Logger) error {
+	if o.CopyHost && (len(o.Nameservers) > 0 || len(o.SearchDomains) > 0 || len(o.Options) > 0) {
+		return fmt.Errorf("Copying the host's resolv.conf can not be combined with nameservers, search domains or options")
+	}
+	for _, ns := range o.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("Invalid nameserver '%s'. Expected an IP address", ns)
+		}
+	}
+	if len(o.Nameservers) > maxNameservers {
+		loggerOrDefault(l).Warnf("Only the first %d of %d nameservers are used by most resolvers", maxNameservers, len(o.Nameservers))
+	}
+	return nil
+}
+
+// resolvConf returns the content of the resolv.conf of build containers
+func (o DNSOptions) resolvConf() ([]byte, error) {
+	if o.CopyHost {
+		return ioutil.ReadFile(hostResolvConf)
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("# Generated by nut\n")
+	for _, ns := range o.Nameservers {
+		buffer.WriteString("nameserver " + ns + "\n")
+	}
+	if len(o.SearchDomains) > 0 {
+		buffer.WriteString("search " + strings.Join(o.SearchDomains, " ") + "\n")
+	}
+	if len(o.Options) > 0 {
+		buffer.WriteString("options " + strings.Join(o.Options, " ") + "\n")
+	}
+	return buffer.Bytes(), nil
+}
+
+// configureDNS replaces the resolv.conf of the container as configured by o,
+// keeping the original in resolvConfBackup. The file is staged in the container's
+// /tmp and moved into place by the container's root, so it gets the ownership of
+// the container
+func (c *Container) configureDNS(o DNSOptions) error {
+	if !o.enabled() {
+		return nil
+	}
+	content, err := o.resolvConf()
+	if err != nil {
+		return fmt.Errorf("Failed to read resolv.conf of the host. Error: %s", err)
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	staged, err := ioutil.TempFile(filepath.Join(rootfs, "tmp"), stagePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	_, err = staged.Write(content)
+	if closeErr := staged.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(staged.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`b=%[1]s
+if [ ! -e $b ] && [ ! -L $b ] && [ ! -e $b.absent ]; then
+  if [ -e /etc/resolv.conf ] || [ -L /etc/resolv.conf ]; then mv /etc/resolv.conf $b; else touch $b.absent; fi
+fi
+rm -f /etc/resolv.conf && cp %[2]s /etc/resolv.conf && chmod 644 /etc/resolv.conf`, resolvConfBackup, shellQuote(filepath.Join("/tmp", filepath.Base(staged.Name()))))
+	if err := c.runAsRoot(context.Background(), []string{script}); err != nil {
+		return fmt.Errorf("Failed to configure DNS of container %s. Error: %s", c.ct.Name(), err)
+	}
+	c.logger().Debugf("Configured DNS of container %s", c.ct.Name())
+	return nil
+}
+
+// finishDNS restores the original resolv.conf of the container if o asks to,
+// and removes its backup otherwise
+func (c *Container) finishDNS(o DNSOptions) error {
+	if !o.enabled() {
+		return nil
+	}
+	script := fmt.Sprintf("rm -f %[1]s %[1]s.absent", resolvConfBackup)
+	if o.RestoreResolvConf {
+		script = fmt.Sprintf(`b=%[1]s
+if [ -e $b ] || [ -L $b ]; then rm -f /etc/resolv.conf && mv $b /etc/resolv.conf
+elif [ -e $b.absent ]; then rm -f /etc/resolv.conf $b.absent
+fi`, resolvConfBackup)
+	}
+	if err := c.runAsRoot(context.Background(), []string{script}); err != nil {
+		return fmt.Errorf("Failed to restore resolv.conf of container %s. Error: %s", c.ct.Name(), err)
+	}
+	return nil
+}
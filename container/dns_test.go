@@ -0,0 +1,115 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_DNSOptionsValidate(t *testing.T) {
+	valid := []DNSOptions{
+		{},
+		{Nameservers: []string{"10.0.0.53", "2001:db8::53"}, SearchDomains: []string{"corp.example.com"}},
+		{CopyHost: true, RestoreResolvConf: true},
+	}
+	for _, o := range valid {
+		if err := o.validate(nil); err != nil {
+			t.Errorf("Expected %+v to be valid, found %s", o, err)
+		}
+	}
+	invalid := []DNSOptions{
+		{Nameservers: []string{"dns.example.com"}},
+		{CopyHost: true, Nameservers: []string{"10.0.0.53"}},
+		{CopyHost: true, Options: []string{"ndots:2"}},
+	}
+	for _, o := range invalid {
+		if err := o.validate(nil); err == nil {
+			t.Errorf("Expected error for %+v", o)
+		}
+	}
+}
+
+func Test_ResolvConf(t *testing.T) {
+	o := DNSOptions{
+		Nameservers:   []string{"10.0.0.53", "10.0.1.53"},
+		SearchDomains: []string{"corp.example.com", "example.com"},
+		Options:       []string{"ndots:2", "timeout:1"},
+	}
+	if o.enabled() == (DNSOptions{RestoreResolvConf: true}).enabled() {
+		t.Error("Expected only options with DNS settings to be enabled")
+	}
+	content, err := o.resolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# Generated by nut
+nameserver 10.0.0.53
+nameserver 10.0.1.53
+search corp.example.com example.com
+options ndots:2 timeout:1
+`
+	if string(content) != expected {
+		t.Errorf("Expected:\n%s\nfound:\n%s", expected, content)
+	}
+
+	dir, err := ioutil.TempDir("", "nut-test-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { hostResolvConf = path }(hostResolvConf)
+	hostResolvConf = filepath.Join(dir, "resolv.conf")
+	host := "nameserver 127.0.0.53\noptions edns0\n"
+	if err := ioutil.WriteFile(hostResolvConf, []byte(host), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content, err = DNSOptions{CopyHost: true}.resolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != host {
+		t.Errorf("Expected the host's resolv.conf, found %q", content)
+	}
+}
+
+func Test_ConfigureDNSLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.DestroyAll()
+	ct.network = networkWait{skip: true}
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	rootfs, err := ct.rootfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolvConf := filepath.Join(rootfs, "etc", "resolv.conf")
+	original, _ := ioutil.ReadFile(resolvConf)
+	o := DNSOptions{Nameservers: []string{"10.0.0.53"}, RestoreResolvConf: true}
+	if err := ct.configureDNS(o); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := o.resolvConf(); string(content) != string(expected) {
+		t.Errorf("Expected injected resolv.conf, found %q", content)
+	}
+	if err := ct.finishDNS(o); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(resolvConf); string(content) != string(original) {
+		t.Errorf("Expected original resolv.conf %q to be restored, found %q", original, content)
+	}
+	if fileExists(filepath.Join(rootfs, resolvConfBackup)) {
+		t.Error("Expected the backup of resolv.conf to be removed")
+	}
+}
@@ -0,0 +1,172 @@
+package container
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// dockerTag is the tag of images written to docker archives
+const dockerTag = "latest"
+
+// invalidDockerName matches the characters docker does not allow in repository
+// names
+var invalidDockerName = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// DockerManifestEntry describes an image of a docker archive in its manifest.json
+type DockerManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// ExportDockerArchive writes the container as tarball in the format of docker
+// save to file, which docker load imports as image tagged with the container
+// name
+func (i *Image) ExportDockerArchive(file string) error {
+	var m Manifest
+	if err := m.load(i.logger(), i.ct.Name()); err != nil {
+		return fmt.Errorf("Failed to load container manifest. Error: %s", err)
+	}
+	ctDir, cleanup, err := i.exportDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return writeDockerArchive(i.logger(), file, filepath.Join(ctDir, "rootfs"), m, i.ct.Name())
+}
+
+// dockerRepository returns name in the form docker accepts as repository name
+func dockerRepository(name string) string {
+	repo := strings.Trim(invalidDockerName.ReplaceAllString(strings.ToLower(name), "-"), "._-")
+	if repo == "" {
+		return "nut"
+	}
+	return repo
+}
+
+// writeDockerArchive writes the rootfs as single layer docker archive, with the
+// image configuration derived from m, to file. The archive is removed if writing
+// it fails
+func writeDockerArchive(l Logger, file, rootfs string, m Manifest, name string) (err error) {
+	layer, err := ioutil.TempFile(filepath.Dir(file), ".layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+	diffID := sha256.New()
+	if err := writeTree(l, io.MultiWriter(layer, diffID), rootfs, ""); err != nil {
+		return fmt.Errorf("Failed to write layer of %s. Error: %s", rootfs, err)
+	}
+	layerID := hex.EncodeToString(diffID.Sum(nil))
+	config := m.ToOCIConfig()
+	if config.Architecture == "" {
+		config.Architecture = runtime.GOARCH
+	}
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+	config.RootFS.DiffIDs = []string{"sha256:" + layerID}
+	configData, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	configSum := sha256.Sum256(configData)
+	configName := hex.EncodeToString(configSum[:]) + ".json"
+	repo := dockerRepository(name)
+	manifest, err := json.Marshal([]DockerManifestEntry{{
+		Config:   configName,
+		RepoTags: []string{repo + ":" + dockerTag},
+		Layers:   []string{layerID + "/layer.tar"},
+	}})
+	if err != nil {
+		return err
+	}
+	repositories, err := json.Marshal(map[string]map[string]string{repo: {dockerTag: layerID}})
+	if err != nil {
+		return err
+	}
+	layerJSON, err := json.Marshal(map[string]interface{}{
+		"id":      layerID,
+		"created": config.Created,
+		"os":      config.OS,
+		"config":  config.Config,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+	tw := tar.NewWriter(f)
+	now := time.Now()
+	if err := tw.WriteHeader(&tar.Header{Name: layerID + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: now}); err != nil {
+		return err
+	}
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{layerID + "/VERSION", []byte("1.0")},
+		{layerID + "/json", layerJSON},
+	} {
+		if err := writeTarFile(tw, entry.name, entry.data, now); err != nil {
+			return err
+		}
+	}
+	info, err := layer.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := layer.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: layerID + "/layer.tar", Mode: 0644, Size: info.Size(), ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, layer); err != nil {
+		return err
+	}
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{configName, configData},
+		{"manifest.json", manifest},
+		{"repositories", repositories},
+	} {
+		if err := writeTarFile(tw, entry.name, entry.data, now); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
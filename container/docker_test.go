@@ -0,0 +1,124 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_DockerArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "bin", "app"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := Manifest{
+		Env:          []string{"PATH=/bin"},
+		EntryPoint:   []string{"/bin/app"},
+		Cmd:          []string{"--port", "80"},
+		ExposedPorts: []ExposedPort{{Port: 80, Protocol: "tcp"}},
+		WorkDir:      "/srv",
+		Labels:       map[string]string{"version": "1.0"},
+	}
+	file := filepath.Join(dir, "app.tar")
+	if err := writeDockerArchive(nil, file, rootfs, m, "My_App"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = d
+	}
+	var manifest []DockerManifestEntry
+	if err := json.Unmarshal(entries["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || len(manifest[0].Layers) != 1 || !reflect.DeepEqual(manifest[0].RepoTags, []string{"my_app:latest"}) {
+		t.Fatalf("Unexpected manifest.json %+v", manifest)
+	}
+	configData, ok := entries[manifest[0].Config]
+	if !ok {
+		t.Fatalf("Missing config %s", manifest[0].Config)
+	}
+	configSum := sha256.Sum256(configData)
+	if hex.EncodeToString(configSum[:])+".json" != manifest[0].Config {
+		t.Errorf("Expected config named after its digest, found %s", manifest[0].Config)
+	}
+	validateOCIConfig(t, configData)
+	layer, ok := entries[manifest[0].Layers[0]]
+	if !ok {
+		t.Fatalf("Missing layer %s", manifest[0].Layers[0])
+	}
+	layerSum := sha256.Sum256(layer)
+	layerID := hex.EncodeToString(layerSum[:])
+	var config OCIImageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, []string{"sha256:" + layerID}) {
+		t.Errorf("Expected diff id of the layer, found %v", config.RootFS.DiffIDs)
+	}
+	expected := OCIContainerConfig{
+		ExposedPorts: map[string]struct{}{"80/tcp": {}},
+		Env:          m.Env,
+		Entrypoint:   m.EntryPoint,
+		Cmd:          m.Cmd,
+		WorkingDir:   m.WorkDir,
+		Labels:       m.Labels,
+	}
+	if !reflect.DeepEqual(config.Config, expected) {
+		t.Errorf("Expected config %+v, found %+v", expected, config.Config)
+	}
+	var repositories map[string]map[string]string
+	if err := json.Unmarshal(entries["repositories"], &repositories); err != nil {
+		t.Fatal(err)
+	}
+	if repositories["my_app"]["latest"] != layerID || manifest[0].Layers[0] != layerID+"/layer.tar" {
+		t.Errorf("Expected repositories to reference layer %s, found %v", layerID, repositories)
+	}
+	if string(entries[layerID+"/VERSION"]) != "1.0" {
+		t.Errorf("Expected layer VERSION 1.0, found %q", entries[layerID+"/VERSION"])
+	}
+	lr := tar.NewReader(bytes.NewReader(layer))
+	hdr, err := lr.Next()
+	if err != nil || hdr.Name != "bin/" {
+		t.Errorf("Expected bin/ as first layer entry, found %+v (%v)", hdr, err)
+	}
+	if hdr, err = lr.Next(); err != nil || hdr.Name != "bin/app" || hdr.Mode&0777 != 0755 {
+		t.Errorf("Expected executable bin/app in layer, found %+v (%v)", hdr, err)
+	}
+	if dockerRepository("--") != "nut" || dockerRepository("Web App") != "web-app" {
+		t.Errorf("Unexpected repository names %s, %s", dockerRepository("--"), dockerRepository("Web App"))
+	}
+}
@@ -0,0 +1,194 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ParseError is returned for specifications that can not be parsed. File is
+// empty for specifications not read from a file
+type ParseError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%s at line %d", e.Msg, e.Line)
+	}
+	return fmt.Sprintf("%s at line %d of %s", e.Msg, e.Line, e.File)
+}
+
+// StatementError describes a failure while processing a build statement, along
+// with its index in Builder.Statements and the source line it starts at. Log
+// holds the last lines of the logs of the build container, if any
+type StatementError struct {
+	Index     int
+	Line      int
+	Statement string
+	Err       error
+	Log       string
+}
+
+func (e *StatementError) Error() string {
+	msg := fmt.Sprintf("Failed to process statement '%s' at line %d. Error: %s", e.Statement, e.Line, e.Err)
+	if e.Log != "" {
+		msg += "\n" + e.Log
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// ExitError is returned for commands run in a container that exit with a non
+// zero status. Statement is the RUN statement the command belongs to, empty for
+// commands run outside of a build
+type ExitError struct {
+	Command   []string
+	ExitCode  int
+	Statement string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Failed to execute command: '%s'. Exit code: %d", strings.Join(e.Command, " "), e.ExitCode)
+}
+
+// ContainerError is returned for lxc operations like starting, stopping or
+// destroying a container that fail. Op names the operation
+type ContainerError struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+func (e *ContainerError) Error() string {
+	return fmt.Sprintf("Failed to %s container %s. Error: %s", e.Op, e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ContainerError) Unwrap() error {
+	return e.Err
+}
+
+// ArtifactError is returned for artifacts that could not be fetched from the
+// container at path Source to the host path Destination
+type ArtifactError struct {
+	Label       string
+	Source      string
+	Destination string
+	Err         error
+}
+
+func (e *ArtifactError) Error() string {
+	return fmt.Sprintf("Failed to fetch artifact %s of label %s to %s. Error: %s", e.Source, e.Label, e.Destination, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ArtifactError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidManifestError is returned for manifest files that can not be decoded
+type InvalidManifestError struct {
+	Path string
+	Err  error
+}
+
+func (e *InvalidManifestError) Error() string {
+	return fmt.Sprintf("Invalid manifest %s. Error: %s", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *InvalidManifestError) Unwrap() error {
+	return e.Err
+}
+
+// MissingManifestError is returned for container archives without a manifest
+type MissingManifestError struct {
+	Archive string
+}
+
+func (e *MissingManifestError) Error() string {
+	return fmt.Sprintf("No manifest found in archive %s", e.Archive)
+}
+
+// TimeoutError is returned for RUN statements exceeding their timeout
+type TimeoutError struct {
+	Statement string
+	Timeout   time.Duration
+	Elapsed   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Statement '%s' timed out after %s (timeout %s)", e.Statement, e.Elapsed, e.Timeout)
+}
+
+// RetryError is returned for RUN statements that still failed after all retries
+type RetryError struct {
+	Statement string
+	Attempts  int
+	Err       error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("Statement '%s' failed after %d attempts. Error: %s", e.Statement, e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownInstructionError is returned for statements using an instruction Build
+// does not understand
+type UnknownInstructionError struct {
+	Instruction string
+	Line        int
+}
+
+func (e *UnknownInstructionError) Error() string {
+	return fmt.Sprintf("Unknown instruction '%s' at line %d", e.Instruction, e.Line)
+}
+
+// DigestMismatchError is returned for images whose content does not match their
+// recorded digest
+type DigestMismatchError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("Digest of %s does not match. Expected: %s, found: %s", e.Path, e.Expected, e.Actual)
+}
+
+// PartialExportError is returned for exports that failed after writing part of
+// the image
+type PartialExportError struct {
+	Written int64
+	Err     error
+}
+
+func (e *PartialExportError) Error() string {
+	return fmt.Sprintf("Export failed after writing %d bytes. Error: %s", e.Written, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *PartialExportError) Unwrap() error {
+	return e.Err
+}
+
+// SignatureError is returned for images whose signature can not be verified
+type SignatureError struct {
+	Archive string
+	Detail  string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("Invalid signature of %s. Error: %s", e.Archive, e.Detail)
+}
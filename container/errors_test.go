@@ -0,0 +1,107 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ParseError(t *testing.T) {
+	specs := map[string]int{
+		"FROM ubuntu\nRUN apt-get update \\\n":            2,
+		"# escape=x\nFROM ubuntu\n":                       1,
+		"FROM ubuntu\nRUN <<EOF\necho unterminated\n":     2,
+		"# escape=`\n# escape=`\nFROM ubuntu\nRUN true\n": 2,
+	}
+	for spec, line := range specs {
+		err := NewBuilder("nut-test-errors").ParseReader(strings.NewReader(spec))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError for %q, found %v", spec, err)
+			continue
+		}
+		if parseErr.Line != line || parseErr.File != "" {
+			t.Errorf("Expected a ParseError at line %d for %q, found %+v", line, spec, parseErr)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "nut-test-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(file, []byte("FROM ubuntu\nRUN make \\\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = NewBuilder("nut-test-errors").Parse(file)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.File != file {
+		t.Fatalf("Expected a ParseError naming %s, found %v", file, err)
+	}
+	if expected := "Unterminated line continuation at line 2 of " + file; err.Error() != expected {
+		t.Errorf("Expected %q, found %q", expected, err)
+	}
+}
+
+func Test_StatementErrorIndex(t *testing.T) {
+	b := NewBuilder("nut-test-errors")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\n\nENV A=1\nRNU false\n")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := b.BuildWithOptions(BuildOptions{DryRun: true})
+	var stmtErr *StatementError
+	if !errors.As(err, &stmtErr) || stmtErr.Index != 2 || stmtErr.Line != 4 {
+		t.Fatalf("Expected a StatementError for the third statement, found %#v", err)
+	}
+	var unknown *UnknownInstructionError
+	if !errors.As(err, &unknown) || unknown.Instruction != "RNU" {
+		t.Errorf("Expected the StatementError to wrap an UnknownInstructionError, found %v", stmtErr.Err)
+	}
+	if errs := b.Validate(); len(errs) != 1 || !errors.As(errs[0], &stmtErr) || stmtErr.Index != 2 {
+		t.Errorf("Expected Validate to report the third statement, found %v", errs)
+	}
+}
+
+func Test_ErrorsUnwrap(t *testing.T) {
+	exitErr := &ExitError{Command: []string{"make"}, ExitCode: 2}
+	errs := []error{
+		&StatementError{Index: 1, Line: 2, Statement: "RUN make", Err: exitErr},
+		&ContainerError{Op: "attach to", Name: "app", Err: exitErr},
+		&ArtifactError{Label: "artifact.app", Source: "/app", Destination: "app", Err: exitErr},
+		&RetryError{Statement: "RUN make", Attempts: 3, Err: exitErr},
+	}
+	for _, err := range errs {
+		var found *ExitError
+		if !errors.As(err, &found) || found != exitErr || !errors.Is(err, exitErr) {
+			t.Errorf("Expected %T to wrap the ExitError", err)
+		}
+	}
+	err := &ContainerError{Op: "stop", Name: "app", Err: context.DeadlineExceeded}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected ContainerError to wrap its cause")
+	}
+	if expected := "Failed to stop container app. Error: context deadline exceeded"; err.Error() != expected {
+		t.Errorf("Expected %q, found %q", expected, err)
+	}
+}
+
+func Test_ContainerErrorLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-errors-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ct.Start()
+	var ctErr *ContainerError
+	if !errors.As(err, &ctErr) || ctErr.Op != "start" || ctErr.Name != "nut-test-errors-missing" {
+		t.Errorf("Expected a ContainerError starting a missing container, found %v", err)
+	}
+	err = ct.Create("nut-test-errors-no-parent")
+	if !errors.As(err, &ctErr) || ctErr.Op != "create" {
+		t.Errorf("Expected a ContainerError cloning a missing parent, found %v", err)
+	}
+}
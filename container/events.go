@@ -0,0 +1,66 @@
+package container
+
+import (
+	"time"
+)
+
+// BuildEvent is implemented by the progress events emitted during a build
+type BuildEvent interface {
+	buildEvent()
+}
+
+// StatementStarted is emitted before a statement is executed
+type StatementStarted struct {
+	Index int
+	Raw   string
+}
+
+// StatementFinished is emitted after a statement was executed, with Err set if it
+// failed
+type StatementFinished struct {
+	Index    int
+	Duration time.Duration
+	Err      error
+}
+
+// CommandOutput is emitted for every line written by a command run in the container
+type CommandOutput struct {
+	Line string
+}
+
+// ContainerLog is emitted for failed statements with the last lines of the
+// console output and the lxc log of the build container
+type ContainerLog struct {
+	Index   int
+	Console []string
+	LXC     []string
+}
+
+// ArtifactFetched is emitted for every artifact copied from the container to the host
+type ArtifactFetched struct {
+	Path string
+}
+
+// BuildFinished is emitted once the build is over, with Err set if it failed
+type BuildFinished struct {
+	Err error
+}
+
+func (StatementStarted) buildEvent()  {}
+func (StatementFinished) buildEvent() {}
+func (CommandOutput) buildEvent()     {}
+func (ContainerLog) buildEvent()      {}
+func (ArtifactFetched) buildEvent()   {}
+func (BuildFinished) buildEvent()     {}
+
+// emit sends an event without blocking the build. Events are dropped when the
+// receiver does not keep up
+func (b *Builder) emit(event BuildEvent) {
+	if b.opts.Events == nil {
+		return
+	}
+	select {
+	case b.opts.Events <- event:
+	default:
+	}
+}
@@ -0,0 +1,48 @@
+package container
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_BuildEvents(t *testing.T) {
+	b := NewBuilder("nut-test-events")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nENV A=1\n")); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan BuildEvent, 10)
+	if _, err := b.BuildWithOptions(BuildOptions{DryRun: true, Events: events}); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+	var received []BuildEvent
+	for event := range events {
+		if finished, ok := event.(StatementFinished); ok {
+			finished.Duration = 0
+			event = finished
+		}
+		received = append(received, event)
+	}
+	expected := []BuildEvent{
+		StatementStarted{Index: 0, Raw: "FROM ubuntu"},
+		StatementFinished{Index: 0},
+		StatementStarted{Index: 1, Raw: "ENV A=1"},
+		StatementFinished{Index: 1},
+		BuildFinished{},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected events %#v, found %#v", expected, received)
+	}
+}
+
+func Test_BuildEventsDoNotBlock(t *testing.T) {
+	b := NewBuilder("nut-test-events")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nENV A=1\n")); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan BuildEvent)
+	if _, err := b.BuildWithOptions(BuildOptions{DryRun: true, Events: events}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,91 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExistingContainerPolicy selects what builds do if containers they create exist
+// already, typically left behind by a crashed build of the same name
+type ExistingContainerPolicy string
+
+// Policies for existing containers. ExistingContainerError is the default
+const (
+	// ExistingContainerError fails the build
+	ExistingContainerError ExistingContainerPolicy = "error"
+	// ExistingContainerReplace stops and destroys the containers before building
+	ExistingContainerReplace ExistingContainerPolicy = "replace"
+	// ExistingContainerReuse attaches to the containers and continues the build
+	// they were kept from, like Resume
+	ExistingContainerReuse ExistingContainerPolicy = "reuse"
+)
+
+// ParseExistingContainerPolicy returns the policy named s, ExistingContainerError
+// if s is empty
+func ParseExistingContainerPolicy(s string) (ExistingContainerPolicy, error) {
+	switch p := ExistingContainerPolicy(strings.ToLower(s)); p {
+	case "":
+		return ExistingContainerError, nil
+	case ExistingContainerError, ExistingContainerReplace, ExistingContainerReuse:
+		return p, nil
+	}
+	return "", fmt.Errorf("Invalid existing container policy '%s'. Expected error, replace or reuse", s)
+}
+
+// existingContainers returns the names of the containers of the build's stages
+// that exist already
+func (b *Builder) existingContainers() []string {
+	var names []string
+	total := b.countStages()
+	for i := 0; i < total; i++ {
+		name := b.stageContainerName(i, total)
+		ct, err := b.containerBackend().container(name)
+		if err == nil && ct.Defined() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveExisting applies the existing container policy to the containers of a
+// new build, returning the index of the statement the build starts at. Reused
+// containers continue at the statement their build failed at
+func (b *Builder) resolveExisting() (int, error) {
+	policy, err := ParseExistingContainerPolicy(string(b.opts.ExistingContainer))
+	if err != nil {
+		return 0, err
+	}
+	names := b.existingContainers()
+	if len(names) == 0 {
+		return 0, nil
+	}
+	list := strings.Join(names, ", ")
+	switch policy {
+	case ExistingContainerReplace:
+		b.logger().Warnf("Replacing existing containers %s", list)
+		for _, name := range names {
+			c, err := newContainer(b.containerBackend(), name)
+			if err == nil {
+				err = c.DestroyAll()
+			}
+			if err != nil {
+				return 0, fmt.Errorf("Failed to replace existing container %s. Error: %s", name, err)
+			}
+		}
+	case ExistingContainerReuse:
+		progress, err := b.loadProgress()
+		if err != nil {
+			return 0, fmt.Errorf("Containers %s exist but hold no failed build to reuse. Replace them instead", list)
+		}
+		if err := b.checkProgress(progress); err != nil {
+			return 0, err
+		}
+		b.logger().Warnf("Reusing existing containers %s", list)
+		b.result.ExistingContainer = policy
+		return progress.Statement, nil
+	default:
+		return 0, fmt.Errorf("Containers %s exist already, probably left by a crashed build. Destroy them with lxc-destroy, or replace them with the replace policy", list)
+	}
+	b.result.ExistingContainer = policy
+	return 0, nil
+}
@@ -0,0 +1,54 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_ParseExistingContainerPolicy(t *testing.T) {
+	for s, expected := range map[string]ExistingContainerPolicy{
+		"":        ExistingContainerError,
+		"error":   ExistingContainerError,
+		"Replace": ExistingContainerReplace,
+		"reuse":   ExistingContainerReuse,
+	} {
+		if p, err := ParseExistingContainerPolicy(s); err != nil || p != expected {
+			t.Errorf("Expected %q to select %s, found %s (%v)", s, expected, p, err)
+		}
+	}
+	if _, err := ParseExistingContainerPolicy("ignore"); err == nil {
+		t.Error("Expected unknown policy to be rejected")
+	}
+}
+
+func Test_ExistingContainerLXC(t *testing.T) {
+	stale, err := NewContainer("nut-test-existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	defer stale.DestroyAll()
+	b := NewBuilder("nut-test-existing")
+	if err := b.ParseReader(strings.NewReader("FROM trusty\nRUN true\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BuildWithResult(BuildOptions{}); err == nil || !strings.Contains(err.Error(), "exist already") {
+		t.Fatalf("Expected existing container to fail the build, found %v", err)
+	}
+	if !stale.ct.Defined() {
+		t.Fatal("Expected failed build to keep the existing container")
+	}
+	if _, err := b.BuildWithResult(BuildOptions{ExistingContainer: ExistingContainerReuse}); err == nil {
+		t.Error("Expected container without build progress not to be reused")
+	}
+	result, err := b.BuildWithResult(BuildOptions{ExistingContainer: ExistingContainerReplace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Container.DestroyAll()
+	if result.ExistingContainer != ExistingContainerReplace {
+		t.Errorf("Expected result to report the replaced container, found %q", result.ExistingContainer)
+	}
+}
@@ -0,0 +1,93 @@
+package container
+
+import (
+	"strings"
+)
+
+// expandableInstructions lists instructions whose arguments are subject to
+// environment variable expansion
+var expandableInstructions = map[string]bool{
+	"ADD":     true,
+	"COPY":    true,
+	"ENV":     true,
+	"EXPOSE":  true,
+	"LABEL":   true,
+	"WORKDIR": true,
+}
+
+// expandVariables substitutes $VAR and ${VAR} references in s using lookup. A
+// backslash in front of '$' suppresses expansion. Unset variables expand to empty
+// string and their names are returned
+func expandVariables(s string, lookup func(string) (string, bool)) (string, []string) {
+	var buffer strings.Builder
+	var missing []string
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == '$' {
+			buffer.WriteByte('$')
+			i++
+			continue
+		}
+		if s[i] != '$' {
+			buffer.WriteByte(s[i])
+			continue
+		}
+		var name string
+		end := i
+		if i+1 < len(s) && s[i+1] == '{' {
+			closing := strings.IndexByte(s[i+2:], '}')
+			if closing < 0 {
+				buffer.WriteByte(s[i])
+				continue
+			}
+			name = s[i+2 : i+2+closing]
+			end = i + 2 + closing
+		} else {
+			j := i + 1
+			for j < len(s) && isNameChar(s[j], j == i+1) {
+				j++
+			}
+			name = s[i+1 : j]
+			end = j - 1
+		}
+		if name == "" {
+			buffer.WriteByte(s[i])
+			continue
+		}
+		if value, ok := lookup(name); ok {
+			buffer.WriteString(value)
+		} else {
+			missing = append(missing, name)
+		}
+		i = end
+	}
+	return buffer.String(), missing
+}
+
+func isNameChar(c byte, first bool) bool {
+	switch {
+	case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
+
+// lookupVariable resolves a variable from the ENV statements of the build and
+// its parent, falling back to build arguments declared with a value. The
+// environment commands run with is not consulted, so unset variables such as
+// HOME stay unresolved
+func (b *Builder) lookupVariable(c *Container, name string) (string, bool) {
+	if c != nil {
+		for i := len(c.Manifest.Env) - 1; i >= 0; i-- {
+			pair := strings.SplitN(c.Manifest.Env[i], "=", 2)
+			if pair[0] == name && len(pair) == 2 {
+				return pair[1], true
+			}
+		}
+	}
+	if arg, ok := b.args[name]; ok && arg.defined {
+		return arg.value, true
+	}
+	return "", false
+}
@@ -0,0 +1,58 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ExpandVariables(t *testing.T) {
+	env := map[string]string{"APP_HOME": "/opt/app", "PORT": "8080"}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	cases := []struct {
+		in      string
+		out     string
+		missing []string
+	}{
+		{"WORKDIR ${APP_HOME}", "WORKDIR /opt/app", nil},
+		{"ADD app.tar $APP_HOME/", "ADD app.tar /opt/app/", nil},
+		{"EXPOSE $PORT", "EXPOSE 8080", nil},
+		{`ENV PRICE=\$PORT`, "ENV PRICE=$PORT", nil},
+		{"LABEL dir=${UNSET}/bin", "LABEL dir=/bin", []string{"UNSET"}},
+		{"LABEL cost=5$ brace=${", "LABEL cost=5$ brace=${", nil},
+	}
+	for _, c := range cases {
+		out, missing := expandVariables(c.in, lookup)
+		if out != c.out {
+			t.Errorf("Expected: %s, found: %s", c.out, out)
+		}
+		if !reflect.DeepEqual(missing, c.missing) {
+			t.Errorf("Expected missing variables %v, found %v", c.missing, missing)
+		}
+	}
+}
+
+func Test_LookupVariable(t *testing.T) {
+	b := NewBuilder("nut-test-lookup")
+	b.args = map[string]buildArg{"VERSION": {value: "1.2", defined: true}, "ARCH": {}}
+	c := &Container{Manifest: Manifest{Env: []string{"APP_HOME=/opt/app", "VERSION=2.0"}}}
+	cases := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"APP_HOME", "/opt/app", true},
+		{"VERSION", "2.0", true},
+		{"ARCH", "", false},
+		{"HOME", "", false},
+		{"PATH", "", false},
+	}
+	for _, v := range cases {
+		value, ok := b.lookupVariable(c, v.name)
+		if value != v.value || ok != v.ok {
+			t.Errorf("Expected %s to resolve to %q, %v, found %q, %v", v.name, v.value, v.ok, value, ok)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package container
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxReportedPaths limits the paths named by export permission errors
+const maxReportedPaths = 5
+
+// treeFile is a file added to a tar stream in addition to a directory tree
+type treeFile struct {
+	name string
+	data []byte
+}
+
+// exportCompressed writes the directory tree at dir and the extra files as
+// tarball compressed with c to w, without invoking tar
+func exportCompressed(l Logger, w io.Writer, dir string, c Compression, level int, extra ...treeFile) error {
+	zw, err := c.compressor(w, level)
+	if err != nil {
+		return err
+	}
+	if err := exportTree(l, zw, dir, extra...); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// exportTree writes the directory tree at dir as tar stream to w,
+// with paths relative to dir like tar -C dir . would. Modes, numeric owners,
+// modification times, symlinks, hard links and device nodes are preserved. Files
+// that can not be read for lack of permission are collected and reported in a
+// single error. The extra files are appended to the tree
+func exportTree(l Logger, w io.Writer, dir string, extra ...treeFile) error {
+	return writeTree(l, w, dir, "./", extra...)
+}
+
+// writeTree writes the directory tree at dir as tar stream to w, prefixing the
+// paths relative to dir with prefix. dir itself is only included with a non
+// empty prefix. Entries are written in lexical order, followed by the extra files
+func writeTree(l Logger, w io.Writer, dir, prefix string, extra ...treeFile) error {
+	tw := tar.NewWriter(w)
+	links := make(map[[2]uint64]string)
+	var denied []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsPermission(err) {
+				denied = append(denied, path)
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := prefix + filepath.ToSlash(rel)
+		if rel == "." {
+			if prefix == "" {
+				return nil
+			}
+			name = prefix
+		}
+		if err := exportEntry(l, tw, path, name, info, links); err != nil {
+			if os.IsPermission(err) {
+				denied = append(denied, path)
+				return nil
+			}
+			return fmt.Errorf("Failed to export %s. Error: %s", path, err)
+		}
+		return nil
+	})
+	for _, f := range extra {
+		if err != nil {
+			break
+		}
+		err = writeTarFile(tw, prefix+f.name, f.data, time.Now())
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if len(denied) > 0 {
+		reported := denied
+		if len(reported) > maxReportedPaths {
+			reported = reported[:maxReportedPaths]
+		}
+		return fmt.Errorf("Failed to export %d files due to missing permissions, including %s. Retry with sudo", len(denied), strings.Join(reported, ", "))
+	}
+	return nil
+}
+
+// exportEntry writes the header, and the content of regular files, of the file
+// at path to tw
+func exportEntry(l Logger, tw *tar.Writer, path, name string, info os.FileInfo, links map[[2]uint64]string) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSocket != 0 {
+		loggerOrDefault(l).Warnf("Skipping socket %s", path)
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() && !strings.HasSuffix(name, "/") {
+		hdr.Name += "/"
+	}
+	// like tar --numeric-owner
+	hdr.Uname, hdr.Gname = "", ""
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 && info.Mode().IsRegular() {
+		key := [2]uint64{uint64(stat.Dev), stat.Ino}
+		if first, ok := links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		links[key] = name
+	}
+	if !info.Mode().IsRegular() {
+		return tw.WriteHeader(hdr)
+	}
+	// open the file before writing the header, so unreadable files are skipped
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
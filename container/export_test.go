@@ -0,0 +1,136 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func Test_ExportTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "rootfs", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config"), []byte("lxc.utsname = app\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "rootfs", "bin", "app"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "rootfs", "bin", "app"), filepath.Join(dir, "rootfs", "bin", "app2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/app", filepath.Join(dir, "rootfs", "app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "rootfs", "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := exportTree(nil, &buf, dir); err != nil {
+		t.Fatal(err)
+	}
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[hdr.Name] = hdr
+		d, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name] = string(d)
+	}
+	for _, name := range []string{"./", "./config", "./rootfs/", "./rootfs/bin/", "./rootfs/bin/app", "./rootfs/bin/app2", "./rootfs/app", "./rootfs/fifo"} {
+		if _, ok := headers[name]; !ok {
+			t.Fatalf("Expected %s in the tarball, found %v", name, headers)
+		}
+	}
+	if hdr := headers["./config"]; hdr.Mode&0777 != 0640 || contents["./config"] != "lxc.utsname = app\n" || hdr.Uid != os.Getuid() || hdr.Uname != "" {
+		t.Errorf("Unexpected header %+v for config", hdr)
+	}
+	if hdr := headers["./rootfs/bin/app"]; hdr.Typeflag != tar.TypeReg || hdr.Mode&0777 != 0755 || contents["./rootfs/bin/app"] != "#!/bin/sh\n" {
+		t.Errorf("Unexpected header %+v for app", hdr)
+	}
+	if hdr := headers["./rootfs/bin/app2"]; hdr.Typeflag != tar.TypeLink || hdr.Linkname != "./rootfs/bin/app" {
+		t.Errorf("Expected hard link to ./rootfs/bin/app, found %+v", hdr)
+	}
+	if hdr := headers["./rootfs/app"]; hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "bin/app" {
+		t.Errorf("Expected symlink to bin/app, found %+v", hdr)
+	}
+	if hdr := headers["./rootfs/fifo"]; hdr.Typeflag != tar.TypeFifo {
+		t.Errorf("Expected fifo, found %+v", hdr)
+	}
+	if os.Getuid() == 0 {
+		t.Skip("Permission errors can not be tested as root")
+	}
+	if err := os.Chmod(filepath.Join(dir, "config"), 0); err != nil {
+		t.Fatal(err)
+	}
+	err = exportTree(nil, ioutil.Discard, dir)
+	if err == nil || !strings.Contains(err.Error(), "Failed to export 1 files") || !strings.Contains(err.Error(), "sudo") {
+		t.Errorf("Expected aggregated permission error, found %v", err)
+	}
+}
+
+func Test_ArchiveManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-archive-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctDir := filepath.Join(dir, "app")
+	if err := os.MkdirAll(filepath.Join(ctDir, "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := &Image{Manifest: &Manifest{User: "app"}}
+	data, err := image.archiveManifest(ctDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "app.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exportCompressed(nil, f, ctDir, CompressionGzip, 0, treeFile{name: ArchiveManifest, data: data}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	var m Manifest
+	if err := m.LoadFromArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	if m.User != "app" || m.SchemaVersion != manifestVersion {
+		t.Errorf("Expected manifest generated from the image manifest, found %+v", m)
+	}
+	if err := (&Manifest{User: "json"}).SaveJSON(filepath.Join(ctDir, ArchiveManifestJSON)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = image.archiveManifest(ctDir); err != nil || !strings.Contains(string(data), "user: json") {
+		t.Errorf("Expected manifest generated from manifest.json, found %s (%v)", data, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ctDir, ArchiveManifest), []byte("user: app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = image.archiveManifest(ctDir); err != nil || data != nil {
+		t.Errorf("Expected no generated manifest for containers with manifest.yml, found %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,315 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/lxc/go-lxc.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeBackend keeps containers in memory, with their directories in dir, so
+// builds can be tested without lxc. Rootfs directories are plain copies of
+// their parent's. Attached commands are recorded and handed to run
+type fakeBackend struct {
+	dir string
+	// run returns the output and exit code of an attached command, no output
+	// and 0 if nil
+	run        func(cmd fakeCommand) (string, int)
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	commands   []fakeCommand
+	// shutdowns holds the timeouts containers were asked to shut down within
+	shutdowns []time.Duration
+}
+
+// fakeCommand is a command attached to a fake container. Script holds the
+// content of the script shell form commands are written to
+type fakeCommand struct {
+	Container string
+	Args      []string
+	Script    string
+	Env       []string
+	Cwd       string
+}
+
+// newFakeBackend returns a backend with the base container name, whose rootfs
+// holds /bin/bash and /tmp
+func newFakeBackend(t *testing.T, base string) *fakeBackend {
+	dir, err := ioutil.TempDir("", "nut-test-fakelxc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &fakeBackend{dir: dir, containers: make(map[string]*fakeContainer)}
+	ct := be.open(base)
+	rootfs := filepath.Join(dir, base, "rootfs")
+	for _, d := range []string{"bin", "tmp", "root"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "bin", "bash"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ct.defined = true
+	ct.config[configKey("lxc.rootfs")] = []string{rootfs}
+	return be
+}
+
+func (be *fakeBackend) cleanup() {
+	os.RemoveAll(be.dir)
+}
+
+func (be *fakeBackend) container(name string) (lxcContainer, error) {
+	return be.open(name), nil
+}
+
+func (be *fakeBackend) open(name string) *fakeContainer {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	ct, ok := be.containers[name]
+	if !ok {
+		ct = &fakeContainer{be: be, name: name, config: make(map[string][]string)}
+		be.containers[name] = ct
+	}
+	return ct
+}
+
+// defined returns the names of the defined containers
+func (be *fakeBackend) defined() []string {
+	be.mu.Lock()
+	containers := make([]*fakeContainer, 0, len(be.containers))
+	for _, ct := range be.containers {
+		containers = append(containers, ct)
+	}
+	be.mu.Unlock()
+	var names []string
+	for _, ct := range containers {
+		if ct.Defined() {
+			names = append(names, ct.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scripts returns the commands of the shell form scripts attached to the
+// container name
+func (be *fakeBackend) scripts(name string) []string {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	var scripts []string
+	for _, cmd := range be.commands {
+		if cmd.Container == name && cmd.Script != "" {
+			lines := strings.Split(cmd.Script, "\n")
+			scripts = append(scripts, strings.Join(lines[2:], "\n"))
+		}
+	}
+	return scripts
+}
+
+// multiValued lists configuration keys whose values SetConfigItem appends to
+var multiValued = map[string]bool{"lxc.mount.entry": true, "lxc.idmap": true, "lxc.id_map": true}
+
+// fakeContainer is a container of fakeBackend. Its state is guarded by mu, as
+// concurrent builds share parent and cache containers
+type fakeContainer struct {
+	be      *fakeBackend
+	name    string
+	mu      sync.Mutex
+	defined bool
+	running bool
+	config  map[string][]string
+}
+
+func (c *fakeContainer) Name() string { return c.name }
+func (c *fakeContainer) InitPid() int { return -1 }
+
+func (c *fakeContainer) Defined() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.defined
+}
+
+func (c *fakeContainer) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
+
+func (c *fakeContainer) State() lxc.State {
+	if c.Running() {
+		return lxc.RUNNING
+	}
+	return lxc.STOPPED
+}
+
+func (c *fakeContainer) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.defined {
+		return fmt.Errorf("Container %s is not defined", c.name)
+	}
+	c.running = true
+	return nil
+}
+
+func (c *fakeContainer) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = false
+	return nil
+}
+
+func (c *fakeContainer) Shutdown(timeout time.Duration) error {
+	c.be.mu.Lock()
+	c.be.shutdowns = append(c.be.shutdowns, timeout)
+	c.be.mu.Unlock()
+	return c.Stop()
+}
+
+func (c *fakeContainer) Wait(state lxc.State, timeout time.Duration) bool {
+	return c.State() == state
+}
+
+func (c *fakeContainer) Destroy() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.defined {
+		return fmt.Errorf("Container %s is not defined", c.name)
+	}
+	c.defined, c.running = false, false
+	c.config = make(map[string][]string)
+	return os.RemoveAll(filepath.Join(c.be.dir, c.name))
+}
+
+func (c *fakeContainer) Clone(name string, options lxc.CloneOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.defined {
+		return fmt.Errorf("Container %s is not defined", c.name)
+	}
+	clone := c.be.open(name)
+	clone.mu.Lock()
+	defer clone.mu.Unlock()
+	if clone.defined {
+		return fmt.Errorf("Container %s exists", name)
+	}
+	if options.Snapshot {
+		return errors.New("Snapshots are not supported")
+	}
+	rootfs := filepath.Join(c.be.dir, name, "rootfs")
+	if err := copyTree(nil, filepath.Join(c.be.dir, c.name, "rootfs"), rootfs, nil); err != nil {
+		return err
+	}
+	for key, values := range c.config {
+		clone.config[key] = append([]string(nil), values...)
+	}
+	clone.config[configKey("lxc.rootfs")] = []string{rootfs}
+	clone.defined = true
+	return nil
+}
+
+func (c *fakeContainer) Snapshots() ([]lxc.Snapshot, error) {
+	return nil, nil
+}
+
+func (c *fakeContainer) CreateSnapshot() (*lxc.Snapshot, error) {
+	return nil, errors.New("Snapshots are not supported")
+}
+
+func (c *fakeContainer) DestroySnapshot(snapshot lxc.Snapshot) error {
+	return errors.New("Snapshots are not supported")
+}
+
+func (c *fakeContainer) ConfigFileName() string {
+	return filepath.Join(c.be.dir, c.name, "config")
+}
+
+func (c *fakeContainer) ConfigItem(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config[key]
+}
+
+func (c *fakeContainer) SetConfigItem(key, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if multiValued[key] || strings.HasPrefix(key, "lxc.cgroup") {
+		c.config[key] = append(c.config[key], value)
+	} else {
+		c.config[key] = []string{value}
+	}
+	return nil
+}
+
+func (c *fakeContainer) ClearConfigItem(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.config, key)
+	return nil
+}
+
+func (c *fakeContainer) SaveConfigFile(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var lines []string
+	for key, values := range c.config {
+		for _, v := range values {
+			lines = append(lines, key+" = "+v)
+		}
+	}
+	sort.Strings(lines)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func (c *fakeContainer) IPAddresses() ([]string, error) {
+	return c.IPv4Addresses()
+}
+
+func (c *fakeContainer) IPv4Addresses() ([]string, error) {
+	if !c.Running() {
+		return nil, errors.New("Container is not running")
+	}
+	return []string{"10.0.3.2"}, nil
+}
+
+// RunCommandStatus records the command and writes the output run returns for
+// it to the stdout of the command
+func (c *fakeContainer) RunCommandStatus(args []string, options lxc.AttachOptions) (int, error) {
+	if !c.Running() {
+		return -1, fmt.Errorf("Container %s is not running", c.name)
+	}
+	cmd := fakeCommand{Container: c.name, Args: args, Env: options.Env, Cwd: options.Cwd}
+	if len(args) == 2 && args[0] == "/bin/bash" {
+		data, err := ioutil.ReadFile(filepath.Join(c.be.dir, c.name, "rootfs", args[1]))
+		if err != nil {
+			return -1, err
+		}
+		cmd.Script = string(data)
+	}
+	c.be.mu.Lock()
+	c.be.commands = append(c.be.commands, cmd)
+	run := c.be.run
+	c.be.mu.Unlock()
+	if run == nil {
+		return 0, nil
+	}
+	output, exitCode := run(cmd)
+	if output != "" && options.StdoutFd > 0 {
+		if _, err := syscall.Write(int(options.StdoutFd), []byte(output)); err != nil {
+			return -1, err
+		}
+	}
+	return exitCode, nil
+}
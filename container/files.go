@@ -1,63 +1,490 @@
 package container
 
 import (
-	log "github.com/sirupsen/logrus"
+	"context"
+	"errors"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"os/exec"
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func (c *Container) addFiles(src, dest string) error {
-	rootfs := c.ct.ConfigItem("lxc.rootfs")[0]
+// stagePrefix prefixes the directories ADD and COPY sources are staged in below
+// the container's /tmp
+const stagePrefix = "nut-add-"
+
+// fileFlags holds the options of an ADD or COPY statement given as leading
+// --name=value flags
+type fileFlags struct {
+	from     string
+	chown    string
+	checksum string
+}
+
+// parseFileFlags splits the leading flags off the arguments of an ADD or COPY
+// statement. ADD accepts --chown and --checksum, COPY accepts --chown and --from
+func parseFileFlags(instruction string, args []string) (fileFlags, []string, error) {
+	var flags fileFlags
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		flag := args[0]
+		switch {
+		case strings.HasPrefix(flag, "--chown="):
+			flags.chown = strings.TrimPrefix(flag, "--chown=")
+			if flags.chown == "" || strings.Count(flags.chown, ":") > 1 {
+				return flags, nil, fmt.Errorf("Invalid %s flag '%s'. Expected --chown=user[:group]", instruction, flag)
+			}
+		case strings.HasPrefix(flag, "--from=") && instruction == "COPY":
+			flags.from = strings.TrimPrefix(flag, "--from=")
+		case strings.HasPrefix(flag, "--checksum=") && instruction == "ADD":
+			flags.checksum = strings.ToLower(strings.TrimPrefix(flag, "--checksum="))
+			if !checksumPattern.MatchString(flags.checksum) {
+				return flags, nil, fmt.Errorf("Invalid ADD checksum '%s'. Expected sha256:<hex digest>", flag)
+			}
+		default:
+			return flags, nil, fmt.Errorf("Unknown %s flag '%s'", instruction, flag)
+		}
+		args = args[1:]
+	}
+	return flags, args, nil
+}
+
+// fileOwner resolves the --chown flag of ADD and COPY against the users and
+// groups of the container with the given rootfs. Without a group, the group id
+// equals the user id. Without the flag files are owned by root
+func fileOwner(rootfs, chown string) (string, error) {
+	if chown == "" {
+		return "0:0", nil
+	}
+	u, err := lookupUser(rootfs, chown)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(chown, ":") {
+		u.gid = u.uid
+	}
+	return fmt.Sprintf("%d:%d", u.uid, u.gid), nil
+}
+
+// expandSources expands the glob patterns of ADD and COPY sources below root.
+// Remote ADD sources are kept as is. Patterns matching nothing are an error, as
+// are matches escaping root via .. unless allowOutside is set
+func expandSources(instruction, root string, patterns []string, allowOutside bool) ([]string, error) {
+	var sources []string
+	for _, pattern := range patterns {
+		if instruction == "ADD" && isRemote(pattern) {
+			sources = append(sources, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s source '%s'. Error: %s", instruction, pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s source '%s' matches no files. Resolved to %s", instruction, pattern, filepath.Join(root, pattern))
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(root, match)
+			if !allowOutside && (err != nil || rel == ".." || strings.HasPrefix(rel, "../")) {
+				return nil, fmt.Errorf("%s source '%s' is outside of the build context %s", instruction, pattern, root)
+			}
+		}
+		sources = append(sources, matches...)
+	}
+	return sources, nil
+}
+
+// checkSource verifies that an ADD or COPY source exists and is readable before
+// it is staged. The number and size of the files below directory sources is
+// logged to l at debug level
+func checkSource(l Logger, src string, ignore *IgnoreMatcher) error {
+	l = loggerOrDefault(l)
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Source %s does not exist", src)
+	}
+	if err != nil {
+		return fmt.Errorf("Source %s is not accessible. Error: %s", src, err)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Source %s is not readable. Error: %s", src, err)
+	}
+	f.Close()
+	if info.IsDir() && debugEnabled(l) {
+		files, size := 0, int64(0)
+		filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if ignore.Ignored(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				files++
+				size += info.Size()
+			}
+			return nil
+		})
+		l.Debugf("Copying %d files (%d bytes) from %s", files, size, src)
+	}
+	return nil
+}
+
+// transferFiles executes an ADD or COPY statement, transferring every source
+// matching its glob patterns to the destination. With several sources the
+// destination must be a directory
+func (b *Builder) transferFiles(c *Container, st Statement) error {
+	flags, files, err := parseFileFlags(st.Instruction, st.Args)
+	if err != nil {
+		return err
+	}
+	if len(files) < 2 {
+		return fmt.Errorf("%s requires a source and a destination", st.Instruction)
+	}
+	patterns, dest := files[:len(files)-1], resolveDest(c.Manifest.WorkDir, files[len(files)-1])
+	if flags.checksum != "" && (len(patterns) != 1 || !isRemote(patterns[0])) {
+		return errors.New("ADD --checksum is only supported for a single remote source")
+	}
+	root, ignore := b.contextDir(), b.ignore
+	if flags.from != "" {
+		stage, err := b.lookupStage(flags.from, c)
+		if err != nil {
+			return err
+		}
+		if b.opts.DryRun {
+			b.planFiles(patterns, dest, true)
+			return nil
+		}
+		if root, err = stage.rootfs(); err != nil {
+			return err
+		}
+		ignore = nil
+	}
+	sources, err := expandSources(st.Instruction, root, patterns, flags.from == "" && b.opts.AllowOutsideContext)
+	if err != nil {
+		return err
+	}
+	for _, src := range sources {
+		if isRemote(src) {
+			continue
+		}
+		if err := checkSource(b.logger(), src, ignore); err != nil {
+			return err
+		}
+	}
+	if b.opts.DryRun {
+		b.planFiles(sources, dest, false)
+		return nil
+	}
+	if len(sources) > 1 && !strings.HasSuffix(dest, "/") && !c.isDir(dest) {
+		return fmt.Errorf("%s with more than one source requires the destination '%s' to be a directory ending with /", st.Instruction, dest)
+	}
+	for _, src := range sources {
+		if isRemote(src) {
+			err = b.addRemote(c, src, dest, flags)
+		} else if st.Instruction == "ADD" {
+			// unlike COPY, ADD unpacks local archives
+			var extracted bool
+			if extracted, err = c.extractFiles(src, dest); !extracted && err == nil {
+				err = c.addFiles(src, dest, ignore, flags.chown)
+			}
+		} else {
+			err = c.addFiles(src, dest, ignore, flags.chown)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyScript returns the script moving the staged copy of an ADD or COPY source
+// to dest inside the container, following docker's rules: the contents of
+// directories are merged into dest, files are placed into dest if it ends with /
+// and copied to dest otherwise. Ownership is applied inside the container, where
+// user ids are mapped
+func copyScript(staged, dest, owner string, dir bool) string {
+	parent := path.Dir(dest)
+	cp := "cp -aT"
+	if strings.HasSuffix(dest, "/") {
+		parent = dest
+		if !dir {
+			cp = "cp -a"
+		}
+	}
+	return fmt.Sprintf("chown -R %s %s && mkdir -p %s && %s %s %s", owner, shellQuote(staged), shellQuote(parent), cp, shellQuote(staged), shellQuote(dest))
+}
+
+// resolveDest resolves a relative ADD or COPY destination against the working
+// directory, keeping the trailing / of directories. Destinations naming a
+// directory as . or .. are directories as well. Absolute destinations are only
+// cleaned
+func resolveDest(workDir, dest string) string {
+	resolved := resolveWorkDir(workDir, dest)
+	base := path.Base(dest)
+	if (strings.HasSuffix(dest, "/") || base == "." || base == "..") && resolved != "/" {
+		resolved += "/"
+	}
+	return resolved
+}
+
+// contextDir returns the build context ADD and COPY sources are resolved
+// against, BuildOptions.ContextDir or the directory of the parsed spec file.
+// Without either, sources are resolved against the working directory of the
+// process
+func (b *Builder) contextDir() string {
+	if b.opts.ContextDir != "" {
+		dir, err := filepath.Abs(b.opts.ContextDir)
+		if err != nil {
+			return b.opts.ContextDir
+		}
+		return dir
+	}
+	if b.RootDir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return "."
+		}
+		return dir
+	}
+	dir, err := filepath.Abs(b.RootDir)
+	if err != nil {
+		return b.RootDir
+	}
+	return dir
+}
+
+// isDir reports whether the path p inside the container is a directory. Relative
+// paths are resolved against the working directory
+func (c *Container) isDir(p string) bool {
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return false
+	}
+	hostPath, err := resolveInRoot(rootfs, resolveWorkDir(c.Manifest.WorkDir, p))
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(hostPath)
+	return err == nil && info.IsDir()
+}
+
+// addFiles copies src from the host to dest inside the container, owned by the
+// user and group of chown, root by default. Directory sources are filtered
+// against the ignore matcher
+func (c *Container) addFiles(src, dest string, ignore *IgnoreMatcher, chown string) error {
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	owner, err := fileOwner(rootfs, chown)
+	if err != nil {
+		return err
+	}
+	ids, err := c.idMap()
+	if err != nil {
+		return err
+	}
+	// sources are staged in a directory of their own, so they can not collide
+	// with each other or files of the container. It is removed whether or not
+	// the copy succeeds
+	stage, err := ioutil.TempDir(filepath.Join(rootfs, "tmp"), stagePrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(stage); err != nil {
+			c.logger().Errorf("Failed to delete temporary files %s. Error: %s", stage, err)
+		}
+	}()
 	base := filepath.Base(src)
-	tmpContainer := filepath.Join(rootfs, "tmp", base)
-	cmd := exec.Command("/bin/cp", "-ar", src, tmpContainer)
-	log.Warnln("/bin/cp", "-ar", src, tmpContainer)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Errorln("Failed to copy temporary files from host to container tmp directory")
-		log.Errorln("Error:", err)
-		log.Errorln("Output:", string(out[:]))
+	tmpContainer := filepath.Join(stage, base)
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		c.logger().Debugf("Copying directory %s to %s", src, tmpContainer)
+		if err := copyTree(c.logger(), src, tmpContainer, ignore); err != nil {
+			c.logger().Errorf("Failed to copy temporary files from host to container tmp directory. Error: %s", err)
+			return err
+		}
+	} else if err := hostCopy(c.logger(), src, tmpContainer); err != nil {
+		c.logger().Errorf("Failed to copy temporary files from host to container tmp directory. Error: %s", err)
 		return err
 	}
-	if err := c.RunCommand([]string{"cp", "-r", filepath.Join("/tmp", base), dest}); err != nil {
-		log.Errorln("Failed to copy temporary files within container's /tmp to target directory. Error:", err)
+	// host root owns the staged files, which unprivileged containers can not
+	// chown until they are owned by the container's root. Unprivileged builds
+	// stage files owned by the user running nut instead
+	if c.unprivileged {
+		err = ids.chownToRoot(stage)
+	} else {
+		err = ids.shiftOwnership(c.logger(), stage, true)
+	}
+	if err != nil {
 		return err
 	}
-	rmCmd := exec.Command("/bin/rm", "-rf", tmpContainer)
-	if err := rmCmd.Run(); err != nil {
-		log.Error("Failed to delete temporary files")
+	script := copyScript(filepath.Join("/tmp", filepath.Base(stage), base), dest, owner, info.IsDir())
+	if err := c.runAsRoot(context.Background(), []string{script}); err != nil {
+		c.logger().Errorf("Failed to copy temporary files within container's /tmp to target directory. Error: %s", err)
 		return err
 	}
 	return nil
 }
 
-func (c *Container) fetchArtifacts() error {
-	rootfs := c.ct.ConfigItem("lxc.rootfs")[0]
-	for k, v := range c.Manifest.Labels {
-		if strings.HasPrefix(k, "nut_artifact_") {
-			artifact := filepath.Base(v)
-			if err := c.RunCommand([]string{"cp", "-r", v, filepath.Join("/tmp", artifact)}); err != nil {
-				log.Errorf("Failed to copy artifact to /tmp. Error: %s\n", err)
+// fetchArtifacts copies the paths referenced by nut_artifact_ labels from the
+// container's rootfs straight to their host paths as out names them, calling
+// record with the outcome of every artifact. Label values may be glob patterns,
+// fetching every match. Artifacts that can not be fetched fail with an
+// ArtifactError, unless they are missing and optional or out allows that. The
+// digests of the fetched files are written to SHA256SUMS in the artifact
+// directory
+func (c *Container) fetchArtifacts(out artifactOutput, record func(ArtifactResult)) error {
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	ids, err := c.idMap()
+	if err != nil {
+		return err
+	}
+	var labels []string
+	for k := range c.Manifest.Labels {
+		if strings.HasPrefix(k, artifactLabelPrefix) {
+			labels = append(labels, k)
+		}
+	}
+	sort.Strings(labels)
+	var artifacts []ArtifactResult
+	// artifacts named alike would overwrite each other
+	sources := make(map[string]string)
+	for _, k := range labels {
+		v, optional := parseArtifactValue(c.Manifest.Labels[k])
+		matches := []string{v}
+		if hasGlobMeta(v) {
+			matches, err = globInRoot(rootfs, resolveWorkDir(c.Manifest.WorkDir, v))
+			if err != nil {
+				return &ArtifactError{Label: k, Source: v, Destination: out.dir, Err: err}
+			}
+		}
+		if len(matches) == 0 {
+			result := ArtifactResult{Label: k, Source: v, Status: ArtifactStatusMissing, Err: errors.New("No files match")}
+			if optional || out.allowMissing {
+				c.logger().Warnf("Skipping artifact %s of label %s, no files match", v, k)
+				artifacts = append(artifacts, result)
+				continue
+			}
+			result.Status = ArtifactStatusFailed
+			result.Err = &ArtifactError{Label: k, Source: v, Destination: out.dir, Err: result.Err}
+			record(result)
+			return result.Err
+		}
+		for _, match := range matches {
+			artifact, err := out.path(strings.TrimPrefix(k, artifactLabelPrefix), match)
+			if err != nil {
 				return err
 			}
-			pathInContainer := filepath.Join(rootfs, "tmp", artifact)
-			cmd := exec.Command("/bin/cp", "-ar", pathInContainer, artifact)
-			if err := cmd.Run(); err != nil {
-				log.Errorf("Failed to copy files from container to host. Error: %s\n", err)
+			if other, ok := sources[artifact]; ok {
+				return fmt.Errorf("Artifacts %s and %s are both fetched to %s. Use an artifact name including {label}", other, k, artifact)
 			}
+			sources[artifact] = k
+			artifacts = append(artifacts, ArtifactResult{Label: k, Source: match, Path: artifact, Status: ArtifactStatusFetched, optional: optional})
 		}
 	}
-	return nil
+	var fetched []ArtifactResult
+	for _, result := range artifacts {
+		if result.Status == ArtifactStatusMissing {
+			record(result)
+			continue
+		}
+		missing, err := c.fetchArtifact(rootfs, ids, result.Source, result.Path)
+		if missing && (result.optional || out.allowMissing) {
+			c.logger().Warnf("Skipping missing artifact %s of label %s", result.Source, result.Label)
+			result.Status, result.Err = ArtifactStatusMissing, err
+			record(result)
+			continue
+		}
+		if err != nil {
+			result.Status = ArtifactStatusFailed
+			result.Err = &ArtifactError{Label: result.Label, Source: result.Source, Destination: result.Path, Err: err}
+			record(result)
+			return result.Err
+		}
+		if result.Digests, err = artifactDigests(out.dir, result.Path); err != nil {
+			return fmt.Errorf("Failed to compute digests of artifact %s. Error: %s", result.Path, err)
+		}
+		fetched = append(fetched, result)
+		record(result)
+	}
+	return writeArtifactSums(out.dir, fetched)
+}
+
+// fetchArtifact copies the artifact at path v in the container to the host path
+// artifact. It reports whether the artifact is missing in the container
+func (c *Container) fetchArtifact(rootfs string, ids idMap, v, artifact string) (bool, error) {
+	pathInContainer, err := resolveInRoot(rootfs, resolveWorkDir(c.Manifest.WorkDir, v))
+	if err == nil {
+		_, err = os.Lstat(pathInContainer)
+	}
+	if err != nil {
+		return os.IsNotExist(err), err
+	}
+	if err := os.MkdirAll(filepath.Dir(artifact), 0755); err != nil {
+		return false, err
+	}
+	if err := hostCopy(c.logger(), pathInContainer, artifact); err != nil {
+		return false, err
+	}
+	// copies made by unprivileged builds are owned by the user running nut
+	if !c.unprivileged {
+		return false, ids.shiftOwnership(c.logger(), artifact, false)
+	}
+	return false, nil
+}
+
+// manifestPath returns the location of the container's manifest file
+func (c *Container) manifestPath() string {
+	return filepath.Join(c.dir(), "manifest.yml")
 }
 
 func (c *Container) WriteManifest() error {
-	rootfs := c.ct.ConfigItem("lxc.rootfs")[0]
-	manifestPath := filepath.Join(rootfs, "../manifest.yml")
-	d, err := yaml.Marshal(&c.Manifest)
+	manifestPath := c.manifestPath()
+	d, err := yaml.Marshal(c.Manifest.stamped())
 	if err != nil {
 		return err
 	}
 	return ioutil.WriteFile(manifestPath, d, 0644)
 }
+
+// jsonManifestPath returns the location of the container's json manifest file
+func (c *Container) jsonManifestPath() string {
+	return strings.TrimSuffix(c.manifestPath(), ".yml") + ".json"
+}
+
+// writeManifests writes the container's manifest in format, ManifestYAML,
+// ManifestJSON or ManifestBoth. Empty formats mean ManifestYAML. A json only
+// manifest replaces manifest.yml, which Manifest.Load would prefer otherwise
+func (c *Container) writeManifests(format string) error {
+	switch format {
+	case "", ManifestYAML:
+		return c.WriteManifest()
+	case ManifestJSON:
+		if err := os.Remove(c.manifestPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return c.Manifest.SaveJSON(c.jsonManifestPath())
+	case ManifestBoth:
+		if err := c.WriteManifest(); err != nil {
+			return err
+		}
+		return c.Manifest.SaveJSON(c.jsonManifestPath())
+	}
+	return fmt.Errorf("Unknown manifest format '%s'", format)
+}
@@ -0,0 +1,275 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ParseFileFlags(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	flags, args, err := parseFileFlags("ADD", []string{"--chown=app:staff", "--checksum=" + digest, "https://example.com/app.tar", "/srv/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != (fileFlags{chown: "app:staff", checksum: digest}) || !reflect.DeepEqual(args, []string{"https://example.com/app.tar", "/srv/"}) {
+		t.Errorf("Unexpected flags %+v and arguments %v", flags, args)
+	}
+	flags, args, err = parseFileFlags("COPY", []string{"--chown=1000", "--from=builder", "/out", "/srv/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != (fileFlags{chown: "1000", from: "builder"}) || !reflect.DeepEqual(args, []string{"/out", "/srv/"}) {
+		t.Errorf("Unexpected flags %+v and arguments %v", flags, args)
+	}
+	invalid := map[string]string{
+		"--checksum=md5:abc":    "ADD",
+		"--checksum=sha256:xyz": "ADD",
+		"--from=builder":        "ADD",
+		"--checksum=" + digest:  "COPY",
+		"--chown=":              "COPY",
+		"--chown=a:b:c":         "COPY",
+		"--mode=0644":           "COPY",
+	}
+	for flag, instruction := range invalid {
+		if _, _, err := parseFileFlags(instruction, []string{flag, "src", "dest"}); err == nil {
+			t.Errorf("Expected error for %s %s", instruction, flag)
+		}
+	}
+}
+
+func Test_FileOwner(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("app:x:1000:100:App:/home/app:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("staff:x:50:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	owners := map[string]string{
+		"":          "0:0",
+		"app":       "1000:1000",
+		"app:staff": "1000:50",
+		"1001:1002": "1001:1002",
+		"app:1002":  "1000:1002",
+	}
+	for chown, expected := range owners {
+		owner, err := fileOwner(rootfs, chown)
+		if err != nil {
+			t.Errorf("Failed to resolve '%s'. Error: %s", chown, err)
+			continue
+		}
+		if owner != expected {
+			t.Errorf("Expected %s for '%s', found %s", expected, chown, owner)
+		}
+	}
+	for _, chown := range []string{"nobody", "app:wheel"} {
+		if _, err := fileOwner(rootfs, chown); err == nil {
+			t.Errorf("Expected error for '%s'", chown)
+		}
+	}
+}
+
+func Test_ExpandSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"build/b.deb", "build/a.deb", "build/notes.txt", "README.md"} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources, err := expandSources("ADD", dir, []string{"build/*.deb", "README.md", "https://example.com/app.tar"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "build/a.deb"), filepath.Join(dir, "build/b.deb"), filepath.Join(dir, "README.md"), "https://example.com/app.tar"}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("Expected %v, found %v", expected, sources)
+	}
+	for _, pattern := range []string{"build/*.rpm", "missing", "build/[a"} {
+		if _, err := expandSources("COPY", dir, []string{"README.md", pattern}, false); err == nil {
+			t.Errorf("Expected error for '%s'", pattern)
+		}
+	}
+	b := NewBuilder("nut-test-sources")
+	b.RootDir = dir
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nCOPY --chown=app build/*.deb README.md /packages/\n")); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := b.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(steps[1].Sources, expected[:3]) || steps[1].Destination != "/packages/" {
+		t.Errorf("Unexpected planned transfer %v -> %s", steps[1].Sources, steps[1].Destination)
+	}
+}
+
+func Test_ContextDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"spec/Dockerfile", "spec/app.conf", "context/app.conf", "secret.key"} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan := func(spec string, opts BuildOptions) ([]PlannedStep, error) {
+		b := NewBuilder("nut-test-context")
+		b.RootDir = filepath.Join(dir, "spec")
+		if err := b.ParseReader(strings.NewReader("FROM ubuntu\n" + spec + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		return b.DryRun(opts)
+	}
+	steps, err := plan("COPY app.conf /etc/", BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "spec", "app.conf"); steps[1].Sources[0] != expected {
+		t.Errorf("Expected source %s, found %s", expected, steps[1].Sources[0])
+	}
+	steps, err = plan("COPY app.conf /etc/", BuildOptions{ContextDir: filepath.Join(dir, "context")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "context", "app.conf"); steps[1].Sources[0] != expected {
+		t.Errorf("Expected source %s, found %s", expected, steps[1].Sources[0])
+	}
+	if _, err := plan("COPY ../secret.key /etc/", BuildOptions{}); err == nil || !strings.Contains(err.Error(), "outside of the build context") {
+		t.Errorf("Expected source outside of the context to be refused, found %v", err)
+	}
+	if _, err := plan("COPY ../secret.key /etc/", BuildOptions{AllowOutsideContext: true}); err != nil {
+		t.Errorf("Expected source outside of the context to be allowed. Error: %s", err)
+	}
+	if _, err := plan("COPY app.conf /etc/", BuildOptions{ContextDir: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("Expected error for missing build context")
+	}
+}
+
+func Test_CheckSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.conf"), []byte("port=80"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{dir, filepath.Join(dir, "app.conf")} {
+		if err := checkSource(nil, src, nil); err != nil {
+			t.Errorf("Expected %s to be accepted. Error: %s", src, err)
+		}
+	}
+	missing := filepath.Join(dir, "missing.conf")
+	if err := checkSource(nil, missing, nil); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("Expected error naming %s, found %v", missing, err)
+	}
+	b := NewBuilder("nut-test-sources")
+	b.RootDir = dir
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nCOPY conf/*.conf /etc/app/\n")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.DryRun(BuildOptions{})
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "conf/*.conf")) || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected error naming the statement and resolved path, found %v", err)
+	}
+}
+
+func Test_CopyScript(t *testing.T) {
+	scripts := []struct {
+		dest     string
+		dir      bool
+		expected string
+	}{
+		{"/etc/myapp/app.conf", false, "chown -R 0:0 '/tmp/s/src' && mkdir -p '/etc/myapp' && cp -aT '/tmp/s/src' '/etc/myapp/app.conf'"},
+		{"/etc/myapp/", false, "chown -R 0:0 '/tmp/s/src' && mkdir -p '/etc/myapp/' && cp -a '/tmp/s/src' '/etc/myapp/'"},
+		{"/srv/conf", true, "chown -R 0:0 '/tmp/s/src' && mkdir -p '/srv' && cp -aT '/tmp/s/src' '/srv/conf'"},
+		{"/srv/conf/", true, "chown -R 0:0 '/tmp/s/src' && mkdir -p '/srv/conf/' && cp -aT '/tmp/s/src' '/srv/conf/'"},
+		{"app.conf", false, "chown -R 0:0 '/tmp/s/src' && mkdir -p '.' && cp -aT '/tmp/s/src' 'app.conf'"},
+	}
+	for _, s := range scripts {
+		if script := copyScript("/tmp/s/src", s.dest, "0:0", s.dir); script != s.expected {
+			t.Errorf("Expected %q for %s, found %q", s.expected, s.dest, script)
+		}
+	}
+}
+
+func Test_ResolveDest(t *testing.T) {
+	dests := []struct {
+		workDir, dest, expected string
+	}{
+		{"/app", "./src", "/app/src"},
+		{"/app", "src/", "/app/src/"},
+		{"/app", ".", "/app/"},
+		{"/app/lib", "..", "/app/"},
+		{"/app", "/etc/app.conf", "/etc/app.conf"},
+		{"/app", "/etc/myapp/", "/etc/myapp/"},
+		{"", "conf", "/conf"},
+		{"", "/", "/"},
+	}
+	for _, d := range dests {
+		if dest := resolveDest(d.workDir, d.dest); dest != d.expected {
+			t.Errorf("Expected %s for %s in %s, found %s", d.expected, d.dest, d.workDir, dest)
+		}
+	}
+}
+
+func Test_DryRunRelativePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "context", "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	spec := filepath.Join(dir, "context", "Dockerfile")
+	if err := ioutil.WriteFile(spec, []byte("FROM ubuntu\nWORKDIR /app\nCOPY src ./src\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// sources resolve against the spec file's directory, not the process's
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("nut-test-context")
+	if err := b.Parse("context/Dockerfile"); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := b.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "context", "src")}
+	if !reflect.DeepEqual(steps[2].Sources, expected) || steps[2].Destination != "/app/src" {
+		t.Errorf("Unexpected planned transfer %v -> %s", steps[2].Sources, steps[2].Destination)
+	}
+}
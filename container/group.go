@@ -9,6 +9,7 @@ import (
 type Group struct {
 	Version string            `yaml:"version"`
 	Members map[string]Member `yaml:"services"`
+	log     Logger
 }
 
 // GroupFromYAML initializes a Group struct from yaml file
@@ -27,6 +28,7 @@ func GroupFromYAML(file string) (*Group, error) {
 // Create creates the containes defined inside the group
 func (g *Group) Create() error {
 	for name, member := range g.Members {
+		member.SetLogger(g.log)
 		if err := member.Create(name); err != nil {
 			return err
 		}
@@ -0,0 +1,66 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Healthcheck describes the command used to check that a container is still working
+type Healthcheck struct {
+	Test        []string      `yaml:"test" json:"test"`
+	Interval    time.Duration `yaml:"interval" json:"interval"`
+	Timeout     time.Duration `yaml:"timeout" json:"timeout"`
+	StartPeriod time.Duration `yaml:"start_period" json:"start_period"`
+	Retries     int           `yaml:"retries" json:"retries"`
+}
+
+// parseHealthcheck parses the arguments of a HEALTHCHECK instruction of the form
+// [--interval=d] [--timeout=d] [--start-period=d] [--retries=n] CMD <command>.
+// A nil Healthcheck is returned for HEALTHCHECK NONE
+func parseHealthcheck(args string) (*Healthcheck, error) {
+	rest := strings.TrimSpace(args)
+	if rest == "NONE" {
+		return nil, nil
+	}
+	h := &Healthcheck{}
+	for strings.HasPrefix(rest, "--") {
+		option := rest
+		rest = ""
+		if i := strings.IndexAny(option, " \t"); i >= 0 {
+			option, rest = option[:i], strings.TrimSpace(option[i:])
+		}
+		pair := strings.SplitN(strings.TrimPrefix(option, "--"), "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Invalid HEALTHCHECK option '%s'", option)
+		}
+		var err error
+		switch pair[0] {
+		case "interval":
+			h.Interval, err = time.ParseDuration(pair[1])
+		case "timeout":
+			h.Timeout, err = time.ParseDuration(pair[1])
+		case "start-period":
+			h.StartPeriod, err = time.ParseDuration(pair[1])
+		case "retries":
+			h.Retries, err = strconv.Atoi(pair[1])
+		default:
+			return nil, fmt.Errorf("Unknown HEALTHCHECK option '%s'", option)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for HEALTHCHECK option '%s'. Error: %s", option, err)
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 2 || fields[0] != "CMD" {
+		return nil, errors.New("Invalid HEALTHCHECK instruction. Expected HEALTHCHECK [options] CMD <command> or HEALTHCHECK NONE")
+	}
+	test, err := parseCommand(strings.TrimSpace(rest)[len("CMD"):])
+	if err != nil {
+		return nil, err
+	}
+	h.Test = test
+	return h, nil
+}
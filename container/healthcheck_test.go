@@ -0,0 +1,33 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ParseHealthcheck(t *testing.T) {
+	h, err := parseHealthcheck("--interval=30s --timeout=5s --retries=3 CMD curl -f http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Healthcheck{
+		Test:     []string{"curl", "-f", "http://localhost/"},
+		Interval: 30 * time.Second,
+		Timeout:  5 * time.Second,
+		Retries:  3,
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, h)
+	}
+	h, err = parseHealthcheck("NONE")
+	if err != nil || h != nil {
+		t.Fatalf("Expected nil healthcheck for NONE, found: %#v, %v", h, err)
+	}
+	if _, err := parseHealthcheck("--interval=often CMD true"); err == nil {
+		t.Fatal("Expected error for invalid interval")
+	}
+	if _, err := parseHealthcheck("curl -f http://localhost/"); err == nil {
+		t.Fatal("Expected error for missing CMD")
+	}
+}
@@ -0,0 +1,37 @@
+package container
+
+import (
+	"regexp"
+	"strings"
+)
+
+// heredocPattern matches heredoc markers. The character in front of the marker
+// is matched too, to tell them from here-strings (<<<word)
+var heredocPattern = regexp.MustCompile(`(^|[^<])<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+
+// heredocMarker detects a heredoc marker (<<WORD, <<-WORD, <<"WORD") in the first
+// line of a RUN statement, returning the terminator word and whether leading tabs
+// should be stripped from the body lines
+func heredocMarker(statement string) (string, bool, bool) {
+	words := strings.Fields(statement)
+	if len(words) < 2 || strings.ToUpper(words[0]) != "RUN" {
+		return "", false, false
+	}
+	match := heredocPattern.FindStringSubmatch(statement)
+	if match == nil || match[3] != match[5] {
+		return "", false, false
+	}
+	return match[4], match[2] == "-", true
+}
+
+// heredocScript converts the arguments of a heredoc RUN statement into a script
+// body. A bare '<<WORD' marker makes the heredoc body itself the script, otherwise
+// the statement is kept verbatim so the shell feeds the heredoc to the command
+func heredocScript(args string) string {
+	lines := strings.Split(args, "\n")
+	match := heredocPattern.FindStringSubmatch(lines[0])
+	if match != nil && strings.TrimSpace(lines[0]) == match[0][len(match[1]):] && len(lines) >= 2 {
+		return strings.Join(lines[1:len(lines)-1], "\n") + "\n"
+	}
+	return args + "\n"
+}
@@ -0,0 +1,53 @@
+package container
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ParseHeredoc(t *testing.T) {
+	spec := "FROM trusty\nRUN <<EOF\napt-get update\n# not a comment\n\napt-get install -y build-essential \\\nEOF\nRUN python3 <<-'PY'\n\tprint('hi')\n\tPY\nRUN echo done \\\n  again\n"
+	b := NewBuilder("nut-test-heredoc")
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"FROM trusty",
+		"RUN <<EOF\napt-get update\n# not a comment\n\napt-get install -y build-essential \\\nEOF",
+		"RUN python3 <<-'PY'\nprint('hi')\nPY",
+		"RUN echo done    again",
+	}
+	if !reflect.DeepEqual(b.RawStatements(), expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, b.RawStatements())
+	}
+	if lines := statementLines(b); !reflect.DeepEqual(lines, []int{1, 2, 8, 11}) {
+		t.Fatalf("Unexpected line numbers: %v", lines)
+	}
+	script := heredocScript("<<EOF\napt-get update\napt-get install -y curl\nEOF")
+	if script != "apt-get update\napt-get install -y curl\n" {
+		t.Fatalf("Unexpected script: %q", script)
+	}
+	script = heredocScript("python3 <<PY\nprint('hi')\nPY")
+	if script != "python3 <<PY\nprint('hi')\nPY\n" {
+		t.Fatalf("Unexpected script: %q", script)
+	}
+	if err := b.ParseReader(strings.NewReader("RUN <<EOF\necho unterminated\n")); err == nil {
+		t.Fatal("Expected error for unterminated heredoc")
+	}
+}
+
+func Test_ParseHereString(t *testing.T) {
+	spec := "FROM trusty\nRUN grep foo <<<\"hello\"\nRUN cat<<<EOF\nRUN cat<<EOF\nhi\nEOF\n"
+	b := NewBuilder("nut-test-herestring")
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"FROM trusty", "RUN grep foo <<<\"hello\"", "RUN cat<<<EOF", "RUN cat<<EOF\nhi\nEOF"}
+	if !reflect.DeepEqual(b.RawStatements(), expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, b.RawStatements())
+	}
+	if script := heredocScript("grep foo <<<\"hello\""); script != "grep foo <<<\"hello\"\n" {
+		t.Fatalf("Unexpected script: %q", script)
+	}
+}
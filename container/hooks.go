@@ -0,0 +1,70 @@
+package container
+
+import (
+	"fmt"
+)
+
+// HookContext describes the statement a hook is called for
+type HookContext struct {
+	Index     int
+	Statement Statement
+	// Manifest is the state of the build container when the hook is called
+	Manifest Manifest
+	// ContainerName is empty before the first FROM statement and in dry runs,
+	// Container is nil then
+	ContainerName string
+	Container     *Container
+	// IPAddress is the IPv4 address of the build container, empty if its
+	// network was not waited for
+	IPAddress string
+	// Skipped is set for statements that were not executed, because they were
+	// restored from the build cache or replayed when resuming a build
+	Skipped bool
+}
+
+// StatementHook is called before or after a build statement
+type StatementHook func(ctx HookContext) error
+
+// preStatement calls the pre statement hook for the statement at index
+func (b *Builder) preStatement(index int, skipped bool) error {
+	if err := b.callHook(b.opts.PreStatementHook, index, skipped); err != nil {
+		return fmt.Errorf("Pre statement hook failed. Error: %s", err)
+	}
+	return nil
+}
+
+// postStatement calls the post statement hook for the statement at index
+func (b *Builder) postStatement(index int, skipped bool) error {
+	if err := b.callHook(b.opts.PostStatementHook, index, skipped); err != nil {
+		return fmt.Errorf("Post statement hook failed. Error: %s", err)
+	}
+	return nil
+}
+
+func (b *Builder) callHook(hook StatementHook, index int, skipped bool) error {
+	if hook == nil {
+		return nil
+	}
+	ctx := HookContext{
+		Index:     index,
+		Statement: b.Statements[index],
+		Skipped:   skipped,
+	}
+	if b.ct != nil {
+		ctx.Manifest = b.ct.Manifest.snapshot()
+		if b.ct.ct != nil {
+			ctx.ContainerName = b.ct.ct.Name()
+			ctx.Container = b.ct
+			ctx.IPAddress = b.ct.ipAddress
+		}
+	}
+	return hook(ctx)
+}
+
+// skippedHooks calls both hooks for statements that were not executed
+func (b *Builder) skippedHooks(index int) error {
+	if err := b.preStatement(index, true); err != nil {
+		return err
+	}
+	return b.postStatement(index, true)
+}
@@ -0,0 +1,65 @@
+package container
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_StatementHooks(t *testing.T) {
+	b := NewBuilder("nut-test-hooks")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nENV A=1\nRUN make\n")); err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	opts := BuildOptions{
+		DryRun: true,
+		PreStatementHook: func(ctx HookContext) error {
+			calls = append(calls, "pre "+ctx.Statement.Instruction)
+			return nil
+		},
+		PostStatementHook: func(ctx HookContext) error {
+			calls = append(calls, "post "+ctx.Statement.Instruction)
+			if ctx.Index == 1 && !reflect.DeepEqual(ctx.Manifest.Env, []string{"A=1"}) {
+				t.Errorf("Expected post hook to see ENV, found: %v", ctx.Manifest.Env)
+			}
+			return nil
+		},
+	}
+	if _, err := b.BuildWithOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"pre FROM", "post FROM", "pre ENV", "post ENV", "pre RUN", "post RUN"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected hook calls %v, found %v", expected, calls)
+	}
+}
+
+func Test_PreStatementHookFailure(t *testing.T) {
+	b := NewBuilder("nut-test-hooks")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nENV A=1\nRUN make\n")); err != nil {
+		t.Fatal(err)
+	}
+	var executed []int
+	opts := BuildOptions{
+		DryRun: true,
+		Plan: func(step PlannedStep) {
+			executed = append(executed, step.Index)
+		},
+		PreStatementHook: func(ctx HookContext) error {
+			if ctx.Statement.Instruction == "ENV" {
+				return errors.New("policy violation")
+			}
+			return nil
+		},
+	}
+	_, err := b.BuildWithOptions(opts)
+	stmtErr, ok := err.(*StatementError)
+	if !ok || stmtErr.Line != 2 {
+		t.Fatalf("Expected StatementError at line 2, found: %v", err)
+	}
+	if !reflect.DeepEqual(executed, []int{0}) {
+		t.Errorf("Expected only FROM to be executed, found: %v", executed)
+	}
+}
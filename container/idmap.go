@@ -0,0 +1,103 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// idRange maps count consecutive ids, starting at first inside the container, to
+// the ids starting at host on the host
+type idRange struct {
+	kind  string
+	first int
+	host  int
+	count int
+}
+
+// idMap is the user and group id mapping of an unprivileged container. Privileged
+// containers have an empty map
+type idMap []idRange
+
+// parseIDMap parses lxc.idmap entries of the form "u|g|b first host count"
+func parseIDMap(entries []string) (idMap, error) {
+	var m idMap
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 || (fields[0] != "u" && fields[0] != "g" && fields[0] != "b") {
+			return nil, fmt.Errorf("Invalid id map '%s'. Expected 'u|g|b first host count'", entry)
+		}
+		var ids [3]int
+		for i, field := range fields[1:] {
+			id, err := strconv.Atoi(field)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("Invalid id map '%s'. Expected 'u|g|b first host count'", entry)
+			}
+			ids[i] = id
+		}
+		m = append(m, idRange{kind: fields[0], first: ids[0], host: ids[1], count: ids[2]})
+	}
+	return m, nil
+}
+
+// idMap returns the id mapping of the container, read from lxc.idmap or the
+// lxc.id_map key of older lxc versions
+func (c *Container) idMap() (idMap, error) {
+	entries := c.ct.ConfigItem("lxc.idmap")
+	if len(strings.Join(entries, "")) == 0 {
+		entries = c.ct.ConfigItem("lxc.id_map")
+	}
+	return parseIDMap(entries)
+}
+
+// shift maps id of the given kind, u or g, to the host if toHost is set and
+// from the host otherwise. Ids outside of the mapping are returned unchanged
+func (m idMap) shift(kind string, id int, toHost bool) int {
+	for _, r := range m {
+		if r.kind != kind && r.kind != "b" {
+			continue
+		}
+		from, to := r.host, r.first
+		if toHost {
+			from, to = r.first, r.host
+		}
+		if id >= from && id < from+r.count {
+			return to + id - from
+		}
+	}
+	return id
+}
+
+// shiftOwnership changes the owners of the file tree at root from container to
+// host ids if toHost is set, and from host to container ids otherwise. Nothing
+// is changed for empty maps
+func (m idMap) shiftOwnership(l Logger, root string, toHost bool) error {
+	if len(m) == 0 {
+		return nil
+	}
+	loggerOrDefault(l).Debugf("Shifting ownership of %s", root)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		uid := m.shift("u", int(stat.Uid), toHost)
+		gid := m.shift("g", int(stat.Gid), toHost)
+		if uid == int(stat.Uid) && gid == int(stat.Gid) {
+			return nil
+		}
+		if err := os.Lchown(path, uid, gid); err != nil && !os.IsPermission(err) {
+			return fmt.Errorf("Failed to change owner of %s. Error: %s", path, err)
+		}
+		return nil
+	})
+}
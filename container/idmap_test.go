@@ -0,0 +1,81 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func Test_ParseIDMap(t *testing.T) {
+	m, err := parseIDMap([]string{"u 0 100000 65536", "g 0 200000 65536", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		kind     string
+		id       int
+		toHost   bool
+		expected int
+	}{
+		{"u", 0, true, 100000},
+		{"u", 1000, true, 101000},
+		{"g", 1000, true, 201000},
+		{"u", 70000, true, 70000},
+		{"u", 101000, false, 1000},
+		{"g", 200000, false, 0},
+		{"u", 0, false, 0},
+	} {
+		if shifted := m.shift(c.kind, c.id, c.toHost); shifted != c.expected {
+			t.Errorf("Expected %s id %d to shift to %d, found %d", c.kind, c.id, c.expected, shifted)
+		}
+	}
+	for _, entry := range []string{"u 0 100000", "x 0 100000 65536", "u 0 -1 65536"} {
+		if _, err := parseIDMap([]string{entry}); err == nil {
+			t.Errorf("Expected error for id map '%s'", entry)
+		}
+	}
+	if m, err := parseIDMap(nil); err != nil || len(m) != 0 {
+		t.Errorf("Expected empty id map, found %v (%v)", m, err)
+	}
+}
+
+func Test_ShiftOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing file owners requires root")
+	}
+	dir, err := ioutil.TempDir("", "nut-test-idmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(file, []byte("port=80"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	owner := func(p string) (uint32, uint32) {
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		return stat.Uid, stat.Gid
+	}
+	m := idMap{{kind: "b", first: 0, host: 100000, count: 65536}}
+	if err := m.shiftOwnership(nil, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := owner(file); uid != 100000 || gid != 100000 {
+		t.Errorf("Expected owner 100000:100000, found %d:%d", uid, gid)
+	}
+	if err := m.shiftOwnership(nil, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := owner(dir); uid != 0 || gid != 0 {
+		t.Errorf("Expected owner 0:0, found %d:%d", uid, gid)
+	}
+	if err := idMap(nil).shiftOwnership(nil, filepath.Join(dir, "missing"), true); err != nil {
+		t.Errorf("Expected empty id map to change nothing. Error: %s", err)
+	}
+}
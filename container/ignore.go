@@ -0,0 +1,144 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignorePattern is a single compiled .nutignore pattern
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreMatcher decides which files below a build context directory are excluded
+// from ADD and COPY, based on gitignore style patterns
+type IgnoreMatcher struct {
+	root     string
+	patterns []ignorePattern
+}
+
+// LoadIgnoreFile reads the .nutignore file of a build context directory. A missing
+// file yields a matcher that ignores nothing, invalid patterns a ParseError
+func LoadIgnoreFile(root string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{root: root}
+	path := filepath.Join(root, ".nutignore")
+	fi, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	scanner := bufio.NewScanner(fi)
+	for line := 1; scanner.Scan(); line++ {
+		if err := m.AddPattern(scanner.Text()); err != nil {
+			return nil, &ParseError{File: path, Line: line, Msg: err.Error()}
+		}
+	}
+	return m, scanner.Err()
+}
+
+// AddPattern appends a gitignore style pattern. Blank lines and comments are skipped,
+// a leading '!' re-includes previously excluded paths, a trailing '/' only matches
+// directories, and patterns without a leading or inner '/' match at any depth
+func (m *IgnoreMatcher) AddPattern(line string) error {
+	pattern := strings.TrimRight(line, " \t")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+	p := ignorePattern{}
+	if strings.HasPrefix(pattern, "!") {
+		p.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	expr := globToRegexp(pattern)
+	if !anchored {
+		expr = "(.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return fmt.Errorf("Invalid ignore pattern '%s'. Error: %s", line, err)
+	}
+	p.re = re
+	m.patterns = append(m.patterns, p)
+	return nil
+}
+
+// globToRegexp translates a glob with '*', '?', '[...]' and '**' into a regular
+// expression matching slash separated relative paths
+func globToRegexp(glob string) string {
+	var buffer strings.Builder
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			buffer.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			buffer.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buffer.WriteString(".*")
+			i++
+		case ch == '*':
+			buffer.WriteString("[^/]*")
+		case ch == '?':
+			buffer.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				buffer.WriteString(regexp.QuoteMeta(string(ch)))
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buffer.WriteString("[" + class + "]")
+			i += end
+		case ch == '\\' && i+1 < len(glob):
+			i++
+			buffer.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			buffer.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return buffer.String()
+}
+
+// Ignored reports whether path should be excluded. The last matching pattern wins
+func (m *IgnoreMatcher) Ignored(path string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(rel) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
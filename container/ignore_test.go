@@ -0,0 +1,118 @@
+package container
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_CopyTreeWithIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	context := filepath.Join(dir, "context")
+	fixture := []string{
+		".git/HEAD",
+		"node_modules/left-pad/index.js",
+		"app/main.go",
+		"app/debug.log",
+		"app/important.log",
+		"app/build/output.bin",
+		"docs/build",
+		"README.md",
+	}
+	for _, f := range fixture {
+		path := filepath.Join(context, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("README.md", filepath.Join(context, "README")); err != nil {
+		t.Fatal(err)
+	}
+	ignore := "# vcs and deps\n.git\n/node_modules\n*.log\n!important.log\nbuild/\n"
+	if err := ioutil.WriteFile(filepath.Join(context, ".nutignore"), []byte(ignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadIgnoreFile(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := copyTree(nil, context, dest, m); err != nil {
+		t.Fatal(err)
+	}
+	var copied []string
+	err = filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dest, path)
+			copied = append(copied, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(copied)
+	expected := []string{".nutignore", "README", "README.md", "app/important.log", "app/main.go", "docs/build"}
+	if strings.Join(copied, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected: %v, found: %v", expected, copied)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "README")); err != nil || link != "README.md" {
+		t.Fatalf("Expected symlink to README.md, found: %s (%v)", link, err)
+	}
+}
+
+func Test_IgnorePatterns(t *testing.T) {
+	m := &IgnoreMatcher{root: "/ctx"}
+	for _, p := range []string{"**/tmp/**", "docs/*.md", "cache?"} {
+		if err := m.AddPattern(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := map[string]bool{
+		"/ctx/a/b/tmp/file":     true,
+		"/ctx/docs/index.md":    true,
+		"/ctx/docs/sub/more.md": false,
+		"/ctx/src/cache1":       true,
+		"/ctx/src/cache12":      false,
+		"/ctx/main.go":          false,
+	}
+	for path, expected := range cases {
+		if m.Ignored(path, false) != expected {
+			t.Errorf("Expected Ignored(%s) to be %v", path, expected)
+		}
+	}
+}
+
+func Test_InvalidIgnorePattern(t *testing.T) {
+	context, err := ioutil.TempDir("", "nut-test-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(context)
+	path := filepath.Join(context, ".nutignore")
+	if err := ioutil.WriteFile(path, []byte("*.log\n\n[z-a].txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadIgnoreFile(context)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.File != path || parseErr.Line != 3 {
+		t.Fatalf("Expected a ParseError at line 3 of %s, found %v", path, err)
+	}
+	if !strings.Contains(parseErr.Msg, "[z-a].txt") {
+		t.Errorf("Expected the error to name the pattern, found %s", parseErr.Msg)
+	}
+}
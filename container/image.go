@@ -1,12 +1,15 @@
 package container
 
 import (
-	"fmt"
+	"bytes"
+	"crypto/sha256"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	log "github.com/sirupsen/logrus"
 	"gopkg.in/lxc/go-lxc.v2"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,7 +19,10 @@ import (
 // Image represent a container image, which holds rootfs and metadata
 type Image struct {
 	Path string
-	ct   *lxc.Container
+	// Manifest is added to images of containers without manifest on disk
+	Manifest *Manifest
+	ct       *lxc.Container
+	log      Logger
 }
 
 // NewImage Returns a Image struct for the provided container name and
@@ -29,46 +35,216 @@ func NewImage(name, path string) (*Image, error) {
 	return &Image{ct: ct, Path: path}, nil
 }
 
-// Create creates a new tarball image from a container.
-// sudo is used for invoking tar, if set to true
+// Create creates a new tarball image from a container. Without sudo the
+// container directory is archived in process as gzip compressed tarball, with
+// sudo tar is invoked through sudo and compresses with xz. Image paths ending in
+// a tarball extension select the compression implied by it instead
 func (i *Image) Create(sudo bool) error {
-	//ExportContainer(string, string, bool) error
-	lxcdir := lxc.GlobalConfigItem("lxc.lxcpath")
-	ctDir := filepath.Join(lxcdir, i.ct.Name())
-	command := fmt.Sprintf("tar -Jcpf %s --numeric-owner -C %s .", i.Path, ctDir)
-	if sudo {
-		command = "sudo " + command
+	_, err := i.CreateWithOptions(ExportOptions{Sudo: sudo})
+	return err
+}
+
+// ExportResult describes a created image
+type ExportResult struct {
+	Path string
+	// Digest is the sha256 digest of the image, in the form sha256:<hex>
+	Digest string
+	Size   int64
+	// Signature is the location of the detached signature, if the image was
+	// signed
+	Signature string
+}
+
+// CreateWithOptions creates a new tarball image from a container. If the image
+// path has no file name extension, the extension of the compression is appended
+// to it. The digest of the image is computed while writing it and recorded in
+// a checksum file next to it, which VerifyExport checks
+func (i *Image) CreateWithOptions(opts ExportOptions) (ExportResult, error) {
+	c, err := i.compression(opts)
+	if err != nil {
+		return ExportResult{}, err
 	}
-	parts := strings.Fields(command)
-	cmd := exec.Command(parts[0], parts[1:]...)
-	out, err := cmd.CombinedOutput()
+	f, err := os.Create(i.Path)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	digest := sha256.New()
+	counter := &countingWriter{}
+	err = i.exportTo(io.MultiWriter(f, digest, counter), c, opts)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(i.Path)
+		i.logger().Errorf("%s", err)
+		return ExportResult{}, err
+	}
+	result := ExportResult{Path: i.Path, Digest: digestOf(digest), Size: counter.n}
+	if err := writeChecksumFile(result); err != nil {
+		return result, err
+	}
+	signer := opts.Signer
+	if signer == nil && opts.SignKey != "" {
+		signer = &GPGSigner{KeyFile: opts.SignKey}
+	}
+	if signer != nil {
+		if result.Signature, err = signImage(i.Path, signer); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// ExportTo streams the container as tarball to w, compressed with
+// opts.Compression or, if unset, gzip (xz with sudo). If writing fails after
+// some of the tarball was written, a PartialExportError is returned, otherwise
+// a ContainerError
+func (i *Image) ExportTo(w io.Writer, opts ExportOptions) error {
+	c, err := exportCompression(opts, "")
+	if err != nil {
+		return err
+	}
+	return i.exportTo(w, c, opts)
+}
+
+func (i *Image) exportTo(w io.Writer, c Compression, opts ExportOptions) error {
+	pw := &progressWriter{w: w, progress: opts.Progress}
+	if err := i.export(pw, c, opts); err != nil {
+		if pw.n > 0 {
+			return &PartialExportError{Written: pw.n, Err: err}
+		}
+		return &ContainerError{Op: "export", Name: i.ct.Name(), Err: err}
+	}
+	return nil
+}
+
+// exportCompression returns the compression of images exported with opts to
+// path, which may be empty for streamed images
+func exportCompression(opts ExportOptions, path string) (Compression, error) {
+	c := opts.Compression
+	if c == "" && path != "" {
+		c = compressionFromPath(path)
+	}
+	if c == "" {
+		c = CompressionGzip
+		if opts.Sudo {
+			c = CompressionXz
+		}
+	}
+	if _, err := ParseCompression(string(c)); err != nil {
+		return "", err
+	}
+	if err := c.validateLevel(opts.Level); err != nil {
+		return "", err
+	}
+	return c, nil
+}
+
+// compression returns the compression of the image created with opts, and
+// appends its extension to the image path if the path has none
+func (i *Image) compression(opts ExportOptions) (Compression, error) {
+	c, err := exportCompression(opts, i.Path)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Ext(i.Path) == "" {
+		i.Path += c.Extension()
+	} else if implied := compressionFromPath(i.Path); implied != "" && implied != c {
+		i.logger().Warnf("Image %s is compressed with %s, which does not match its file name extension", i.Path, c)
+	}
+	return c, nil
+}
+
+// export writes the container directory as tarball compressed with c to w.
+// The image always holds the manifest at ArchiveManifest
+func (i *Image) export(w io.Writer, c Compression, opts ExportOptions) error {
+	ctDir, cleanup, err := i.exportDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	manifest, err := i.archiveManifest(ctDir)
 	if err != nil {
-		log.Error(string(out))
-		log.Error(err)
+		return err
+	}
+	if !opts.Sudo {
+		if manifest != nil {
+			return exportCompressed(i.logger(), w, ctDir, c, opts.Level, treeFile{name: ArchiveManifest, data: manifest})
+		}
+		return exportCompressed(i.logger(), w, ctDir, c, opts.Level)
+	}
+	args := append([]string{"tar", "-cpf", "-", "--numeric-owner"}, c.tarFlags(opts.Level)...)
+	args = append(args, "-C", ctDir, ".")
+	if manifest != nil {
+		dir, err := ioutil.TempDir("", "nut-manifest")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, ArchiveManifest), manifest, 0644); err != nil {
+			return err
+		}
+		args = append(args, "-C", dir, "./"+ArchiveManifest)
+	}
+	cmd := exec.Command("sudo", args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		i.logger().Errorf("%s", stderr.String())
 		return err
 	}
 	return nil
 }
 
-// Decompress decompress the image into a container
+// archiveManifest returns the manifest to add to the image of the container at
+// ctDir, or nil if the container has a manifest.yml. The manifest is generated
+// from the container's manifest.json, the image's Manifest or, lacking both, an
+// empty manifest
+func (i *Image) archiveManifest(ctDir string) ([]byte, error) {
+	if _, err := os.Stat(filepath.Join(ctDir, ArchiveManifest)); !os.IsNotExist(err) {
+		return nil, nil
+	}
+	var m Manifest
+	jsonPath := filepath.Join(ctDir, ArchiveManifestJSON)
+	switch {
+	case fileExists(jsonPath):
+		if err := m.loadFile(i.logger(), jsonPath); err != nil {
+			return nil, err
+		}
+	case i.Manifest != nil:
+		m = *i.Manifest
+	default:
+		i.logger().Warnf("Container %s has no manifest, adding an empty one to the image", i.ct.Name())
+	}
+	return yaml.Marshal(m.stamped())
+}
+
+// Decompress decompress the image into a container. The compression of the
+// image is detected from its content
 func (i *Image) Decompress(sudo bool) error {
 	lxcpath := lxc.GlobalConfigItem("lxc.lxcpath")
 	ctDir := filepath.Join(lxcpath, i.ct.Name())
-	untarCommand := fmt.Sprintf("tar --numeric-owner -xpJf  %s -C %s", i.Path, ctDir)
+	c, err := detectCompression(i.Path)
+	if err != nil {
+		i.logger().Errorf("%s", err)
+		return err
+	}
+	args := append([]string{"tar", "--numeric-owner", "-xp"}, c.tarFlags(0)...)
+	args = append(args, "-f", i.Path, "-C", ctDir)
 	if sudo {
-		untarCommand = "sudo " + untarCommand
+		args = append([]string{"sudo"}, args...)
 	}
 	if err := os.Mkdir(ctDir, 0770); err != nil {
-		log.Errorln(err)
+		i.logger().Errorf("%s", err)
 		return err
 	}
-	log.Infof("Invoking: %s", untarCommand)
-	parts := strings.Fields(untarCommand)
-	cmd := exec.Command(parts[0], parts[1:]...)
+	i.logger().Infof("Invoking: %s", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Error(string(out))
-		log.Error(err)
+		i.logger().Errorf("%s", out)
+		i.logger().Errorf("%s", err)
 		return err
 	}
 	return nil
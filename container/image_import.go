@@ -0,0 +1,382 @@
+package container
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// whiteout prefixes of layer entries, which delete files of lower layers
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// dockerManifestListMediaType is the media type of docker multi platform image
+// manifests, which OCI image layouts may reference instead of an OCI index
+const dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// lxcCommonConfigs are included into the configuration of imported containers,
+// if present on the host
+var lxcCommonConfigs = []string{"/usr/share/lxc/config/common.conf", "/etc/lxc/default.conf"}
+
+// ImportOCI creates the container name from an image of the OCI image layout dir.
+// ref selects the image by its ref name annotation and may be empty if the layout
+// holds a single image. Layers are applied in process, opts.Sudo is not used.
+// Layouts are verified by the digests of their content, signatures are not
+// supported
+func ImportOCI(dir, ref, name string, opts ImportOptions) (*Container, error) {
+	if opts.Keyring != "" {
+		return nil, fmt.Errorf("Signatures of OCI image layouts can not be verified")
+	}
+	config, layers, err := readOCIImage(dir, ref)
+	if err != nil {
+		return nil, err
+	}
+	return importImage(opts.Logger, name, dir, config, layers, opts.Force)
+}
+
+// ImportDockerArchive creates the container name from the first image of a
+// tarball written by docker save. Layers are applied in process, opts.Sudo is not
+// used. With opts.Keyring the signature of the tarball is verified first
+func ImportDockerArchive(file, name string, opts ImportOptions) (*Container, error) {
+	if err := opts.verify(file); err != nil {
+		return nil, err
+	}
+	a, err := openTar(file)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, fmt.Errorf("%s is no tar archive", file)
+	}
+	dir, err := ioutil.TempDir("", "nut-docker-import")
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	err = extractArchive(opts.Logger, a, dir, "/", nil)
+	if closeErr := a.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unpack %s. Error: %s", file, err)
+	}
+	config, layers, err := readDockerArchive(opts.Logger, dir)
+	if err != nil {
+		return nil, err
+	}
+	return importImage(opts.Logger, name, file, config, layers, opts.Force)
+}
+
+// readOCIImage returns the configuration and the layer blob locations of the
+// image ref of the OCI image layout dir
+func readOCIImage(dir, ref string) (OCIImageConfig, []string, error) {
+	var config OCIImageConfig
+	var index OCIIndex
+	if err := readJSONFile(filepath.Join(dir, "index.json"), &index); err != nil {
+		return config, nil, fmt.Errorf("Failed to read OCI image index. Error: %s", err)
+	}
+	desc, err := selectManifest(index.Manifests, ref)
+	if err != nil {
+		return config, nil, err
+	}
+	if desc.MediaType == OCIIndexMediaType || desc.MediaType == dockerManifestListMediaType {
+		var nested OCIIndex
+		if err := readBlobJSON(dir, desc, &nested); err != nil {
+			return config, nil, err
+		}
+		if desc, err = selectPlatform(nested.Manifests); err != nil {
+			return config, nil, err
+		}
+	}
+	var manifest OCIManifest
+	if err := readBlobJSON(dir, desc, &manifest); err != nil {
+		return config, nil, err
+	}
+	if err := readBlobJSON(dir, manifest.Config, &config); err != nil {
+		return config, nil, err
+	}
+	var layers []string
+	for _, layer := range manifest.Layers {
+		p, err := blobPath(dir, layer)
+		if err != nil {
+			return config, nil, err
+		}
+		if err := verifyBlob(p, layer.Digest); err != nil {
+			return config, nil, err
+		}
+		layers = append(layers, p)
+	}
+	return config, layers, nil
+}
+
+// readDockerArchive returns the configuration and the layer tarball locations
+// of the first image of the docker save tarball unpacked into dir
+func readDockerArchive(l Logger, dir string) (OCIImageConfig, []string, error) {
+	var config OCIImageConfig
+	var manifest []DockerManifestEntry
+	if err := readJSONFile(filepath.Join(dir, "manifest.json"), &manifest); err != nil {
+		return config, nil, fmt.Errorf("Failed to read docker archive manifest. Error: %s", err)
+	}
+	if len(manifest) == 0 {
+		return config, nil, fmt.Errorf("Docker archive contains no images")
+	}
+	if len(manifest) > 1 {
+		loggerOrDefault(l).Warnf("Docker archive contains %d images, importing %v", len(manifest), manifest[0].RepoTags)
+	}
+	configPath, err := resolveInRoot(dir, manifest[0].Config)
+	if err != nil {
+		return config, nil, err
+	}
+	if err := readJSONFile(configPath, &config); err != nil {
+		return config, nil, fmt.Errorf("Failed to read image configuration. Error: %s", err)
+	}
+	var layers []string
+	for _, layer := range manifest[0].Layers {
+		p, err := resolveInRoot(dir, layer)
+		if err != nil {
+			return config, nil, err
+		}
+		layers = append(layers, p)
+	}
+	return config, layers, nil
+}
+
+// importImage creates the container name by applying the layer tarballs in order
+// to a new rootfs. The manifest is derived from the image configuration
+func importImage(l Logger, name, source string, config OCIImageConfig, layers []string, force bool) (*Container, error) {
+	l = loggerOrDefault(l)
+	if config.OS != "" && config.OS != "linux" {
+		return nil, fmt.Errorf("Image is built for %s, only linux images can be imported", config.OS)
+	}
+	if config.Architecture != "" && config.Architecture != runtime.GOARCH {
+		l.Warnf("Importing %s image on %s host", config.Architecture, runtime.GOARCH)
+	}
+	ctDir, err := prepareImport(name, force)
+	if err != nil {
+		return nil, err
+	}
+	c, err := createFromLayers(l, name, ctDir, source, config, layers)
+	if err != nil {
+		if removeErr := os.RemoveAll(ctDir); removeErr != nil {
+			l.Warnf("Failed to remove partially imported container %s. Error: %s", name, removeErr)
+		}
+		return nil, err
+	}
+	l.Infof("Imported %s as container %s", source, name)
+	return c, nil
+}
+
+func createFromLayers(l Logger, name, ctDir, source string, config OCIImageConfig, layers []string) (*Container, error) {
+	rootfs := filepath.Join(ctDir, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return nil, err
+	}
+	for i, layer := range layers {
+		l.Debugf("Applying layer %d of %d", i+1, len(layers))
+		if err := applyLayerFile(l, layer, rootfs); err != nil {
+			return nil, fmt.Errorf("Failed to apply layer %d. Error: %s", i+1, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(ctDir, "config"), []byte(lxcConfig(name, rootfs, source, config.Architecture)), 0644); err != nil {
+		return nil, err
+	}
+	c, err := NewContainer(name)
+	if err != nil {
+		return nil, err
+	}
+	c.SetLogger(l)
+	c.Manifest = config.toManifest(l)
+	if err := c.WriteManifest(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lxcConfig returns a minimal lxc configuration for a container imported from
+// source
+func lxcConfig(name, rootfs, source, arch string) string {
+	lines := []string{"# Imported by nut from " + source}
+	for _, include := range lxcCommonConfigs {
+		if fileExists(include) {
+			lines = append(lines, "lxc.include = "+include)
+		}
+	}
+	if arch != "" {
+		lines = append(lines, "lxc.arch = "+arch)
+	}
+	lines = append(lines, configKey("lxc.rootfs")+" = "+rootfs, configKey("lxc.utsname")+" = "+name)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// applyLayerFile applies the layer tarball at file to rootfs
+func applyLayerFile(l Logger, file, rootfs string) error {
+	a, err := openTar(file)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		loggerOrDefault(l).Debugf("Layer %s contains no files", file)
+		return nil
+	}
+	err = applyLayer(l, a, rootfs)
+	if closeErr := a.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// applyLayer extracts the layer tar stream r into rootfs. Whiteout entries
+// delete the files they name, opaque whiteouts the content of their directory
+// from lower layers
+func applyLayer(l Logger, r io.Reader, rootfs string) error {
+	added := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := archiveEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		dir, base := path.Split(name)
+		parent, err := resolveInRoot(rootfs, "/"+dir)
+		if err != nil {
+			return err
+		}
+		switch {
+		case base == whiteoutOpaque:
+			if err := removeLowerEntries(parent, path.Clean("/"+dir), added); err != nil {
+				return err
+			}
+		case strings.HasPrefix(base, whiteoutPrefix):
+			if err := os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+		default:
+			if err := os.MkdirAll(parent, 0755); err != nil {
+				return err
+			}
+			if err := extractEntry(l, tr, hdr, filepath.Join(parent, base), rootfs, "/", nil); err != nil {
+				return fmt.Errorf("Failed to extract %s. Error: %s", hdr.Name, err)
+			}
+			added["/"+name] = true
+		}
+	}
+}
+
+// removeLowerEntries removes the entries of the directory dir, located at
+// rootfs path p, that were not added by the current layer
+func removeLowerEntries(dir, p string, added map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if added[path.Join(p, entry.Name())] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectManifest returns the manifest named ref, or the only manifest if ref is
+// empty
+func selectManifest(manifests []OCIDescriptor, ref string) (OCIDescriptor, error) {
+	if ref == "" {
+		if len(manifests) != 1 {
+			return OCIDescriptor{}, fmt.Errorf("OCI image layout holds %d images, select one by its ref name", len(manifests))
+		}
+		return manifests[0], nil
+	}
+	for _, m := range manifests {
+		if m.Annotations[ociRefNameAnnotation] == ref {
+			return m, nil
+		}
+	}
+	return OCIDescriptor{}, fmt.Errorf("OCI image layout holds no image named %s", ref)
+}
+
+// selectPlatform returns the manifest of the platform nut runs on from the
+// manifests of a multi platform image
+func selectPlatform(manifests []OCIDescriptor) (OCIDescriptor, error) {
+	for _, m := range manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return m, nil
+		}
+	}
+	return OCIDescriptor{}, fmt.Errorf("Image has no manifest for linux/%s", runtime.GOARCH)
+}
+
+// blobPath returns the location of the blob desc references in the OCI image
+// layout dir
+func blobPath(dir string, desc OCIDescriptor) (string, error) {
+	parts := strings.SplitN(desc.Digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || strings.ContainsAny(parts[1], `/\.`) {
+		return "", fmt.Errorf("Unsupported digest %s", desc.Digest)
+	}
+	return filepath.Join(dir, "blobs", parts[0], parts[1]), nil
+}
+
+// verifyBlob checks that the content of the blob file matches digest
+func verifyBlob(file, digest string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if "sha256:"+hex.EncodeToString(h.Sum(nil)) != digest {
+		return fmt.Errorf("Blob %s does not match its digest %s", file, digest)
+	}
+	return nil
+}
+
+// readBlobJSON decodes the json blob desc references in the OCI image layout dir
+// into v, after verifying its digest
+func readBlobJSON(dir string, desc OCIDescriptor, v interface{}) error {
+	p, err := blobPath(dir, desc)
+	if err != nil {
+		return err
+	}
+	if err := verifyBlob(p, desc.Digest); err != nil {
+		return err
+	}
+	return readJSONFile(p, v)
+}
+
+func readJSONFile(file string, v interface{}) error {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, v)
+}
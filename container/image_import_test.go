@@ -0,0 +1,144 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// layerTar returns a tar stream of the given files, directories end in /
+func layerTar(t *testing.T, files ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(name))}
+		if name[len(name)-1] == '/' {
+			hdr = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// treeFiles lists the paths below dir
+func treeFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func Test_ApplyLayer(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := applyLayer(nil, layerTar(t, "etc/", "etc/a", "etc/b", "opt/x/", "opt/x/old", "opt/x/sub/", "opt/x/sub/deep"), rootfs); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyLayer(nil, layerTar(t, "etc/.wh.a", "opt/x/new", "opt/x/.wh..wh..opq", "srv/app"), rootfs); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"etc", "etc/b", "opt", "opt/x", "opt/x/new", "srv", "srv/app"}
+	if files := treeFiles(t, rootfs); !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v, found %v", expected, files)
+	}
+	if d, err := ioutil.ReadFile(filepath.Join(rootfs, "opt", "x", "new")); err != nil || string(d) != "opt/x/new" {
+		t.Errorf("Unexpected content %q of opt/x/new (%v)", d, err)
+	}
+	if err := applyLayer(nil, layerTar(t, "../escape"), rootfs); err == nil {
+		t.Error("Expected error for entry escaping the rootfs")
+	}
+}
+
+func Test_ReadExportedImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-image-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := applyLayer(nil, layerTar(t, "bin/", "bin/app", "etc/", "etc/hostname"), rootfs); err != nil {
+		t.Fatal(err)
+	}
+	m := Manifest{
+		Labels:       map[string]string{"version": "1.0"},
+		Maintainers:  []string{"ops@example.com"},
+		ExposedPorts: []ExposedPort{{Port: 53, Protocol: "udp"}, {Port: 80, Protocol: "tcp"}},
+		EntryPoint:   []string{"/bin/app"},
+		Cmd:          []string{"--port", "80"},
+		Env:          []string{"PATH=/bin"},
+		User:         "app",
+		WorkDir:      "/srv",
+		Volumes:      []string{"/data", "/var/log"},
+		StopSignal:   "SIGTERM",
+		Architecture: "amd64",
+		OS:           "linux",
+	}
+	layout := filepath.Join(dir, "layout")
+	if err := writeOCILayout(nil, layout, rootfs, m, "app"); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "app.tar")
+	if err := writeDockerArchive(nil, archive, rootfs, m, "app"); err != nil {
+		t.Fatal(err)
+	}
+	unpacked := filepath.Join(dir, "unpacked")
+	a, err := openTar(archive)
+	if err != nil || a == nil {
+		t.Fatalf("Failed to open docker archive. Error: %v", err)
+	}
+	if err := extractArchive(nil, a, unpacked, "/", nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	for format, read := range map[string]func() (OCIImageConfig, []string, error){
+		"oci":    func() (OCIImageConfig, []string, error) { return readOCIImage(layout, "app") },
+		"docker": func() (OCIImageConfig, []string, error) { return readDockerArchive(nil, unpacked) },
+	} {
+		config, layers, err := read()
+		if err != nil {
+			t.Fatalf("Failed to read %s image. Error: %s", format, err)
+		}
+		if len(layers) != 1 {
+			t.Fatalf("Expected one %s layer, found %v", format, layers)
+		}
+		restored := filepath.Join(dir, "restored-"+format)
+		if err := applyLayerFile(nil, layers[0], restored); err != nil {
+			t.Fatal(err)
+		}
+		if files := treeFiles(t, restored); !reflect.DeepEqual(files, treeFiles(t, rootfs)) {
+			t.Errorf("Expected %s rootfs %v, found %v", format, treeFiles(t, rootfs), files)
+		}
+		if imported := config.ToManifest(); !reflect.DeepEqual(imported, m) {
+			t.Errorf("Expected %s manifest %+v, found %+v", format, m, imported)
+		}
+	}
+	if _, _, err := readOCIImage(layout, "other"); err == nil {
+		t.Error("Expected error for unknown ref name")
+	}
+}
@@ -0,0 +1,121 @@
+package container
+
+import (
+	"fmt"
+	"gopkg.in/lxc/go-lxc.v2"
+	"os"
+	"path/filepath"
+)
+
+// ImportOptions controls how exported containers are imported
+type ImportOptions struct {
+	// Force replaces an existing container of the same name
+	Force bool
+	// Sudo invokes tar through sudo
+	Sudo bool
+	// Keyring, if set, holds the public keys the image signature is verified
+	// against before the image is extracted. Signature defaults to the image
+	// path with .asc appended
+	Keyring   string
+	Signature string
+	// Logger receives the log messages of the import, the standard logger of
+	// logrus if nil
+	Logger Logger
+}
+
+// ImportContainer extracts the container image archive, as created by
+// Image.Create, into the lxc path as container name. The container's lxc
+// configuration is updated to its new name and location, and its manifest is
+// verified to load. Images may be uncompressed or compressed with gzip, xz or
+// zstd. With opts.Keyring the image signature is verified before anything is
+// extracted
+func ImportContainer(archive, name string, opts ImportOptions) (*Container, error) {
+	if _, err := os.Stat(archive); err != nil {
+		return nil, err
+	}
+	if err := opts.verify(archive); err != nil {
+		return nil, err
+	}
+	ctDir, err := prepareImport(name, opts.Force)
+	if err != nil {
+		return nil, err
+	}
+	image, err := NewImage(name, archive)
+	if err != nil {
+		return nil, err
+	}
+	image.SetLogger(opts.Logger)
+	if err := image.Decompress(opts.Sudo); err != nil {
+		os.RemoveAll(ctDir)
+		return nil, fmt.Errorf("Failed to extract %s. Error: %s", archive, err)
+	}
+	c, err := importedContainer(opts.Logger, name, ctDir)
+	if err != nil {
+		if removeErr := os.RemoveAll(ctDir); removeErr != nil {
+			loggerOrDefault(opts.Logger).Warnf("Failed to remove partially imported container %s. Error: %s", name, removeErr)
+		}
+		return nil, err
+	}
+	c.SetLogger(opts.Logger)
+	loggerOrDefault(opts.Logger).Infof("Imported %s as container %s", archive, name)
+	return c, nil
+}
+
+// importedContainer fixes up the configuration of the container extracted into
+// ctDir and loads its manifest
+func importedContainer(l Logger, name, ctDir string) (*Container, error) {
+	if !fileExists(filepath.Join(ctDir, "config")) {
+		return nil, fmt.Errorf("Image contains no lxc configuration, it is no container image")
+	}
+	c, err := NewContainer(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.UpdateUTS(name); err != nil {
+		return nil, fmt.Errorf("Failed to update lxc configuration. Error: %s", err)
+	}
+	if err := c.Manifest.load(l, name); err != nil {
+		return nil, fmt.Errorf("Failed to load manifest of imported container. Error: %s", err)
+	}
+	return c, nil
+}
+
+// verify checks the signature of archive if a keyring is set
+func (opts ImportOptions) verify(archive string) error {
+	if opts.Keyring == "" {
+		return nil
+	}
+	sig := opts.Signature
+	if sig == "" {
+		sig = signaturePath(archive)
+	}
+	return VerifyExportSignature(archive, sig, opts.Keyring)
+}
+
+// prepareImport returns the directory of the container name, after removing an
+// existing container of that name if force is set
+func prepareImport(name string, force bool) (string, error) {
+	ctDir := filepath.Join(lxc.GlobalConfigItem("lxc.lxcpath"), name)
+	if _, err := os.Lstat(ctDir); err == nil {
+		if !force {
+			return "", fmt.Errorf("Container %s already exists. Use force to replace it", name)
+		}
+		if err := removeContainer(name, ctDir); err != nil {
+			return "", fmt.Errorf("Failed to remove existing container %s. Error: %s", name, err)
+		}
+	}
+	return ctDir, nil
+}
+
+// removeContainer destroys the container name, or removes its directory if lxc
+// does not know it
+func removeContainer(name, ctDir string) error {
+	ct, err := lxc.NewContainer(name)
+	if err == nil && ct.Defined() {
+		if ct.Running() {
+			return fmt.Errorf("Container %s is running", name)
+		}
+		return ct.Destroy()
+	}
+	return os.RemoveAll(ctDir)
+}
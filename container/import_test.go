@@ -0,0 +1,58 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_ImportContainerLXC(t *testing.T) {
+	src, err := NewContainer("trusty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.WriteManifest(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.manifestPath())
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		image, err := NewImage("trusty", "trusty-import"+c.Extension())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := image.CreateWithOptions(ExportOptions{Sudo: true, Compression: c}); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(image.Path)
+		defer os.Remove(checksumPath(image.Path))
+		ct, err := ImportContainer(image.Path, "trusty-import", ImportOptions{Sudo: true, Force: true})
+		if err != nil {
+			t.Fatalf("Failed to import %s image. Error: %s", c, err)
+		}
+		if rootfs := rootfsConfig(ct.ct); !strings.HasSuffix(rootfs, "/trusty-import/rootfs") {
+			t.Errorf("Expected rootfs of the imported container, found %s", rootfs)
+		}
+		if _, err := ImportContainer(image.Path, "trusty-import", ImportOptions{Sudo: true}); err == nil {
+			t.Error("Expected import over an existing container to fail without force")
+		}
+	}
+	ct, err := NewContainer("trusty-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ImportedContainerWithoutConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := importedContainer(nil, "app", dir); err == nil || !strings.Contains(err.Error(), "no lxc configuration") {
+		t.Errorf("Expected missing configuration error, found %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package container
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits restricts the resources available to build containers. Zero values
+// leave the corresponding resource unlimited
+type Limits struct {
+	// CPUShares is the relative cpu weight of the container, 1024 by default
+	CPUShares int
+	// CPUSetCPUs lists the cpus the container may run on, e.g. "0-3" or "0,2"
+	CPUSetCPUs string
+	// MemoryLimit is the maximum memory usage of the container in bytes
+	MemoryLimit int64
+	// PidsLimit is the maximum number of processes in the container
+	PidsLimit int
+}
+
+// limit is an lxc cgroup config item
+type limit struct {
+	key   string
+	value string
+}
+
+// cgroupLimitKeys are the config items set for the resource limits, per cgroup
+// hierarchy version
+var cgroupLimitKeys = map[bool][]string{
+	false: {"lxc.cgroup.cpu.shares", "lxc.cgroup.cpuset.cpus", "lxc.cgroup.memory.limit_in_bytes", "lxc.cgroup.pids.max"},
+	true:  {"lxc.cgroup2.cpu.weight", "lxc.cgroup2.cpuset.cpus", "lxc.cgroup2.memory.max", "lxc.cgroup2.pids.max"},
+}
+
+// unifiedCgroup reports whether the host uses the cgroup v2 unified hierarchy
+func unifiedCgroup() bool {
+	return fileExists("/sys/fs/cgroup/cgroup.controllers")
+}
+
+// validate checks that no limit is negative
+func (l Limits) validate() error {
+	if l.CPUShares < 0 || l.MemoryLimit < 0 || l.PidsLimit < 0 {
+		return fmt.Errorf("Invalid resource limits %+v. Limits must not be negative", l)
+	}
+	return nil
+}
+
+// configItems returns the lxc config items applying the limits, using the keys
+// of cgroup v2 if cgroup2 is set and of cgroup v1 otherwise
+func (l Limits) configItems(cgroup2 bool) []limit {
+	keys := cgroupLimitKeys[cgroup2]
+	var items []limit
+	if l.CPUShares > 0 {
+		shares := l.CPUShares
+		if cgroup2 {
+			// cgroup v2 replaced shares (2-262144) with a weight (1-10000)
+			if shares < 2 {
+				shares = 2
+			}
+			shares = 1 + (shares-2)*9999/262142
+		}
+		items = append(items, limit{keys[0], strconv.Itoa(shares)})
+	}
+	if l.CPUSetCPUs != "" {
+		items = append(items, limit{keys[1], l.CPUSetCPUs})
+	}
+	if l.MemoryLimit > 0 {
+		items = append(items, limit{keys[2], strconv.FormatInt(l.MemoryLimit, 10)})
+	}
+	if l.PidsLimit > 0 {
+		items = append(items, limit{keys[3], strconv.Itoa(l.PidsLimit)})
+	}
+	return items
+}
+
+// SetLimits applies resource limits to the container's configuration. They take
+// effect once the container is (re)started
+func (c *Container) SetLimits(l Limits) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	for _, item := range l.configItems(unifiedCgroup()) {
+		if err := c.ct.SetConfigItem(item.key, item.value); err != nil {
+			return fmt.Errorf("Failed to set %s to %s. Error: %s", item.key, item.value, err)
+		}
+	}
+	return c.ct.SaveConfigFile(c.ct.ConfigFileName())
+}
+
+// clearLimits removes all resource limits from the container's configuration
+func (c *Container) clearLimits() error {
+	for _, keys := range cgroupLimitKeys {
+		for _, key := range keys {
+			if v := c.ct.ConfigItem(key); len(v) == 0 || v[0] == "" {
+				continue
+			}
+			if err := c.ct.ClearConfigItem(key); err != nil {
+				return err
+			}
+		}
+	}
+	return c.ct.SaveConfigFile(c.ct.ConfigFileName())
+}
+
+// limitKeys returns the config keys applied for l, joined for error messages
+func limitKeys(l Limits) string {
+	var keys []string
+	for _, item := range l.configItems(unifiedCgroup()) {
+		keys = append(keys, item.key+"="+item.value)
+	}
+	return strings.Join(keys, ", ")
+}
+
+// ParseSize parses a human readable size like "512m" or "2g" into bytes. The
+// suffixes k, m, g and t, optionally followed by b, denote powers of 1024
+func ParseSize(s string) (int64, error) {
+	size := strings.ToLower(strings.TrimSpace(s))
+	size = strings.TrimSuffix(size, "b")
+	multiplier := int64(1)
+	if n := len(size); n > 0 {
+		if i := strings.IndexByte("kmgt", size[n-1]); i >= 0 {
+			multiplier = int64(1) << (10 * uint(i+1))
+			size = size[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'. Expected a number with an optional k, m, g or t suffix", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,63 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ParseSize(t *testing.T) {
+	sizes := map[string]int64{
+		"0":    0,
+		"512":  512,
+		"1k":   1024,
+		"64M":  64 << 20,
+		"2g":   2 << 30,
+		"2GB":  2 << 30,
+		"1.5g": 3 << 29,
+		" 1t ": 1 << 40,
+		"100b": 100,
+	}
+	for s, expected := range sizes {
+		size, err := ParseSize(s)
+		if err != nil {
+			t.Errorf("Failed to parse '%s'. Error: %s", s, err)
+			continue
+		}
+		if size != expected {
+			t.Errorf("Expected %d for '%s', found %d", expected, s, size)
+		}
+	}
+	for _, s := range []string{"", "g", "2x", "-1g", "two"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("Expected error for '%s'", s)
+		}
+	}
+}
+
+func Test_LimitsConfigItems(t *testing.T) {
+	l := Limits{CPUShares: 1024, CPUSetCPUs: "0-3", MemoryLimit: 2 << 30, PidsLimit: 512}
+	v1 := []limit{
+		{"lxc.cgroup.cpu.shares", "1024"},
+		{"lxc.cgroup.cpuset.cpus", "0-3"},
+		{"lxc.cgroup.memory.limit_in_bytes", "2147483648"},
+		{"lxc.cgroup.pids.max", "512"},
+	}
+	if items := l.configItems(false); !reflect.DeepEqual(items, v1) {
+		t.Errorf("Expected %v, found %v", v1, items)
+	}
+	v2 := []limit{
+		{"lxc.cgroup2.cpu.weight", "39"},
+		{"lxc.cgroup2.cpuset.cpus", "0-3"},
+		{"lxc.cgroup2.memory.max", "2147483648"},
+		{"lxc.cgroup2.pids.max", "512"},
+	}
+	if items := l.configItems(true); !reflect.DeepEqual(items, v2) {
+		t.Errorf("Expected %v, found %v", v2, items)
+	}
+	if items := (Limits{}).configItems(true); len(items) != 0 {
+		t.Errorf("Expected no config items without limits, found %v", items)
+	}
+	if err := (Limits{MemoryLimit: -1}).validate(); err == nil {
+		t.Error("Expected error for negative limit")
+	}
+}
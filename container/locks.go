@@ -0,0 +1,81 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// Builds of one process share the lxc path, the build cache and possibly an
+// artifact directory. These locks serialize access to them across builds
+var (
+	// activeBuilds holds the names of the builds in progress, whose
+	// containers are derived from them
+	activeBuilds = make(map[string]bool)
+	activeMu     sync.Mutex
+	// cacheLocks serializes storing, restoring and pruning cache containers
+	cacheLocks keyedMutex
+	// artifactLocks serializes fetching artifacts into the same directory
+	artifactLocks keyedMutex
+)
+
+// keyedMutex is a set of mutexes, one per key
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	// refs counts the holders and waiters of the lock
+	refs int
+}
+
+// lock locks the mutex of key and returns the function unlocking it
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// claimBuild registers a build of the container name, failing if the process
+// already builds it. The returned function releases the name
+func claimBuild(name string) (func(), error) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if activeBuilds[name] {
+		return nil, fmt.Errorf("Container %s is already being built", name)
+	}
+	activeBuilds[name] = true
+	return func() {
+		activeMu.Lock()
+		delete(activeBuilds, name)
+		activeMu.Unlock()
+	}, nil
+}
+
+// lockArtifactDir locks the artifact directory dir, so builds fetching into it
+// do not interleave their SHA256SUMS
+func lockArtifactDir(dir string) func() {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return artifactLocks.lock(dir)
+}
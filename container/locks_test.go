@@ -0,0 +1,129 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ConcurrentBuilds(t *testing.T) {
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	be.run = func(cmd fakeCommand) (string, int) {
+		// keep the builds running side by side until they store the shared state
+		if strings.Contains(cmd.Script, "echo shared") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if strings.Contains(cmd.Script, "echo build") {
+			app := filepath.Join(be.dir, cmd.Container, "rootfs", "app")
+			if err := ioutil.WriteFile(app, []byte(cmd.Container), 0644); err != nil {
+				return err.Error(), 1
+			}
+		}
+		return "", 0
+	}
+	// half of the builds share an artifact directory, the others have their own
+	artifactDir := func(i int) string {
+		if i%2 == 0 {
+			return filepath.Join(be.dir, "artifacts")
+		}
+		return filepath.Join(be.dir, fmt.Sprintf("artifacts-%d", i))
+	}
+	loggers := make([]*captureLogger, 4)
+	errs := make([]error, len(loggers))
+	var wg sync.WaitGroup
+	for i := range loggers {
+		loggers[i] = &captureLogger{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := NewBuilder(fmt.Sprintf("nut-test-concurrent-%d", i))
+			b.backend = be
+			// the builds share the cached state after the first RUN
+			spec := fmt.Sprintf("FROM nut-test-base\nRUN echo shared\nENV A=$UNSET_%d\nRUN echo build\nLABEL nut_artifact_app%d=/app\n", i, i)
+			if errs[i] = b.ParseReader(strings.NewReader(spec)); errs[i] != nil {
+				return
+			}
+			_, errs[i] = b.BuildWithOptions(BuildOptions{SkipNetworkWait: true, ArtifactDir: artifactDir(i), Logger: loggers[i]})
+		}(i)
+	}
+	wg.Wait()
+	for i, l := range loggers {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		for j := range loggers {
+			expected := fmt.Sprintf("warn Variable UNSET_%d is not set, substituting empty string in statement 'ENV A=$UNSET_%d'", j, j)
+			if l.contains(expected) != (i == j) {
+				t.Errorf("Expected messages of build %d to go to its own logger only, found %q in logger %d", j, l.messages, i)
+			}
+		}
+		app := filepath.Join(artifactDir(i), fmt.Sprintf("app%d", i), "app")
+		if content, err := ioutil.ReadFile(app); err != nil || string(content) != fmt.Sprintf("nut-test-concurrent-%d", i) {
+			t.Errorf("Expected the artifact of build %d at %s, found %q (%v)", i, app, content, err)
+		}
+		if _, err := os.Stat(filepath.Join(artifactDir(i), artifactSumsFile)); err != nil {
+			t.Errorf("Expected %s in the artifact directory of build %d. Error: %s", artifactSumsFile, i, err)
+		}
+	}
+	var caches []string
+	for _, name := range be.defined() {
+		if strings.HasPrefix(name, cachePrefix) {
+			caches = append(caches, name)
+		}
+	}
+	// the shared state and the state after the last RUN of every build
+	if len(caches) != 1+len(loggers) {
+		t.Errorf("Expected %d cache containers, found %v", 1+len(loggers), caches)
+	}
+}
+
+func Test_ClaimBuild(t *testing.T) {
+	release, err := claimBuild("nut-test-claim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("nut-test-claim")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BuildWithOptions(BuildOptions{}); err == nil || !strings.Contains(err.Error(), "already being built") {
+		t.Errorf("Expected a second build of the same name to fail, found %v", err)
+	}
+	if _, err := b.BuildWithOptions(BuildOptions{DryRun: true}); err != nil {
+		t.Errorf("Expected dry runs to ignore builds in progress, found %v", err)
+	}
+	release()
+	release, err = claimBuild("nut-test-claim")
+	if err != nil {
+		t.Fatalf("Expected the name to be released, found %v", err)
+	}
+	release()
+}
+
+func Test_KeyedMutex(t *testing.T) {
+	var m keyedMutex
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			unlock := m.lock(key)
+			defer unlock()
+			counts[key]++
+		}(fmt.Sprintf("key-%d", i%3))
+	}
+	wg.Wait()
+	if counts["key-0"] != 17 || counts["key-1"] != 17 || counts["key-2"] != 16 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+	if len(m.locks) != 0 {
+		t.Errorf("Expected unused locks to be removed, found %d", len(m.locks))
+	}
+}
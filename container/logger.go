@@ -0,0 +1,79 @@
+package container
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Logger receives the log messages of builds, containers and images. Both
+// *logrus.Logger and *logrus.Entry implement it, other logging libraries can be
+// adapted with a few methods
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// loggerOrDefault returns l, or the standard logger of logrus if l is nil
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return log.StandardLogger()
+	}
+	return l
+}
+
+// debugEnabled reports whether l logs debug messages. Loggers other than those
+// of logrus are assumed to do so
+func debugEnabled(l Logger) bool {
+	switch l := l.(type) {
+	case *log.Logger:
+		return l.IsLevelEnabled(log.DebugLevel)
+	case *log.Entry:
+		return l.Logger.IsLevelEnabled(log.DebugLevel)
+	}
+	return true
+}
+
+// SetLogger makes the container log to l, the standard logger of logrus if l is
+// nil
+func (c *Container) SetLogger(l Logger) {
+	c.log = l
+}
+
+func (c *Container) logger() Logger {
+	return loggerOrDefault(c.log)
+}
+
+// SetLogger makes the builder log to l, the standard logger of logrus if l is
+// nil. BuildOptions.Logger overrides it for a build
+func (b *Builder) SetLogger(l Logger) {
+	b.log = l
+}
+
+func (b *Builder) logger() Logger {
+	if b.opts.Logger != nil {
+		return b.opts.Logger
+	}
+	return loggerOrDefault(b.log)
+}
+
+// SetLogger makes the image log to l, the standard logger of logrus if l is nil
+func (i *Image) SetLogger(l Logger) {
+	i.log = l
+}
+
+func (i *Image) logger() Logger {
+	return loggerOrDefault(i.log)
+}
+
+// SetLogger makes the members of the group log to l, the standard logger of
+// logrus if l is nil
+func (g *Group) SetLogger(l Logger) {
+	g.log = l
+}
+
+// SetLogger makes the member and its build log to l, the standard logger of
+// logrus if l is nil
+func (m *Member) SetLogger(l Logger) {
+	m.log = l
+}
@@ -0,0 +1,95 @@
+package container
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureLogger records the messages it receives, prefixed by their level
+type captureLogger struct {
+	messages []string
+}
+
+func (l *captureLogger) logf(level, format string, args ...interface{}) {
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.logf("debug", format, args...) }
+func (l *captureLogger) Infof(format string, args ...interface{})  { l.logf("info", format, args...) }
+func (l *captureLogger) Warnf(format string, args ...interface{})  { l.logf("warn", format, args...) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.logf("error", format, args...) }
+
+func (l *captureLogger) contains(message string) bool {
+	for _, m := range l.messages {
+		if m == message {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_BuildLogger(t *testing.T) {
+	var _ Logger = log.StandardLogger()
+	var _ Logger = log.NewEntry(log.StandardLogger())
+
+	b := NewBuilder("nut-test-logger")
+	set := &captureLogger{}
+	b.SetLogger(set)
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nenv A=$UNSET\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !set.contains("debug Normalized instruction 'env' to 'ENV'") {
+		t.Errorf("Expected the logger set on the builder to receive parse messages, found %q", set.messages)
+	}
+	opts := &captureLogger{}
+	if _, err := b.BuildWithOptions(BuildOptions{DryRun: true, Logger: opts}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "warn Variable UNSET is not set, substituting empty string in statement 'env A=$UNSET'"
+	if !opts.contains(expected) {
+		t.Errorf("Expected BuildOptions.Logger to receive %q, found %q", expected, opts.messages)
+	}
+	if set.contains(expected) {
+		t.Error("Expected BuildOptions.Logger to replace the logger set on the builder")
+	}
+}
+
+func Test_ParentManifestLogger(t *testing.T) {
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	parent := filepath.Join(be.dir, "nut-test-base", "manifest.yml")
+	if err := ioutil.WriteFile(parent, []byte("env: [A=1]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("nut-test-parent-logger")
+	b.backend = be
+	if err := b.ParseReader(strings.NewReader("FROM nut-test-base\n")); err != nil {
+		t.Fatal(err)
+	}
+	l := &captureLogger{}
+	if _, err := b.BuildWithOptions(BuildOptions{NoCache: true, SkipNetworkWait: true, Logger: l}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range l.messages {
+		if strings.HasPrefix(m, "info Migrated manifest "+parent) {
+			return
+		}
+	}
+	t.Errorf("Expected BuildOptions.Logger to receive the migration of the parent manifest, found %q", l.messages)
+}
+
+func Test_MemberLogger(t *testing.T) {
+	l := &captureLogger{}
+	g := Group{Members: map[string]Member{"web": {Image: "nut-test-missing"}}}
+	g.SetLogger(l)
+	if err := g.Create(); err == nil {
+		t.Fatal("Expected a missing image to fail")
+	}
+	if !l.contains("debug Creating container from image nut-test-missing") {
+		t.Errorf("Expected the logger of the group to receive member messages, found %q", l.messages)
+	}
+}
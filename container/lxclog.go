@@ -0,0 +1,132 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultLXCLogLevel is the level of the lxc log of build containers if
+// BuildOptions.LXCLogLevel is not set
+const DefaultLXCLogLevel = "warn"
+
+// lxcLogLevels are the log levels of lxc, in the order of their numeric values
+var lxcLogLevels = []string{"trace", "debug", "info", "notice", "warn", "error", "crit", "alert", "fatal"}
+
+// Files in the container directory capturing the console output and the lxc log
+// of build containers
+const (
+	consoleLogFile = "console.log"
+	lxcLogFile     = "lxc.log"
+)
+
+// logTailLines is the number of lines of each log attached to failures
+var logTailLines = 20
+
+// parseLXCLogLevel returns the numeric value of the lxc log level s,
+// DefaultLXCLogLevel if s is empty
+func parseLXCLogLevel(s string) (int, error) {
+	if s == "" {
+		s = DefaultLXCLogLevel
+	}
+	for i, level := range lxcLogLevels {
+		if strings.ToLower(s) == level {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid lxc log level '%s'. Expected one of %s", s, strings.Join(lxcLogLevels, ", "))
+}
+
+// logConfigKeys returns the configuration keys of the logs of containers
+func logConfigKeys() []string {
+	return []string{"lxc.console.logfile", configKey("lxc.logfile"), configKey("lxc.loglevel")}
+}
+
+// captureLogs configures the container to write its console output and its lxc
+// log at level to files in its directory, once it is (re)started
+func (c *Container) captureLogs(level string) error {
+	n, err := parseLXCLogLevel(level)
+	if err != nil {
+		return err
+	}
+	values := []string{filepath.Join(c.dir(), consoleLogFile), filepath.Join(c.dir(), lxcLogFile), strconv.Itoa(n)}
+	for i, key := range logConfigKeys() {
+		if err := c.ct.SetConfigItem(key, values[i]); err != nil {
+			return fmt.Errorf("Failed to set %s to %s. Error: %s", key, values[i], err)
+		}
+	}
+	return c.ct.SaveConfigFile(c.ct.ConfigFileName())
+}
+
+// clearLogs removes the log configuration set by captureLogs from the container,
+// and the log files if remove is set
+func (c *Container) clearLogs(remove bool) error {
+	for _, key := range logConfigKeys() {
+		if v := c.ct.ConfigItem(key); len(v) == 0 || v[0] == "" {
+			continue
+		}
+		if err := c.ct.ClearConfigItem(key); err != nil {
+			return err
+		}
+	}
+	if remove {
+		for _, f := range []string{consoleLogFile, lxcLogFile} {
+			if err := os.Remove(filepath.Join(c.dir(), f)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return c.ct.SaveConfigFile(c.ct.ConfigFileName())
+}
+
+// logTail returns the last lines of the console output and the lxc log of the
+// container
+func (c *Container) logTail() (console, lxcLog []string) {
+	return tailLines(filepath.Join(c.dir(), consoleLogFile), logTailLines), tailLines(filepath.Join(c.dir(), lxcLogFile), logTailLines)
+}
+
+// tailLines returns the last n lines of the file path, none if it can not be read
+func tailLines(path string, n int) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
+
+// containerLog emits the tails of the logs of the current build container for
+// the failed statement at index, and returns them for the statement's error
+func (b *Builder) containerLog(index int) string {
+	c := b.ct
+	if b.unregistered != nil {
+		c = b.unregistered
+	}
+	if c == nil || c.ct == nil || b.opts.DryRun {
+		return ""
+	}
+	console, lxcLog := c.logTail()
+	if len(console) == 0 && len(lxcLog) == 0 {
+		return ""
+	}
+	b.emit(ContainerLog{Index: index, Console: console, LXC: lxcLog})
+	var sections []string
+	if len(console) > 0 {
+		sections = append(sections, "Console of "+c.ct.Name()+":\n"+strings.Join(console, "\n"))
+	}
+	if len(lxcLog) > 0 {
+		sections = append(sections, "lxc log of "+c.ct.Name()+":\n"+strings.Join(lxcLog, "\n"))
+	}
+	return strings.Join(sections, "\n")
+}
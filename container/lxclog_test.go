@@ -0,0 +1,85 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ParseLXCLogLevel(t *testing.T) {
+	for s, expected := range map[string]int{"": 4, "warn": 4, "TRACE": 0, "debug": 1, "fatal": 8} {
+		if n, err := parseLXCLogLevel(s); err != nil || n != expected {
+			t.Errorf("Expected %d for %q, found %d (%v)", expected, s, n, err)
+		}
+	}
+	if _, err := parseLXCLogLevel("verbose"); err == nil {
+		t.Error("Expected error for unknown log level")
+	}
+}
+
+func Test_TailLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, consoleLogFile)
+	var content []string
+	for i := 1; i <= 30; i++ {
+		content = append(content, fmt.Sprintf("line %d", i))
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(content, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if lines := tailLines(path, 3); !reflect.DeepEqual(lines, []string{"line 28", "line 29", "line 30"}) {
+		t.Errorf("Unexpected tail %v", lines)
+	}
+	if lines := tailLines(path, 50); len(lines) != 30 {
+		t.Errorf("Expected all 30 lines, found %d", len(lines))
+	}
+	if lines := tailLines(filepath.Join(dir, "missing"), 3); lines != nil {
+		t.Errorf("Expected no lines of a missing log, found %v", lines)
+	}
+}
+
+func Test_StatementErrorLog(t *testing.T) {
+	err := &StatementError{Line: 3, Statement: "RUN make", Err: errors.New("Exit code: 137")}
+	if strings.Contains(err.Error(), "\n") {
+		t.Errorf("Expected single line error without log, found %q", err.Error())
+	}
+	err.Log = "Console of nut-test:\nOut of memory: Killed process 42 (make)"
+	if !strings.HasSuffix(err.Error(), "\n"+err.Log) {
+		t.Errorf("Expected log to be appended, found %q", err.Error())
+	}
+}
+
+func Test_ContainerLogLXC(t *testing.T) {
+	b := NewBuilder("nut-test-container-log")
+	if err := b.ParseReader(strings.NewReader("FROM trusty\nRUN echo failing >/dev/console; exit 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan BuildEvent, 100)
+	_, err := b.BuildWithOptions(BuildOptions{NoCache: true, Cleanup: CleanupAlways, LXCLogLevel: "info", Events: events})
+	close(events)
+	var stErr *StatementError
+	if !errors.As(err, &stErr) {
+		t.Fatalf("Expected statement error, found %v", err)
+	}
+	if stErr.Log == "" {
+		t.Error("Expected the container log to be attached to the error")
+	}
+	found := false
+	for event := range events {
+		if log, ok := event.(ContainerLog); ok && log.Index == 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected container log event for the failed statement")
+	}
+}
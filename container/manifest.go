@@ -1,30 +1,300 @@
 package container
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"gopkg.in/lxc/go-lxc.v2"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// Version is the nut release recorded in the manifests of built containers
+const Version = "0.2"
+
+// manifestVersion is the version of the manifest schema. Manifests without a
+// version were written before the schema was versioned
+const manifestVersion = 1
+
 // Manifest represents metadata about a container
 type Manifest struct {
-	Labels       map[string]string
-	Maintainers  []string
-	ExposedPorts []uint64
-	EntryPoint   []string
-	Env          []string
-	User         string
-	WorkDir      string
+	// SchemaVersion is the manifest schema version the manifest was written with
+	SchemaVersion int               `yaml:"version,omitempty" json:"version,omitempty"`
+	Labels        map[string]string `yaml:"labels" json:"labels"`
+	Maintainers   []string          `yaml:"maintainers" json:"maintainers"`
+	ExposedPorts  []ExposedPort     `yaml:"exposedports" json:"exposedports"`
+	EntryPoint    []string          `yaml:"entrypoint" json:"entrypoint"`
+	// Cmd holds the default arguments of EntryPoint, or the default command if no
+	// entry point is set
+	Cmd     []string `yaml:"cmd" json:"cmd"`
+	Env     []string `yaml:"env" json:"env"`
+	User    string   `yaml:"user" json:"user"`
+	WorkDir string   `yaml:"workdir" json:"workdir"`
+	// OnBuild holds trigger instructions executed when a child container is
+	// built from this one
+	OnBuild []string `yaml:"onbuild" json:"onbuild"`
+	// Volumes lists the mount points declared via VOLUME
+	Volumes     []string     `yaml:"volumes,omitempty" json:"volumes,omitempty"`
+	Healthcheck *Healthcheck `yaml:"healthcheck,omitempty" json:"healthcheck,omitempty"`
+	StopSignal  string       `yaml:"stop_signal,omitempty" json:"stop_signal,omitempty"`
+	// Parent, NutVersion and BuildHost record the provenance of the container.
+	// Parent is the container the last stage was built from
+	Parent     string `yaml:"parent,omitempty" json:"parent,omitempty"`
+	NutVersion string `yaml:"nut_version,omitempty" json:"nut_version,omitempty"`
+	BuildHost  string `yaml:"build_host,omitempty" json:"build_host,omitempty"`
+	// Created is the time the build completed in RFC3339 format. Architecture and
+	// OS name the platform of the rootfs, using the names of the OCI image spec
+	Created      string `yaml:"created,omitempty" json:"created,omitempty"`
+	Architecture string `yaml:"architecture,omitempty" json:"architecture,omitempty"`
+	OS           string `yaml:"os,omitempty" json:"os,omitempty"`
+	// History lists the statements executed to build the container, starting
+	// with those of its parents
+	History []HistoryEntry `yaml:"history,omitempty" json:"history,omitempty"`
+}
+
+// HistoryEntry records the execution of a statement
+type HistoryEntry struct {
+	Statement string        `yaml:"statement" json:"statement"`
+	Created   time.Time     `yaml:"created" json:"created"`
+	Duration  time.Duration `yaml:"duration" json:"duration"`
+	// CacheHit is set for statements restored from the build cache
+	CacheHit bool `yaml:"cache_hit,omitempty" json:"cache_hit,omitempty"`
+}
+
+// Manifest formats written by builds, see BuildOptions.ManifestFormat
+const (
+	ManifestYAML = "yaml"
+	ManifestJSON = "json"
+	ManifestBoth = "both"
+)
+
+// Command returns the command started by the container, the entry point
+// followed by the default arguments of Cmd
+func (m *Manifest) Command() []string {
+	command := make([]string, 0, len(m.EntryPoint)+len(m.Cmd))
+	command = append(command, m.EntryPoint...)
+	return append(command, m.Cmd...)
 }
 
-// Load loads manifest details from an yaml file
+// stamped returns a copy of the manifest carrying the current schema version
+func (m *Manifest) stamped() *Manifest {
+	stamped := *m
+	stamped.SchemaVersion = manifestVersion
+	return &stamped
+}
+
+// Merge combines the manifest with the one of its parent. Labels and environment
+// variables of the manifest override those of the parent by key, keeping the
+// parent's order, exposed ports and volumes are united and maintainers are
+// appended without duplicates. The command, user, working directory, health
+// check and stop signal are inherited unless the manifest sets them
+func (m *Manifest) Merge(parent Manifest) {
+	if len(parent.Labels) > 0 {
+		labels := make(map[string]string, len(parent.Labels)+len(m.Labels))
+		for k, v := range parent.Labels {
+			labels[k] = v
+		}
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		m.Labels = labels
+	}
+	m.Env = mergeEnv(parent.Env, m.Env)
+	m.ExposedPorts = unitePorts(parent.ExposedPorts, m.ExposedPorts)
+	m.Volumes = appendUnique(append([]string(nil), parent.Volumes...), m.Volumes...)
+	m.Maintainers = appendUnique(append([]string(nil), parent.Maintainers...), m.Maintainers...)
+	if m.EntryPoint == nil && m.Cmd == nil {
+		m.EntryPoint, m.Cmd = parent.EntryPoint, parent.Cmd
+	}
+	if m.User == "" {
+		m.User = parent.User
+	}
+	if m.WorkDir == "" {
+		m.WorkDir = parent.WorkDir
+	}
+	if m.Healthcheck == nil {
+		m.Healthcheck = parent.Healthcheck
+	}
+	if m.StopSignal == "" {
+		m.StopSignal = parent.StopSignal
+	}
+}
+
+// appendUnique appends the values to list that it does not contain yet
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			found = found || existing == v
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Names of the manifest files at the root of container images. Images always
+// hold ArchiveManifest, ArchiveManifestJSON if the container was built with json
+// manifests
+const (
+	ArchiveManifest     = "manifest.yml"
+	ArchiveManifestJSON = "manifest.json"
+)
+
+// archiveManifestRanks orders the manifests found in archives by precedence.
+// Manifests at the archive root rank before those one directory deep
+var archiveManifestRanks = map[string]int{ArchiveManifest: 0, ArchiveManifestJSON: 1}
+
+// Load loads the manifest of the container name, from manifest.yml or, if the
+// container has none, manifest.json
 func (m *Manifest) Load(name string) error {
-	lxcdir := lxc.GlobalConfigItem("lxc.lxcpath")
-	manifestPath := filepath.Join(lxcdir, name, "manifest.yml")
-	data, err := ioutil.ReadFile(manifestPath)
+	return m.load(nil, name)
+}
+
+// load is Load logging to l
+func (m *Manifest) load(l Logger, name string) error {
+	return m.loadDir(l, filepath.Join(lxc.GlobalConfigItem("lxc.lxcpath"), name))
+}
+
+// loadDir loads the manifest of the container directory dir
+func (m *Manifest) loadDir(l Logger, dir string) error {
+	manifestPath := filepath.Join(dir, "manifest.yml")
+	if !fileExists(manifestPath) {
+		if jsonPath := filepath.Join(dir, "manifest.json"); fileExists(jsonPath) {
+			manifestPath = jsonPath
+		}
+	}
+	return m.loadFile(l, manifestPath)
+}
+
+// LoadFile loads the manifest from a yaml or json file. The format is detected
+// by the file name extension, or by the content for other names
+func (m *Manifest) LoadFile(path string) error {
+	return m.loadFile(nil, path)
+}
+
+// loadFile is LoadFile logging to l
+func (m *Manifest) loadFile(l Logger, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	isJSON := ext == ".json" || (ext != ".yml" && ext != ".yaml" && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")))
+	return m.decode(l, data, isJSON, path)
+}
+
+// decode unmarshals the yaml or json manifest data, read from the file name, and
+// migrates it to the current schema version
+func (m *Manifest) decode(l Logger, data []byte, isJSON bool, name string) error {
+	var err error
+	if isJSON {
+		err = json.Unmarshal(data, m)
+	} else {
+		err = yaml.Unmarshal(data, m)
+	}
+	if err == nil {
+		err = m.migrate(l, name)
+	}
+	if err != nil {
+		return &InvalidManifestError{Path: name, Err: err}
+	}
+	return nil
+}
+
+// migrate upgrades a manifest written by an older nut to the current schema
+// version. Manifests of newer versions are refused, as fields they rely on
+// would be lost
+func (m *Manifest) migrate(l Logger, name string) error {
+	if m.SchemaVersion > manifestVersion {
+		return fmt.Errorf("Manifest version %d was written by a newer nut, this one supports up to version %d", m.SchemaVersion, manifestVersion)
+	}
+	if m.SchemaVersion == manifestVersion {
+		return nil
+	}
+	var migrated []string
+	// version 0 manifests predate versioning
+	if m.Labels == nil {
+		m.Labels = make(map[string]string)
+		migrated = append(migrated, "initialized labels")
+	}
+	if len(m.ExposedPorts) > 0 {
+		migrated = append(migrated, "converted exposed port numbers to port/protocol")
+	}
+	if len(migrated) > 0 {
+		loggerOrDefault(l).Infof("Migrated manifest %s from version %d to %d: %s", name, m.SchemaVersion, manifestVersion, strings.Join(migrated, ", "))
+	}
+	m.SchemaVersion = manifestVersion
+	return nil
+}
+
+// LoadFromArchive loads the manifest from a container archive, as created by
+// Image.Create, without extracting it. The manifest at the archive root is
+// authoritative, manifest.yml before manifest.json. Archives of other tools are
+// searched for a manifest one directory deep. A MissingManifestError is returned
+// for archives without manifest
+func (m *Manifest) LoadFromArchive(file string) error {
+	a, err := openTar(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read archive %s. Error: %s", file, err)
+	}
+	if a == nil {
+		return fmt.Errorf("Failed to read archive %s. Error: Not a tar archive", file)
+	}
+	defer a.Close()
+	var name string
+	var data []byte
+	rank := 2 * len(archiveManifestRanks)
+	tr := tar.NewReader(a)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read archive %s. Error: %s", file, err)
+		}
+		entry := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(entry)
+		if hdr.Typeflag != tar.TypeReg || strings.Count(dir, "/") > 1 || dir == "rootfs/" {
+			continue
+		}
+		r, ok := archiveManifestRanks[base]
+		if !ok {
+			continue
+		}
+		if dir != "" {
+			r += 2
+		}
+		if r >= rank {
+			continue
+		}
+		if data, err = ioutil.ReadAll(tr); err != nil {
+			return fmt.Errorf("Failed to read archive %s. Error: %s", file, err)
+		}
+		name, rank = entry, r
+		if rank == 0 {
+			break
+		}
+	}
+	if name == "" {
+		return &MissingManifestError{Archive: file}
+	}
+	return m.decode(nil, data, path.Ext(name) == ".json", file+":"+name)
+}
+
+// SaveJSON writes the manifest as json to path
+func (m *Manifest) SaveJSON(path string) error {
+	d, err := json.MarshalIndent(m.stamped(), "", "  ")
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(data, &m)
+	return ioutil.WriteFile(path, append(d, '\n'), 0644)
 }
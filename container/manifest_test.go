@@ -0,0 +1,407 @@
+package container
+
+import (
+	"archive/tar"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ManifestEntryPointRoundTrip(t *testing.T) {
+	entryPoint, err := parseCommand(`["/usr/bin/myapp", "--flag", "value with spaces"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Manifest{EntryPoint: entryPoint}
+	d, err := yaml.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Manifest
+	if err := yaml.Unmarshal(d, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/usr/bin/myapp", "--flag", "value with spaces"}
+	if !reflect.DeepEqual(loaded.EntryPoint, expected) {
+		t.Fatalf("Expected: %#v, found: %#v", expected, loaded.EntryPoint)
+	}
+}
+
+func Test_ManifestCommand(t *testing.T) {
+	var m Manifest
+	if err := yaml.Unmarshal([]byte("entrypoint:\n- /usr/bin/myapp\n"), &m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Command(), []string{"/usr/bin/myapp"}) || m.Cmd != nil {
+		t.Errorf("Expected manifests without cmd to run the entry point, found %#v", m.Command())
+	}
+	m.Cmd = []string{"--port", "80"}
+	d, err := yaml.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Manifest
+	if err := yaml.Unmarshal(d, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/usr/bin/myapp", "--port", "80"}
+	if !reflect.DeepEqual(loaded.Command(), expected) {
+		t.Errorf("Expected: %#v, found: %#v", expected, loaded.Command())
+	}
+}
+
+func Test_ManifestHistory(t *testing.T) {
+	b := NewBuilder("nut-test-history")
+	b.ct = &Container{Manifest: Manifest{History: []HistoryEntry{{Statement: "FROM ubuntu", CacheHit: true}}}}
+	started := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	b.recordHistory(NewStatement("RUN make install", 4), started, 90*time.Second)
+	b.recordProvenance(b.ct)
+	m := b.ct.Manifest
+	if len(m.History) != 2 || m.NutVersion != Version || m.BuildHost == "" {
+		t.Fatalf("Unexpected provenance: %+v", m)
+	}
+	d, err := yaml.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Manifest
+	if err := yaml.Unmarshal(d, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	entry := loaded.History[1]
+	if entry.Statement != "RUN make install" || !entry.Created.Equal(started) || entry.Duration != 90*time.Second || entry.CacheHit {
+		t.Errorf("Unexpected history entry after round trip: %+v", entry)
+	}
+	if !loaded.History[0].CacheHit {
+		t.Error("Expected inherited history to be preserved")
+	}
+	b.opts.OmitHistory = true
+	b.recordHistory(NewStatement("RUN make test", 5), started, time.Second)
+	b.recordProvenance(b.ct)
+	if m := b.ct.Manifest; m.History != nil || m.NutVersion != "" || m.BuildHost != "" {
+		t.Errorf("Expected provenance to be omitted, found %+v", m)
+	}
+}
+
+func Test_ManifestPlatform(t *testing.T) {
+	b := NewBuilder("nut-test-platform")
+	c := &Container{}
+	if err := yaml.Unmarshal([]byte("entrypoint:\n- /usr/bin/myapp\n"), &c.Manifest); err != nil {
+		t.Fatal(err)
+	}
+	b.recordPlatform(c, time.Date(2016, 3, 1, 13, 0, 0, 0, time.FixedZone("CET", 3600)))
+	if c.Manifest.Created != "2016-03-01T12:00:00Z" || c.Manifest.Architecture != runtime.GOARCH || c.Manifest.OS != "linux" {
+		t.Errorf("Unexpected platform: %s %s/%s", c.Manifest.Created, c.Manifest.OS, c.Manifest.Architecture)
+	}
+	b.opts = BuildOptions{Architecture: "arm64", OS: "freebsd"}
+	b.recordPlatform(c, time.Now())
+	d, err := yaml.Marshal(&c.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Manifest
+	if err := yaml.Unmarshal(d, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Architecture != "arm64" || loaded.OS != "freebsd" || loaded.Created != c.Manifest.Created {
+		t.Errorf("Unexpected platform after round trip: %s %s/%s", loaded.Created, loaded.OS, loaded.Architecture)
+	}
+}
+
+func Test_ManifestJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := Manifest{
+		Labels:       map[string]string{"version": "1.0"},
+		ExposedPorts: []ExposedPort{{Port: 53, Protocol: "udp"}},
+		EntryPoint:   []string{"/srv/app"},
+		Healthcheck:  &Healthcheck{Test: []string{"true"}, Interval: 30 * time.Second},
+		StopSignal:   "SIGTERM",
+		History:      []HistoryEntry{{Statement: "FROM ubuntu", Created: time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)}},
+	}
+	jsonPath := filepath.Join(dir, "manifest.json")
+	if err := m.SaveJSON(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"exposedports": [`, `"53/udp"`, `"stop_signal": "SIGTERM"`, `"start_period": 0`} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("Expected %s in json manifest:\n%s", key, data)
+		}
+	}
+	// the format of files without extension is detected from the content
+	sniffed := filepath.Join(dir, "manifest")
+	if err := ioutil.WriteFile(sniffed, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := m
+	expected.SchemaVersion = manifestVersion
+	for _, path := range []string{jsonPath, sniffed} {
+		var loaded Manifest
+		if err := loaded.LoadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, expected) {
+			t.Errorf("Expected %+v from %s, found %+v", expected, path, loaded)
+		}
+	}
+}
+
+func Test_LoadParentManifest(t *testing.T) {
+	b := NewBuilder("nut-test-parent-manifest")
+	var m Manifest
+	if err := b.loadParentManifest(&m, "nut-test-missing-parent"); err != nil {
+		t.Errorf("Expected missing parent manifest to be accepted. Error: %s", err)
+	}
+	b.opts.RequireParentManifest = true
+	if err := b.loadParentManifest(&m, "nut-test-missing-parent"); err == nil || !strings.Contains(err.Error(), filepath.Join("nut-test-missing-parent", "manifest.yml")) {
+		t.Errorf("Expected error naming the manifest path, found %v", err)
+	}
+	dir, err := ioutil.TempDir("", "nut-test-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	corrupt := filepath.Join(dir, "manifest.yml")
+	if err := ioutil.WriteFile(corrupt, []byte("env: [PATH=/bin\nuser: {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = m.LoadFile(corrupt)
+	var invalid *InvalidManifestError
+	if !errors.As(err, &invalid) || invalid.Path != corrupt {
+		t.Errorf("Expected invalid manifest error for %s, found %v", corrupt, err)
+	}
+}
+
+func Test_ManifestMerge(t *testing.T) {
+	http := ExposedPort{Port: 80, Protocol: "tcp"}
+	dns := ExposedPort{Port: 53, Protocol: "udp"}
+	parent := Manifest{
+		Labels:       map[string]string{"team": "core", "version": "1.0"},
+		Env:          []string{"PATH=/bin", "LANG=C"},
+		ExposedPorts: []ExposedPort{http},
+		Volumes:      []string{"/var/log"},
+		Maintainers:  []string{"ops@example.com"},
+		EntryPoint:   []string{"/sbin/init"},
+		User:         "app",
+		WorkDir:      "/srv",
+	}
+	cases := []struct {
+		name     string
+		child    Manifest
+		expected Manifest
+	}{
+		{
+			name:  "empty child inherits everything",
+			child: Manifest{},
+			expected: Manifest{
+				Labels:       map[string]string{"team": "core", "version": "1.0"},
+				Env:          []string{"PATH=/bin", "LANG=C"},
+				ExposedPorts: []ExposedPort{http},
+				Volumes:      []string{"/var/log"},
+				Maintainers:  []string{"ops@example.com"},
+				EntryPoint:   []string{"/sbin/init"},
+				User:         "app",
+				WorkDir:      "/srv",
+			},
+		},
+		{
+			name: "child overrides and extends",
+			child: Manifest{
+				Labels:       map[string]string{"version": "2.0"},
+				Env:          []string{"LANG=C.UTF-8", "PATH=/usr/bin", "HOME=/srv"},
+				ExposedPorts: []ExposedPort{dns, http},
+				Volumes:      []string{"/var/lib/app", "/var/log"},
+				Maintainers:  []string{"ops@example.com", "dev@example.com"},
+				Cmd:          []string{"/srv/app"},
+				User:         "root",
+			},
+			expected: Manifest{
+				Labels:       map[string]string{"team": "core", "version": "2.0"},
+				Env:          []string{"PATH=/usr/bin", "LANG=C.UTF-8", "HOME=/srv"},
+				ExposedPorts: []ExposedPort{http, dns},
+				Volumes:      []string{"/var/log", "/var/lib/app"},
+				Maintainers:  []string{"ops@example.com", "dev@example.com"},
+				Cmd:          []string{"/srv/app"},
+				User:         "root",
+				WorkDir:      "/srv",
+			},
+		},
+	}
+	for _, c := range cases {
+		merged := c.child
+		merged.Merge(parent)
+		if !reflect.DeepEqual(merged, c.expected) {
+			t.Errorf("%s: expected %+v, found %+v", c.name, c.expected, merged)
+		}
+	}
+	if parent.Labels["version"] != "1.0" || len(parent.Volumes) != 1 {
+		t.Errorf("Expected the parent manifest to be unchanged, found %+v", parent)
+	}
+}
+
+func Test_RedeclaredManifestFields(t *testing.T) {
+	spec := `FROM ubuntu
+MAINTAINER ops@example.com
+EXPOSE 80 53/udp
+ENV LANG=C PATH=/bin
+LABEL version=1.0
+VOLUME /var/log
+MAINTAINER ops@example.com
+EXPOSE 80/tcp
+ENV LANG=C.UTF-8
+LABEL version=2.0
+VOLUME ["/var/log", "/var/lib/app"]
+`
+	b := NewBuilder("nut-test-redeclare")
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := b.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := steps[len(steps)-1].Manifest
+	expected := Manifest{
+		Labels:       map[string]string{"version": "2.0"},
+		Maintainers:  []string{"ops@example.com"},
+		ExposedPorts: []ExposedPort{{Port: 80, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}},
+		Env:          []string{"LANG=C.UTF-8", "PATH=/bin"},
+		Volumes:      []string{"/var/log", "/var/lib/app"},
+	}
+	if !reflect.DeepEqual(m.Labels, expected.Labels) || !reflect.DeepEqual(m.Maintainers, expected.Maintainers) ||
+		!reflect.DeepEqual(m.ExposedPorts, expected.ExposedPorts) || !reflect.DeepEqual(m.Env, expected.Env) ||
+		!reflect.DeepEqual(m.Volumes, expected.Volumes) {
+		t.Errorf("Expected %+v, found %+v", expected, m)
+	}
+}
+
+func Test_ManifestLoadFromArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manifest := "entrypoint:\n- /srv/app\nuser: app\n"
+	archives := map[string][]archiveEntry{
+		"root.tar.gz": {
+			{name: "./", typeflag: tar.TypeDir},
+			{name: "./rootfs/etc/manifest.yml", typeflag: tar.TypeReg, body: "user: root\n"},
+			{name: "./manifest.yml", typeflag: tar.TypeReg, body: manifest},
+			{name: "./config", typeflag: tar.TypeReg, body: "lxc.rootfs = /var/lib/lxc/app/rootfs"},
+		},
+		"nested.tar": {
+			{name: "app/config", typeflag: tar.TypeReg, body: "lxc.rootfs = /var/lib/lxc/app/rootfs"},
+			{name: "app/manifest.yml", typeflag: tar.TypeReg, body: manifest},
+		},
+		"json.tar": {
+			{name: "manifest.json", typeflag: tar.TypeReg, body: `{"entrypoint": ["/srv/app"], "user": "app"}`},
+		},
+		"authoritative.tar": {
+			{name: "backup/manifest.yml", typeflag: tar.TypeReg, body: "user: backup\n"},
+			{name: "./manifest.json", typeflag: tar.TypeReg, body: `{"entrypoint": ["/srv/app"], "user": "app"}`},
+			{name: "other/manifest.yml", typeflag: tar.TypeReg, body: "user: other\n"},
+		},
+	}
+	for name, entries := range archives {
+		file := filepath.Join(dir, name)
+		writeArchive(t, file, strings.HasSuffix(name, ".gz"), entries)
+		var m Manifest
+		if err := m.LoadFromArchive(file); err != nil {
+			t.Errorf("Failed to load manifest from %s. Error: %s", name, err)
+			continue
+		}
+		if m.User != "app" || !reflect.DeepEqual(m.EntryPoint, []string{"/srv/app"}) {
+			t.Errorf("Unexpected manifest from %s: %+v", name, m)
+		}
+	}
+	file := filepath.Join(dir, "empty.tar")
+	writeArchive(t, file, false, []archiveEntry{{name: "rootfs/manifest.yml", typeflag: tar.TypeReg, body: manifest}})
+	var m Manifest
+	var missing *MissingManifestError
+	if err := m.LoadFromArchive(file); !errors.As(err, &missing) {
+		t.Errorf("Expected missing manifest error, found %v", err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.tar.gz")
+	if err := ioutil.WriteFile(corrupt, []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{corrupt, filepath.Join(dir, "missing.tar")} {
+		if err := m.LoadFromArchive(file); err == nil || errors.As(err, &missing) {
+			t.Errorf("Expected read error for %s, found %v", file, err)
+		}
+	}
+}
+
+func Test_LabelValues(t *testing.T) {
+	spec := "FROM ubuntu\nLABEL org.opencontainers.image.source=https://git.example.com/a=b \"description=a label = with spaces\" empty=\n"
+	b := NewBuilder("nut-test-labels")
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := b.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"org.opencontainers.image.source": "https://git.example.com/a=b",
+		"description":                     "a label = with spaces",
+		"empty":                           "",
+	}
+	if labels := steps[1].Manifest.Labels; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected labels %v, found %v", expected, labels)
+	}
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nLABEL broken\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.DryRun(BuildOptions{}); err == nil {
+		t.Error("Expected error for LABEL without value")
+	}
+}
+
+func Test_ManifestMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	legacy := filepath.Join(dir, "legacy.yml")
+	if err := ioutil.WriteFile(legacy, []byte("exposedports:\n- 80\n- 443\nentrypoint:\n- /srv/app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	if err := m.LoadFile(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if m.SchemaVersion != manifestVersion || m.Labels == nil || !reflect.DeepEqual(portStrings(m.ExposedPorts), []string{"80/tcp", "443/tcp"}) {
+		t.Errorf("Unexpected migrated manifest %+v", m)
+	}
+	current := filepath.Join(dir, "current.json")
+	if err := (&Manifest{}).SaveJSON(current); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(current); err != nil || !strings.Contains(string(data), `"version": 1`) {
+		t.Errorf("Expected written manifest to carry the schema version, found %s (%v)", data, err)
+	}
+	future := filepath.Join(dir, "future.yml")
+	if err := ioutil.WriteFile(future, []byte("version: 99\nuser: app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var invalid *InvalidManifestError
+	if err := m.LoadFile(future); !errors.As(err, &invalid) || !strings.Contains(err.Error(), "newer nut") {
+		t.Errorf("Expected error for manifest of a newer nut, found %v", err)
+	}
+}
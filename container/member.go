@@ -2,7 +2,6 @@ package container
 
 import (
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"path/filepath"
 	"strings"
 )
@@ -19,14 +18,17 @@ type Member struct {
 	Ports         []string
 	Image         string
 	ct            *Container
+	log           Logger
 }
 
 // Create creates a container from member specification
 func (m *Member) Create(name string) error {
+	l := loggerOrDefault(m.log)
 	b := NewBuilder(name)
+	b.SetLogger(l)
 	b.Volumes = m.Volumes
 	if m.Image != "" {
-		log.Debugln("Creating container from image", m.Image)
+		l.Debugf("Creating container from image %s", m.Image)
 		c, err := b.CreateContainer(m.Image)
 		if err != nil {
 			return err
@@ -46,7 +48,7 @@ func (m *Member) Create(name string) error {
 	if err := b.Parse(file); err != nil {
 		return err
 	}
-	c, err := b.Build()
+	c, err := b.BuildWithOptions(BuildOptions{Volumes: m.Volumes, Logger: l})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,140 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/lxc/go-lxc.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// NetworkBridge runs commands with the container's network
+	NetworkBridge = "bridge"
+	// NetworkNone runs commands without network access
+	NetworkNone = "none"
+)
+
+// parseNetwork validates the network mode of RUN statements, defaulting to
+// NetworkBridge
+func parseNetwork(network string) (string, error) {
+	switch network {
+	case "", "default", NetworkBridge:
+		return NetworkBridge, nil
+	case NetworkNone:
+		return NetworkNone, nil
+	}
+	return "", fmt.Errorf("Invalid network '%s'. Expected %s or %s", network, NetworkBridge, NetworkNone)
+}
+
+// isolateNetwork wraps argv to run in a new network namespace, using the unshare
+// of the container with the given rootfs. The namespace only has a loopback device which is down,
+// so connections fail immediately instead of timing out. unshare needs to run as
+// root, it switches to the user of options itself
+func isolateNetwork(rootfs string, argv []string, options *lxc.AttachOptions) ([]string, error) {
+	unshare := ""
+	for _, p := range []string{"/usr/bin/unshare", "/bin/unshare"} {
+		if fileExists(filepath.Join(rootfs, p)) {
+			unshare = p
+			break
+		}
+	}
+	if unshare == "" {
+		return nil, errors.New("No unshare in the container to run the command without network. Install util-linux or use --network=bridge")
+	}
+	wrapped := []string{unshare, "--net"}
+	if options.UID > 0 || options.GID > 0 {
+		wrapped = append(wrapped, "--setuid", strconv.Itoa(options.UID), "--setgid", strconv.Itoa(options.GID))
+		options.UID, options.GID = lxc.DefaultAttachOptions.UID, lxc.DefaultAttachOptions.GID
+	}
+	wrapped = append(wrapped, "--")
+	return append(wrapped, argv...), nil
+}
+
+const (
+	// DefaultNetworkTimeout is how long started build containers are waited for
+	// to reach the network
+	DefaultNetworkTimeout = 30 * time.Second
+	// DefaultNetworkProbe is the name build containers have to resolve before
+	// their network is considered ready
+	DefaultNetworkProbe = "example.com"
+)
+
+// networkPollInterval is the delay between checks of the network of a container
+var networkPollInterval = 250 * time.Millisecond
+
+// dnsProbeScript resolves its first argument with getent or nslookup, exiting
+// with 127 if the container has neither
+const dnsProbeScript = `if command -v getent >/dev/null; then exec getent hosts "$1"; fi
+if command -v nslookup >/dev/null; then exec nslookup "$1"; fi
+exit 127`
+
+// networkWait configures how Start waits for the network of a container
+type networkWait struct {
+	skip    bool
+	timeout time.Duration
+	// probe is resolved inside the container to check its DNS, which is not
+	// checked if probe is empty
+	probe string
+}
+
+// waitForNetwork waits until the container has an IPv4 address and resolves the
+// probe name, recording the address
+func (c *Container) waitForNetwork() error {
+	timeout := c.network.timeout
+	if timeout <= 0 {
+		timeout = DefaultNetworkTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		addrs, err := c.ct.IPv4Addresses()
+		if err == nil && len(addrs) > 0 {
+			c.ipAddress = addrs[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Container %s obtained no IPv4 address within %s", c.ct.Name(), timeout)
+		}
+		time.Sleep(networkPollInterval)
+	}
+	c.logger().Debugf("Container %s obtained IPv4 address %s", c.ct.Name(), c.ipAddress)
+	if c.network.probe == "" {
+		return nil
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	if !fileExists(filepath.Join(rootfs, "bin", "sh")) {
+		c.logger().Warnf("No /bin/sh in container %s, not waiting for DNS resolution", c.ct.Name())
+		return nil
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	options := lxc.DefaultAttachOptions
+	options.ClearEnv = true
+	options.Env = MinimalEnv
+	argv := []string{"/bin/sh", "-c", dnsProbeScript, "sh", c.network.probe}
+	for {
+		exitCode, err := c.attach(ctx, argv, options, "", ioutil.Discard, ioutil.Discard)
+		switch {
+		case err == nil && exitCode == 0:
+			return nil
+		case err == nil && exitCode == 127:
+			c.logger().Warnf("No getent or nslookup in container %s, not waiting for DNS resolution", c.ct.Name())
+			return nil
+		case ctx.Err() != nil || time.Now().After(deadline):
+			return fmt.Errorf("Container %s failed to resolve %s within %s. Use another probe name or skip waiting for the network", c.ct.Name(), c.network.probe, timeout)
+		}
+		time.Sleep(networkPollInterval)
+	}
+}
+
+// IPAddress returns the IPv4 address the container obtained when it was last
+// started, empty if its network was not waited for
+func (c *Container) IPAddress() string {
+	return c.ipAddress
+}
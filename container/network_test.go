@@ -0,0 +1,101 @@
+package container
+
+import (
+	"gopkg.in/lxc/go-lxc.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_IsolateNetwork(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	options := lxc.DefaultAttachOptions
+	if _, err := isolateNetwork(rootfs, []string{"make"}, &options); err == nil {
+		t.Error("Expected error without unshare in the container")
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "usr", "bin", "unshare"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	argv, err := isolateNetwork(rootfs, []string{"make", "test"}, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/usr/bin/unshare", "--net", "--", "make", "test"}
+	if !reflect.DeepEqual(argv, expected) {
+		t.Errorf("Expected %v, found %v", expected, argv)
+	}
+	options.UID, options.GID = 1000, 100
+	argv, err = isolateNetwork(rootfs, []string{"make"}, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"/usr/bin/unshare", "--net", "--setuid", "1000", "--setgid", "100", "--", "make"}
+	if !reflect.DeepEqual(argv, expected) {
+		t.Errorf("Expected %v, found %v", expected, argv)
+	}
+	if options.UID != lxc.DefaultAttachOptions.UID || options.GID != lxc.DefaultAttachOptions.GID {
+		t.Errorf("Expected unshare to be attached as root, found %+v", options)
+	}
+}
+
+func Test_ParseNetwork(t *testing.T) {
+	for network, expected := range map[string]string{"": NetworkBridge, "default": NetworkBridge, "bridge": NetworkBridge, "none": NetworkNone} {
+		if n, err := parseNetwork(network); err != nil || n != expected {
+			t.Errorf("Expected %s for '%s', found %s (%v)", expected, network, n, err)
+		}
+	}
+	if _, err := parseNetwork("host"); err == nil {
+		t.Error("Expected error for unsupported network")
+	}
+}
+
+func Test_NetworkWait(t *testing.T) {
+	b := NewBuilder("nut-test")
+	if wait := b.networkWait(); wait.skip || wait.probe != DefaultNetworkProbe {
+		t.Errorf("Expected build containers to wait for %s, found %+v", DefaultNetworkProbe, wait)
+	}
+	b.opts = BuildOptions{SkipNetworkWait: true, NetworkProbe: "mirror.internal", NetworkTimeout: time.Minute}
+	expected := networkWait{skip: true, timeout: time.Minute, probe: "mirror.internal"}
+	if wait := b.networkWait(); wait != expected {
+		t.Errorf("Expected %+v, found %+v", expected, wait)
+	}
+}
+
+func Test_WaitForNetworkLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.DestroyAll()
+	ct.network = networkWait{probe: "localhost"}
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if net.ParseIP(ct.IPAddress()).To4() == nil {
+		t.Errorf("Expected IPv4 address, found %q", ct.IPAddress())
+	}
+	if err := ct.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	ct.network = networkWait{skip: true}
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if ct.IPAddress() != "" {
+		t.Errorf("Expected no address without waiting for the network, found %s", ct.IPAddress())
+	}
+}
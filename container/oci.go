@@ -0,0 +1,346 @@
+package container
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Media types of the OCI image spec
+const (
+	OCIConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	OCIManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	OCIIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	OCILayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// ociRefNameAnnotation names the image a manifest of an OCI image layout belongs to
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// OCIImageConfig is an OCI image configuration, as defined by the OCI image spec
+type OCIImageConfig struct {
+	Created      string             `json:"created,omitempty"`
+	Author       string             `json:"author,omitempty"`
+	Architecture string             `json:"architecture"`
+	OS           string             `json:"os"`
+	Config       OCIContainerConfig `json:"config"`
+	RootFS       OCIRootFS          `json:"rootfs"`
+	History      []OCIHistory       `json:"history,omitempty"`
+}
+
+// OCIContainerConfig holds the execution parameters of an OCI image
+type OCIContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// OCIRootFS references the layers of an OCI image by the digests of their
+// uncompressed content
+type OCIRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// OCIHistory describes the statement that produced a layer
+type OCIHistory struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// ToOCIConfig converts the manifest into an OCI image configuration. Port ranges
+// are expanded into single ports. The layer digests are left empty, they are
+// added by the tooling packing the rootfs into layers
+func (m *Manifest) ToOCIConfig() OCIImageConfig {
+	config := OCIImageConfig{
+		Created:      m.Created,
+		Architecture: m.Architecture,
+		OS:           m.OS,
+		Config: OCIContainerConfig{
+			User:       m.User,
+			Env:        m.Env,
+			Entrypoint: m.EntryPoint,
+			Cmd:        m.Cmd,
+			WorkingDir: m.WorkDir,
+			Labels:     m.Labels,
+			StopSignal: m.StopSignal,
+		},
+		RootFS: OCIRootFS{Type: "layers", DiffIDs: []string{}},
+	}
+	if len(m.Maintainers) > 0 {
+		config.Author = m.Maintainers[0]
+	}
+	for _, p := range m.ExposedPorts {
+		if config.Config.ExposedPorts == nil {
+			config.Config.ExposedPorts = make(map[string]struct{})
+		}
+		last := int(p.EndPort)
+		if last == 0 {
+			last = int(p.Port)
+		}
+		for port := int(p.Port); port <= last; port++ {
+			config.Config.ExposedPorts[fmt.Sprintf("%d/%s", port, p.Protocol)] = struct{}{}
+		}
+	}
+	for _, volume := range m.Volumes {
+		if config.Config.Volumes == nil {
+			config.Config.Volumes = make(map[string]struct{})
+		}
+		config.Config.Volumes[volume] = struct{}{}
+	}
+	for _, entry := range m.History {
+		config.History = append(config.History, OCIHistory{
+			Created:   entry.Created.UTC().Format(time.RFC3339),
+			CreatedBy: entry.Statement,
+		})
+	}
+	return config
+}
+
+// ToManifest converts the OCI image configuration into a manifest. Exposed ports
+// that can not be parsed are skipped with a warning
+func (config *OCIImageConfig) ToManifest() Manifest {
+	return config.toManifest(nil)
+}
+
+// toManifest is ToManifest logging to l
+func (config *OCIImageConfig) toManifest(l Logger) Manifest {
+	m := Manifest{
+		Labels:       config.Config.Labels,
+		EntryPoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+		Env:          config.Config.Env,
+		User:         config.Config.User,
+		WorkDir:      config.Config.WorkingDir,
+		StopSignal:   config.Config.StopSignal,
+		Created:      config.Created,
+		Architecture: config.Architecture,
+		OS:           config.OS,
+	}
+	if config.Author != "" {
+		m.Maintainers = []string{config.Author}
+	}
+	for _, port := range sortedSet(config.Config.ExposedPorts) {
+		p, err := parseExposedPort(port)
+		if err != nil {
+			loggerOrDefault(l).Warnf("Skipping exposed port %s of the image configuration. Error: %s", port, err)
+			continue
+		}
+		m.ExposedPorts = unitePorts(m.ExposedPorts, []ExposedPort{p})
+	}
+	m.Volumes = sortedSet(config.Config.Volumes)
+	for _, entry := range config.History {
+		created, _ := time.Parse(time.RFC3339Nano, entry.Created)
+		m.History = append(m.History, HistoryEntry{Statement: entry.CreatedBy, Created: created})
+	}
+	return m
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	var values []string
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// ociConfigPath returns the location of the OCI image configuration written
+// next to the image tarball at path
+func ociConfigPath(path string) string {
+	return path + ".config.json"
+}
+
+// WriteOCIConfig writes the manifest as OCI image configuration next to the
+// image tarball and returns its path
+func (i *Image) WriteOCIConfig(m Manifest) (string, error) {
+	d, err := json.MarshalIndent(m.ToOCIConfig(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := ociConfigPath(i.Path)
+	if err := ioutil.WriteFile(path, append(d, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("Failed to write OCI image configuration %s. Error: %s", path, err)
+	}
+	return path, nil
+}
+
+// OCIDescriptor references content of an OCI image by its digest
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *OCIPlatform      `json:"platform,omitempty"`
+}
+
+// OCIPlatform describes the platform an OCI image runs on
+type OCIPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// OCIManifest references the configuration and layers of an OCI image
+type OCIManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        OCIDescriptor   `json:"config"`
+	Layers        []OCIDescriptor `json:"layers"`
+}
+
+// OCIIndex lists the manifests of an OCI image layout
+type OCIIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []OCIDescriptor `json:"manifests"`
+}
+
+// ExportOCI writes the container as OCI image layout to dir, with the rootfs
+// packed as single gzip compressed layer and the image named after the container
+func (i *Image) ExportOCI(dir string) error {
+	var m Manifest
+	if err := m.load(i.logger(), i.ct.Name()); err != nil {
+		return fmt.Errorf("Failed to load container manifest. Error: %s", err)
+	}
+	ctDir, cleanup, err := i.exportDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return writeOCILayout(i.logger(), dir, filepath.Join(ctDir, "rootfs"), m, i.ct.Name())
+}
+
+// writeOCILayout writes the OCI image layout of the rootfs and manifest to dir.
+// index.json of an existing layout in dir is replaced
+func writeOCILayout(l Logger, dir, rootfs string, m Manifest, ref string) error {
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return err
+	}
+	layer, diffID, err := writeLayerBlob(l, blobs, rootfs)
+	if err != nil {
+		return fmt.Errorf("Failed to write layer of %s. Error: %s", rootfs, err)
+	}
+	config := m.ToOCIConfig()
+	if config.Architecture == "" {
+		config.Architecture = runtime.GOARCH
+	}
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+	config.RootFS.DiffIDs = []string{diffID}
+	configDesc, err := writeJSONBlob(blobs, OCIConfigMediaType, config)
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := writeJSONBlob(blobs, OCIManifestMediaType, OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     OCIManifestMediaType,
+		Config:        configDesc,
+		Layers:        []OCIDescriptor{layer},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{ociRefNameAnnotation: ref}
+	manifestDesc.Platform = &OCIPlatform{Architecture: config.Architecture, OS: config.OS}
+	index := OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     OCIIndexMediaType,
+		Manifests:     []OCIDescriptor{manifestDesc},
+	}
+	if err := writeJSONFile(filepath.Join(dir, "index.json"), index); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(dir, "oci-layout"), map[string]string{"imageLayoutVersion": "1.0.0"})
+}
+
+// writeLayerBlob packs rootfs as gzip compressed layer into the blob directory
+// blobs and returns its descriptor and the digest of the uncompressed layer
+func writeLayerBlob(l Logger, blobs, rootfs string) (OCIDescriptor, string, error) {
+	diffID := sha256.New()
+	desc, err := writeBlob(blobs, OCILayerMediaType, func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		if err := writeTree(l, io.MultiWriter(zw, diffID), rootfs, ""); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+	return desc, digestOf(diffID), err
+}
+
+// writeJSONBlob writes v as json blob into the blob directory blobs
+func writeJSONBlob(blobs, mediaType string, v interface{}) (OCIDescriptor, error) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+	return writeBlob(blobs, mediaType, func(w io.Writer) error {
+		_, err := w.Write(d)
+		return err
+	})
+}
+
+// writeBlob stores the content written by write in the blob directory blobs,
+// named after its sha256 digest
+func writeBlob(blobs, mediaType string, write func(io.Writer) error) (OCIDescriptor, error) {
+	f, err := ioutil.TempFile(blobs, ".blob-")
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+	defer os.Remove(f.Name())
+	digest := sha256.New()
+	counter := &countingWriter{}
+	if err := write(io.MultiWriter(f, digest, counter)); err != nil {
+		f.Close()
+		return OCIDescriptor{}, err
+	}
+	if err := f.Close(); err != nil {
+		return OCIDescriptor{}, err
+	}
+	desc := OCIDescriptor{MediaType: mediaType, Digest: digestOf(digest), Size: counter.n}
+	path := filepath.Join(blobs, desc.Digest[len("sha256:"):])
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return OCIDescriptor{}, err
+	}
+	return desc, os.Rename(f.Name(), path)
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+func digestOf(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,240 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// validateOCIConfig checks a json document against the constraints of the OCI
+// image-spec config schema (schema/config-schema.json)
+func validateOCIConfig(t *testing.T, data []byte) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"architecture", "os"} {
+		if _, ok := doc[key].(string); !ok {
+			t.Errorf("Expected required string %s, found %v", key, doc[key])
+		}
+	}
+	if created, ok := doc["created"]; ok {
+		if _, err := time.Parse(time.RFC3339, created.(string)); err != nil {
+			t.Errorf("Expected created to be a date-time. Error: %s", err)
+		}
+	}
+	rootfs, ok := doc["rootfs"].(map[string]interface{})
+	if !ok || rootfs["type"] != "layers" {
+		t.Errorf("Expected rootfs of type layers, found %v", doc["rootfs"])
+	} else if _, ok := rootfs["diff_ids"].([]interface{}); !ok {
+		t.Errorf("Expected rootfs.diff_ids array, found %v", rootfs["diff_ids"])
+	}
+	config, _ := doc["config"].(map[string]interface{})
+	stringArrays := map[string]bool{"Env": true, "Entrypoint": true, "Cmd": true}
+	stringMaps := map[string]bool{"Labels": true}
+	objectMaps := map[string]bool{"ExposedPorts": true, "Volumes": true}
+	scalars := map[string]bool{"User": true, "WorkingDir": true, "StopSignal": true}
+	for key, value := range config {
+		switch {
+		case stringArrays[key]:
+			for _, v := range value.([]interface{}) {
+				if _, ok := v.(string); !ok {
+					t.Errorf("Expected strings in %s, found %v", key, v)
+				}
+			}
+		case stringMaps[key]:
+			for _, v := range value.(map[string]interface{}) {
+				if _, ok := v.(string); !ok {
+					t.Errorf("Expected string values in %s, found %v", key, v)
+				}
+			}
+		case objectMaps[key]:
+			for k, v := range value.(map[string]interface{}) {
+				if obj, ok := v.(map[string]interface{}); !ok || len(obj) != 0 {
+					t.Errorf("Expected empty object for %s in %s, found %v", k, key, v)
+				}
+			}
+		case scalars[key]:
+			if _, ok := value.(string); !ok {
+				t.Errorf("Expected string %s, found %v", key, value)
+			}
+		default:
+			t.Errorf("Unexpected config property %s", key)
+		}
+	}
+	ports, _ := config["ExposedPorts"].(map[string]interface{})
+	for port := range ports {
+		if !regexp.MustCompile(`^\d+/(tcp|udp|sctp)$`).MatchString(port) {
+			t.Errorf("Invalid exposed port key %s", port)
+		}
+	}
+}
+
+func Test_ToOCIConfig(t *testing.T) {
+	m := Manifest{
+		Labels:       map[string]string{"version": "1.0"},
+		Maintainers:  []string{"ops@example.com"},
+		ExposedPorts: []ExposedPort{{Port: 80, Protocol: "tcp"}, {Port: 8000, EndPort: 8002, Protocol: "udp"}},
+		EntryPoint:   []string{"/srv/app"},
+		Cmd:          []string{"--port", "80"},
+		Env:          []string{"PATH=/usr/bin"},
+		User:         "app",
+		WorkDir:      "/srv",
+		Volumes:      []string{"/var/log"},
+		StopSignal:   "SIGTERM",
+		Created:      "2016-03-01T12:00:00Z",
+		Architecture: "amd64",
+		OS:           "linux",
+		History:      []HistoryEntry{{Statement: "FROM ubuntu", Created: time.Date(2016, 3, 1, 11, 0, 0, 0, time.UTC)}},
+	}
+	config := m.ToOCIConfig()
+	expectedPorts := map[string]struct{}{"80/tcp": {}, "8000/udp": {}, "8001/udp": {}, "8002/udp": {}}
+	if !reflect.DeepEqual(config.Config.ExposedPorts, expectedPorts) {
+		t.Errorf("Expected ports %v, found %v", expectedPorts, config.Config.ExposedPorts)
+	}
+	if config.Author != "ops@example.com" || config.History[0].CreatedBy != "FROM ubuntu" || config.History[0].Created != "2016-03-01T11:00:00Z" {
+		t.Errorf("Unexpected OCI config %+v", config)
+	}
+	dir, err := ioutil.TempDir("", "nut-test-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := &Image{Path: filepath.Join(dir, "app.tar.xz")}
+	path, err := image.WriteOCIConfig(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateOCIConfig(t, data)
+	var loaded OCIImageConfig
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Errorf("Expected %+v after round trip, found %+v", config, loaded)
+	}
+	validateOCIConfig(t, mustMarshal(t, (&Manifest{Architecture: "arm64", OS: "linux"}).ToOCIConfig()))
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	d, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// readBlob reads the blob desc references from the OCI image layout dir and
+// verifies its digest and size
+func readBlob(t *testing.T, dir string, desc OCIDescriptor) []byte {
+	if !regexp.MustCompile(`^sha256:[a-f0-9]{64}$`).MatchString(desc.Digest) {
+		t.Fatalf("Invalid digest %s", desc.Digest)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", desc.Digest[len("sha256:"):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if "sha256:"+hex.EncodeToString(sum[:]) != desc.Digest || int64(len(data)) != desc.Size {
+		t.Fatalf("Blob does not match descriptor %+v", desc)
+	}
+	return data
+}
+
+func Test_OCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-oci-layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("etc/hostname", filepath.Join(rootfs, "hostname")); err != nil {
+		t.Fatal(err)
+	}
+	layout := filepath.Join(dir, "layout")
+	m := Manifest{EntryPoint: []string{"/bin/sh"}, Env: []string{"PATH=/bin"}}
+	if err := writeOCILayout(nil, layout, rootfs, m, "app"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := ioutil.ReadFile(filepath.Join(layout, "oci-layout"))
+	if err != nil || string(d) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Errorf("Unexpected oci-layout %s (%v)", d, err)
+	}
+	var index OCIIndex
+	d, err = ioutil.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(d, &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.SchemaVersion != 2 || index.MediaType != OCIIndexMediaType || len(index.Manifests) != 1 {
+		t.Fatalf("Unexpected index %+v", index)
+	}
+	desc := index.Manifests[0]
+	if desc.MediaType != OCIManifestMediaType || desc.Annotations[ociRefNameAnnotation] != "app" || desc.Platform == nil || desc.Platform.OS != "linux" {
+		t.Errorf("Unexpected manifest descriptor %+v", desc)
+	}
+	var manifest OCIManifest
+	if err := json.Unmarshal(readBlob(t, layout, desc), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SchemaVersion != 2 || manifest.Config.MediaType != OCIConfigMediaType || len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != OCILayerMediaType {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+	configData := readBlob(t, layout, manifest.Config)
+	validateOCIConfig(t, configData)
+	var config OCIImageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(readBlob(t, layout, manifest.Layers[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID := sha256.New()
+	tr := tar.NewReader(io.TeeReader(zr, diffID))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	io.Copy(ioutil.Discard, zr)
+	expected := []string{"etc/", "etc/hostname", "hostname"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected layer entries %v, found %v", expected, names)
+	}
+	if len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != "sha256:"+hex.EncodeToString(diffID.Sum(nil)) {
+		t.Errorf("Expected diff id of the uncompressed layer, found %v", config.RootFS.DiffIDs)
+	}
+	if !reflect.DeepEqual(config.Config.Entrypoint, m.EntryPoint) {
+		t.Errorf("Expected entrypoint %v, found %v", m.EntryPoint, config.Config.Entrypoint)
+	}
+}
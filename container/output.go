@@ -0,0 +1,102 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// commandWriters returns the writers receiving stdout and stderr of commands run
+// in build containers
+func (b *Builder) commandWriters() (io.Writer, io.Writer) {
+	stdout, stderr := b.opts.Stdout, b.opts.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	if b.opts.Events == nil && !b.opts.Prefix {
+		return stdout, stderr
+	}
+	if stdout == stderr {
+		// both streams are copied concurrently
+		shared := &syncWriter{w: stdout}
+		stdout, stderr = shared, shared
+	}
+	return b.lineWriter(stdout), b.lineWriter(stderr)
+}
+
+func (b *Builder) lineWriter(out io.Writer) *lineWriter {
+	w := &lineWriter{out: out}
+	if b.opts.Events != nil {
+		w.emit = func(line string) {
+			b.emit(CommandOutput{Line: line})
+		}
+	}
+	if b.opts.Prefix {
+		w.prefix = func() string {
+			return fmt.Sprintf("[%d] ", b.current)
+		}
+	}
+	return w
+}
+
+// lineWriter writes complete lines to out, optionally prefixed, and passes every
+// line to emit
+type lineWriter struct {
+	out    io.Writer
+	prefix func() string
+	emit   func(string)
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if err := w.writeLine(line, "\n"); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes the trailing incomplete line, if any
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(string(w.buf), "")
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) writeLine(line, end string) error {
+	if w.emit != nil {
+		w.emit(line)
+	}
+	prefix := ""
+	if w.prefix != nil {
+		prefix = w.prefix()
+	}
+	_, err := io.WriteString(w.out, prefix+line+end)
+	return err
+}
+
+// syncWriter serializes writes to a writer shared by stdout and stderr
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,73 @@
+package container
+
+import (
+	"bytes"
+	"gopkg.in/lxc/go-lxc.v2"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func Test_LineWriter(t *testing.T) {
+	var out bytes.Buffer
+	var lines []string
+	w := &lineWriter{out: &out, emit: func(line string) {
+		lines = append(lines, line)
+	}}
+	for _, chunk := range []string{"hel", "lo\nwor", "ld\n\npartial"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	expected := []string{"hello", "world", "", "partial"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected lines %q, found %q", expected, lines)
+	}
+	if out.String() != "hello\nworld\n\npartial" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
+
+func Test_LineWriterPrefix(t *testing.T) {
+	var out bytes.Buffer
+	b := NewBuilder("nut-test-prefix")
+	b.opts.Prefix = true
+	w := b.lineWriter(&out)
+	b.current = 3
+	w.Write([]byte("configure\nmake"))
+	b.current = 4
+	w.Write([]byte("\n"))
+	w.Flush()
+	if out.String() != "[3] configure\n[4] make\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
+
+func Test_AttachOutput(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	options := lxc.DefaultAttachOptions
+	done, err := attachOutput(&options, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		syscall.Write(int(options.StdoutFd), []byte("out\n"))
+		syscall.Write(int(options.StderrFd), []byte("err\n"))
+	}
+	done()
+	if stdout.String() != string(bytes.Repeat([]byte("out\n"), 100)) {
+		t.Errorf("Unexpected stdout %q", stdout.String())
+	}
+	if stderr.String() != string(bytes.Repeat([]byte("err\n"), 100)) {
+		t.Errorf("Unexpected stderr %q", stderr.String())
+	}
+	options = lxc.DefaultAttachOptions
+	if _, err := attachOutput(&options, os.Stdout, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+	if options.StdoutFd != os.Stdout.Fd() || options.StderrFd != os.Stderr.Fd() {
+		t.Error("Expected files to be attached directly")
+	}
+}
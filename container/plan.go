@@ -0,0 +1,104 @@
+package container
+
+import (
+	"fmt"
+)
+
+// PlannedStep describes what a build statement would do, as evaluated by a dry run
+type PlannedStep struct {
+	Index int
+	Line  int
+	// Statement is the statement after build argument and variable expansion
+	Statement string
+	// Parent is the container a FROM statement would clone
+	Parent string
+	// Command is the command a RUN statement would execute
+	Command []string
+	// Sources and Destination are the paths an ADD or COPY statement would
+	// transfer, with glob patterns expanded
+	Sources     []string
+	Destination string
+	// Env, WorkDir and User describe the state the statement would see
+	Env     []string
+	WorkDir string
+	User    string
+	// Manifest is the container manifest after the statement. The manifest of the
+	// last step is the one the build would write
+	Manifest Manifest
+	// Unverified marks statements whose outcome depends on the container, with
+	// Reason explaining what could not be checked
+	Unverified bool
+	Reason     string
+}
+
+// DryRun evaluates the build statements without creating any container and returns
+// the planned steps
+func (b *Builder) DryRun(opts BuildOptions) ([]PlannedStep, error) {
+	var steps []PlannedStep
+	opts.DryRun = true
+	opts.Plan = func(step PlannedStep) {
+		steps = append(steps, step)
+	}
+	_, err := b.BuildWithOptions(opts)
+	return steps, err
+}
+
+// unverified marks the step of the statement being planned as unverified
+func (b *Builder) unverified(reason string) {
+	if b.step != nil {
+		b.step.Unverified = true
+		b.step.Reason = reason
+	}
+}
+
+// snapshot returns a copy of m that is not affected by later statements
+func (m Manifest) snapshot() Manifest {
+	if m.Labels != nil {
+		labels := make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		m.Labels = labels
+	}
+	return m
+}
+
+// planContainer returns a container placeholder for a FROM statement in dry run
+// mode, carrying the manifest of the parent stage or container
+func (b *Builder) planContainer(from string) *Container {
+	c := &Container{}
+	if b.step != nil {
+		b.step.Parent = from
+	}
+	if parent, ok := b.stages[from]; ok {
+		c.Manifest = parent.Manifest.snapshot()
+		for i, stage := range b.stageList {
+			if stage == parent && b.step != nil {
+				b.step.Parent = b.stageContainerName(i, b.countStages())
+			}
+		}
+	} else if err := c.Manifest.load(b.logger(), TagToName(from)); err != nil {
+		b.unverified(fmt.Sprintf("Failed to load manifest of parent container. Error: %s", err))
+	}
+	return c
+}
+
+// planFiles records the transfer of an ADD or COPY statement in dry run mode.
+// Sources in other stages and at remote URLs can not be checked
+func (b *Builder) planFiles(sources []string, dest string, fromStage bool) {
+	if b.step != nil {
+		b.step.Sources = sources
+		b.step.Destination = dest
+	}
+	if fromStage {
+		b.unverified("Source is resolved inside the stage container")
+		return
+	}
+	for _, src := range sources {
+		if isRemote(src) {
+			b.unverified("Remote sources are not downloaded in dry run mode")
+			return
+		}
+	}
+	b.unverified("Destination is resolved inside the container")
+}
@@ -0,0 +1,108 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_DryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.tar"), []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spec := `ARG VERSION=1.0
+FROM ubuntu AS base
+ENV APP_VERSION=${VERSION}
+WORKDIR /srv
+FROM base
+LABEL version=${VERSION}
+ADD app.tar /srv/app.tar
+RUN make install
+STOPSIGNAL SIGTERM
+ENTRYPOINT ["/srv/app"]
+CMD ["--port", "80"]
+`
+	b := NewBuilder("nut-test-dry-run")
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	b.RootDir = dir
+	steps, err := b.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 11 {
+		t.Fatalf("Expected 11 planned steps, found %d", len(steps))
+	}
+	if steps[4].Parent != "nut-test-dry-run-stage-0" {
+		t.Errorf("Expected second stage to clone the first one, found: %q", steps[4].Parent)
+	}
+	add := steps[6]
+	if !reflect.DeepEqual(add.Sources, []string{filepath.Join(dir, "app.tar")}) || add.Destination != "/srv/app.tar" || !add.Unverified {
+		t.Errorf("Unexpected ADD step: %+v", add)
+	}
+	run := steps[7]
+	if !reflect.DeepEqual(run.Command, []string{"make install"}) {
+		t.Errorf("Unexpected RUN command: %v", run.Command)
+	}
+	if run.WorkDir != "/srv" || !reflect.DeepEqual(run.Env, []string{"APP_VERSION=1.0"}) {
+		t.Errorf("Unexpected RUN state. WorkDir: %q, Env: %v", run.WorkDir, run.Env)
+	}
+	manifest := steps[10].Manifest
+	if manifest.Labels["version"] != "1.0" || manifest.StopSignal != "SIGTERM" {
+		t.Errorf("Unexpected final manifest: %+v", manifest)
+	}
+	if !reflect.DeepEqual(manifest.EntryPoint, []string{"/srv/app"}) || !reflect.DeepEqual(manifest.Cmd, []string{"--port", "80"}) {
+		t.Errorf("Unexpected entry point %v and command %v", manifest.EntryPoint, manifest.Cmd)
+	}
+	if len(steps[5].Manifest.Labels) != 1 || steps[0].Statement != "ARG VERSION=1.0" {
+		t.Errorf("Unexpected steps: %+v", steps[:6])
+	}
+}
+
+func Test_DryRunMissingSource(t *testing.T) {
+	b := NewBuilder("nut-test-dry-run")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nADD missing /missing\n")); err != nil {
+		t.Fatal(err)
+	}
+	b.RootDir = os.TempDir()
+	if _, err := b.DryRun(BuildOptions{}); err == nil {
+		t.Fatal("Expected error for missing ADD source")
+	}
+}
+
+func Test_DryRunRelativeWorkDir(t *testing.T) {
+	b := NewBuilder("nut-test-dry-run")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nWORKDIR /srv\nWORKDIR app\nRUN make\n")); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := b.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps[3].WorkDir != "/srv/app" {
+		t.Errorf("Expected RUN to see /srv/app, found %s", steps[3].WorkDir)
+	}
+}
+
+func Test_DryRunEnvOverride(t *testing.T) {
+	b := NewBuilder("nut-test-dry-run")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nENV A=1 B=2\nENV A=3\n")); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := b.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := steps[2].Manifest.Env; !reflect.DeepEqual(env, []string{"A=3", "B=2"}) {
+		t.Errorf("Expected ENV to override A, found %v", env)
+	}
+}
@@ -0,0 +1,42 @@
+package container
+
+import (
+	"errors"
+)
+
+// RunFailurePolicy decides how a build proceeds after a failed RUN statement
+type RunFailurePolicy int
+
+const (
+	// AbortOnRunFailure fails the build, the default
+	AbortOnRunFailure RunFailurePolicy = iota
+	// ContinueOnRunFailure records the failure and continues with the next
+	// statement. The build still returns an error joining all failures
+	ContinueOnRunFailure
+	// PromptOnRunFailure continues if BuildOptions.RunFailurePrompt returns true
+	PromptOnRunFailure
+)
+
+// continueAfterRun reports whether the build continues after st failed with err.
+// Only failures of RUN statements are considered, failures of other statements
+// leave later statements without a meaningful starting point
+func (b *Builder) continueAfterRun(st Statement, err error) bool {
+	if st.Instruction != "RUN" || b.ctx.Err() != nil {
+		return false
+	}
+	switch b.opts.OnRunFailure {
+	case ContinueOnRunFailure:
+		return true
+	case PromptOnRunFailure:
+		if b.opts.RunFailurePrompt == nil {
+			return false
+		}
+		exitCode := -1
+		var exitErr *ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode
+		}
+		return b.opts.RunFailurePrompt(st.Raw, exitCode)
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_ContinueAfterRun(t *testing.T) {
+	run := NewStatement("RUN make test", 3)
+	add := NewStatement("ADD app /app", 4)
+	failure := &StatementError{Line: 3, Statement: run.Raw, Err: &ExitError{Command: []string{"make test"}, ExitCode: 2, Statement: run.Raw}}
+	b := NewBuilder("nut-test-policy")
+	b.ctx = context.Background()
+	if b.continueAfterRun(run, failure) {
+		t.Error("Expected build to abort by default")
+	}
+	b.opts.OnRunFailure = ContinueOnRunFailure
+	if !b.continueAfterRun(run, failure) {
+		t.Error("Expected build to continue after failed RUN")
+	}
+	if b.continueAfterRun(add, errors.New("missing source")) {
+		t.Error("Expected build to abort after failed ADD")
+	}
+	var prompted string
+	var exitCode int
+	b.opts.OnRunFailure = PromptOnRunFailure
+	b.opts.RunFailurePrompt = func(statement string, code int) bool {
+		prompted, exitCode = statement, code
+		return false
+	}
+	if b.continueAfterRun(run, failure) {
+		t.Error("Expected build to abort when prompt declines")
+	}
+	if prompted != "RUN make test" || exitCode != 2 {
+		t.Errorf("Unexpected prompt for '%s' with exit code %d", prompted, exitCode)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.ctx = ctx
+	b.opts.OnRunFailure = ContinueOnRunFailure
+	if b.continueAfterRun(run, failure) {
+		t.Error("Expected cancelled build to abort")
+	}
+}
@@ -0,0 +1,115 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// protocols lists the protocols accepted by EXPOSE
+var protocols = map[string]bool{"tcp": true, "udp": true, "sctp": true}
+
+// ExposedPort is a port, or range of ports, declared via EXPOSE. It is stored in
+// manifests in its canonical form, e.g. 53/udp or 8000-8010/tcp
+type ExposedPort struct {
+	Port uint16
+	// EndPort is the last port of a range, zero for single ports
+	EndPort  uint16
+	Protocol string
+}
+
+// parseExposedPort parses an EXPOSE argument of the form port[-end][/protocol].
+// The protocol defaults to tcp
+func parseExposedPort(s string) (ExposedPort, error) {
+	p := ExposedPort{Protocol: "tcp"}
+	ports := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		ports, p.Protocol = s[:i], strings.ToLower(s[i+1:])
+		if !protocols[p.Protocol] {
+			return p, fmt.Errorf("Invalid port '%s'. Unknown protocol '%s'", s, s[i+1:])
+		}
+	}
+	bounds := strings.SplitN(ports, "-", 2)
+	for i, bound := range bounds {
+		port, err := strconv.ParseUint(bound, 10, 16)
+		if err != nil || port == 0 {
+			return p, fmt.Errorf("Invalid port '%s'. Ports must be between 1 and 65535", s)
+		}
+		if i == 0 {
+			p.Port = uint16(port)
+		} else {
+			p.EndPort = uint16(port)
+		}
+	}
+	if p.EndPort != 0 && p.EndPort < p.Port {
+		return p, fmt.Errorf("Invalid port range '%s'", s)
+	}
+	if p.EndPort == p.Port {
+		p.EndPort = 0
+	}
+	return p, nil
+}
+
+// String returns the canonical form of the port
+func (p ExposedPort) String() string {
+	if p.EndPort != 0 {
+		return fmt.Sprintf("%d-%d/%s", p.Port, p.EndPort, p.Protocol)
+	}
+	return fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+}
+
+// unitePorts appends the ports to list that it does not contain yet, comparing
+// their canonical forms
+func unitePorts(list []ExposedPort, ports []ExposedPort) []ExposedPort {
+	united := append([]ExposedPort(nil), list...)
+	for _, p := range ports {
+		found := false
+		for _, existing := range united {
+			found = found || existing.String() == p.String()
+		}
+		if !found {
+			united = append(united, p)
+		}
+	}
+	return united
+}
+
+// MarshalYAML stores the port in its canonical form
+func (p ExposedPort) MarshalYAML() (interface{}, error) {
+	return p.String(), nil
+}
+
+// MarshalJSON stores the port in its canonical form
+func (p ExposedPort) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON reads ports in their canonical form
+func (p *ExposedPort) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := parseExposedPort(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// UnmarshalYAML reads ports in their canonical form, as well as the plain port
+// numbers of older manifests
+func (p *ExposedPort) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := parseExposedPort(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
@@ -0,0 +1,53 @@
+package container
+
+import (
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"testing"
+)
+
+func Test_ParseExposedPort(t *testing.T) {
+	for s, expected := range map[string]string{
+		"80":        "80/tcp",
+		"53/udp":    "53/udp",
+		"8000-8010": "8000-8010/tcp",
+		"9000/SCTP": "9000/sctp",
+		"443-443":   "443/tcp",
+	} {
+		p, err := parseExposedPort(s)
+		if err != nil {
+			t.Errorf("Failed to parse '%s'. Error: %s", s, err)
+			continue
+		}
+		if p.String() != expected {
+			t.Errorf("Expected '%s' to parse as %s, found %s", s, expected, p)
+		}
+	}
+	for _, s := range []string{"http", "0", "65536", "53/icmp", "8010-8000", "80-", "/tcp"} {
+		if _, err := parseExposedPort(s); err == nil {
+			t.Errorf("Expected error for '%s'", s)
+		}
+	}
+}
+
+func Test_ExposedPortsManifest(t *testing.T) {
+	var m Manifest
+	if err := yaml.Unmarshal([]byte("exposedports:\n- 80\n- 53/udp\n- 8000-8010/tcp\n"), &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ExposedPort{{Port: 80, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}, {Port: 8000, EndPort: 8010, Protocol: "tcp"}}
+	if !reflect.DeepEqual(m.ExposedPorts, expected) {
+		t.Fatalf("Expected %v, found %v", expected, m.ExposedPorts)
+	}
+	d, err := yaml.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Manifest
+	if err := yaml.Unmarshal(d, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.ExposedPorts, expected) {
+		t.Errorf("Expected %v after round trip, found %v", expected, loaded.ExposedPorts)
+	}
+}
@@ -0,0 +1,168 @@
+package container
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxRedirects limits the redirects followed when downloading ADD sources
+	maxRedirects = 10
+	// downloadAttempts is how often an interrupted download is resumed
+	downloadAttempts = 3
+)
+
+// checksumPattern matches the value of the ADD --checksum flag
+var checksumPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// isRemote reports whether an ADD source is an http(s) URL
+func isRemote(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// downloadName returns the file name of a downloaded ADD source, the last
+// element of the URL's path
+func downloadName(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err == nil {
+		if name := path.Base(u.Path); name != "/" && name != "." {
+			return name
+		}
+	}
+	return "download"
+}
+
+// addRemote downloads the ADD source rawurl and places it at dest inside the
+// container with mode 0600
+func (b *Builder) addRemote(c *Container, rawurl, dest string, flags fileFlags) error {
+	dir, err := ioutil.TempDir("", "nut-download")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, downloadName(rawurl))
+	ctx := b.ctx
+	if b.opts.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.DownloadTimeout)
+		defer cancel()
+	}
+	if err := download(ctx, b.logger(), rawurl, file, flags.checksum); err != nil {
+		return err
+	}
+	if err := os.Chmod(file, 0600); err != nil {
+		return err
+	}
+	return c.addFiles(file, dest, nil, flags.chown)
+}
+
+// download fetches rawurl into file, resuming interrupted transfers and verifying
+// the content against checksum if set. file is removed if the download fails
+func download(ctx context.Context, l Logger, rawurl, file, checksum string) (err error) {
+	defer func() {
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return &downloadError{fmt.Sprintf("Stopped after %d redirects", maxRedirects)}
+			}
+			return nil
+		},
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var written int64
+	for attempt := 1; ; attempt++ {
+		err = fetch(ctx, client, rawurl, f, &written)
+		if err == nil || ctx.Err() != nil || attempt == downloadAttempts {
+			break
+		}
+		var permanent *downloadError
+		if errors.As(err, &permanent) {
+			break
+		}
+		loggerOrDefault(l).Warnf("Download of %s interrupted after %d bytes, resuming. Error: %s", rawurl, written, err)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Failed to download %s. Error: %s", rawurl, ctx.Err())
+		}
+		return fmt.Errorf("Failed to download %s. Error: %s", rawurl, err)
+	}
+	if checksum == "" {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); digest != checksum {
+		return fmt.Errorf("Checksum mismatch for %s. Expected %s, found %s", rawurl, checksum, digest)
+	}
+	return nil
+}
+
+// downloadError is returned for download failures that resuming can not fix
+type downloadError struct {
+	reason string
+}
+
+func (e *downloadError) Error() string {
+	return e.reason
+}
+
+// fetch appends the content of rawurl from offset *written onwards to f,
+// advancing *written
+func fetch(ctx context.Context, client *http.Client, rawurl string, f *os.File, written *int64) error {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if *written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", *written))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range, start over
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		*written = 0
+	case resp.StatusCode == http.StatusPartialContent && *written > 0:
+	default:
+		return &downloadError{"Unexpected response " + resp.Status}
+	}
+	n, err := io.Copy(f, resp.Body)
+	*written += n
+	return err
+}
@@ -0,0 +1,84 @@
+package container
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Download(t *testing.T) {
+	content := strings.Repeat("nut", 1000)
+	sum := sha256.Sum256([]byte(content))
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	interrupted := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	})
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if !interrupted {
+			interrupted = true
+			// announce the full length but hang up half way
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write([]byte(content[:len(content)/2]))
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.Handle("/moved", http.RedirectHandler("/file", http.StatusMovedPermanently))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "nut-test-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	for _, p := range []string{"/file", "/moved", "/flaky"} {
+		if err := download(context.Background(), nil, server.URL+p, file, checksum); err != nil {
+			t.Errorf("Failed to download %s. Error: %s", p, err)
+			continue
+		}
+		if data, err := ioutil.ReadFile(file); err != nil || string(data) != content {
+			t.Errorf("Unexpected content downloaded from %s (%v)", p, err)
+		}
+	}
+	failures := map[string]string{
+		"/missing": checksum,
+		"/loop":    "",
+		"/file":    "sha256:" + strings.Repeat("0", 64),
+	}
+	for p, sum := range failures {
+		if err := download(context.Background(), nil, server.URL+p, file, sum); err == nil {
+			t.Errorf("Expected download of %s to fail", p)
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("Expected failed download of %s to be removed", p)
+		}
+	}
+}
+
+func Test_DownloadName(t *testing.T) {
+	names := map[string]string{
+		"https://example.com/releases/app.tar.gz?token=x": "app.tar.gz",
+		"https://example.com/":                            "download",
+		"https://example.com":                             "download",
+	}
+	for u, expected := range names {
+		if name := downloadName(u); name != expected {
+			t.Errorf("Expected %s for %s, found %s", expected, u, name)
+		}
+	}
+}
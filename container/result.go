@@ -0,0 +1,33 @@
+package container
+
+import (
+	"time"
+)
+
+// BuildResult describes a finished build
+type BuildResult struct {
+	// Container is the container built by the last stage
+	Container *Container
+	// Manifest is the manifest of the built container, written to ManifestPath
+	Manifest     Manifest
+	ManifestPath string
+	Duration     time.Duration
+	Steps        []StepResult
+	// Artifacts lists the host paths of artifacts fetched from the container
+	Artifacts []string
+	// ArtifactResults describes the outcome of every artifact of the build
+	ArtifactResults []ArtifactResult
+	// ExistingContainer is the policy applied to containers of the build that
+	// existed already, empty if there were none
+	ExistingContainer ExistingContainerPolicy
+}
+
+// StepResult describes the execution of a single statement
+type StepResult struct {
+	Index    int
+	Raw      string
+	Duration time.Duration
+	// CacheHit is set for statements restored from the build cache
+	CacheHit bool
+	Err      error
+}
@@ -0,0 +1,180 @@
+package container
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// progressFile records how far a failed build kept for inspection got. It is
+// stored next to the manifest of the container that was being built
+const progressFile = "nut-progress.yml"
+
+// buildProgress describes the progress of a failed build
+type buildProgress struct {
+	// Statement is the index of the statement that failed
+	Statement int
+	// Digest identifies the statements executed before the failure
+	Digest string
+}
+
+// statementsDigest returns a digest of the raw text of statements
+func statementsDigest(statements []Statement) string {
+	h := sha256.New()
+	for _, st := range statements {
+		h.Write([]byte(st.Raw + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Resume continues a build that failed with BuildOptions.KeepOnFailure set. The
+// state of the statements executed before the failure is restored without running
+// them, and execution continues with the statement that failed. Resuming is refused
+// if any statement before the failure point changed since
+func (b *Builder) Resume(opts BuildOptions) (*Container, error) {
+	progress, err := b.loadProgress()
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkProgress(progress); err != nil {
+		return nil, err
+	}
+	result, err := b.run(context.Background(), opts, progress.Statement)
+	return result.Container, err
+}
+
+// checkProgress verifies that the statements before the failure point of a
+// previous build did not change since
+func (b *Builder) checkProgress(progress *buildProgress) error {
+	if progress.Statement > len(b.Statements) || statementsDigest(b.Statements[:progress.Statement]) != progress.Digest {
+		return fmt.Errorf("Specification changed before the failed statement of the previous build. Rebuild from scratch")
+	}
+	if progress.Statement < len(b.Statements) {
+		b.logger().Infof("Resuming build from line %d", b.Statements[progress.Statement].Line)
+	}
+	return nil
+}
+
+// replay restores builder state and stage containers from the statements before
+// start, without executing them
+func (b *Builder) replay(start int) error {
+	if start <= 0 {
+		return nil
+	}
+	dryRun := b.opts.DryRun
+	b.opts.DryRun = true
+	b.replaying = true
+	defer func() {
+		b.opts.DryRun = dryRun
+		b.replaying = false
+	}()
+	for i, st := range b.Statements[:start] {
+		err := b.preStatement(i, true)
+		if err == nil {
+			err = b.execute(st)
+		}
+		if err == nil {
+			err = b.postStatement(i, true)
+		}
+		if err != nil {
+			return &StatementError{Index: i, Line: st.Line, Statement: st.Raw, Err: err}
+		}
+	}
+	if b.ct != nil && !b.ct.ct.Running() {
+		return b.ct.Start()
+	}
+	return nil
+}
+
+// attachContainer binds the placeholder created for a replayed FROM statement to
+// the container kept from the failed build
+func (b *Builder) attachContainer(c *Container) error {
+	name := b.stageContainerName(len(b.stageList), b.countStages())
+	ct, err := b.containerBackend().container(name)
+	if err != nil {
+		return err
+	}
+	if !ct.Defined() {
+		return fmt.Errorf("Container %s of the failed build does not exist", name)
+	}
+	c.ct = ct
+	c.backend = b.containerBackend()
+	c.rootfsDir = ""
+	c.log = b.logger()
+	c.stdout, c.stderr = b.commandWriters()
+	c.env = b.environment()
+	c.network = b.networkWait()
+	c.StopTimeout = b.opts.StopTimeout
+	c.unprivileged = b.opts.Unprivileged
+	return nil
+}
+
+// progressPath returns the path of the progress file of the stage container name
+func (b *Builder) progressPath(name string) (string, error) {
+	ct, err := b.containerBackend().container(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(containerDir(ct), progressFile), nil
+}
+
+// saveProgress records the failure point of the current build
+func (b *Builder) saveProgress() {
+	if b.ct == nil || b.ct.ct == nil {
+		return
+	}
+	progress := buildProgress{
+		Statement: b.done + 1,
+		Digest:    statementsDigest(b.Statements[:b.done+1]),
+	}
+	d, err := yaml.Marshal(&progress)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(b.ct.dir(), progressFile), d, 0644)
+	}
+	if err != nil {
+		b.logger().Warnf("Failed to record build progress. Error: %s", err)
+	}
+}
+
+// loadProgress reads the progress file of the stage the previous build failed in
+func (b *Builder) loadProgress() (*buildProgress, error) {
+	total := b.countStages()
+	for i := total - 1; i >= 0; i-- {
+		path, err := b.progressPath(b.stageContainerName(i, total))
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		progress := &buildProgress{}
+		if err := yaml.Unmarshal(data, progress); err != nil {
+			return nil, err
+		}
+		return progress, nil
+	}
+	return nil, fmt.Errorf("No failed build of %s to resume", b.Name)
+}
+
+// clearProgress removes progress files left by a previous failed build
+func (b *Builder) clearProgress() {
+	total := b.countStages()
+	for i := 0; i < total; i++ {
+		path, err := b.progressPath(b.stageContainerName(i, total))
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			b.logger().Warnf("Failed to remove build progress. Error: %s", err)
+		}
+	}
+}
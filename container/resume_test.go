@@ -0,0 +1,35 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_ResumeWithoutFailedBuild(t *testing.T) {
+	b := NewBuilder("nut-test-resume-missing")
+	if err := b.ParseReader(strings.NewReader("FROM ubuntu\nRUN true\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Resume(BuildOptions{}); err == nil {
+		t.Fatal("Expected error when no failed build exists")
+	}
+}
+
+func Test_StatementsDigest(t *testing.T) {
+	parse := func(spec string) []Statement {
+		b := NewBuilder("nut-test-digest")
+		if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+			t.Fatal(err)
+		}
+		return b.Statements
+	}
+	original := parse("FROM ubuntu\nRUN make\nRUN make install\n")
+	fixed := parse("FROM ubuntu\nRUN make\nRUN make install PREFIX=/usr\n")
+	changed := parse("FROM ubuntu\nRUN make all\nRUN make install\n")
+	if statementsDigest(original[:2]) != statementsDigest(fixed[:2]) {
+		t.Error("Expected digest to ignore statements after the failure point")
+	}
+	if statementsDigest(original[:2]) == statementsDigest(changed[:2]) {
+		t.Error("Expected digest to change with statements before the failure point")
+	}
+}
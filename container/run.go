@@ -0,0 +1,206 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runFlags holds the options of a RUN statement given as leading --name=value flags.
+// Negative retries and retryDelay, and an empty network mean the flag was not given
+type runFlags struct {
+	timeout    time.Duration
+	retries    int
+	retryDelay time.Duration
+	network    string
+	secrets    []secretMount
+}
+
+// parseRunFlags splits the leading flags off the arguments of a RUN statement
+func parseRunFlags(args string) (runFlags, string, error) {
+	flags := runFlags{retries: -1, retryDelay: -1}
+	for strings.HasPrefix(args, "--") {
+		end := strings.IndexAny(args, " \t\n")
+		if end < 0 {
+			end = len(args)
+		}
+		flag := args[:end]
+		args = strings.TrimLeft(args[end:], " \t")
+		switch {
+		case strings.HasPrefix(flag, "--timeout="):
+			timeout, err := time.ParseDuration(strings.TrimPrefix(flag, "--timeout="))
+			if err != nil {
+				return flags, "", fmt.Errorf("Invalid RUN timeout '%s'. Error: %s", flag, err)
+			}
+			if timeout <= 0 {
+				return flags, "", fmt.Errorf("Invalid RUN timeout '%s'. Timeout must be positive", flag)
+			}
+			flags.timeout = timeout
+		case strings.HasPrefix(flag, "--retries="):
+			retries, err := strconv.Atoi(strings.TrimPrefix(flag, "--retries="))
+			if err != nil || retries < 0 {
+				return flags, "", fmt.Errorf("Invalid RUN retries '%s'. Expected a non negative number", flag)
+			}
+			flags.retries = retries
+		case strings.HasPrefix(flag, "--retry-delay="):
+			delay, err := time.ParseDuration(strings.TrimPrefix(flag, "--retry-delay="))
+			if err != nil || delay < 0 {
+				return flags, "", fmt.Errorf("Invalid RUN retry delay '%s'. Expected a non negative duration", flag)
+			}
+			flags.retryDelay = delay
+		case strings.HasPrefix(flag, "--network="):
+			network, err := parseNetwork(strings.TrimPrefix(flag, "--network="))
+			if err != nil {
+				return flags, "", fmt.Errorf("Invalid RUN flag '%s'. Error: %s", flag, err)
+			}
+			flags.network = network
+		case strings.HasPrefix(flag, "--secret="):
+			secret, err := parseSecret(strings.TrimPrefix(flag, "--secret="))
+			if err != nil {
+				return flags, "", err
+			}
+			flags.secrets = append(flags.secrets, secret)
+		default:
+			return flags, "", fmt.Errorf("Unknown RUN flag '%s'", flag)
+		}
+	}
+	if strings.TrimSpace(args) == "" {
+		return flags, "", fmt.Errorf("RUN requires a command")
+	}
+	return flags, args, nil
+}
+
+// runCommand returns the command executed for the arguments of a RUN statement,
+// and whether it is in JSON exec form (["executable", "param"]). The exec form is
+// executed without a shell, the shell form is passed to the shell exactly as
+// written
+func runCommand(script string) ([]string, bool, error) {
+	if strings.Contains(script, "\n") {
+		return []string{heredocScript(script)}, false, nil
+	}
+	if !strings.HasPrefix(script, "[") {
+		return []string{script}, false, nil
+	}
+	argv, err := parseCommand(script)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(argv) == 0 {
+		return nil, false, errors.New("RUN requires a command")
+	}
+	return argv, true, nil
+}
+
+// resolveWorkDir returns the working directory set by WORKDIR dir, resolving
+// relative paths against the current working directory
+func resolveWorkDir(current, dir string) string {
+	if !path.IsAbs(dir) {
+		if current == "" {
+			current = "/"
+		}
+		dir = path.Join(current, dir)
+	}
+	return path.Clean(dir)
+}
+
+// executeRun runs the command of a RUN statement, enforcing its timeout and
+// retrying it after non zero exits. Secrets are only present while the command
+// runs
+func (b *Builder) executeRun(c *Container, st Statement, args string) (err error) {
+	flags, script, err := parseRunFlags(args)
+	if err != nil {
+		return err
+	}
+	command, exec, err := runCommand(script)
+	if err != nil {
+		return err
+	}
+	timeout := b.opts.StepTimeout
+	if flags.timeout > 0 {
+		timeout = flags.timeout
+	}
+	retries := b.opts.RunRetries
+	if flags.retries >= 0 {
+		retries = flags.retries
+	}
+	delay := b.opts.RunRetryDelay
+	if flags.retryDelay >= 0 {
+		delay = flags.retryDelay
+	}
+	network, err := parseNetwork(b.opts.DefaultNetwork)
+	if err != nil {
+		return err
+	}
+	if flags.network != "" {
+		network = flags.network
+	}
+	for _, s := range flags.secrets {
+		if _, ok := b.opts.Secrets[s.id]; !ok {
+			return fmt.Errorf("Secret '%s' is not provided", s.id)
+		}
+	}
+	if b.opts.DryRun {
+		if b.step != nil {
+			b.step.Command = command
+		}
+		b.unverified("Commands are not executed in dry run mode")
+		return nil
+	}
+	// the timeout covers all attempts
+	ctx := b.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(b.ctx, timeout)
+		defer cancel()
+	}
+	run := c.RunCommandContext
+	if exec {
+		run = c.RunExecContext
+	}
+	c.noNetwork = network == NetworkNone
+	defer func() { c.noNetwork = false }()
+	unmountSecrets, err := c.mountSecrets(flags.secrets, b.opts.Secrets)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unmountErr := unmountSecrets(); unmountErr != nil && err == nil {
+			err = unmountErr
+		}
+	}()
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := run(ctx, command)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() == context.DeadlineExceeded && b.ctx.Err() == nil {
+			return &TimeoutError{Statement: st.Raw, Timeout: timeout, Elapsed: time.Since(started)}
+		}
+		var exitErr *ExitError
+		if ctx.Err() != nil || !errors.As(err, &exitErr) {
+			b.logger().Errorf("Failed to run command inside container. Error: %s\n", err)
+			return err
+		}
+		exitErr.Statement = st.Raw
+		if attempt > retries {
+			if retries == 0 {
+				return err
+			}
+			return &RetryError{Statement: st.Raw, Attempts: attempt, Err: err}
+		}
+		b.logger().Warnf("Attempt %d of %d of '%s' failed, retrying in %s", attempt, retries+1, st.Raw, delay)
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded && b.ctx.Err() == nil {
+				return &TimeoutError{Statement: st.Raw, Timeout: timeout, Elapsed: time.Since(started)}
+			}
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
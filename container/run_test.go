@@ -0,0 +1,114 @@
+package container
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseRunFlags(t *testing.T) {
+	flags, script, err := parseRunFlags("--timeout=10m apt-get update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.timeout != 10*time.Minute || script != "apt-get update" {
+		t.Errorf("Unexpected flags %+v and script %q", flags, script)
+	}
+	flags, script, err = parseRunFlags("echo --timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.timeout != 0 || script != "echo --timeout=1s" {
+		t.Errorf("Expected flags after the command to be kept, found %+v and %q", flags, script)
+	}
+	flags, script, err = parseRunFlags("--retries=3 --retry-delay=10s --timeout=1h pip install -r requirements.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.retries != 3 || flags.retryDelay != 10*time.Second || flags.timeout != time.Hour || script != "pip install -r requirements.txt" {
+		t.Errorf("Unexpected flags %+v and script %q", flags, script)
+	}
+	flags, script, err = parseRunFlags("--network=none make test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.network != NetworkNone || script != "make test" {
+		t.Errorf("Unexpected flags %+v and script %q", flags, script)
+	}
+	flags, _, err = parseRunFlags("make")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags.retries >= 0 || flags.retryDelay >= 0 || flags.network != "" {
+		t.Errorf("Expected unset flags, found %+v", flags)
+	}
+	for _, args := range []string{"--timeout=soon make", "--timeout=-1s make", "--network=host make", "--timeout=1m", "--retries=-1 make", "--retries=x make", "--retry-delay=-1s make"} {
+		if _, _, err := parseRunFlags(args); err == nil {
+			t.Errorf("Expected error for '%s'", args)
+		}
+	}
+}
+
+func Test_RunCommandVerbatim(t *testing.T) {
+	specs := []string{
+		`echo "a    b"`,
+		`sh -c 'x; y'`,
+		`cat /etc/passwd | grep root > /tmp/root 2>&1`,
+		`echo $HOME ${PATH} '$literal'`,
+		"printf 'a\tb\\n'\t| tee /tmp/out",
+	}
+	for _, spec := range specs {
+		b := NewBuilder("nut-test-verbatim")
+		if err := b.ParseReader(strings.NewReader("FROM ubuntu\nRUN " + spec + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		_, script, err := parseRunFlags(b.Statements[1].ArgString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		command, exec, err := runCommand(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exec {
+			t.Errorf("Expected '%s' in shell form", spec)
+		}
+		c := &Container{}
+		generated := string(c.commandScript(command, "/tmp/nut-run.pid"))
+		if !strings.HasSuffix(generated, "\n"+spec) {
+			t.Errorf("Expected script to end with %q, found %q", spec, generated)
+		}
+	}
+}
+
+func Test_RunCommandExecForm(t *testing.T) {
+	command, exec, err := runCommand(`["/usr/bin/python3", "-c", "print('a    b')"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/usr/bin/python3", "-c", "print('a    b')"}
+	if !exec || !reflect.DeepEqual(command, expected) {
+		t.Errorf("Expected exec form %q, found %q", expected, command)
+	}
+	if _, _, err := runCommand(`[]`); err == nil {
+		t.Error("Expected error for empty exec form")
+	}
+}
+
+func Test_ResolveWorkDir(t *testing.T) {
+	cases := []struct {
+		current, dir, expected string
+	}{
+		{"", "/srv", "/srv"},
+		{"", "app", "/app"},
+		{"/srv", "app", "/srv/app"},
+		{"/srv/app", "../lib/", "/srv/lib"},
+		{"/srv", "/opt//tool/.", "/opt/tool"},
+	}
+	for _, c := range cases {
+		if dir := resolveWorkDir(c.current, c.dir); dir != c.expected {
+			t.Errorf("Expected WORKDIR %s in %s to resolve to %s, found %s", c.dir, c.current, c.expected, dir)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/lxc/go-lxc.v2"
+	"strings"
+)
+
+// RuntimeInfo describes a container as seen from the host
+type RuntimeInfo struct {
+	Name string
+	// Rootfs is the host path of the container's root file system
+	Rootfs string
+	// IPAddresses lists the IPv4 and IPv6 addresses of the container, if it is
+	// running
+	IPAddresses []string
+	// InitPID is the host pid of the container's init, -1 if it is not running
+	InitPID    int
+	LXCVersion string
+}
+
+// RuntimeInfo returns the runtime information of the container
+func (c *Container) RuntimeInfo() RuntimeInfo {
+	addrs, _ := c.ct.IPAddresses()
+	rootfs, _ := c.rootfs()
+	return RuntimeInfo{
+		Name:        c.ct.Name(),
+		Rootfs:      rootfs,
+		IPAddresses: addrs,
+		InitPID:     c.ct.InitPid(),
+		LXCVersion:  lxc.Version(),
+	}
+}
+
+// RuntimeInfo returns the runtime information of the current build container.
+// It fails before the first FROM statement and in dry runs
+func (b *Builder) RuntimeInfo() (RuntimeInfo, error) {
+	if b.ct == nil || b.ct.ct == nil || b.opts.DryRun {
+		return RuntimeInfo{}, errors.New("No container has been created yet")
+	}
+	return b.ct.RuntimeInfo(), nil
+}
+
+// rootfs returns the host path of the container's rootfs. It is looked up once
+// and cached until the container is started, stopped or replaced
+func (c *Container) rootfs() (string, error) {
+	if c.rootfsDir == "" {
+		rootfs, err := rootfsPath(c.ct)
+		if err != nil {
+			return "", err
+		}
+		c.rootfsDir = rootfs
+	}
+	return c.rootfsDir, nil
+}
+
+// dir returns the directory of the container in the lxc path
+func (c *Container) dir() string {
+	return containerDir(c.ct)
+}
+
+// configKeys maps configuration keys renamed in lxc 3.0 to their current names
+var configKeys = map[string]string{
+	"lxc.rootfs":   "lxc.rootfs.path",
+	"lxc.utsname":  "lxc.uts.name",
+	"lxc.id_map":   "lxc.idmap",
+	"lxc.logfile":  "lxc.log.file",
+	"lxc.loglevel": "lxc.log.level",
+}
+
+// configKey returns the name of the configuration key legacy, as named before
+// lxc 3.0, in the lxc version nut runs against
+func configKey(legacy string) string {
+	if current, ok := configKeys[legacy]; ok && lxc.VersionAtLeast(3, 0, 0) {
+		return current
+	}
+	return legacy
+}
+
+// rootfsConfig returns the configured rootfs of ct, which may be prefixed with
+// the storage type, e.g. dir: or overlay:. lxc.rootfs.path is tried before
+// lxc.rootfs of lxc versions before 3.0
+func rootfsConfig(ct lxcContainer) string {
+	for _, key := range []string{"lxc.rootfs.path", "lxc.rootfs"} {
+		if values := ct.ConfigItem(key); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// splitRootfs splits a configured rootfs into its storage type, empty for plain
+// paths, and the storage specific location
+func splitRootfs(value string) (string, string) {
+	if i := strings.Index(value, ":"); i > 0 && !strings.HasPrefix(value, "/") {
+		return value[:i], value[i+1:]
+	}
+	return "", value
+}
+
+// rootfsPath returns the host path of the rootfs of ct. The merged rootfs of
+// running overlay containers is reached through the root of their init process,
+// stopped ones yield their writable upper directory. Other storage types are
+// only mounted inside running containers
+func rootfsPath(ct lxcContainer) (string, error) {
+	value := rootfsConfig(ct)
+	if value == "" {
+		return "", fmt.Errorf("Container %s has no rootfs configured", ct.Name())
+	}
+	storage, path := splitRootfs(value)
+	switch storage {
+	case "", "dir", "btrfs":
+		return path, nil
+	}
+	if pid := ct.InitPid(); ct.Running() && pid > 0 {
+		return fmt.Sprintf("/proc/%d/root", pid), nil
+	}
+	switch storage {
+	case "overlay", "overlayfs", "aufs":
+		return path[strings.LastIndex(path, ":")+1:], nil
+	}
+	return "", fmt.Errorf("Rootfs %s of container %s is not mounted", value, ct.Name())
+}
@@ -0,0 +1,73 @@
+package container
+
+import (
+	"gopkg.in/lxc/go-lxc.v2"
+	"path/filepath"
+	"testing"
+)
+
+func Test_SplitRootfs(t *testing.T) {
+	for value, expected := range map[string][2]string{
+		"/var/lib/lxc/app/rootfs":                           {"", "/var/lib/lxc/app/rootfs"},
+		"dir:/var/lib/lxc/app/rootfs":                       {"dir", "/var/lib/lxc/app/rootfs"},
+		"btrfs:/var/lib/lxc/app/rootfs":                     {"btrfs", "/var/lib/lxc/app/rootfs"},
+		"overlay:/var/lib/lxc/base/rootfs:/var/lib/lxc/app": {"overlay", "/var/lib/lxc/base/rootfs:/var/lib/lxc/app"},
+		"": {"", ""},
+	} {
+		storage, path := splitRootfs(value)
+		if storage != expected[0] || path != expected[1] {
+			t.Errorf("Expected %q to split into %q, found %q %q", value, expected, storage, path)
+		}
+	}
+}
+
+func Test_RootfsMissing(t *testing.T) {
+	c, err := NewContainer("nut-test-no-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.rootfs(); err == nil {
+		t.Error("Expected error for container without rootfs")
+	}
+}
+
+func Test_ConfigKey(t *testing.T) {
+	legacy := !lxc.VersionAtLeast(3, 0, 0)
+	for key, current := range map[string]string{"lxc.rootfs": "lxc.rootfs.path", "lxc.utsname": "lxc.uts.name", "lxc.arch": "lxc.arch"} {
+		expected := current
+		if legacy {
+			expected = key
+		}
+		if found := configKey(key); found != expected {
+			t.Errorf("Expected key %s for %s, found %s", expected, key, found)
+		}
+	}
+}
+
+func Test_BuilderRuntimeInfo(t *testing.T) {
+	b := NewBuilder("nut-test-runtime")
+	if _, err := b.RuntimeInfo(); err == nil {
+		t.Error("Expected runtime information to be unavailable before FROM")
+	}
+}
+
+func Test_RuntimeInfoLXC(t *testing.T) {
+	ct, err := NewContainer("nut-test-runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.Create("trusty"); err != nil {
+		t.Fatal(err)
+	}
+	defer ct.DestroyAll()
+	if err := ct.Start(); err != nil {
+		t.Fatal(err)
+	}
+	info := ct.RuntimeInfo()
+	if info.Name != "nut-test-runtime" || info.InitPID <= 0 || len(info.IPAddresses) == 0 || info.LXCVersion == "" {
+		t.Errorf("Expected runtime information of running container, found %+v", info)
+	}
+	if !fileExists(filepath.Join(info.Rootfs, "bin", "sh")) {
+		t.Errorf("Expected rootfs %s to hold /bin/sh", info.Rootfs)
+	}
+}
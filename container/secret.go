@@ -0,0 +1,225 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// secretMount is a secret made available to a single RUN statement
+type secretMount struct {
+	id     string
+	target string
+}
+
+// parseSecret parses the value of a RUN --secret flag, id=name[,target=path]. The
+// target defaults to /run/secrets/<id>
+func parseSecret(spec string) (secretMount, error) {
+	var s secretMount
+	for _, field := range strings.Split(spec, ",") {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return s, fmt.Errorf("Invalid secret '%s'. Expected id=name[,target=path]", spec)
+		}
+		switch pair[0] {
+		case "id":
+			s.id = pair[1]
+		case "target", "dst":
+			s.target = pair[1]
+		default:
+			return s, fmt.Errorf("Invalid secret '%s'. Unknown option '%s'", spec, pair[0])
+		}
+	}
+	if s.id == "" {
+		return s, fmt.Errorf("Invalid secret '%s'. Missing id", spec)
+	}
+	if s.target == "" {
+		s.target = path.Join("/run/secrets", s.id)
+	}
+	if !path.IsAbs(s.target) {
+		return s, fmt.Errorf("Invalid secret '%s'. Target must be an absolute path", spec)
+	}
+	s.target = path.Clean(s.target)
+	return s, nil
+}
+
+// mountSecrets writes the secrets, read from the host files in sources, into the
+// container's rootfs. The returned function removes them again, overwriting their
+// content first, and restores files they replaced. It must be called before the
+// container is stored or exported
+func (c *Container) mountSecrets(secrets []secretMount, sources map[string]string) (func() error, error) {
+	if len(secrets) == 0 {
+		return func() error { return nil }, nil
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return nil, err
+	}
+	uid, gid := 0, 0
+	if c.Manifest.User != "" {
+		u, err := lookupUser(rootfs, c.Manifest.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, gid = u.uid, u.gid
+	}
+	// like copied files, secrets are owned by host ids in id mapped containers.
+	// Unprivileged builds can only hand files to them from a user namespace
+	ids, err := c.idMap()
+	if err != nil {
+		return nil, err
+	}
+	chown := func(p string, uid, gid int) error {
+		if c.unprivileged {
+			return ids.chownTo(p, uid, gid)
+		}
+		return os.Lchown(p, ids.shift("u", uid, true), ids.shift("g", gid, true))
+	}
+	var unmounts []func() error
+	unmountAll := func() error {
+		var failed error
+		for i := len(unmounts) - 1; i >= 0; i-- {
+			if err := unmounts[i](); err != nil {
+				failed = err
+			}
+		}
+		return failed
+	}
+	for _, s := range secrets {
+		unmount, err := mountSecret(c.logger(), rootfs, s.target, sources[s.id], uid, gid, chown)
+		if err != nil {
+			unmountAll()
+			return nil, fmt.Errorf("Failed to mount secret '%s' at %s. Error: %s", s.id, s.target, err)
+		}
+		c.logger().Debugf("Mounted secret '%s' at %s", s.id, s.target)
+		unmounts = append(unmounts, unmount)
+	}
+	return unmountAll, nil
+}
+
+// mountSecret copies the host file source to the container path target below
+// rootfs, readable only by the container ids uid and gid. chown hands the secret
+// to them and the directories created for it to root. Paths are resolved with
+// resolveInRoot, again when removing the secret, so symlinks in the image or
+// created by the command can not lead outside of rootfs
+func mountSecret(l Logger, rootfs, target, source string, uid, gid int, chown func(path string, uid, gid int) error) (func() error, error) {
+	content, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	// resolve resolves the parent directory of p, so p itself may be a symlink
+	resolve := func(p string) (string, error) {
+		dir, err := resolveInRoot(rootfs, path.Dir(p))
+		return filepath.Join(dir, path.Base(p)), err
+	}
+	hostTarget, err := resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	// remember the directories created for the target to remove them again
+	var created []string
+	for dir := filepath.Dir(hostTarget); dir != rootfs && !fileExists(dir); dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(rootfs, dir)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, "/"+filepath.ToSlash(rel))
+	}
+	backup := ""
+	if _, err := os.Lstat(hostTarget); err == nil {
+		backup = target + ".nut-secret-backup"
+		hostBackup, err := resolve(backup)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Rename(hostTarget, hostBackup); err != nil {
+			return nil, err
+		}
+	}
+	unmount := func() error {
+		hostTarget, err := resolve(target)
+		if err == nil {
+			err = shred(hostTarget)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to remove secret %s. Error: %s", target, err)
+		}
+		for _, dir := range created {
+			hostDir, err := resolveInRoot(rootfs, dir)
+			if err == nil {
+				err = os.Remove(hostDir)
+			}
+			if err != nil {
+				loggerOrDefault(l).Warnf("Failed to remove directory %s created for a secret. Error: %s", dir, err)
+			}
+		}
+		if backup == "" {
+			return nil
+		}
+		hostBackup, err := resolve(backup)
+		if err == nil {
+			hostTarget, err = resolve(target)
+		}
+		if err == nil {
+			err = os.Rename(hostBackup, hostTarget)
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(hostTarget), 0755); err != nil {
+		unmount()
+		return nil, err
+	}
+	for _, dir := range created {
+		hostDir, err := resolveInRoot(rootfs, dir)
+		if err == nil {
+			err = chown(hostDir, 0, 0)
+		}
+		if err != nil {
+			unmount()
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(hostTarget, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		unmount()
+		return nil, err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = chown(hostTarget, uid, gid)
+	}
+	if err != nil {
+		unmount()
+		return nil, err
+	}
+	return unmount, nil
+}
+
+// shred overwrites the content of the file at p with zeros before removing it
+func shred(p string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		f, err := os.OpenFile(p, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(make([]byte, info.Size()))
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(p)
+}
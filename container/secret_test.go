@@ -0,0 +1,212 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func Test_ParseSecret(t *testing.T) {
+	secrets := map[string]secretMount{
+		"id=netrc,target=/root/.netrc": {"netrc", "/root/.netrc"},
+		"id=token":                     {"token", "/run/secrets/token"},
+		"target=/tmp/../key,id=key":    {"key", "/key"},
+	}
+	for spec, expected := range secrets {
+		s, err := parseSecret(spec)
+		if err != nil {
+			t.Errorf("Failed to parse '%s'. Error: %s", spec, err)
+			continue
+		}
+		if s != expected {
+			t.Errorf("Expected %+v for '%s', found %+v", expected, spec, s)
+		}
+	}
+	for _, spec := range []string{"", "netrc", "target=/root/.netrc", "id=netrc,target=.netrc", "id=netrc,mode=0400"} {
+		if _, err := parseSecret(spec); err == nil {
+			t.Errorf("Expected error for '%s'", spec)
+		}
+	}
+}
+
+func Test_MountSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "netrc")
+	if err := ioutil.WriteFile(source, []byte("machine example.com password s3cr3t"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	existing := filepath.Join(rootfs, "root", ".netrc")
+	if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(existing, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(rootfs, "run", "secrets", "netrc")
+	var unmounts []func() error
+	for _, target := range []string{"/root/.netrc", "/run/secrets/netrc"} {
+		unmount, err := mountSecret(nil, rootfs, target, source, 0, 0, os.Lchown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unmounts = append(unmounts, unmount)
+		content, err := ioutil.ReadFile(filepath.Join(rootfs, target))
+		if err != nil || string(content) != "machine example.com password s3cr3t" {
+			t.Errorf("Expected secret at %s, found %q (%v)", target, content, err)
+		}
+	}
+	for _, unmount := range unmounts {
+		if err := unmount(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content, err := ioutil.ReadFile(existing); err != nil || string(content) != "image" {
+		t.Errorf("Expected replaced file to be restored, found %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "run")); !os.IsNotExist(err) {
+		t.Errorf("Expected directories created for the secret to be removed, found %v", err)
+	}
+	if _, err := mountSecret(nil, rootfs, "/run/secrets/netrc", filepath.Join(dir, "missing"), 0, 0, os.Lchown); err == nil {
+		t.Error("Expected error for missing secret source")
+	}
+	if fileExists(created) {
+		t.Errorf("Expected no secret at %s", created)
+	}
+}
+
+func Test_MountSecretSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "netrc")
+	if err := ioutil.WriteFile(source, []byte("s3cr3t"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the image links its secrets directory to an absolute path, which must
+	// resolve inside the rootfs rather than on the host
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "netrc"), []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "run"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(rootfs, "run", "secrets")); err != nil {
+		t.Fatal(err)
+	}
+	unmount, err := mountSecret(nil, rootfs, "/run/secrets/netrc", source, 0, 0, os.Lchown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside := filepath.Join(rootfs, outside, "netrc")
+	if content, err := ioutil.ReadFile(inside); err != nil || string(content) != "s3cr3t" {
+		t.Errorf("Expected secret at %s, found %q (%v)", inside, content, err)
+	}
+	if err := unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(outside, "netrc")); err != nil || string(content) != "host" {
+		t.Errorf("Expected the host file to be left alone, found %q (%v)", content, err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "run", "secrets")); err != nil {
+		t.Errorf("Expected the symlink to be kept. Error: %s", err)
+	}
+	if fileExists(filepath.Join(rootfs, dir)) {
+		t.Errorf("Expected directories created for the secret to be removed")
+	}
+}
+
+func Test_MountSecretsIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing file owners requires root")
+	}
+	be := newFakeBackend(t, "nut-test-base")
+	defer be.cleanup()
+	source := filepath.Join(be.dir, "netrc")
+	if err := ioutil.WriteFile(source, []byte("s3cr3t"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ct := be.open("nut-test-base")
+	ct.SetConfigItem("lxc.idmap", "u 0 100000 65536")
+	ct.SetConfigItem("lxc.idmap", "g 0 100000 65536")
+	c, err := newContainer(be, "nut-test-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := func(p string) (uint32, uint32) {
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		return stat.Uid, stat.Gid
+	}
+	secrets := []secretMount{{id: "netrc", target: "/run/secrets/netrc"}}
+	sources := map[string]string{"netrc": source}
+	for user, expected := range map[string]uint32{"": 100000, "1000:1000": 101000} {
+		c.Manifest.User = user
+		unmount, err := c.mountSecrets(secrets, sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid, gid := owner(filepath.Join(rootfs, "run", "secrets", "netrc")); uid != expected || gid != expected {
+			t.Errorf("Expected the secret of user '%s' to be owned by %d:%d, found %d:%d", user, expected, expected, uid, gid)
+		}
+		if uid, gid := owner(filepath.Join(rootfs, "run")); uid != 100000 || gid != 100000 {
+			t.Errorf("Expected directories created for the secret to be owned by 100000:100000, found %d:%d", uid, gid)
+		}
+		if err := unmount(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// unprivileged builds chown to container ids inside a user namespace, which
+	// a stand-in for lxc-usernsexec records
+	bin := filepath.Join(be.dir, "bin")
+	calls := filepath.Join(be.dir, "usernsexec")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "lxc-usernsexec"), []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	c.unprivileged = true
+	c.Manifest.User = "1000:1000"
+	unmount, err := c.mountSecrets(secrets, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmount()
+	data, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"-- chown -h 0:0 " + filepath.Join(rootfs, "run") + "\n",
+		"-- chown -h 0:0 " + filepath.Join(rootfs, "run", "secrets") + "\n",
+		"-- chown -h 1000:1000 " + filepath.Join(rootfs, "run", "secrets", "netrc") + "\n",
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %q in the user namespace commands, found %q", expected, data)
+		}
+	}
+}
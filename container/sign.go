@@ -0,0 +1,122 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Signer creates detached signatures of images
+type Signer interface {
+	// Sign writes the armored detached signature of the content of r to sig
+	Sign(r io.Reader, sig io.Writer) error
+}
+
+// GPGSigner signs images with gpg, using the armored private key in KeyFile.
+// The key is imported into a temporary keyring, the keyring of the user is not
+// touched
+type GPGSigner struct {
+	KeyFile string
+	// PassphraseFile holds the passphrase of the key, if it has one
+	PassphraseFile string
+}
+
+// Sign writes the armored detached signature of the content of r to sig
+func (s *GPGSigner) Sign(r io.Reader, sig io.Writer) error {
+	home, err := gpgHome(s.KeyFile)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+	args := []string{"--armor", "--detach-sign", "--output", "-"}
+	if s.PassphraseFile != "" {
+		args = append([]string{"--pinentry-mode", "loopback", "--passphrase-file", s.PassphraseFile}, args...)
+	}
+	cmd := gpgCommand(home, args...)
+	var stderr bytes.Buffer
+	cmd.Stdin = r
+	cmd.Stdout = sig
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to sign image. Error: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// signaturePath returns the location of the detached signature of the image at
+// path
+func signaturePath(path string) string {
+	return path + ".asc"
+}
+
+// signImage writes the detached signature of the image at path next to it and
+// returns its location
+func signImage(path string, signer Signer) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sigPath := signaturePath(path)
+	sig, err := os.Create(sigPath)
+	if err != nil {
+		return "", err
+	}
+	err = signer.Sign(f, sig)
+	if closeErr := sig.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(sigPath)
+		return "", err
+	}
+	return sigPath, nil
+}
+
+// VerifyExportSignature checks the detached signature sig of the image archive
+// against the public keys in keyring, an armored or binary OpenPGP key file. A
+// SignatureError is returned if the signature is not valid
+func VerifyExportSignature(archive, sig, keyring string) error {
+	for _, f := range []string{archive, sig} {
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	home, err := gpgHome(keyring)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+	var status, stderr bytes.Buffer
+	cmd := gpgCommand(home, "--status-fd", "1", "--verify", sig, archive)
+	cmd.Stdout = &status
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil || !strings.Contains(status.String(), "[GNUPG:] VALIDSIG ") {
+		return &SignatureError{Archive: archive, Detail: strings.TrimSpace(stderr.String())}
+	}
+	return nil
+}
+
+// gpgHome returns a temporary gpg home directory with the keys of keyFile
+// imported
+func gpgHome(keyFile string) (string, error) {
+	home, err := ioutil.TempDir("", "nut-gpg")
+	if err != nil {
+		return "", err
+	}
+	out, err := gpgCommand(home, "--import", keyFile).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(home)
+		return "", fmt.Errorf("Failed to import keys from %s. Error: %s %s", keyFile, err, strings.TrimSpace(string(out)))
+	}
+	return home, nil
+}
+
+func gpgCommand(home string, args ...string) *exec.Cmd {
+	return exec.Command("gpg", append([]string{"--batch", "--no-tty", "--homedir", home}, args...)...)
+}
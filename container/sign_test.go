@@ -0,0 +1,80 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// generateKey creates a gpg key without passphrase and returns the files of its
+// armored private and public key
+func generateKey(t *testing.T, dir, uid string) (string, string) {
+	home := filepath.Join(dir, "home-"+uid)
+	if err := os.Mkdir(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := gpgCommand(home, "--passphrase", "", "--quick-gen-key", uid+"@example.com", "ed25519", "sign", "never").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to generate key. Error: %s %s", err, out)
+	}
+	private, err := gpgCommand(home, "--armor", "--export-secret-keys").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := gpgCommand(home, "--armor", "--export").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateFile := filepath.Join(dir, uid+".key")
+	publicFile := filepath.Join(dir, uid+".pub")
+	if err := ioutil.WriteFile(privateFile, private, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(publicFile, public, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privateFile, publicFile
+}
+
+func Test_SignImage(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	dir, err := ioutil.TempDir("", "nut-test-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	private, public := generateKey(t, dir, "release")
+	_, otherPublic := generateKey(t, dir, "other")
+	image := filepath.Join(dir, "app.tar.gz")
+	if err := ioutil.WriteFile(image, []byte("image content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signImage(image, &GPGSigner{KeyFile: private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig != image+".asc" {
+		t.Errorf("Expected signature next to the image, found %s", sig)
+	}
+	if err := VerifyExportSignature(image, sig, public); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := VerifyExportSignature(image, sig, otherPublic).(*SignatureError); !ok {
+		t.Error("Expected signature error for an unknown key")
+	}
+	if err := ioutil.WriteFile(image, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := VerifyExportSignature(image, sig, public).(*SignatureError); !ok {
+		t.Error("Expected signature error for a tampered image")
+	}
+	opts := ImportOptions{Keyring: public}
+	if _, err := ImportContainer(image, "signed-import", opts); err == nil {
+		t.Error("Expected import of a tampered image to fail")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("Expected import to fail on the signature, found %v", err)
+	}
+}
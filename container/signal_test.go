@@ -0,0 +1,23 @@
+package container
+
+import (
+	"syscall"
+	"testing"
+)
+
+func Test_ParseSignal(t *testing.T) {
+	for _, s := range []string{"SIGUSR1", "usr1", "10"} {
+		name, sig, err := ParseSignal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "SIGUSR1" || sig != syscall.SIGUSR1 {
+			t.Fatalf("Expected SIGUSR1 for %s, found: %s (%d)", s, name, sig)
+		}
+	}
+	for _, s := range []string{"SIGFOO", "0", "99", ""} {
+		if _, _, err := ParseSignal(s); err == nil {
+			t.Errorf("Expected error for signal '%s'", s)
+		}
+	}
+}
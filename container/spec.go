@@ -0,0 +1,150 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Spec assembles a specification in code. Each method appends a statement
+// after running it through the parser and the checks of Validate, so specs
+// build exactly like their rendered specification files. Methods return the
+// spec for chaining; once a statement is rejected, later ones are ignored and
+// Err reports the first failure. Specs share no state, but a single Spec must
+// not be used from several goroutines at once
+type Spec struct {
+	statements []Statement
+	v          validator
+	// line is the line of the rendered specification the next statement
+	// starts at
+	line int
+	err  error
+}
+
+// NewSpec returns an empty spec
+func NewSpec() *Spec {
+	return &Spec{v: validator{stages: make(map[string]bool)}, line: 1}
+}
+
+// Err returns the error of the first rejected statement
+func (s *Spec) Err() error {
+	return s.err
+}
+
+// Append appends a statement written in specification syntax, e.g. to use
+// instructions or flags that have no method of their own. Heredocs are
+// supported, line continuations and comments are not
+func (s *Spec) Append(statement string) *Spec {
+	if s.err != nil {
+		return s
+	}
+	p := NewBuilder("")
+	if err := p.ParseReader(strings.NewReader(statement)); err != nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			parseErr.Line += s.line - 1
+		}
+		s.err = err
+		return s
+	}
+	if len(p.Statements) != 1 || p.Statements[0].Raw != statement {
+		s.err = fmt.Errorf("Invalid statement '%s'. Expected a single statement without comments", statement)
+		return s
+	}
+	st := p.Statements[0]
+	st.Line = s.line
+	s.v.check(st, func(err error) {
+		if s.err == nil {
+			s.err = &StatementError{Index: len(s.statements), Line: st.Line, Statement: st.Raw, Err: err}
+		}
+	})
+	if s.err != nil {
+		return s
+	}
+	s.statements = append(s.statements, st)
+	s.line += strings.Count(statement, "\n") + 1
+	return s
+}
+
+// From starts a build stage from the container or image parent
+func (s *Spec) From(parent string) *Spec {
+	return s.Append("FROM " + parent)
+}
+
+// Run runs the shell command cmd, which must fit on a single line
+func (s *Spec) Run(cmd string) *Spec {
+	return s.Append("RUN " + cmd)
+}
+
+// Env sets the environment variable key. Variables referenced in value are
+// expanded like in specification files
+func (s *Spec) Env(key, value string) *Spec {
+	return s.keyValue("ENV", key, value)
+}
+
+// Label sets the label key. Variables referenced in value are expanded like in
+// specification files
+func (s *Spec) Label(key, value string) *Spec {
+	return s.keyValue("LABEL", key, value)
+}
+
+func (s *Spec) keyValue(instruction, key, value string) *Spec {
+	if s.err == nil && (key == "" || strings.ContainsAny(key, "= \t\n'\"\\")) {
+		s.err = fmt.Errorf("Invalid %s key '%s'", instruction, key)
+	}
+	if value == "" || strings.ContainsAny(value, " \t'\"\\") {
+		value = shellQuote(value)
+	}
+	return s.Append(instruction + " " + key + "=" + value)
+}
+
+// Copy copies src from the build context to dst in the container. Neither path
+// may contain whitespace
+func (s *Spec) Copy(src, dst string) *Spec {
+	if s.err == nil && (src == "" || dst == "" || strings.ContainsAny(src+dst, " \t\n")) {
+		s.err = fmt.Errorf("Invalid COPY paths '%s' and '%s'. Paths must not be empty or contain whitespace", src, dst)
+	}
+	return s.Append("COPY " + src + " " + dst)
+}
+
+// Expose declares the ports the container listens on, e.g. 80 or 53/udp
+func (s *Spec) Expose(ports ...string) *Spec {
+	if s.err == nil && len(ports) == 0 {
+		s.err = errors.New("EXPOSE requires at least one port")
+	}
+	return s.Append("EXPOSE " + strings.Join(ports, " "))
+}
+
+// Cmd sets the default command of the container, in exec form
+func (s *Spec) Cmd(argv ...string) *Spec {
+	if argv == nil {
+		argv = []string{}
+	}
+	data, err := json.Marshal(argv)
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	return s.Append("CMD " + string(data))
+}
+
+// Render returns the spec in specification file syntax
+func (s *Spec) Render() string {
+	var b strings.Builder
+	for _, st := range s.statements {
+		b.WriteString(st.Raw)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// LoadSpec populates build instructions from s, like Parse does from a
+// specification file. Build context paths are relative to RootDir
+func (b *Builder) LoadSpec(s *Spec) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	b.Statements = append([]Statement(nil), s.statements...)
+	b.Directives = make(map[string]string)
+	return nil
+}
@@ -0,0 +1,87 @@
+package container
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Spec(t *testing.T) {
+	s := NewSpec().
+		From("ubuntu").
+		Env("GREETING", "it's a \"test\"").
+		Env("PATH", "/opt/app/bin:$PATH").
+		Label("team", "").
+		Run("make install").
+		Append("WORKDIR /srv").
+		Expose("80", "53/udp").
+		Cmd("/srv/app", "--name", "a b")
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := `FROM ubuntu
+ENV GREETING='it'\''s a "test"'
+ENV PATH=/opt/app/bin:$PATH
+LABEL team=''
+RUN make install
+WORKDIR /srv
+EXPOSE 80 53/udp
+CMD ["/srv/app","--name","a b"]
+`
+	if s.Render() != expected {
+		t.Fatalf("Expected:\n%s\nfound:\n%s", expected, s.Render())
+	}
+
+	fromSpec := NewBuilder("nut-test-spec")
+	if err := fromSpec.LoadSpec(s); err != nil {
+		t.Fatal(err)
+	}
+	parsed := NewBuilder("nut-test-spec")
+	if err := parsed.ParseReader(strings.NewReader(s.Render())); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromSpec.Statements, parsed.Statements) {
+		t.Errorf("Expected statements of the spec to equal those of its rendering, found %+v and %+v", fromSpec.Statements, parsed.Statements)
+	}
+	steps, err := fromSpec.DryRun(BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := steps[len(steps)-1].Manifest
+	if !reflect.DeepEqual(manifest.Cmd, []string{"/srv/app", "--name", "a b"}) || manifest.Labels["team"] != "" {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+	if env := manifest.Env; len(env) == 0 || env[0] != `GREETING=it's a "test"` {
+		t.Errorf("Expected quoted ENV value to survive, found %v", env)
+	}
+}
+
+func Test_SpecErrors(t *testing.T) {
+	specs := map[string]*Spec{
+		"RUN instruction before FROM":         NewSpec().Run("true"),
+		"Invalid port 'http'":                 NewSpec().From("ubuntu").Expose("http"),
+		"Expected a single statement":         NewSpec().From("ubuntu").Run("make\nmake install"),
+		"Invalid ENV key":                     NewSpec().From("ubuntu").Env("A B", "1"),
+		"Paths must not be empty":             NewSpec().From("ubuntu").Copy("my app", "/srv"),
+		"Unknown build stage 'builder'":       NewSpec().From("ubuntu").Append("COPY --from=builder /app /app"),
+		"Unterminated line continuation":      NewSpec().From("ubuntu").Run("make \\"),
+		"Unknown instruction 'RNU' at line 2": NewSpec().From("ubuntu").Append("RNU true").Run("true"),
+	}
+	for expected, s := range specs {
+		if err := s.Err(); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q, found %v", expected, err)
+		}
+	}
+	s := NewSpec().From("ubuntu").Run("true").Expose("http")
+	var stmtErr *StatementError
+	if !errors.As(s.Err(), &stmtErr) || stmtErr.Index != 2 || stmtErr.Line != 3 {
+		t.Errorf("Expected a StatementError for the third statement, found %v", s.Err())
+	}
+	if s.Render() != "FROM ubuntu\nRUN true\n" {
+		t.Errorf("Expected rejected statements to be left out, found %q", s.Render())
+	}
+	if err := NewBuilder("nut-test-spec").LoadSpec(s); err != s.Err() {
+		t.Errorf("Expected LoadSpec to fail with the error of the spec, found %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package container
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseFrom parses the arguments of a FROM instruction of the form
+// <parent> [AS <stage>]
+func parseFrom(args []string) (string, string, error) {
+	switch {
+	case len(args) == 1:
+		return args[0], "", nil
+	case len(args) == 3 && strings.EqualFold(args[1], "AS"):
+		return args[0], args[2], nil
+	}
+	return "", "", fmt.Errorf("Invalid FROM instruction. Expected FROM <parent> [AS <stage>]")
+}
+
+// countStages returns the number of FROM instructions in the build
+func (b *Builder) countStages() int {
+	count := 0
+	for _, st := range b.Statements {
+		if st.Instruction == "FROM" {
+			count++
+		}
+	}
+	return count
+}
+
+// stageContainerName returns the container name for the stage at index. The last
+// stage produces the final container and gets the builder's name
+func (b *Builder) stageContainerName(index, total int) string {
+	if index == total-1 {
+		return b.Name
+	}
+	return fmt.Sprintf("%s-stage-%d", b.Name, index)
+}
+
+// addStage registers the container of a stage by its index and optional alias
+func (b *Builder) addStage(c *Container, alias string) error {
+	if alias != "" {
+		if _, ok := b.stages[alias]; ok {
+			return fmt.Errorf("Duplicate stage name '%s'", alias)
+		}
+		b.stages[alias] = c
+	}
+	b.stages[strconv.Itoa(len(b.stageList))] = c
+	b.stageList = append(b.stageList, c)
+	if b.unregistered == c {
+		b.unregistered = nil
+	}
+	return nil
+}
+
+// lookupStage returns the container of a previous stage referenced by name or index
+func (b *Builder) lookupStage(ref string, current *Container) (*Container, error) {
+	c, ok := b.stages[ref]
+	if !ok {
+		return nil, fmt.Errorf("Unknown build stage '%s'", ref)
+	}
+	if c == current {
+		return nil, fmt.Errorf("Build stage '%s' refers to the current stage", ref)
+	}
+	return c, nil
+}
+
+// cleanup stops and optionally destroys all containers created by a failed build
+func (b *Builder) cleanup(stop, destroy bool) {
+	containers := b.stageList
+	if b.unregistered != nil {
+		containers = append(containers, b.unregistered)
+	}
+	for _, c := range containers {
+		if stop && c.ct.Running() {
+			if err := c.Stop(); err != nil {
+				b.logger().Warnf("%s", err)
+			}
+		}
+		if !destroy {
+			continue
+		}
+		b.logger().Infof("Destroying container %s of failed build", c.ct.Name())
+		if err := c.DestroyAll(); err != nil {
+			b.logger().Warnf("%s", err)
+		}
+	}
+}
+
+// destroyStages stops and destroys containers of intermediate stages
+func (b *Builder) destroyStages(final *Container) error {
+	for _, c := range b.stageList {
+		if c == final {
+			continue
+		}
+		b.logger().Infof("Destroying intermediate stage container %s", c.ct.Name())
+		if err := c.DestroyAll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanupPolicy selects whether build containers are destroyed once the build
+// finished
+type CleanupPolicy string
+
+// Cleanup policies. CleanupKeep is the default
+const (
+	// CleanupKeep keeps the built container, and the containers of failed
+	// builds if KeepOnFailure is set
+	CleanupKeep CleanupPolicy = "keep"
+	// CleanupDestroyOnSuccess destroys the built container once the build
+	// succeeded, after its manifest and artifacts were written
+	CleanupDestroyOnSuccess CleanupPolicy = "destroy-on-success"
+	// CleanupAlways destroys the build containers whether or not the build
+	// succeeded, overriding KeepOnFailure
+	CleanupAlways CleanupPolicy = "always"
+)
+
+// ParseCleanupPolicy returns the cleanup policy named s, CleanupKeep if s is
+// empty
+func ParseCleanupPolicy(s string) (CleanupPolicy, error) {
+	switch p := CleanupPolicy(strings.ToLower(s)); p {
+	case "":
+		return CleanupKeep, nil
+	case CleanupKeep, CleanupDestroyOnSuccess, CleanupAlways:
+		return p, nil
+	}
+	return "", fmt.Errorf("Invalid cleanup policy '%s'. Expected keep, destroy-on-success or always", s)
+}
+
+// finish applies the cleanup policy to the containers of a build that ended with
+// err. Containers of failed builds are destroyed already, unless they were kept
+// with KeepOnFailure or the build continued after failed RUN statements.
+// Intermediate stages kept with KeepStages survive successful builds
+func (b *Builder) finish(c *Container, err error) {
+	if b.opts.DryRun {
+		return
+	}
+	switch {
+	case b.opts.Cleanup == CleanupAlways && err != nil:
+		if !b.opts.KeepOnFailure && !b.built {
+			return
+		}
+		b.logger().Infof("Destroying containers of failed build as of cleanup policy %s", b.opts.Cleanup)
+		b.cleanup(true, true)
+	case (b.opts.Cleanup == CleanupAlways || b.opts.Cleanup == CleanupDestroyOnSuccess) && err == nil && c != nil:
+		b.logger().Infof("Destroying container %s as of cleanup policy %s", c.ct.Name(), b.opts.Cleanup)
+		if err := c.DestroyAll(); err != nil {
+			b.logger().Warnf("%s", err)
+		}
+	}
+}
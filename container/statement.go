@@ -0,0 +1,57 @@
+package container
+
+import (
+	"strings"
+)
+
+// Statement represents a single build instruction of a specification
+type Statement struct {
+	// Instruction is the upper-cased instruction keyword, e.g. RUN
+	Instruction string
+	// Args holds the whitespace separated arguments following the instruction
+	Args []string
+	// Raw is the statement as written, with line continuations joined
+	Raw string
+	// Line is the source line the statement starts at
+	Line int
+}
+
+// NewStatement parses a raw statement starting at the given source line
+func NewStatement(raw string, line int) Statement {
+	words := strings.Fields(raw)
+	s := Statement{Raw: raw, Line: line}
+	if len(words) == 0 {
+		return s
+	}
+	s.Instruction = strings.ToUpper(words[0])
+	s.Args = words[1:]
+	return s
+}
+
+// ArgString returns the text following the instruction keyword, verbatim
+func (s Statement) ArgString() string {
+	trimmed := strings.TrimLeft(s.Raw, " \t")
+	end := strings.IndexAny(trimmed, " \t\n")
+	if end < 0 {
+		return ""
+	}
+	return strings.TrimSpace(trimmed[end:])
+}
+
+// String renders the statement with its canonical instruction keyword
+func (s Statement) String() string {
+	args := s.ArgString()
+	if args == "" {
+		return s.Instruction
+	}
+	return s.Instruction + " " + args
+}
+
+// RawStatements returns the statements as written in the specification
+func (b *Builder) RawStatements() []string {
+	raw := make([]string, len(b.Statements))
+	for i, s := range b.Statements {
+		raw[i] = s.Raw
+	}
+	return raw
+}
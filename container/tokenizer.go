@@ -0,0 +1,55 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokenize splits statement arguments on whitespace while honoring single quotes,
+// double quotes and backslash escapes. Quotes are removed from the resulting tokens,
+// so `KEY="hello world"` yields the single token `KEY=hello world`
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	var quote rune
+	inToken := false
+	escaped := false
+	for _, ch := range s {
+		switch {
+		case escaped:
+			token.WriteRune(ch)
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped = true
+			inToken = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else {
+				token.WriteRune(ch)
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+			inToken = true
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(ch)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote %c in '%s'", quote, s)
+	}
+	if escaped {
+		token.WriteRune('\\')
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
@@ -0,0 +1,30 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Tokenize(t *testing.T) {
+	cases := map[string][]string{
+		`GREETING="hello world"`:                  {"GREETING=hello world"},
+		`a='single "quoted"' b="double 'quoted'"`: {`a=single "quoted"`, `b=double 'quoted'`},
+		`url="https://example.com/?a=b&c=d" x=1`:  {"url=https://example.com/?a=b&c=d", "x=1"},
+		`escaped=hello\ world quote=\"`:           {"escaped=hello world", `quote="`},
+		"  spaced   \t words ":                    {"spaced", "words"},
+		`empty=""`:                                {"empty="},
+		`literal='back\slash'`:                    {`literal=back\slash`},
+	}
+	for in, expected := range cases {
+		tokens, err := tokenize(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tokens, expected) {
+			t.Errorf("Expected: %#v, found: %#v", expected, tokens)
+		}
+	}
+	if _, err := tokenize(`GREETING="hello`); err == nil {
+		t.Fatal("Expected error for unterminated quote")
+	}
+}
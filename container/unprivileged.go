@@ -0,0 +1,236 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"gopkg.in/lxc/go-lxc.v2"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Files allocating subordinate ids to users, which unprivileged containers map
+// their ids to
+var (
+	subUIDFile = "/etc/subuid"
+	subGIDFile = "/etc/subgid"
+)
+
+// runningUnprivileged reports whether nut runs without root privileges
+func runningUnprivileged() bool {
+	return os.Geteuid() != 0
+}
+
+// readSubIDs returns the subordinate id ranges allocated to the user name or id
+// in file, a /etc/subuid or /etc/subgid file. The ranges map no container ids,
+// only their host and count fields are set
+func readSubIDs(file, name string, id int) ([]idRange, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ranges []idRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid entry '%s' in %s", scanner.Text(), file)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid entry '%s' in %s", scanner.Text(), file)
+		}
+		ranges = append(ranges, idRange{host: start, count: count})
+	}
+	return ranges, scanner.Err()
+}
+
+// covers reports whether the subordinate id ranges hold the host ids of r
+func covers(ranges []idRange, r idRange) bool {
+	for _, sub := range ranges {
+		if r.host >= sub.host && r.host+r.count <= sub.host+sub.count {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultConfigPath returns the location of the lxc configuration new containers
+// of the user running nut are created with
+func defaultConfigPath() string {
+	if path := lxc.GlobalConfigItem("lxc.default_config"); path != "" {
+		return path
+	}
+	if !runningUnprivileged() {
+		return "/etc/lxc/default.conf"
+	}
+	config := os.Getenv("XDG_CONFIG_HOME")
+	if config == "" {
+		config = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(config, "lxc", "default.conf")
+}
+
+// readDefaultIDMap returns the id map of the lxc configuration file path
+func readDefaultIDMap(path string) (idMap, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "lxc.idmap", "lxc.id_map":
+			entries = append(entries, strings.TrimSpace(kv[1]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseIDMap(entries)
+}
+
+// checkUnprivileged verifies that the user running nut can build unprivileged
+// containers, and returns the id map of its default lxc configuration. The
+// user needs subordinate uids and gids, and the id map has to stay within them
+func checkUnprivileged() (idMap, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	uid, gid := os.Geteuid(), os.Getegid()
+	subUIDs, err := readSubIDs(subUIDFile, u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	subGIDs, err := readSubIDs(subGIDFile, u.Username, gid)
+	if err != nil {
+		return nil, err
+	}
+	if len(subUIDs) == 0 || len(subGIDs) == 0 {
+		return nil, fmt.Errorf("User %s has no subordinate uids or gids allocated in %s and %s, which unprivileged builds need. Allocate them with 'usermod --add-subuids 100000-165535 --add-subgids 100000-165535 %s'", u.Username, subUIDFile, subGIDFile, u.Username)
+	}
+	config := defaultConfigPath()
+	ids, err := readDefaultIDMap(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read id map from %s. Error: %s", config, err)
+	}
+	for _, r := range ids {
+		if (r.kind != "g" && !covers(subUIDs, r)) || (r.kind != "u" && !covers(subGIDs, r)) {
+			return nil, fmt.Errorf("Id map '%s' of %s is not allocated to user %s in %s and %s", r, config, u.Username, subUIDFile, subGIDFile)
+		}
+	}
+	return ids, nil
+}
+
+// String returns the range in the form of lxc.idmap entries
+func (r idRange) String() string {
+	return fmt.Sprintf("%s %d %d %d", r.kind, r.first, r.host, r.count)
+}
+
+// applyIDMap gives the container the id map defaults if it has none, as lxc does
+// when unprivileged users create containers. The files of its rootfs, owned by
+// the user running nut, are handed to the container's root
+func (c *Container) applyIDMap(defaults idMap) error {
+	ids, err := c.idMap()
+	if err != nil || len(ids) > 0 {
+		return err
+	}
+	if len(defaults) == 0 {
+		return fmt.Errorf("Container %s has no id map and %s defines none. Add lxc.idmap entries for your subordinate ids to %s", c.ct.Name(), defaultConfigPath(), defaultConfigPath())
+	}
+	c.logger().Warnf("Container %s has no id map, applying the one of %s", c.ct.Name(), defaultConfigPath())
+	for _, r := range defaults {
+		if err := c.ct.SetConfigItem(configKey("lxc.id_map"), r.String()); err != nil {
+			return err
+		}
+	}
+	if err := c.ct.SaveConfigFile(c.ct.ConfigFileName()); err != nil {
+		return err
+	}
+	rootfs, err := c.rootfs()
+	if err != nil {
+		return err
+	}
+	return defaults.chownToRoot(rootfs)
+}
+
+// usernsArgs returns the arguments running argv in a user namespace with the id
+// map m, where the user running nut is mapped to the first id m leaves free
+func (m idMap) usernsArgs(argv ...string) []string {
+	free := 0
+	var args []string
+	for _, r := range m {
+		args = append(args, "-m", fmt.Sprintf("%s:%d:%d:%d", r.kind, r.first, r.host, r.count))
+		if r.first+r.count > free {
+			free = r.first + r.count
+		}
+	}
+	args = append(args,
+		"-m", fmt.Sprintf("u:%d:%d:1", free, os.Geteuid()),
+		"-m", fmt.Sprintf("g:%d:%d:1", free, os.Getegid()),
+		"--")
+	return append(args, argv...)
+}
+
+// chownToRoot hands the file tree at path, owned by the user running nut, to the
+// root of containers with the id map m. Unprivileged users can not chown to
+// their subordinate ids directly, so chown runs inside a user namespace
+func (m idMap) chownToRoot(path string) error {
+	return m.usernsChown(path, "-R", "-h", "0:0", path)
+}
+
+// chownTo hands the file path, owned by the user running nut, to the container
+// ids uid and gid of containers with the id map m
+func (m idMap) chownTo(path string, uid, gid int) error {
+	return m.usernsChown(path, "-h", fmt.Sprintf("%d:%d", uid, gid), path)
+}
+
+// usernsChown runs chown with args inside a user namespace with the id map m
+func (m idMap) usernsChown(path string, args ...string) error {
+	if len(m) == 0 {
+		return nil
+	}
+	out, err := exec.Command("lxc-usernsexec", m.usernsArgs(append([]string{"chown"}, args...)...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to change owner of %s. Error: %s %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mknod creates the device node path and reports whether it was created. Device
+// nodes need root, unprivileged users skip them with a warning
+func mknod(l Logger, path string, mode uint32, dev int) (bool, error) {
+	err := syscall.Mknod(path, mode, dev)
+	if err == syscall.EPERM {
+		loggerOrDefault(l).Warnf("Skipping device node %s, creating device nodes requires root", path)
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// mkdev returns the device number of the major and minor numbers
+func mkdev(major, minor int64) int {
+	return int((major&0xfff)<<8 | (major&^0xfff)<<32 | minor&0xff | (minor&^0xff)<<12)
+}
@@ -0,0 +1,108 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_ReadSubIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-subid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "subuid")
+	content := "alice:100000:65536\nbob:165536:65536\n1000:231072:65536\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := readSubIDs(file, "alice", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []idRange{{host: 100000, count: 65536}, {host: 231072, count: 65536}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected ranges %v, found %v", expected, ranges)
+	}
+	if !covers(ranges, idRange{kind: "u", host: 100010, count: 1000}) || covers(ranges, idRange{kind: "u", host: 165000, count: 1000}) {
+		t.Error("Expected only ids within the allocated ranges to be covered")
+	}
+	if ranges, err := readSubIDs(filepath.Join(dir, "missing"), "alice", 1000); err != nil || ranges != nil {
+		t.Errorf("Expected missing file to allocate nothing, found %v (%v)", ranges, err)
+	}
+}
+
+func Test_ReadDefaultIDMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "default.conf")
+	content := "lxc.net.0.type = veth\nlxc.idmap = u 0 100000 65536\nlxc.id_map = g 0 100000 65536\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := readDefaultIDMap(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := idMap{{kind: "u", host: 100000, count: 65536}, {kind: "g", host: 100000, count: 65536}}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected id map %v, found %v", expected, ids)
+	}
+	if ids[0].String() != "u 0 100000 65536" {
+		t.Errorf("Expected lxc.idmap entry, found %s", ids[0])
+	}
+}
+
+func Test_CheckUnprivileged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test-unprivileged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(uid, gid string) { subUIDFile, subGIDFile = uid, gid }(subUIDFile, subGIDFile)
+	subUIDFile = filepath.Join(dir, "subuid")
+	subGIDFile = filepath.Join(dir, "subgid")
+	_, err = checkUnprivileged()
+	if err == nil || !strings.Contains(err.Error(), "usermod --add-subuids") {
+		t.Errorf("Expected missing allocations to be reported, found %v", err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{subUIDFile, subGIDFile} {
+		if err := ioutil.WriteFile(file, []byte(u.Username+":100000:65536\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := checkUnprivileged(); err != nil {
+		t.Errorf("Expected allocated subordinate ids to pass, found %s", err)
+	}
+}
+
+func Test_UsernsArgs(t *testing.T) {
+	ids := idMap{{kind: "u", host: 100000, count: 65536}, {kind: "g", host: 100000, count: 65536}}
+	args := strings.Join(ids.usernsArgs("chown", "0:0", "/tmp/x"), " ")
+	expected := "-m u:0:100000:65536 -m g:0:100000:65536 -m u:65536:" + strconv.Itoa(os.Geteuid()) + ":1 -m g:65536:" + strconv.Itoa(os.Getegid()) + ":1 -- chown 0:0 /tmp/x"
+	if args != expected {
+		t.Errorf("Expected arguments %q, found %q", expected, args)
+	}
+}
+
+func Test_Mkdev(t *testing.T) {
+	if dev := mkdev(1, 3); dev != 0x103 {
+		t.Errorf("Expected device number of /dev/null, found %#x", dev)
+	}
+	if dev := mkdev(259, 65537); dev != 0x10010301 {
+		t.Errorf("Expected device number with large numbers, found %#x", dev)
+	}
+}
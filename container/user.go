@@ -0,0 +1,111 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// userInfo describes the account a command runs as
+type userInfo struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+// lookupUser resolves a USER specification of the form user[:group] against the
+// /etc/passwd and /etc/group files below rootfs. Users and groups may be given by
+// name or numeric id. Numeric ids without an entry are accepted as is
+func lookupUser(rootfs, spec string) (userInfo, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	info := userInfo{name: parts[0], uid: -1, home: "/"}
+	id, numeric := parseID(parts[0])
+	err := scanDatabase(filepath.Join(rootfs, "etc", "passwd"), func(fields []string) bool {
+		if len(fields) < 6 || (fields[0] != parts[0] && (!numeric || fields[2] != parts[0])) {
+			return false
+		}
+		uid, uidOk := parseID(fields[2])
+		gid, gidOk := parseID(fields[3])
+		if !uidOk || !gidOk {
+			return false
+		}
+		info = userInfo{name: fields[0], uid: uid, gid: gid, home: fields[5]}
+		return true
+	})
+	if err != nil {
+		return info, err
+	}
+	if info.uid < 0 {
+		if !numeric {
+			return info, fmt.Errorf("User '%s' does not exist in the container", parts[0])
+		}
+		info.uid = id
+	}
+	if len(parts) == 2 {
+		gid, err := lookupGroup(rootfs, parts[1])
+		if err != nil {
+			return info, err
+		}
+		info.gid = gid
+	}
+	return info, nil
+}
+
+// lookupGroup resolves a group name or numeric id against /etc/group below rootfs
+func lookupGroup(rootfs, group string) (int, error) {
+	gid, numeric := parseID(group)
+	if numeric {
+		return gid, nil
+	}
+	gid = -1
+	err := scanDatabase(filepath.Join(rootfs, "etc", "group"), func(fields []string) bool {
+		if len(fields) < 3 || fields[0] != group {
+			return false
+		}
+		id, ok := parseID(fields[2])
+		if ok {
+			gid = id
+		}
+		return ok
+	})
+	if err != nil {
+		return -1, err
+	}
+	if gid < 0 {
+		return -1, fmt.Errorf("Group '%s' does not exist in the container", group)
+	}
+	return gid, nil
+}
+
+func parseID(s string) (int, bool) {
+	id, err := strconv.Atoi(s)
+	return id, err == nil && id >= 0
+}
+
+// scanDatabase calls match with the colon separated fields of every entry of a
+// passwd style file until it returns true. A missing file has no entries
+func scanDatabase(path string, match func([]string) bool) error {
+	fi, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if match(strings.Split(line, ":")) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,91 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_LookupUser(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/bash\n# comment\napp:x:1000:1001:App:/home/app:/bin/sh\n"
+	group := "root:x:0:\nstaff:x:50:app\n"
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]userInfo{
+		"app":       {name: "app", uid: 1000, gid: 1001, home: "/home/app"},
+		"1000":      {name: "app", uid: 1000, gid: 1001, home: "/home/app"},
+		"2000":      {name: "2000", uid: 2000, gid: 0, home: "/"},
+		"app:staff": {name: "app", uid: 1000, gid: 50, home: "/home/app"},
+		"root:1234": {name: "root", uid: 0, gid: 1234, home: "/root"},
+	}
+	for spec, expected := range cases {
+		info, err := lookupUser(rootfs, spec)
+		if err != nil {
+			t.Errorf("Failed to look up '%s'. Error: %s", spec, err)
+			continue
+		}
+		if info != expected {
+			t.Errorf("Expected %+v for '%s', found %+v", expected, spec, info)
+		}
+	}
+	for _, spec := range []string{"nobody", "app:wheel"} {
+		_, err := lookupUser(rootfs, spec)
+		if err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Errorf("Expected missing user error for '%s', found: %v", spec, err)
+		}
+	}
+}
+
+func Test_AttachOptions(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "app:x:1000:1000:App:/home/app:/bin/sh\n"
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{}
+	c.Manifest.User = "app"
+	c.Manifest.WorkDir = "/srv"
+	c.Manifest.Env = []string{"LANG=C", "GREETING=hello world"}
+	options, err := c.attachOptions(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.UID != 1000 || options.GID != 1000 || options.Cwd != "/srv" || !options.ClearEnv {
+		t.Errorf("Unexpected attach options %+v", options)
+	}
+	env := make(map[string]string)
+	for _, v := range options.Env {
+		pair := strings.SplitN(v, "=", 2)
+		if _, ok := env[pair[0]]; ok {
+			t.Errorf("Duplicate variable %s in %v", pair[0], options.Env)
+		}
+		env[pair[0]] = pair[1]
+	}
+	expected := map[string]string{"HOME": "/home/app", "USER": "app", "PWD": "/srv", "LANG": "C", "GREETING": "hello world"}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("Expected %s=%s, found %s=%s", k, v, k, env[k])
+		}
+	}
+}
@@ -3,6 +3,7 @@ package container
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"os"
 	"strings"
 )
 
@@ -21,6 +22,25 @@ var (
 	}
 )
 
+// mergeEnv merges lists of KEY=value pairs. Values of keys already present are
+// replaced in place, new keys are appended
+func mergeEnv(lists ...[]string) []string {
+	var env []string
+	index := make(map[string]int)
+	for _, list := range lists {
+		for _, v := range list {
+			key := strings.SplitN(v, "=", 2)[0]
+			if i, ok := index[key]; ok {
+				env[i] = v
+				continue
+			}
+			index[key] = len(env)
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
 // UUID generates uuid
 func UUID() (string, error) {
 	u := make([]byte, 16)
@@ -33,6 +53,11 @@ func UUID() (string, error) {
 	return hex.EncodeToString(u), nil
 }
 
+// shellQuote quotes s for safe inclusion in a bash script as a single word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 // TagToName converts Dockerfile's FROM target to a valid lxc container name
 func TagToName(tag string) string {
 	// docker FROM entry: org/repo:version -> org-repo_version
@@ -40,3 +65,29 @@ func TagToName(tag string) string {
 	repoConverted := strings.Replace(orgConverted, ":", "_", 1)
 	return repoConverted
 }
+
+// proxyVariables lists the host variables passed to builds with PropagateProxy
+var proxyVariables = []string{"http_proxy", "https_proxy", "no_proxy", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// environment returns the base environment of commands run during the build
+func (b *Builder) environment() []string {
+	base := MinimalEnv
+	if b.opts.BaseEnv != nil {
+		base = b.opts.BaseEnv
+	}
+	var proxy []string
+	if b.opts.PropagateProxy {
+		for _, name := range proxyVariables {
+			if v, ok := os.LookupEnv(name); ok {
+				proxy = append(proxy, name+"="+v)
+			}
+		}
+	}
+	return mergeEnv(base, proxy, b.opts.ExtraEnv)
+}
+
+// fileExists reports whether path exists on the host
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -1,6 +1,8 @@
 package container
 
 import (
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -22,3 +24,40 @@ func Test_TagToName(t *testing.T) {
 		t.Fatalf("Expected: golang_1.5, found: %s", parent)
 	}
 }
+
+func Test_ShellQuote(t *testing.T) {
+	if q := shellQuote("it's a test"); q != `'it'\''s a test'` {
+		t.Fatalf("Unexpected quoting: %s", q)
+	}
+}
+
+func Test_MergeEnv(t *testing.T) {
+	env := mergeEnv([]string{"A=1", "B=2"}, nil, []string{"C=3", "A=4"}, []string{"B=5=6"})
+	expected := []string{"A=4", "B=5=6", "C=3"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, found %v", expected, env)
+	}
+}
+
+func Test_BuildEnvironment(t *testing.T) {
+	defer os.Setenv("https_proxy", os.Getenv("https_proxy"))
+	os.Setenv("https_proxy", "http://proxy:3128")
+	b := NewBuilder("nut-test-env")
+	b.opts = BuildOptions{
+		BaseEnv:  []string{"PATH=/opt/bin:/usr/bin", "HOME=/root"},
+		ExtraEnv: []string{"HOME=/build", "CI=true"},
+	}
+	expected := []string{"PATH=/opt/bin:/usr/bin", "HOME=/build", "CI=true"}
+	if env := b.environment(); !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, found %v", expected, env)
+	}
+	b.opts.PropagateProxy = true
+	expected = []string{"PATH=/opt/bin:/usr/bin", "HOME=/build", "https_proxy=http://proxy:3128", "CI=true"}
+	if env := b.environment(); !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, found %v", expected, env)
+	}
+	b.opts = BuildOptions{}
+	if env := b.environment(); !reflect.DeepEqual(env, MinimalEnv) {
+		t.Errorf("Expected MinimalEnv by default, found %v", env)
+	}
+}
@@ -0,0 +1,129 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// instructions lists the instructions understood by Build
+var instructions = map[string]bool{
+	"ADD":         true,
+	"ARG":         true,
+	"CMD":         true,
+	"COPY":        true,
+	"ENTRYPOINT":  true,
+	"ENV":         true,
+	"EXPOSE":      true,
+	"FROM":        true,
+	"HEALTHCHECK": true,
+	"LABEL":       true,
+	"MAINTAINER":  true,
+	"ONBUILD":     true,
+	"RUN":         true,
+	"STOPSIGNAL":  true,
+	"USER":        true,
+	"VOLUME":      true,
+	"WORKDIR":     true,
+}
+
+// Validate checks parsed statements for problems Build would run into, without
+// touching lxc. All problems found are returned, each as a StatementError
+// except for the absence of a FROM instruction
+func (b *Builder) Validate() []error {
+	var errs []error
+	v := &validator{stages: make(map[string]bool)}
+	for i, st := range b.Statements {
+		v.check(st, func(err error) {
+			errs = append(errs, &StatementError{Index: i, Line: st.Line, Statement: st.Raw, Err: err})
+		})
+	}
+	if v.stageCount == 0 {
+		errs = append(errs, errors.New("No FROM instruction found"))
+	}
+	return errs
+}
+
+// validator checks statements in order, tracking the build stages declared so
+// far
+type validator struct {
+	stages     map[string]bool
+	stageCount int
+}
+
+// check passes the problems of st to fail
+func (v *validator) check(st Statement, fail func(error)) {
+	args := st.ArgString()
+	if !instructions[st.Instruction] {
+		fail(&UnknownInstructionError{Instruction: st.Instruction, Line: st.Line})
+		return
+	}
+	if v.stageCount == 0 && st.Instruction != "FROM" && st.Instruction != "ARG" {
+		fail(fmt.Errorf("%s instruction before FROM", st.Instruction))
+		return
+	}
+	switch st.Instruction {
+	case "FROM":
+		_, alias, err := parseFrom(st.Args)
+		if err != nil {
+			fail(err)
+		} else if alias != "" {
+			if v.stages[alias] {
+				fail(fmt.Errorf("Duplicate stage name '%s'", alias))
+			}
+			v.stages[alias] = true
+		}
+		v.stages[strconv.Itoa(v.stageCount)] = true
+		v.stageCount++
+	case "ADD", "COPY":
+		flags, files, err := parseFileFlags(st.Instruction, st.Args)
+		if err != nil {
+			fail(err)
+		} else if len(files) < 2 {
+			fail(fmt.Errorf("%s requires a source and a destination", st.Instruction))
+		} else if flags.from != "" && !v.stages[flags.from] {
+			fail(fmt.Errorf("Unknown build stage '%s'", flags.from))
+		}
+	case "LABEL":
+		tokens, err := tokenize(args)
+		if err != nil {
+			fail(err)
+		}
+		if len(tokens) == 0 {
+			fail(errors.New("Invalid LABEL instruction. LABELS must have '=' in them"))
+		}
+		for _, token := range tokens {
+			if !strings.Contains(token, "=") {
+				fail(errors.New("Invalid LABEL instruction. LABELS must have '=' in them"))
+				break
+			}
+		}
+	case "EXPOSE":
+		for _, p := range st.Args {
+			if strings.Contains(p, "$") {
+				// depends on variable expansion at build time
+				continue
+			}
+			if _, err := parseExposedPort(p); err != nil {
+				fail(err)
+			}
+		}
+	case "CMD", "ENTRYPOINT":
+		if _, err := parseCommand(args); err != nil {
+			fail(err)
+		}
+	case "HEALTHCHECK":
+		if _, err := parseHealthcheck(args); err != nil {
+			fail(err)
+		}
+	case "RUN":
+		if _, _, err := parseRunFlags(args); err != nil {
+			fail(err)
+		}
+	case "ARG", "USER", "WORKDIR", "STOPSIGNAL", "ONBUILD":
+		if len(st.Args) < 1 {
+			fail(fmt.Errorf("%s requires an argument", st.Instruction))
+		}
+	}
+}
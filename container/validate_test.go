@@ -0,0 +1,45 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_Validate(t *testing.T) {
+	b := NewBuilder("nut-test-validate")
+	if err := b.ParseReader(strings.NewReader(testSpec)); err != nil {
+		t.Fatal(err)
+	}
+	if errs := b.Validate(); len(errs) != 0 {
+		t.Fatalf("Expected valid spec, found errors: %v", errs)
+	}
+	spec := `RUN echo before from
+FROM trusty
+LABEL broken
+EXPOSE http
+CMD ["/bin/true"
+ENTRYPOINT /bin/false
+RNU apt-get update
+ADD only-source
+COPY --from=missing /a /b
+`
+	if err := b.ParseReader(strings.NewReader(spec)); err != nil {
+		t.Fatal(err)
+	}
+	errs := b.Validate()
+	if len(errs) != 7 {
+		t.Fatalf("Expected 7 errors, found %d: %v", len(errs), errs)
+	}
+	for i, line := range []int{1, 3, 4, 5, 7, 8, 9} {
+		stmtErr, ok := errs[i].(*StatementError)
+		if !ok || stmtErr.Line != line {
+			t.Errorf("Expected error at line %d, found: %v", line, errs[i])
+		}
+	}
+	if err := b.ParseReader(strings.NewReader("RUN echo hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if errs := b.Validate(); len(errs) != 2 {
+		t.Fatalf("Expected statement before FROM and missing FROM errors, found: %v", errs)
+	}
+}
@@ -0,0 +1,72 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// volume is a parsed bind mount specification
+type volume struct {
+	hostDir      string
+	containerDir string
+	options      string
+}
+
+// parseVolume parses a volume specification of the form
+// [host_directory:]container_directory[:mount options]. Without a host directory
+// the current working directory is mounted
+func parseVolume(spec string) (volume, error) {
+	parts := strings.Split(spec, ":")
+	v := volume{options: "bind,create=dir"}
+	switch len(parts) {
+	case 1:
+		dir, err := os.Getwd()
+		if err != nil {
+			return v, err
+		}
+		v.hostDir = dir
+		v.containerDir = parts[0]
+	case 2, 3:
+		if parts[0] == "" {
+			return v, fmt.Errorf("Invalid volume spec '%s'. Empty host directory", spec)
+		}
+		p, err := filepath.Abs(parts[0])
+		if err != nil {
+			return v, err
+		}
+		v.hostDir = p
+		v.containerDir = parts[1]
+		if len(parts) == 3 {
+			v.options = "bind," + parts[2]
+		}
+	default:
+		return v, fmt.Errorf("Invalid volume spec '%s'. Expected [host_directory:]container_directory[:mount options]", spec)
+	}
+	if v.containerDir == "" {
+		return v, fmt.Errorf("Invalid volume spec '%s'. Empty container directory", spec)
+	}
+	return v, nil
+}
+
+// validateVolumes checks the format of all volume specifications and that their
+// host directories exist
+func validateVolumes(specs []string) error {
+	var missing []string
+	for _, spec := range specs {
+		v, err := parseVolume(spec)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(v.hostDir); os.IsNotExist(err) {
+			missing = append(missing, v.hostDir)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Volume host paths do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ParseVolume(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]volume{
+		"/data":                 {hostDir: cwd, containerDir: "/data", options: "bind,create=dir"},
+		"/host/src:/src":        {hostDir: "/host/src", containerDir: "/src", options: "bind,create=dir"},
+		"/host/cache:/cache:ro": {hostDir: "/host/cache", containerDir: "/cache", options: "bind,ro"},
+	}
+	for spec, expected := range cases {
+		v, err := parseVolume(spec)
+		if err != nil {
+			t.Errorf("Failed to parse '%s'. Error: %s", spec, err)
+			continue
+		}
+		if v != expected {
+			t.Errorf("Expected %+v for '%s', found %+v", expected, spec, v)
+		}
+	}
+	for _, spec := range []string{"a:b:c:d", ":/src", "/host:"} {
+		if _, err := parseVolume(spec); err == nil {
+			t.Errorf("Expected error for '%s'", spec)
+		}
+	}
+}
+
+func Test_ValidateVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nut-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := []string{filepath.Join(dir, "missing-1"), filepath.Join(dir, "missing-2")}
+	if err := validateVolumes([]string{dir + ":/ok"}); err != nil {
+		t.Fatal(err)
+	}
+	err = validateVolumes([]string{missing[0] + ":/a", dir + ":/ok", missing[1] + ":/b"})
+	if err == nil {
+		t.Fatal("Expected error for missing host paths")
+	}
+	for _, path := range missing {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("Expected error to list %s, found: %s", path, err)
+		}
+	}
+}
@@ -2,17 +2,14 @@ package main
 
 import (
 	"github.com/PagerDuty/nut/commands"
+	"github.com/PagerDuty/nut/container"
 	"github.com/mitchellh/cli"
 	log "github.com/sirupsen/logrus"
 	"os"
 )
 
-const (
-	version = "0.2"
-)
-
 func main() {
-	c := cli.NewCLI("nut", version)
+	c := cli.NewCLI("nut", container.Version)
 	c.Args = os.Args[1:]
 	c.Commands = map[string]cli.CommandFactory{
 		"archive": commands.Archive,